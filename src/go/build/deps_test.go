@@ -585,13 +585,35 @@ var depsRules = `
     path/filepath, regexp, sort, strconv
     < internal/coverage/pods;
 
-    FMT, bufio, crypto/md5, encoding/binary, runtime/debug,
+    FMT, bufio, compress/gzip, crypto/md5, crypto/sha256,
+    encoding/binary, runtime/debug,
     internal/coverage, internal/coverage/cmerge,
     internal/coverage/cformat, internal/coverage/calloc,
     internal/coverage/decodecounter, internal/coverage/decodemeta,
     internal/coverage/encodecounter, internal/coverage/encodemeta,
-    internal/coverage/pods, os, path/filepath, reflect, time, unsafe
+    internal/coverage/pods, internal/saferio, os, path/filepath,
+    reflect, time, unsafe
     < runtime/coverage;
+
+    # runtime/coverage is linked into every -cover binary and
+    # writes its JSON by hand; encoding/json belongs in the
+    # subpackages.
+    encoding/json !< runtime/coverage;
+
+    encoding/json, runtime/coverage
+    < runtime/coverage/json, runtime/coverage/lcov;
+
+    encoding/json, encoding/xml, runtime/coverage
+    < runtime/coverage/sonarqube;
+
+    net/http, runtime/coverage
+    < runtime/coverage/httphook;
+
+    encoding/json, html, net/http, runtime/coverage
+    < runtime/coverage/debughttp;
+
+    os/signal, runtime/coverage
+    < runtime/coverage/signals;
 `
 
 // listStdPkgs returns the same list of packages as "go list std".
@@ -209,6 +209,13 @@ func (cdr *CounterDataReader) readArgs() error {
 	return nil
 }
 
+// Args returns the key-value pairs recorded in the args section of
+// the counter data file, including the entries from which OsArgs,
+// Goos and Goarch are derived. The caller must not modify the map.
+func (cdr *CounterDataReader) Args() map[string]string {
+	return cdr.args
+}
+
 // OsArgs returns the program arguments (saved from os.Args during
 // the run of the instrumented binary) read from the counter
 // data file. Not all coverage data files will have os.Args values;
@@ -235,6 +242,13 @@ func (cdr *CounterDataReader) Goarch() string {
 	return cdr.goarch
 }
 
+// MetaHash returns the hash of the meta-data file (as recorded in
+// the counter data file header) for the program that produced this
+// counter data file.
+func (cdr *CounterDataReader) MetaHash() [16]byte {
+	return cdr.hdr.MetaHash
+}
+
 // FuncPayload encapsulates the counter data payload for a single
 // function as read from a counter data file.
 type FuncPayload struct {
@@ -25,7 +25,7 @@ import (
 // CoverageMetaFileReader provides state and methods for reading
 // a meta-data file from a code coverage run.
 type CoverageMetaFileReader struct {
-	f          *os.File
+	f          io.ReadSeeker
 	hdr        coverage.MetaFileHeader
 	tmp        []byte
 	pkgOffsets []uint64
@@ -41,8 +41,10 @@ type CoverageMetaFileReader struct {
 // read-only slice containing the contents of 'f' obtained by mmap'ing
 // the file read-only; 'fileView' may be nil, in which case the helper
 // will read the contents of the file using regular file Read
-// operations.
-func NewCoverageMetaFileReader(f *os.File, fileView []byte) (*CoverageMetaFileReader, error) {
+// operations. Note that 'f' need not be an actual file; any
+// io.ReadSeeker positioned at the start of the meta-data payload
+// (for example a bytes.Reader) will do.
+func NewCoverageMetaFileReader(f io.ReadSeeker, fileView []byte) (*CoverageMetaFileReader, error) {
 	r := &CoverageMetaFileReader{
 		f:        f,
 		fileView: fileView,
@@ -86,13 +86,9 @@ func padToFourByteBoundary(ws *slicewriter.WriteSeeker) error {
 	return nil
 }
 
-func (cfw *CoverageDataWriter) writeSegmentPreamble(args map[string]string, visitor CounterVisitor) error {
+func (cfw *CoverageDataWriter) writeSegmentPreamble(args map[string]string, nf int) error {
 	var csh coverage.CounterSegmentHeader
-	if nf, err := visitor.NumFuncs(); err != nil {
-		return err
-	} else {
-		csh.FcnEntries = uint64(nf)
-	}
+	csh.FcnEntries = uint64(nf)
 
 	// Write string table and args to a byte slice (since we need
 	// to capture offsets at various points), then emit the slice
@@ -159,23 +155,62 @@ func (cfw *CoverageDataWriter) writeSegmentPreamble(args map[string]string, visi
 // AppendSegment appends a new segment to a counter data, with a new
 // args section followed by a payload of counter data clauses.
 func (cfw *CoverageDataWriter) AppendSegment(args map[string]string, visitor CounterVisitor) error {
+	nf, err := visitor.NumFuncs()
+	if err != nil {
+		return err
+	}
+	if err := cfw.beginSegment(args, nf); err != nil {
+		return err
+	}
+	if err := visitor.VisitFuncs(cfw.WriteFunc); err != nil {
+		return err
+	}
+	return cfw.endSegment()
+}
+
+// BeginStream writes the file header and the preamble of a single
+// segment with args 'args' that will contain 'nf' function entries.
+// It is the streaming counterpart of Write: the caller must follow it
+// with exactly 'nf' calls to WriteFunc, then call EndStream.
+func (cfw *CoverageDataWriter) BeginStream(metaFileHash [16]byte, args map[string]string, nf int) error {
+	if err := cfw.writeHeader(metaFileHash); err != nil {
+		return err
+	}
+	return cfw.beginSegment(args, nf)
+}
+
+// EndStream completes a file started with BeginStream, writing the
+// file footer and flushing any buffered output.
+func (cfw *CoverageDataWriter) EndStream() error {
+	return cfw.endSegment()
+}
+
+// Flush writes any buffered data to the underlying io.Writer.
+func (cfw *CoverageDataWriter) Flush() error {
+	return cfw.w.Flush()
+}
+
+func (cfw *CoverageDataWriter) beginSegment(args map[string]string, nf int) error {
 	cfw.stab = &stringtab.Writer{}
 	cfw.stab.InitWriter()
 	cfw.stab.Lookup("")
 
-	var err error
-	for k, v := range args {
+	// Intern the args in sorted key order, so that the string table
+	// (and hence the file) does not depend on map iteration order.
+	akeys := make([]string, 0, len(args))
+	for k := range args {
+		akeys = append(akeys, k)
+	}
+	sort.Strings(akeys)
+	for _, k := range akeys {
 		cfw.stab.Lookup(k)
-		cfw.stab.Lookup(v)
+		cfw.stab.Lookup(args[k])
 	}
+	return cfw.writeSegmentPreamble(args, nf)
+}
 
-	if err = cfw.writeSegmentPreamble(args, visitor); err != nil {
-		return err
-	}
-	if err = cfw.writeCounters(visitor); err != nil {
-		return err
-	}
-	if err = cfw.writeFooter(); err != nil {
+func (cfw *CoverageDataWriter) endSegment() error {
+	if err := cfw.writeFooter(); err != nil {
 		return err
 	}
 	if err := cfw.w.Flush(); err != nil {
@@ -214,59 +249,51 @@ func (cfw *CoverageDataWriter) writeBytes(b []byte) error {
 	return nil
 }
 
-func (cfw *CoverageDataWriter) writeCounters(visitor CounterVisitor) error {
+// WriteFunc writes the counter data entry for the function with
+// package index 'pkid' and function index 'funcid' in the segment
+// currently being written.
+func (cfw *CoverageDataWriter) WriteFunc(pkid uint32, funcid uint32, counters []uint32) error {
+	if err := cfw.wrval(uint32(len(counters))); err != nil {
+		return err
+	}
+	if err := cfw.wrval(pkid); err != nil {
+		return err
+	}
+	if err := cfw.wrval(funcid); err != nil {
+		return err
+	}
+	for _, val := range counters {
+		if err := cfw.wrval(val); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// wrval writes a single counter data value in the writer's counter
+// flavor.
+func (cfw *CoverageDataWriter) wrval(val uint32) error {
 	// Notes:
 	// - this version writes everything little-endian, which means
 	//   a call is needed to encode every value (expensive)
 	// - we may want to move to a model in which we just blast out
 	//   all counters, or possibly mmap the file and do the write
 	//   implicitly.
-	ctrb := make([]byte, 4)
-	wrval := func(val uint32) error {
-		var buf []byte
-		var towr int
-		if cfw.cflavor == coverage.CtrRaw {
-			binary.LittleEndian.PutUint32(ctrb, val)
-			buf = ctrb
-			towr = 4
-		} else if cfw.cflavor == coverage.CtrULeb128 {
-			cfw.tmp = cfw.tmp[:0]
-			cfw.tmp = uleb128.AppendUleb128(cfw.tmp, uint(val))
-			buf = cfw.tmp
-			towr = len(buf)
-		} else {
-			panic("internal error: bad counter flavor")
-		}
-		if sz, err := cfw.w.Write(buf); err != nil {
-			return err
-		} else if sz != towr {
-			return fmt.Errorf("writing counters: short write")
-		}
-		return nil
-	}
-
-	// Write out entries for each live function.
-	emitter := func(pkid uint32, funcid uint32, counters []uint32) error {
-		if err := wrval(uint32(len(counters))); err != nil {
-			return err
-		}
-
-		if err := wrval(pkid); err != nil {
-			return err
-		}
-
-		if err := wrval(funcid); err != nil {
-			return err
-		}
-		for _, val := range counters {
-			if err := wrval(val); err != nil {
-				return err
-			}
-		}
-		return nil
+	var buf []byte
+	if cfw.cflavor == coverage.CtrRaw {
+		cfw.tmp = binary.LittleEndian.AppendUint32(cfw.tmp[:0], val)
+		buf = cfw.tmp
+	} else if cfw.cflavor == coverage.CtrULeb128 {
+		cfw.tmp = cfw.tmp[:0]
+		cfw.tmp = uleb128.AppendUleb128(cfw.tmp, uint(val))
+		buf = cfw.tmp
+	} else {
+		panic("internal error: bad counter flavor")
 	}
-	if err := visitor.VisitFuncs(emitter); err != nil {
+	if sz, err := cfw.w.Write(buf); err != nil {
 		return err
+	} else if sz != len(buf) {
+		return fmt.Errorf("writing counters: short write")
 	}
 	return nil
 }
@@ -0,0 +1,165 @@
+// Copyright 2022 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package coverage
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"internal/coverage"
+	"internal/coverage/decodemeta"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// SourceAnnotator writes source files of the currently running
+// program annotated with the current coverage counts of their lines,
+// as a plain-text alternative to "go tool cover -html". Use
+// NewSourceAnnotator to create one.
+type SourceAnnotator struct {
+	goroot  string
+	modRoot string
+	width   int
+}
+
+// defaultAnnotateWidth is the default width of the count column
+// written by a SourceAnnotator.
+const defaultAnnotateWidth = 6
+
+// NewSourceAnnotator returns a SourceAnnotator that looks for source
+// files relative to the module root directory 'modRoot' and the Go
+// root directory 'goroot' (in that order) if they can't be found as
+// given. Either directory may be empty, meaning that it is not
+// searched. An error is returned if the program was not built with
+// "-cover", or if a non-empty directory argument is not a directory.
+func NewSourceAnnotator(goroot, modRoot string) (*SourceAnnotator, error) {
+	if len(getCovMetaList()) == 0 {
+		return nil, fmt.Errorf("program not built with -cover")
+	}
+	for _, dir := range []string{goroot, modRoot} {
+		if dir == "" {
+			continue
+		}
+		if fi, err := os.Stat(dir); err != nil {
+			return nil, err
+		} else if !fi.IsDir() {
+			return nil, fmt.Errorf("%s is not a directory", dir)
+		}
+	}
+	return &SourceAnnotator{goroot: goroot, modRoot: modRoot, width: defaultAnnotateWidth}, nil
+}
+
+// WithColumnWidth sets the width of the count column to 'n'
+// characters (at least 2; smaller values are treated as 2), and
+// returns 'a'. Counts too large for the column widen it for that line.
+func (a *SourceAnnotator) WithColumnWidth(n int) *SourceAnnotator {
+	if n < 2 {
+		n = 2
+	}
+	a.width = n
+	return a
+}
+
+// AnnotateFile writes the source file 'srcFile' to 'w', prefixing
+// each line with a column giving its coverage count and a space. The
+// column holds ">N" for a line executed N times, "!0" for an
+// instrumented line that has not executed, and blanks for a line not
+// in any coverable block. The count for a line is the largest count
+// of the blocks that overlap it; in "set" mode it is 1 for every
+// executed line.
+//
+// The file name is matched with the source file names recorded in the
+// coverage meta-data in the same way as QueryLineHits does. The file
+// is read from 'srcFile' if it exists, and otherwise from the module
+// root or Go root given to NewSourceAnnotator (with 'srcFile' taken
+// relative to the root, or to its "src" directory for the Go root).
+// An error is returned if the file has no coverage data in the
+// running program, or can't be read.
+func (a *SourceAnnotator) AnnotateFile(srcFile string, w io.Writer) error {
+	snap, err := ReadCounterSnapshot()
+	if err != nil {
+		return err
+	}
+	counters := snap.counterMap()
+	rel := !filepath.IsAbs(srcFile)
+	suffix := "/" + filepath.ToSlash(srcFile)
+	metaFile := ""
+	counts := make(map[int]uint32) // line -> count, for instrumented lines
+	err = visitMetaFuncs(metaPayloads(getCovMetaList()), func(pkIdx, fnIdx uint32, pd *decodemeta.CoverageMetaDataDecoder, fd *coverage.FuncDesc) error {
+		if fd.Srcfile != srcFile && !(rel && strings.HasSuffix(filepath.ToSlash(fd.Srcfile), suffix)) {
+			return nil
+		}
+		metaFile = fd.Srcfile
+		ctrs := counters[pkfunc{pk: pkIdx, fcn: fnIdx}]
+		for i, u := range fd.Units {
+			if u.Parent != 0 {
+				continue
+			}
+			count := unitCount(cgran, ctrs, i)
+			for l := int(u.StLine); l <= int(u.EnLine); l++ {
+				if c, ok := counts[l]; !ok || count > c {
+					counts[l] = count
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if metaFile == "" {
+		return fmt.Errorf("no coverage data for source file %s", srcFile)
+	}
+	src, err := a.readSource(srcFile, metaFile)
+	if err != nil {
+		return err
+	}
+
+	bw := bufio.NewWriter(w)
+	blank := strings.Repeat(" ", a.width)
+	sc := bufio.NewScanner(bytes.NewReader(src))
+	sc.Buffer(nil, len(src)+1)
+	for line := 1; sc.Scan(); line++ {
+		if c, ok := counts[line]; !ok {
+			bw.WriteString(blank)
+		} else if c == 0 {
+			fmt.Fprintf(bw, "%-*s", a.width, "!0")
+		} else {
+			fmt.Fprintf(bw, "%-*s", a.width, ">"+strconv.FormatUint(uint64(c), 10))
+		}
+		bw.WriteByte(' ')
+		bw.Write(sc.Bytes())
+		bw.WriteByte('\n')
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// readSource returns the contents of the source file 'srcFile', whose
+// name in the meta-data is 'metaFile', searching the annotator's
+// directories as described for AnnotateFile.
+func (a *SourceAnnotator) readSource(srcFile, metaFile string) ([]byte, error) {
+	cands := []string{srcFile}
+	if !filepath.IsAbs(srcFile) {
+		if a.modRoot != "" {
+			cands = append(cands, filepath.Join(a.modRoot, srcFile))
+		}
+		if a.goroot != "" {
+			cands = append(cands, filepath.Join(a.goroot, "src", srcFile))
+		}
+	}
+	cands = append(cands, metaFile)
+	for _, c := range cands {
+		if b, err := os.ReadFile(c); err == nil {
+			return b, nil
+		}
+	}
+	return nil, fmt.Errorf("source file %s not found", srcFile)
+}
@@ -5,24 +5,76 @@
 package coverage
 
 import (
+	"bytes"
 	"fmt"
 	"internal/coverage"
+	"internal/coverage/encodecounter"
+	"internal/coverage/rtcov"
 	"io"
 	"reflect"
+	"sort"
+	"strings"
 	"sync/atomic"
 	"unsafe"
 )
 
+// CoverageEnabled reports whether the currently running program was
+// built with "-cover" and its coverage meta-data has been finalized,
+// that is, whether the other functions in this package can be
+// expected to succeed. For a regular program, the meta-data is
+// finalized by code the compiler inserts into the init function of
+// package main, which runs after the init functions of all other
+// packages; CoverageEnabled therefore returns false when called from
+// package initialization code, even in a program built with
+// "-cover", and true from main.main onwards. In test binaries
+// finalization is deferred until the first call to an API that needs
+// the meta-data (or until the program exits). CoverageEnabled does
+// not allocate or acquire any locks.
+func CoverageEnabled() bool {
+	return finalHashComputed
+}
+
+// GetCoverageGranularity returns the counter granularity selected
+// when the currently running program was built, using the same names
+// as MetaDataInfo.Granularity. With "perblock" granularity each basic
+// block of a function has its own counter; with "perfunc" granularity
+// a function has a single counter, which counts executions of the
+// function as a whole, and every block of the function reports that
+// count. An error is returned if the program was not built with
+// "-cover".
+func GetCoverageGranularity() (string, error) {
+	if len(getCovCounterList()) == 0 {
+		return "", fmt.Errorf("program not built with -cover")
+	}
+	if err := ensureFinalHash(); err != nil {
+		return "", err
+	}
+	return cgran.String(), nil
+}
+
 // EmitMetaDataToDir writes a coverage meta-data file for the
 // currently running program to the directory specified in 'dir'. An
 // error will be returned if the operation can't be completed
 // successfully (for example, if the currently running program was not
-// built with "-cover", or if the directory does not exist).
+// built with "-cover", or if the directory does not exist). If any
+// hooks are installed (see RegisterEmitHook), the meta-data is also
+// passed to them once the file has been written.
 func EmitMetaDataToDir(dir string) error {
 	if !finalHashComputed {
 		return fmt.Errorf("error: no meta-data available (binary not built with -cover?)")
 	}
-	return emitMetaDataToDirectory(dir, getCovMetaList())
+	ml := getCovMetaList()
+	if err := emitMetaDataToDirectory(dir, ml); err != nil {
+		return err
+	}
+	if hooks := getEmitHooks(); len(hooks) != 0 {
+		return emitToHooks(hooks, metaDataFile, func(w io.Writer) error {
+			return writeWithPlugins(w, metaDataFile, func(w io.Writer) error {
+				return writeMetaData(w, ml, cmode, cgran, finalHash)
+			})
+		})
+	}
+	return nil
 }
 
 // EmitMetaDataToWriter writes the meta-data content (the payload that
@@ -39,7 +91,25 @@ func EmitMetaDataToWriter(w io.Writer) error {
 		return fmt.Errorf("error: no meta-data available (binary not built with -cover?)")
 	}
 	ml := getCovMetaList()
-	return writeMetaData(w, ml, cmode, cgran, finalHash)
+	return writeWithPlugins(w, metaDataFile, func(w io.Writer) error {
+		return writeMetaData(w, ml, cmode, cgran, finalHash)
+	})
+}
+
+// GetCoverageMetaRaw returns the meta-data content (the payload that
+// would be written by EmitMetaDataToWriter, prior to processing by
+// any registered plugins) for the currently running program. A new
+// copy is returned on each call. An error will be returned if the
+// currently running program was not built with "-cover".
+func GetCoverageMetaRaw() ([]byte, error) {
+	if !finalHashComputed {
+		return nil, fmt.Errorf("error: no meta-data available (binary not built with -cover?)")
+	}
+	var b bytes.Buffer
+	if err := writeMetaData(&b, getCovMetaList(), cmode, cgran, finalHash); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
 }
 
 // EmitCounterDataToDir writes a coverage counter-data file for the
@@ -48,9 +118,49 @@ func EmitMetaDataToWriter(w io.Writer) error {
 // successfully (for example, if the currently running program was not
 // built with "-cover", or if the directory does not exist). The
 // counter data written will be a snapshot taken at the point of the
-// call.
+// call. If any hooks are installed (see RegisterEmitHook), the
+// counter data is also passed to them once the file has been written
+// (as a separate snapshot, so the counter values may differ slightly
+// from those in the file).
 func EmitCounterDataToDir(dir string) error {
-	return emitCounterDataToDirectory(dir)
+	if err := emitCounterDataToDirectory(dir); err != nil {
+		return err
+	}
+	cl := getCovCounterList()
+	if hooks := getEmitHooks(); len(hooks) != 0 && len(cl) != 0 {
+		s := &emitState{
+			counterlist: cl,
+			pkgmap:      getCovPkgMap(),
+		}
+		return emitToHooks(hooks, counterDataFile, func(w io.Writer) error {
+			return s.emitCounterDataFile(finalHash, w)
+		})
+	}
+	return nil
+}
+
+// EmitCounterDataToDirAtomic is like EmitCounterDataToDir, but takes
+// additional care that a process reading the directory concurrently
+// never observes a partially written counter data file: the data is
+// written to a uniquely named temporary file whose name begins with
+// "." (and so is ignored by readers such as "go tool covdata"),
+// synced to stable storage, and then renamed to its final name. The
+// temporary file is removed if any step fails.
+func EmitCounterDataToDirAtomic(dir string) error {
+	return emitCounterDataToDirectoryAtomic(dir)
+}
+
+// EmitCounterDataSnapshotToDir writes the counter values captured in
+// 'snap' to a new counter-data file in the directory 'dir', using the
+// same format and file naming conventions as EmitCounterDataToDir.
+// The file records the meta-data hash stored in the snapshot. An
+// error will be returned if the operation can't be completed
+// successfully (for example, if the directory does not exist).
+func EmitCounterDataSnapshotToDir(snap *CounterSnapshot, dir string) error {
+	if snap == nil {
+		return fmt.Errorf("error: nil snapshot in EmitCounterDataSnapshotToDir")
+	}
+	return snap.writeToDir(dir)
 }
 
 // EmitCounterDataToWriter writes coverage counter-data content for
@@ -59,6 +169,11 @@ func EmitCounterDataToDir(dir string) error {
 // example, if the currently running program was not built with
 // "-cover", or if a write fails). The counter data written will be a
 // snapshot taken at the point of the invocation.
+//
+// EmitCounterDataToWriter and EmitMetaDataToWriter may be called
+// concurrently from multiple goroutines, in any counter mode; each
+// call that writes counter data works from its own copy of the
+// counters.
 func EmitCounterDataToWriter(w io.Writer) error {
 	if w == nil {
 		return fmt.Errorf("error: nil writer in EmitCounterDataToWriter")
@@ -80,6 +195,96 @@ func EmitCounterDataToWriter(w io.Writer) error {
 	return s.emitCounterDataToWriter(w)
 }
 
+// EmitDeterministicCounterData writes counter data for the
+// currently running program to 'w', as EmitCounterDataToWriter, but
+// with function records ordered by the import path of their package
+// (and then by function index) rather than in the order in which the
+// runtime registered the counter arrays. Two programs with the same
+// meta-data, arguments and counter values thus produce byte-for-byte
+// identical output. The counter data written will be a snapshot taken
+// at the point of the call.
+func EmitDeterministicCounterData(w io.Writer) error {
+	if w == nil {
+		return fmt.Errorf("error: nil writer in EmitDeterministicCounterData")
+	}
+	snap, err := ReadCounterSnapshot()
+	if err != nil {
+		return err
+	}
+	payloads := metaPayloads(getCovMetaList())
+	paths, err := metaPackagePaths(payloads)
+	if err != nil {
+		return err
+	}
+	pkgPath := func(pk uint32) string {
+		if int(pk) < len(paths) {
+			return paths[pk]
+		}
+		return ""
+	}
+	return writeCounterData(w, snap, nil, func(snap *CounterSnapshot) encodecounter.CounterVisitor {
+		funcs := snap.counterMap()
+		keys := make([]pkfunc, 0, len(funcs))
+		for k := range funcs {
+			keys = append(keys, k)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			pi, pj := pkgPath(keys[i].pk), pkgPath(keys[j].pk)
+			if pi != pj {
+				return pi < pj
+			}
+			if keys[i].pk != keys[j].pk {
+				return keys[i].pk < keys[j].pk
+			}
+			return keys[i].fcn < keys[j].fcn
+		})
+		return orderedVisitor{keys: keys, funcs: funcs}
+	})
+}
+
+// orderedVisitor is a counter visitor that visits the functions in
+// 'funcs' in the order given by 'keys'.
+type orderedVisitor struct {
+	keys  []pkfunc
+	funcs map[pkfunc][]uint32
+}
+
+func (v orderedVisitor) NumFuncs() (int, error) {
+	return len(v.keys), nil
+}
+
+func (v orderedVisitor) VisitFuncs(f encodecounter.CounterVisitorFn) error {
+	for _, k := range v.keys {
+		if err := f(k.pk, k.fcn, v.funcs[k]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetCoverageLabel records a key-value annotation to be written to the
+// args section of counter data files subsequently emitted by the
+// program (for example to tag the data with a test or job name).
+// Setting a label to the empty string removes it. An error is
+// returned if 'key' is empty or collides with one of the keys used to
+// record the program's arguments ("argc", "argv<N>", "GOOS", "GOARCH").
+func SetCoverageLabel(key, value string) error {
+	if key == "" || key == "argc" || key == "GOOS" || key == "GOARCH" || strings.HasPrefix(key, "argv") {
+		return fmt.Errorf("invalid coverage label key %q", key)
+	}
+	covLabelsMu.Lock()
+	defer covLabelsMu.Unlock()
+	if value == "" {
+		delete(covLabels, key)
+		return nil
+	}
+	if covLabels == nil {
+		covLabels = make(map[string]string)
+	}
+	covLabels[key] = value
+	return nil
+}
+
 // ClearCoverageCounters clears/resets all coverage counter variables
 // in the currently running program. It returns an error if the
 // program in question was not built with the "-cover" flag. Clearing
@@ -152,6 +357,42 @@ func ClearCoverageCounters() error {
 	// inconsistency when reading the counter array from the thread
 	// running ClearCoverageCounters.
 
+	clearCounters(cl)
+	return nil
+}
+
+// ClearCoverageCountersUnsafe clears/resets all coverage counter
+// variables in the currently running program, as
+// ClearCoverageCounters does, but without requiring atomic counter
+// mode. It returns an error if the program was not built with the
+// "-cover" flag.
+//
+// For "-covermode=set" and "-covermode=count" programs, counter
+// updates are plain stores, so the clear can be observed out of order
+// by (or race with) instrumented code running on another goroutine,
+// corrupting the counter data as described in the comments in
+// ClearCoverageCounters. The caller must therefore ensure that no
+// other goroutine is executing instrumented code while
+// ClearCoverageCountersUnsafe runs, for example by running with
+// GOMAXPROCS(1) or by synchronizing all goroutines beforehand. The
+// calling goroutine is pinned to its P while each counter array is
+// cleared, so that it is not migrated part way through an array.
+func ClearCoverageCountersUnsafe() error {
+	cl := getCovCounterList()
+	if len(cl) == 0 {
+		return fmt.Errorf("program not built with -cover")
+	}
+	for k := range cl {
+		procPin()
+		clearCounters(cl[k : k+1])
+		procUnpin()
+	}
+	return nil
+}
+
+// clearCounters zeroes the counter values (but not the function
+// prologs) in the counter arrays 'cl'. It does not allocate.
+func clearCounters(cl []rtcov.CovCounterBlob) {
 	var sd []atomic.Uint32
 
 	bufHdr := (*reflect.SliceHeader)(unsafe.Pointer(&sd))
@@ -174,5 +415,117 @@ func ClearCoverageCounters() error {
 			i += coverage.FirstCtrOffset + int(nCtrs) - 1
 		}
 	}
+}
+
+// ClearPackageCoverageCounters clears/resets the coverage counter
+// variables for the functions in the instrumented package with import
+// path 'pkgPath' (the canonical import path, as reported by "go
+// list", not a file or directory path), leaving the counters of
+// other packages untouched. As with ClearCoverageCounters, the
+// program must be built with "-covermode=atomic". An error is
+// returned if the program was not built with "-cover" or if the
+// package is not instrumented.
+func ClearPackageCoverageCounters(pkgPath string) error {
+	cl := getCovCounterList()
+	if len(cl) == 0 {
+		return fmt.Errorf("program not built with -cover")
+	}
+	if cmode != coverage.CtrModeAtomic {
+		return fmt.Errorf("ClearPackageCoverageCounters invoked for program build with -covermode=%s (please use -covermode=atomic)", cmode.String())
+	}
+	paths, err := metaPackagePaths(metaPayloads(getCovMetaList()))
+	if err != nil {
+		return err
+	}
+	pkIdx := -1
+	for i, path := range paths {
+		if path == pkgPath {
+			pkIdx = i
+			break
+		}
+	}
+	if pkIdx < 0 {
+		return fmt.Errorf("package %s is not instrumented", pkgPath)
+	}
+	clearPackageCounters(cl, getCovPkgMap(), uint32(pkIdx))
 	return nil
 }
+
+// clearPackageCounters zeroes the counter values (but not the
+// function prologs) of the functions in the package with index
+// 'pkIdx' in the counter arrays 'cl'.
+func clearPackageCounters(cl []rtcov.CovCounterBlob, pm map[int]int, pkIdx uint32) {
+	var sd []atomic.Uint32
+
+	bufHdr := (*reflect.SliceHeader)(unsafe.Pointer(&sd))
+	for _, c := range cl {
+		bufHdr.Data = uintptr(unsafe.Pointer(c.Counters))
+		bufHdr.Len = int(c.Len)
+		bufHdr.Cap = int(c.Len)
+		for i := 0; i < len(sd); i++ {
+			// Skip ahead until the next non-zero value.
+			nCtrs := sd[i].Load()
+			if nCtrs == 0 {
+				continue
+			}
+			pkgId := sd[i+coverage.PkgIdOffset].Load()
+			funcId := sd[i+coverage.FuncIdOffset].Load()
+			if remapPkgID(pm, i, pkgId, funcId, nCtrs) == pkIdx {
+				for j := 0; j < int(nCtrs); j++ {
+					sd[i+coverage.FirstCtrOffset+j].Store(0)
+				}
+			}
+			// Move to next function.
+			i += coverage.FirstCtrOffset + int(nCtrs) - 1
+		}
+	}
+}
+
+// ClearCountersAndEmitTo captures the current coverage counter values
+// and clears the counters as a single atomic operation, then writes
+// the captured values (along with a meta-data file, if needed) to the
+// directory 'dir'. No counter update made by another goroutine can
+// fall between the capture and the clear, so successive calls produce
+// checkpoints that each cover exactly the execution since the
+// previous call. To achieve this, all other goroutines are suspended
+// while the counters are read and cleared (a "stop the world"
+// operation); this has a latency cost proportional to the number of
+// counters, so ClearCountersAndEmitTo is intended for use in tests or
+// monitoring code, not on latency-sensitive paths. As with
+// ClearCoverageCounters, the program must be built with
+// "-covermode=atomic".
+func ClearCountersAndEmitTo(dir string) error {
+	cl := getCovCounterList()
+	if len(cl) == 0 {
+		return fmt.Errorf("program not built with -cover")
+	}
+	if cmode != coverage.CtrModeAtomic {
+		return fmt.Errorf("ClearCountersAndEmitTo invoked for program build with -covermode=%s (please use -covermode=atomic)", cmode.String())
+	}
+	if err := ensureFinalHash(); err != nil {
+		return err
+	}
+	if err := emitMetaDataToDirectory(dir, getCovMetaList()); err != nil {
+		return err
+	}
+
+	// Allocate everything up front, so that no allocation happens
+	// while the world is stopped.
+	snap := &CounterSnapshot{
+		metaHash: finalHash,
+		args:     counterFileArgs(),
+		pkgmap:   getCovPkgMap(),
+		slabs:    make([][]uint32, len(cl)),
+	}
+	for k, c := range cl {
+		snap.slabs[k] = make([]uint32, 0, c.Len)
+	}
+	stopTheWorld()
+	for k, c := range cl {
+		snap.slabs[k] = readCounterSlab(c, snap.slabs[k])
+	}
+	clearCounters(cl)
+	startTheWorld()
+
+	return snap.writeToDir(dir)
+}
@@ -0,0 +1,768 @@
+// Copyright 2022 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package coverage
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"internal/coverage"
+	"internal/coverage/encodemeta"
+	"internal/coverage/pods"
+	"internal/coverage/slicewriter"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestCoverageFormatVersion(t *testing.T) {
+	v := CoverageFormatVersion()
+	major, minor, err := ParseCoverageFormatVersion(v)
+	if err != nil {
+		t.Fatalf("ParseCoverageFormatVersion(%q): %v", v, err)
+	}
+	if major != 1 || minor != formatExtVersion {
+		t.Errorf("ParseCoverageFormatVersion(%q) = %d, %d", v, major, minor)
+	}
+	for _, bad := range []string{"", "coverage", "coverage/1", "cover/1.0", "coverage/x.1", "coverage/1.-2"} {
+		if _, _, err := ParseCoverageFormatVersion(bad); err == nil {
+			t.Errorf("ParseCoverageFormatVersion(%q): expected error", bad)
+		}
+	}
+
+	tests := []struct {
+		v1, v2 string
+		want   bool
+	}{
+		{"coverage/1.2", "coverage/1.2", true},
+		{"coverage/1.1", "coverage/1.3", true},
+		{"coverage/1.3", "coverage/1.1", false},
+		{"coverage/2.0", "coverage/1.9", false},
+		{"coverage/1.0", "coverage/2.0", false},
+		{"bogus", "coverage/1.0", false},
+	}
+	for _, tc := range tests {
+		if got := IsCompatible(tc.v1, tc.v2); got != tc.want {
+			t.Errorf("IsCompatible(%q, %q) = %v, want %v", tc.v1, tc.v2, got, tc.want)
+		}
+	}
+}
+
+func TestCoverageStatsRoundTrip(t *testing.T) {
+	st := CoverageStats{
+		TotalBlocks:          1700,
+		CoveredBlocks:        1234,
+		TotalLines:           5000,
+		CoveredLines:         4321,
+		BlockCoveragePercent: 72.58823529411765,
+		LineCoveragePercent:  86.42,
+	}
+	var buf bytes.Buffer
+	n, err := st.WriteTo(&buf)
+	if err != nil {
+		t.Fatalf("WriteTo: %v", err)
+	}
+	if n != int64(buf.Len()) {
+		t.Errorf("WriteTo returned %d, wrote %d bytes", n, buf.Len())
+	}
+	var got CoverageStats
+	m, err := got.ReadFrom(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("ReadFrom: %v", err)
+	}
+	if m != n {
+		t.Errorf("ReadFrom returned %d, want %d", m, n)
+	}
+	if got != st {
+		t.Errorf("round trip: got %+v, want %+v", got, st)
+	}
+
+	b := buf.Bytes()
+	b[0] ^= 0xff
+	if _, err := got.ReadFrom(bytes.NewReader(b)); err == nil {
+		t.Errorf("ReadFrom with bad magic: expected error")
+	}
+	if _, err := got.ReadFrom(bytes.NewReader(b[:3])); err == nil {
+		t.Errorf("ReadFrom with short input: expected error")
+	}
+}
+
+func TestHashIndexedStore(t *testing.T) {
+	dir := t.TempDir()
+	hs := NewHashIndexedStore(filepath.Join(dir, "store"))
+	h1 := [16]byte{0xab, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+	h2 := [16]byte{0xab, 0xff}
+	h3 := [16]byte{0x01}
+
+	if hs.Has(h1) {
+		t.Fatalf("Has(h1) true for empty store")
+	}
+	if n, err := hs.GarbageCollect(func([16]byte) bool { return false }); n != 0 || err != nil {
+		t.Fatalf("GarbageCollect on empty store = %d, %v", n, err)
+	}
+	for _, h := range [][16]byte{h1, h2, h3} {
+		if err := hs.Put(h, strings.NewReader(fmt.Sprintf("data-%x", h))); err != nil {
+			t.Fatalf("Put(%x): %v", h, err)
+		}
+	}
+	if err := hs.Put(h1, strings.NewReader("new")); err != nil {
+		t.Fatalf("Put(h1) again: %v", err)
+	}
+	want := filepath.Join(dir, "store", "ab", "0102030405060708090a0b0c0d0e0f")
+	if _, err := os.Stat(want); err != nil {
+		t.Errorf("entry for h1 not at expected path: %v", err)
+	}
+	rc, err := hs.Get(h1)
+	if err != nil {
+		t.Fatalf("Get(h1): %v", err)
+	}
+	b, err := io.ReadAll(rc)
+	rc.Close()
+	if err != nil || string(b) != "new" {
+		t.Errorf("Get(h1) content = %q, %v", b, err)
+	}
+
+	// A stray file should survive garbage collection.
+	stray := filepath.Join(dir, "store", "ab", "README")
+	if err := os.WriteFile(stray, nil, 0666); err != nil {
+		t.Fatal(err)
+	}
+	n, err := hs.GarbageCollect(func(h [16]byte) bool { return h == h2 })
+	if err != nil || n != 2 {
+		t.Fatalf("GarbageCollect = %d, %v, want 2, nil", n, err)
+	}
+	if hs.Has(h1) || !hs.Has(h2) || hs.Has(h3) {
+		t.Errorf("after GarbageCollect: Has = %v %v %v, want false true false", hs.Has(h1), hs.Has(h2), hs.Has(h3))
+	}
+	if _, err := os.Stat(stray); err != nil {
+		t.Errorf("stray file removed by GarbageCollect: %v", err)
+	}
+	if _, err := hs.Get(h1); err == nil {
+		t.Errorf("Get(h1) succeeded after entry was collected")
+	}
+}
+
+func TestCounterHistogram(t *testing.T) {
+	tests := []struct {
+		vals    []uint32
+		n       int
+		buckets []uint32
+		counts  []int
+	}{
+		{[]uint32{1, 2, 3, 4, 5, 8, 8}, 4, []uint32{1, 2, 4, 8}, []int{1, 1, 2, 3}},
+		{[]uint32{7, 100}, 1, []uint32{100}, []int{2}},
+		{[]uint32{1000, 1, 31, 32}, 3, []uint32{1, 32, 1000}, []int{1, 2, 1}},
+		{[]uint32{1, 2}, 4, []uint32{1, 1, 2, 2}, []int{1, 0, 1, 0}},
+		{nil, 2, []uint32{1, 1}, []int{0, 0}},
+	}
+	for _, tc := range tests {
+		buckets, counts := counterHistogram(tc.vals, tc.n)
+		if !reflect.DeepEqual(buckets, tc.buckets) || !reflect.DeepEqual(counts, tc.counts) {
+			t.Errorf("counterHistogram(%v, %d) = %v, %v; want %v, %v", tc.vals, tc.n, buckets, counts, tc.buckets, tc.counts)
+		}
+	}
+	if _, _, err := CounterSamplerHistogram(0); err == nil {
+		t.Errorf("CounterSamplerHistogram(0) succeeded")
+	}
+}
+
+func TestFuzzCoverageNew(t *testing.T) {
+	tests := []struct {
+		a, b []uint8
+		want bool
+	}{
+		{nil, nil, false},
+		{[]uint8{1, 0, 1}, []uint8{1, 0, 1}, false},
+		{[]uint8{1, 1, 1}, []uint8{1, 0, 1}, false},
+		{[]uint8{1, 0, 1}, []uint8{1, 1, 1}, true},
+		{[]uint8{0, 0, 0, 0, 0, 0, 0, 0, 0}, []uint8{0, 0, 0, 0, 0, 0, 0, 0, 1}, true},
+		{[]uint8{0, 0, 0, 0, 0, 0, 1, 0, 0}, []uint8{0, 0, 0, 0, 0, 0, 1, 0, 0}, false},
+		{[]uint8{0, 0, 0, 0, 0, 0, 0, 0, 1}, []uint8{0, 0, 0, 0, 0, 1, 0, 0, 0}, true},
+		{[]uint8{1}, []uint8{1, 0, 0}, false},
+		{[]uint8{1}, []uint8{1, 0, 1}, true},
+		{[]uint8{1, 0, 1}, []uint8{1}, false},
+	}
+	for _, tc := range tests {
+		if got := FuzzCoverageNew(tc.a, tc.b); got != tc.want {
+			t.Errorf("FuzzCoverageNew(%v, %v) = %v, want %v", tc.a, tc.b, got, tc.want)
+		}
+	}
+}
+
+func TestFuzzCoverageSnapshot(t *testing.T) {
+	const npkgs, nfuncs = 3, 5
+	cl, slabs := syntheticCounterList(npkgs, nfuncs)
+	defer injectTestCounterList(cl)()
+	// Leave one function unexecuted, and one with a zero counter.
+	last := slabs[npkgs-1]
+	for i := len(last) - coverage.FirstCtrOffset - 2; i < len(last); i++ {
+		last[i].Store(0)
+	}
+	slabs[0][coverage.FirstCtrOffset+1].Store(0)
+
+	want := func(reset bool) []uint8 {
+		var v []uint8
+		for _, slab := range slabs {
+			for i := 0; i < len(slab); {
+				n := int(slab[i].Load())
+				if n == 0 {
+					v = append(v, 0)
+					i++
+					continue
+				}
+				v = append(v, make([]uint8, coverage.FirstCtrOffset)...)
+				for j := 0; j < n; j++ {
+					if slab[i+coverage.FirstCtrOffset+j].Load() == 0 {
+						v = append(v, 0)
+						continue
+					}
+					if reset {
+						t.Fatalf("counter %d of function at %d not reset", j, i)
+					}
+					v = append(v, 1)
+				}
+				i += coverage.FirstCtrOffset + n
+			}
+		}
+		return v
+	}
+	got := FuzzCoverageSnapshot()
+	if w := want(false); !bytes.Equal(got, w) {
+		t.Fatalf("FuzzCoverageSnapshot() = %v, want %v", got, w)
+	}
+	FuzzCoverageReset()
+	got = FuzzCoverageSnapshot()
+	if w := want(true); !bytes.Equal(got, w) || len(w) != npkgs*nfuncs*(coverage.FirstCtrOffset+2) {
+		t.Fatalf("FuzzCoverageSnapshot() after reset = %v, want %v", got, w)
+	}
+	for _, b := range got {
+		if b != 0 {
+			t.Fatalf("FuzzCoverageSnapshot() after reset = %v, want all zero", got)
+		}
+	}
+	runtime.KeepAlive(slabs)
+}
+
+// BenchmarkMergeCoverageCounters compares merging a batch of counter
+// data sources one at a time with MergeCoverageCounters against
+// merging them with ConcurrentMergeCoverageCounters. The counters
+// merged into are those of the test binary itself, so the benchmark
+// only runs under "go test -cover".
+func BenchmarkMergeCoverageCounters(b *testing.B) {
+	if testing.CoverMode() == "" {
+		b.Skip("test binary not built with -cover")
+	}
+	if err := ensureFinalHash(); err != nil {
+		b.Fatalf("ensureFinalHash: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := EmitCounterDataToWriter(&buf); err != nil {
+		b.Fatalf("EmitCounterDataToWriter: %v", err)
+	}
+	const nsrcs = 64
+	srcs := func() []io.Reader {
+		rs := make([]io.Reader, nsrcs)
+		for i := range rs {
+			rs[i] = bytes.NewReader(buf.Bytes())
+		}
+		return rs
+	}
+	b.Run("sequential", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for _, r := range srcs() {
+				if err := MergeCoverageCounters(r); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+	b.Run("concurrent", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if err := ConcurrentMergeCoverageCounters(srcs()); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// scopedTB wraps a *testing.T, capturing log output and optionally
+// reporting the test as failed.
+type scopedTB struct {
+	*testing.T
+	fail bool
+	logs []string
+}
+
+func (t *scopedTB) Logf(format string, args ...any) {
+	t.logs = append(t.logs, fmt.Sprintf(format, args...))
+}
+
+func (t *scopedTB) Failed() bool {
+	return t.fail || t.T.Failed()
+}
+
+func TestNewTestScopedRecorderSubtests(t *testing.T) {
+	if testing.CoverMode() == "" || testing.CoverMode() == "set" {
+		// In "set" mode, functions already executed by earlier
+		// tests would not show up as executed again.
+		t.Skip("test binary not built with -covermode=count or atomic")
+	}
+	// Each subtest reports itself as failed, so that its recorder
+	// logs every function executed during the subtest.
+	a, b := &scopedTB{fail: true}, &scopedTB{fail: true}
+	t.Run("A", func(t *testing.T) {
+		a.T = t
+		NewTestScopedRecorder(a)
+		CoverageFormatVersion()
+	})
+	t.Run("B", func(t *testing.T) {
+		b.T = t
+		NewTestScopedRecorder(b)
+		IsCompatible("coverage/1.0", "coverage/1.0")
+	})
+	for _, tc := range []struct {
+		name          string
+		tb            *scopedTB
+		want, notWant string
+	}{
+		{"A", a, "runtime/coverage.CoverageFormatVersion", "runtime/coverage.IsCompatible"},
+		{"B", b, "runtime/coverage.IsCompatible", "runtime/coverage.CoverageFormatVersion"},
+	} {
+		log := strings.Join(tc.tb.logs, "\n")
+		if !strings.Contains(log, "functions executed during failed test") || !strings.Contains(log, "\t"+tc.want+"\n") {
+			t.Errorf("subtest %s: log does not list %s:\n%s", tc.name, tc.want, log)
+		}
+		if strings.Contains(log, "\t"+tc.notWant+"\n") {
+			t.Errorf("subtest %s: log lists %s, executed by sibling subtest:\n%s", tc.name, tc.notWant, log)
+		}
+	}
+}
+
+// TestEmitFuncCountStable checks that the function count reported to
+// the counter file writer (which goes into the file header) matches
+// the number of functions subsequently visited, even if another
+// function starts executing in between.
+func TestEmitFuncCountStable(t *testing.T) {
+	const npkgs, nfuncs = 2, 3
+	cl, slabs := syntheticCounterList(npkgs, nfuncs)
+	defer injectTestCounterList(cl)()
+	// Mark the first function as never executed.
+	first := slabs[0][:coverage.FirstCtrOffset+2]
+	saved := make([]uint32, len(first))
+	for i := range first {
+		saved[i] = first[i].Load()
+		first[i].Store(0)
+	}
+
+	s := &emitState{counterlist: cl}
+	s.snap = s.snapshotCounters(finalHash)
+	n, err := s.NumFuncs()
+	if err != nil {
+		t.Fatalf("NumFuncs: %v", err)
+	}
+	// Run the first function.
+	for i := range first {
+		first[i].Store(saved[i])
+	}
+	visited := 0
+	err = s.VisitFuncs(func(pkgId, funcId uint32, counters []uint32) error {
+		visited++
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("VisitFuncs: %v", err)
+	}
+	if want := npkgs*nfuncs - 1; n != want || visited != want {
+		t.Errorf("NumFuncs = %d, visited %d functions, want %d", n, visited, want)
+	}
+}
+
+// TestMergePodArgs checks that the args section of the merged counter
+// data is kept when the files merged agree on it, even if an earlier
+// file in the pod was skipped.
+func TestMergePodArgs(t *testing.T) {
+	dir, dst := t.TempDir(), t.TempDir()
+	hash, other := [16]byte{1}, [16]byte{2}
+	mf := filepath.Join(dir, fmt.Sprintf("%s.%x", coverage.MetaFilePref, hash))
+	var mb bytes.Buffer
+	if err := writeMetaData(&mb, nil, coverage.CtrModeCount, coverage.CtrGranularityPerBlock, hash); err != nil {
+		t.Fatalf("writeMetaData: %v", err)
+	}
+	if err := os.WriteFile(mf, mb.Bytes(), 0666); err != nil {
+		t.Fatal(err)
+	}
+	args := map[string]string{"argc": "1", "argv0": "prog", "label": "x"}
+	funcs := map[pkfunc][]uint32{{pk: 0, fcn: 0}: {1, 2}}
+	p := pods.Pod{MetaFile: mf}
+	for i, h := range [][16]byte{other, hash, hash} {
+		var b bytes.Buffer
+		if err := newSnapshotFromFuncs(h, args, funcs).write(&b); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		cf := filepath.Join(dir, fmt.Sprintf("%s.%x.1.%d", coverage.CounterFilePref, hash, i))
+		if err := os.WriteFile(cf, b.Bytes(), 0666); err != nil {
+			t.Fatal(err)
+		}
+		p.CounterDataFiles = append(p.CounterDataFiles, cf)
+	}
+	if err := mergePod(p, dst); err != nil {
+		t.Fatalf("mergePod: %v", err)
+	}
+	cfs, err := filepath.Glob(filepath.Join(dst, coverage.CounterFilePref+".*"))
+	if err != nil || len(cfs) != 1 {
+		t.Fatalf("merged counter files: %v (err %v)", cfs, err)
+	}
+	snap, err := readCounterFile(cfs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := snap.args["label"]; got != "x" {
+		t.Errorf("merged args have label %q, want %q", got, "x")
+	}
+	if got, want := snap.counterMap()[pkfunc{pk: 0, fcn: 0}], []uint32{2, 4}; !reflect.DeepEqual(got, want) {
+		t.Errorf("merged counters = %v, want %v", got, want)
+	}
+}
+
+func TestWriteJSONString(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"", `""`},
+		{"main.f", `"main.f"`},
+		{`a"b\c`, `"a\"b\\c"`},
+		{"a\nb\rc\td", `"a\nb\rc\td"`},
+		{"\x00\x01\x1f\x7f", `"\u0000\u0001\u001f` + "\x7f" + `"`},
+		{"héllo, 世界", `"héllo, 世界"`},
+		{"a\xffb", `"a\ufffdb"`},
+		{"\xe4\xb8", `"\ufffd\ufffd"`},
+		{"\xed\xa0\x80", `"\ufffd\ufffd\ufffd"`}, // surrogate half
+	}
+	for _, tc := range tests {
+		var sb strings.Builder
+		writeJSONString(&sb, tc.in)
+		got := sb.String()
+		if got != tc.want {
+			t.Errorf("writeJSONString(%q) = %s, want %s", tc.in, got, tc.want)
+		}
+		var s string
+		if err := json.Unmarshal([]byte(got), &s); err != nil {
+			t.Errorf("writeJSONString(%q) = %s: invalid JSON: %v", tc.in, got, err)
+		} else if utf8.ValidString(tc.in) && s != tc.in {
+			t.Errorf("writeJSONString(%q) decodes to %q", tc.in, s)
+		}
+	}
+}
+
+func TestWriteJSON(t *testing.T) {
+	doc := jsonObject{
+		{"name", "f\x00"},
+		{"n", uint32(7)},
+		{"pct", 12.5},
+		{"list", []any{1, uint64(2), nil}},
+		{"empty", []any{}},
+		{"none", []any(nil)},
+		{"obj", jsonObject{}},
+	}
+	for _, tc := range []struct {
+		pretty bool
+		want   string
+	}{
+		{false, `{"name":"f\u0000","n":7,"pct":12.5,"list":[1,2,null],"empty":[],"none":null,"obj":{}}`},
+		{true, "{\n  \"name\": \"f\\u0000\",\n  \"n\": 7,\n  \"pct\": 12.5,\n  \"list\": [\n    1,\n    2,\n    null\n  ],\n  \"empty\": [],\n  \"none\": null,\n  \"obj\": {}\n}"},
+	} {
+		var sb strings.Builder
+		writeJSON(&sb, doc, tc.pretty, 0)
+		if got := sb.String(); got != tc.want {
+			t.Errorf("writeJSON(pretty=%v) = %s, want %s", tc.pretty, got, tc.want)
+		}
+		if !json.Valid([]byte(sb.String())) {
+			t.Errorf("writeJSON(pretty=%v) produced invalid JSON", tc.pretty)
+		}
+	}
+}
+
+func TestHashChainHistory(t *testing.T) {
+	hashChainMu.Lock()
+	links, next, head := hashChainLinks, hashChainNext, hashChainHead
+	hashChainLinks, hashChainNext, hashChainHead = nil, 0, [32]byte{}
+	hashChainMu.Unlock()
+	defer func() {
+		hashChainMu.Lock()
+		hashChainLinks, hashChainNext, hashChainHead = links, next, head
+		hashChainMu.Unlock()
+	}()
+
+	var hash [16]byte
+	chain := [][32]byte{{}}
+	for i := 0; i < hashChainHistory+2; i++ {
+		funcs := map[pkfunc][]uint32{{pk: 0, fcn: 0}: {uint32(i)}}
+		chain = append(chain, appendHashLink(newSnapshotFromFuncs(hash, nil, funcs)))
+		// The first link remains verifiable after further calls,
+		// until it drops out of the history.
+		if got, want := VerifyHashChain(chain[0], chain[1]), i < hashChainHistory; got != want {
+			t.Fatalf("after %d calls, VerifyHashChain(first link) = %v, want %v", i+1, got, want)
+		}
+	}
+	n := len(chain) - 1
+	for i := 1; i <= n; i++ {
+		want := i > n-hashChainHistory
+		if got := VerifyHashChain(chain[i-1], chain[i]); got != want {
+			t.Errorf("VerifyHashChain(link %d of %d) = %v, want %v", i, n, got, want)
+		}
+	}
+	if VerifyHashChain(chain[n], chain[n-1]) || VerifyHashChain([32]byte{}, chain[n]) {
+		t.Errorf("VerifyHashChain accepts invalid links")
+	}
+}
+
+// testMetaPayloads returns the meta-data blobs for two small
+// packages: example.com/a, with functions f (two blocks) and g (one
+// block) in a.go, and example.com/b, with function h (one block) in
+// b.go.
+func testMetaPayloads(t *testing.T) [][]byte {
+	t.Helper()
+	pkgs := []struct {
+		path  string
+		funcs []coverage.FuncDesc
+	}{
+		{"example.com/a", []coverage.FuncDesc{
+			{Funcname: "f", Srcfile: "a.go", Units: []coverage.CoverableUnit{
+				{StLine: 3, StCol: 10, EnLine: 5, EnCol: 2, NxStmts: 2},
+				{StLine: 5, StCol: 2, EnLine: 7, EnCol: 2, NxStmts: 1},
+			}},
+			{Funcname: "g", Srcfile: "a.go", Units: []coverage.CoverableUnit{
+				{StLine: 10, StCol: 10, EnLine: 11, EnCol: 2, NxStmts: 1},
+			}},
+		}},
+		{"example.com/b", []coverage.FuncDesc{
+			{Funcname: "h", Srcfile: "b.go", Units: []coverage.CoverableUnit{
+				{StLine: 1, StCol: 10, EnLine: 2, EnCol: 2, NxStmts: 1},
+			}},
+		}},
+	}
+	var payloads [][]byte
+	for _, p := range pkgs {
+		b, err := encodemeta.NewCoverageMetaDataBuilder(p.path, filepath.Base(p.path), "example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, fd := range p.funcs {
+			b.AddFunc(fd)
+		}
+		var slw slicewriter.WriteSeeker
+		if _, err := b.Emit(&slw); err != nil {
+			t.Fatal(err)
+		}
+		payloads = append(payloads, slw.BytesWritten())
+	}
+	return payloads
+}
+
+func TestDiffSnapshots(t *testing.T) {
+	payloads := testMetaPayloads(t)
+	var hash [16]byte
+	f, g, h := pkfunc{pk: 0, fcn: 0}, pkfunc{pk: 0, fcn: 1}, pkfunc{pk: 1, fcn: 0}
+	entry := func(fn string, before, after uint64) DiffEntry {
+		pkg := "example.com/a"
+		if fn == "h" {
+			pkg = "example.com/b"
+		}
+		return DiffEntry{PackagePath: pkg, FunctionName: fn, Before: before, After: after}
+	}
+	tests := []struct {
+		name          string
+		before, after map[pkfunc][]uint32
+		want          CounterDiff
+		text          string
+	}{
+		{
+			name:  "unchanged",
+			after: map[pkfunc][]uint32{g: {0}},
+			text:  "--- before\n+++ after\n",
+		},
+		{
+			name:  "gained",
+			after: map[pkfunc][]uint32{f: {2, 0}},
+			want:  CounterDiff{Gained: []DiffEntry{entry("f", 0, 2)}},
+			text:  "--- before\n+++ after\n+ example.com/a.f: 0 -> 2\n",
+		},
+		{
+			name:   "lost",
+			before: map[pkfunc][]uint32{f: {1, 1}},
+			after:  map[pkfunc][]uint32{f: {0, 0}},
+			want:   CounterDiff{Lost: []DiffEntry{entry("f", 2, 0)}},
+			text:   "--- before\n+++ after\n- example.com/a.f: 2 -> 0\n",
+		},
+		{
+			name:   "all",
+			before: map[pkfunc][]uint32{f: {1, 0}, g: {2}},
+			after:  map[pkfunc][]uint32{f: {1, 3}, h: {5}},
+			want: CounterDiff{
+				Gained:  []DiffEntry{entry("h", 0, 5)},
+				Lost:    []DiffEntry{entry("g", 2, 0)},
+				Changed: []DiffEntry{entry("f", 1, 4)},
+			},
+			text: "--- before\n+++ after\n- example.com/a.g: 2 -> 0\n+ example.com/b.h: 0 -> 5\n! example.com/a.f: 1 -> 4\n",
+		},
+	}
+	for _, tc := range tests {
+		d, err := diffSnapshots(payloads, newSnapshotFromFuncs(hash, nil, tc.before), newSnapshotFromFuncs(hash, nil, tc.after))
+		if err != nil {
+			t.Fatalf("%s: diffSnapshots: %v", tc.name, err)
+		}
+		if !reflect.DeepEqual(*d, tc.want) {
+			t.Errorf("%s: diffSnapshots = %+v, want %+v", tc.name, *d, tc.want)
+		}
+		var b strings.Builder
+		if err := DiffToText(d, &b); err != nil {
+			t.Fatalf("%s: DiffToText: %v", tc.name, err)
+		}
+		if b.String() != tc.text {
+			t.Errorf("%s: DiffToText output:\n%s\nwant:\n%s", tc.name, b.String(), tc.text)
+		}
+	}
+
+	other := [16]byte{1}
+	if _, err := diffSnapshots(payloads, newSnapshotFromFuncs(hash, nil, nil), newSnapshotFromFuncs(other, nil, nil)); err == nil {
+		t.Errorf("diffSnapshots of snapshots with different hashes succeeded")
+	}
+}
+
+func TestDeltaCounters(t *testing.T) {
+	f, g := pkfunc{pk: 0, fcn: 0}, pkfunc{pk: 0, fcn: 1}
+	tests := []struct {
+		before, after, want map[pkfunc][]uint32
+	}{
+		{nil, nil, map[pkfunc][]uint32{}},
+		{nil, map[pkfunc][]uint32{f: {1, 0}}, map[pkfunc][]uint32{f: {1, 0}}},
+		{map[pkfunc][]uint32{f: {1, 2}}, map[pkfunc][]uint32{f: {1, 2}}, map[pkfunc][]uint32{}},
+		{map[pkfunc][]uint32{f: {1, 2}, g: {3}}, map[pkfunc][]uint32{f: {4, 2}, g: {3}}, map[pkfunc][]uint32{f: {3, 0}}},
+		// Counters that went down were cleared in the interim.
+		{map[pkfunc][]uint32{f: {5, 5}}, map[pkfunc][]uint32{f: {2, 7}}, map[pkfunc][]uint32{f: {2, 2}}},
+		// Functions only in 'before' are omitted.
+		{map[pkfunc][]uint32{g: {3}}, nil, map[pkfunc][]uint32{}},
+	}
+	for _, tc := range tests {
+		if got := deltaCounters(tc.before, tc.after); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("deltaCounters(%v, %v) = %v, want %v", tc.before, tc.after, got, tc.want)
+		}
+	}
+}
+
+func TestMergeDeltaCounterData(t *testing.T) {
+	var hash [16]byte
+	f, g, h := pkfunc{pk: 0, fcn: 0}, pkfunc{pk: 0, fcn: 1}, pkfunc{pk: 1, fcn: 0}
+	encode := func(hash [16]byte, args map[string]string, funcs map[pkfunc][]uint32) []byte {
+		var b bytes.Buffer
+		if err := newSnapshotFromFuncs(hash, args, funcs).write(&b); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		return b.Bytes()
+	}
+	deltaArgs := map[string]string{deltaCountsKey: "1", "label": "x"}
+	tests := []struct {
+		base, delta, want map[pkfunc][]uint32
+	}{
+		{nil, nil, map[pkfunc][]uint32{}},
+		{map[pkfunc][]uint32{f: {1, 2}}, nil, map[pkfunc][]uint32{f: {1, 2}}},
+		{map[pkfunc][]uint32{f: {1, 2}, g: {3}}, map[pkfunc][]uint32{f: {0, 5}, h: {1}}, map[pkfunc][]uint32{f: {1, 7}, g: {3}, h: {1}}},
+		// Counter values saturate.
+		{map[pkfunc][]uint32{f: {math.MaxUint32 - 1, 1}}, map[pkfunc][]uint32{f: {2, 1}}, map[pkfunc][]uint32{f: {math.MaxUint32, 2}}},
+	}
+	for _, tc := range tests {
+		var out bytes.Buffer
+		err := MergeDeltaCounterData(bytes.NewReader(encode(hash, nil, tc.base)), bytes.NewReader(encode(hash, deltaArgs, tc.delta)), &out)
+		if err != nil {
+			t.Fatalf("MergeDeltaCounterData(%v, %v): %v", tc.base, tc.delta, err)
+		}
+		snap, err := readCounterData(bytes.NewReader(out.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := snap.counterMap(); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("MergeDeltaCounterData(%v, %v) = %v, want %v", tc.base, tc.delta, got, tc.want)
+		}
+		if _, ok := snap.args[deltaCountsKey]; ok || snap.args["label"] != "x" {
+			t.Errorf("MergeDeltaCounterData args = %v", snap.args)
+		}
+	}
+
+	base := encode(hash, nil, map[pkfunc][]uint32{f: {1, 1}})
+	if err := MergeDeltaCounterData(bytes.NewReader(base), bytes.NewReader(base), io.Discard); err == nil {
+		t.Errorf("MergeDeltaCounterData with non-delta input succeeded")
+	}
+	other := encode([16]byte{1}, deltaArgs, nil)
+	if err := MergeDeltaCounterData(bytes.NewReader(base), bytes.NewReader(other), io.Discard); err == nil {
+		t.Errorf("MergeDeltaCounterData with mismatched hashes succeeded")
+	}
+}
+
+func TestCoverageRoundTrip(t *testing.T) {
+	payloads := testMetaPayloads(t)
+	hash := [16]byte{0x11, 0x22}
+	var mb bytes.Buffer
+	mfw := encodemeta.NewCoverageMetaFileWriter("<test>", &mb)
+	if err := mfw.Write(hash, payloads, coverage.CtrModeCount, coverage.CtrGranularityPerBlock); err != nil {
+		t.Fatalf("writing meta-data: %v", err)
+	}
+	f, g, h := pkfunc{pk: 0, fcn: 0}, pkfunc{pk: 0, fcn: 1}, pkfunc{pk: 1, fcn: 0}
+	tests := []struct {
+		funcs                    map[pkfunc][]uint32
+		coveredBlocks, coveredLn int
+	}{
+		{nil, 0, 0},
+		{map[pkfunc][]uint32{f: {2, 0}, h: {1}}, 2, 5},
+		{map[pkfunc][]uint32{f: {0, 1}}, 1, 3},
+		{map[pkfunc][]uint32{f: {1, 1}, g: {1}, h: {1}}, 4, 9},
+	}
+	for _, tc := range tests {
+		c := &Coverage{Counters: newSnapshotFromFuncs(hash, nil, tc.funcs), meta: mb.Bytes()}
+		var b bytes.Buffer
+		if err := c.Write(&b); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+		c2, err := ReadCoverage(bytes.NewReader(b.Bytes()))
+		if err != nil {
+			t.Fatalf("ReadCoverage: %v", err)
+		}
+		st := c2.Stats
+		if st.TotalBlocks != 4 || st.CoveredBlocks != tc.coveredBlocks || st.TotalLines != 9 || st.CoveredLines != tc.coveredLn {
+			t.Errorf("counters %v: stats after round trip %+v, want %d/4 blocks and %d/9 lines", tc.funcs, *st, tc.coveredBlocks, tc.coveredLn)
+		}
+		if got := c2.Counters.counterMap(); len(tc.funcs) != 0 && !reflect.DeepEqual(got, tc.funcs) {
+			t.Errorf("counters after round trip = %v, want %v", got, tc.funcs)
+		}
+		mi := c2.Meta
+		if mi.Hash != hash || mi.Mode != "count" || mi.Granularity != "perblock" || len(mi.Packages) != 2 ||
+			mi.Packages[0].ImportPath != "example.com/a" || len(mi.Packages[0].Functions) != 2 ||
+			mi.Packages[1].Functions[0].Name != "h" {
+			t.Errorf("meta-data after round trip = %+v", *mi)
+		}
+	}
+
+	var b bytes.Buffer
+	c := &Coverage{Counters: newSnapshotFromFuncs([16]byte{1}, nil, nil), meta: mb.Bytes()}
+	if err := c.Write(&b); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if _, err := ReadCoverage(bytes.NewReader(b.Bytes())); err == nil {
+		t.Errorf("ReadCoverage with mismatched hashes succeeded")
+	}
+	bad := append([]byte(nil), b.Bytes()...)
+	bad[4] = covStreamVersion + 1
+	if _, err := ReadCoverage(bytes.NewReader(bad)); err == nil {
+		t.Errorf("ReadCoverage of newer version succeeded")
+	}
+	if _, err := ReadCoverage(strings.NewReader("garbage")); err == nil {
+		t.Errorf("ReadCoverage of garbage succeeded")
+	}
+}
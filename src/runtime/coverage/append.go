@@ -0,0 +1,128 @@
+// Copyright 2022 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package coverage
+
+import (
+	"fmt"
+	"internal/coverage/cmerge"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// HashMismatchError is the error returned by AppendCounterDataToFile
+// when the existing counter data file was written by a program with
+// different meta-data.
+type HashMismatchError struct {
+	Path        string   // path of the counter data file
+	FileHash    [16]byte // meta-data hash recorded in the file
+	ProgramHash [16]byte // meta-data hash of the running program
+}
+
+func (e *HashMismatchError) Error() string {
+	return fmt.Sprintf("counter data file %s has meta-data hash %x, program meta-data hash is %x", e.Path, e.FileHash, e.ProgramHash)
+}
+
+// AppendCounterDataToFile accumulates the counter values of the
+// currently running program into the counter data file 'path', so that
+// a single file can collect coverage over repeated runs. If the file
+// does not exist, it is created holding the current counter values.
+// If it does, the values in it are combined with the current values
+// (according to the counter mode, as by "go tool covdata merge") and
+// the file is replaced with the result. A *HashMismatchError is
+// returned if the existing file was written by a program with
+// different meta-data. Note that the name of the file is chosen by
+// the caller, so "go tool covdata" will only read it if it follows
+// the usual naming convention.
+//
+// The read-modify-write sequence is protected by an advisory lock on
+// the file 'path' + ".lock" (which is left in place), so that
+// concurrent calls from several processes, on platforms that support
+// file locking, do not lose updates. The file is replaced by writing
+// a temporary file in the same directory and renaming it, so readers
+// never see a partial file.
+func AppendCounterDataToFile(path string) error {
+	snap, err := ReadCounterSnapshot()
+	if err != nil {
+		return err
+	}
+
+	lf, err := os.OpenFile(path+".lock", os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return err
+	}
+	defer lf.Close()
+	if err := lockFile(lf); err != nil {
+		return fmt.Errorf("locking %s: %v", lf.Name(), err)
+	}
+	defer unlockFile(lf)
+
+	funcs := snap.counterMap()
+	args := snap.args
+	old, err := readCounterFile(path)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return err
+	case old.metaHash != snap.metaHash:
+		return &HashMismatchError{Path: path, FileHash: old.metaHash, ProgramHash: snap.metaHash}
+	default:
+		var cm cmerge.Merger
+		if err := cm.SetModeAndGranularity(path, cmode, cgran); err != nil {
+			return err
+		}
+		err = old.visitFuncs(func(pkgId, funcId uint32, counters []uint32) error {
+			key := pkfunc{pk: pkgId, fcn: funcId}
+			dst, ok := funcs[key]
+			if !ok {
+				funcs[key] = append([]uint32(nil), counters...)
+				return nil
+			}
+			err, _ := cm.MergeCounters(dst, counters)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("merging counter data file %s: %v", path, err)
+		}
+		if !equalArgs(args, old.args) {
+			args = map[string]string{}
+		}
+	}
+	return writeFileAtomically(path, newSnapshotFromFuncs(snap.metaHash, args, funcs).write)
+}
+
+// writeFileAtomically creates the file 'path' with content produced
+// by 'write', by way of a temporary file in the same directory that is
+// renamed into place.
+func writeFileAtomically(path string, write func(w io.Writer) error) (err error) {
+	dir, base := filepath.Split(path)
+	if dir == "" {
+		dir = "."
+	}
+	f, err := os.CreateTemp(dir, "."+base+".*")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(tmp)
+		}
+	}()
+	if err := write(f); err != nil {
+		return fmt.Errorf("writing %s: %v", tmp, err)
+	}
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("syncing %s: %v", tmp, err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("closing %s: %v", tmp, err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("writing %s: rename from %s failed: %v", path, tmp, err)
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+// Copyright 2022 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package coverage
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// maxReportedPackages is the number of least-covered packages listed
+// in the error returned by AssertMinCoverage.
+const maxReportedPackages = 10
+
+// AssertMinCoverage returns an error if the block coverage of the
+// currently running program (see ProgramCoveragePercent) is below
+// 'minPercent', which is on a scale of 0 to 100. It is intended for
+// gating in TestMain or at the end of an integration test:
+//
+//	if err := coverage.AssertMinCoverage(80); err != nil {
+//		log.Fatal(err)
+//	}
+//
+// The error text is line-oriented for the benefit of CI scripts. The
+// first line reports the coverage and the threshold, and is followed
+// by one line for each of the (at most ten) packages with the most
+// uncovered blocks, most first:
+//
+//	coverage: 72.5% of blocks covered (1234/1702), minimum 80.0%
+//	uncovered: pkg=example.com/svc/api uncovered_blocks=210 total_blocks=415 coverage=49.4%
+//
+// An error is also returned if the program was not built with
+// "-cover", or if 'minPercent' is out of range.
+func AssertMinCoverage(minPercent float64) error {
+	if err := checkMinPercent(minPercent); err != nil {
+		return err
+	}
+	return minCoverageError(minPercent, maxReportedPackages)
+}
+
+// minCoverageError returns the error described for AssertMinCoverage,
+// listing at most 'maxPkgs' packages, if the program's block coverage
+// is below 'minPercent'.
+func minCoverageError(minPercent float64, maxPkgs int) error {
+	total, covered, err := liveBlockCounts()
+	if err != nil {
+		return err
+	}
+	nt, nc := 0, 0
+	pkgs := make([]string, 0, len(total))
+	for p, n := range total {
+		nt += n
+		nc += covered[p]
+		if n > covered[p] {
+			pkgs = append(pkgs, p)
+		}
+	}
+	pct := percent(nc, nt)
+	if pct >= minPercent {
+		return nil
+	}
+	sort.Slice(pkgs, func(i, j int) bool {
+		ui, uj := total[pkgs[i]]-covered[pkgs[i]], total[pkgs[j]]-covered[pkgs[j]]
+		if ui != uj {
+			return ui > uj
+		}
+		return pkgs[i] < pkgs[j]
+	})
+	if len(pkgs) > maxPkgs {
+		pkgs = pkgs[:maxPkgs]
+	}
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "coverage: %.1f%% of blocks covered (%d/%d), minimum %.1f%%", pct, nc, nt, minPercent)
+	for _, p := range pkgs {
+		fmt.Fprintf(&sb, "\nuncovered: pkg=%s uncovered_blocks=%d total_blocks=%d coverage=%.1f%%", p, total[p]-covered[p], total[p], percent(covered[p], total[p]))
+	}
+	return fmt.Errorf("%s", sb.String())
+}
+
+// AssertMinPackageCoverage returns an error if the block coverage of
+// the instrumented package 'pkgPath' (see PackageCoverageStats) is
+// below 'minPercent', which is on a scale of 0 to 100. The error text
+// has the same form as the first line of the error returned by
+// AssertMinCoverage, with the package path added:
+//
+//	coverage: example.com/svc/api: 49.4% of blocks covered (205/415), minimum 80.0%
+//
+// An error is also returned if the program was not built with
+// "-cover", if the package is not instrumented, or if 'minPercent' is
+// out of range.
+func AssertMinPackageCoverage(pkgPath string, minPercent float64) error {
+	if err := checkMinPercent(minPercent); err != nil {
+		return err
+	}
+	st, err := PackageCoverageStats(pkgPath)
+	if err != nil {
+		return err
+	}
+	if st.BlockCoveragePercent >= minPercent {
+		return nil
+	}
+	return fmt.Errorf("coverage: %s: %.1f%% of blocks covered (%d/%d), minimum %.1f%%", pkgPath, st.BlockCoveragePercent, st.CoveredBlocks, st.TotalBlocks, minPercent)
+}
+
+// checkMinPercent returns an error if 'minPercent' is not a valid
+// coverage threshold.
+func checkMinPercent(minPercent float64) error {
+	if !(minPercent >= 0 && minPercent <= 100) {
+		return fmt.Errorf("minimum coverage %v out of range [0, 100]", minPercent)
+	}
+	return nil
+}
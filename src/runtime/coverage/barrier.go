@@ -0,0 +1,98 @@
+// Copyright 2022 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package coverage
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// defaultBarrierInterval is the default polling interval for a
+// CoverageBarrier.
+const defaultBarrierInterval = 100 * time.Millisecond
+
+// CoverageBarrier waits for the block coverage of the currently
+// running program to reach a threshold, for example to let a server
+// warm up before test assertions are made. A CoverageBarrier is safe
+// for concurrent use.
+type CoverageBarrier struct {
+	min float64
+
+	mu       sync.Mutex
+	interval time.Duration
+	current  float64
+}
+
+// NewCoverageBarrier returns a barrier that is satisfied once the
+// percentage of instrumented blocks executed (in the range [0, 100])
+// reaches 'minCoverage'.
+func NewCoverageBarrier(minCoverage float64) *CoverageBarrier {
+	return &CoverageBarrier{min: minCoverage, interval: defaultBarrierInterval}
+}
+
+// SetPollInterval sets the interval at which WaitUntilCovered checks
+// coverage. The default is 100ms. Non-positive intervals are ignored.
+func (b *CoverageBarrier) SetPollInterval(d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.interval = d
+}
+
+// WaitUntilCovered polls the program's coverage until it reaches the
+// barrier's threshold, in which case it returns nil, or until 'ctx' is
+// done, in which case it returns ctx.Err(). Coverage is checked once
+// before waiting. An error is also returned if coverage data cannot
+// be read (for example, if the program was not built with "-cover").
+func (b *CoverageBarrier) WaitUntilCovered(ctx context.Context) error {
+	b.mu.Lock()
+	interval := b.interval
+	b.mu.Unlock()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		pct, err := b.poll()
+		if err != nil {
+			return err
+		}
+		if pct >= b.min {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// CurrentCoverage returns the block coverage percentage observed by
+// the most recent poll made by WaitUntilCovered, or 0 if there has
+// been no poll.
+func (b *CoverageBarrier) CurrentCoverage() float64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.current
+}
+
+// poll reads the program's current block coverage percentage and
+// records it as the barrier's current coverage.
+func (b *CoverageBarrier) poll() (float64, error) {
+	snap, err := ReadCounterSnapshot()
+	if err != nil {
+		return 0, err
+	}
+	st, err := computeStats(metaPayloads(getCovMetaList()), cgran, snap.counterMap())
+	if err != nil {
+		return 0, err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.current = st.BlockCoveragePercent
+	return st.BlockCoveragePercent, nil
+}
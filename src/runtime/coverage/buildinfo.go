@@ -0,0 +1,56 @@
+// Copyright 2022 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package coverage
+
+import (
+	"fmt"
+	"internal/coverage"
+	"internal/coverage/decodemeta"
+	"runtime"
+)
+
+// CoverageBuildInfo describes how the currently running program was
+// instrumented for coverage. See BuildInfo.
+type CoverageBuildInfo struct {
+	Mode                     string   // counter mode: "set", "count" or "atomic"
+	Granularity              string   // counter granularity: "perblock" or "perfunc"
+	GoVersion                string   // Go version that built the program, as from runtime.Version
+	NumInstrumentedPackages  int      // number of instrumented packages
+	NumInstrumentedFunctions int      // number of instrumented functions
+	NumInstrumentedBlocks    int      // number of coverable units (blocks) in all functions
+	FinalMetaHash            [16]byte // hash of all package meta-data blobs
+}
+
+// BuildInfo returns a description of how the currently running
+// program was instrumented when it was built, computed from the
+// program's coverage meta-data. It is intended for diagnosing
+// unexpected coverage results, for example by logging the settings
+// when a server starts. An error is returned if the program was not
+// built with "-cover".
+func BuildInfo() (*CoverageBuildInfo, error) {
+	ml := getCovMetaList()
+	if len(ml) == 0 {
+		return nil, fmt.Errorf("program not built with -cover")
+	}
+	if err := ensureFinalHash(); err != nil {
+		return nil, err
+	}
+	bi := &CoverageBuildInfo{
+		Mode:                    cmode.String(),
+		Granularity:             cgran.String(),
+		GoVersion:               runtime.Version(),
+		NumInstrumentedPackages: len(ml),
+		FinalMetaHash:           finalHash,
+	}
+	err := visitMetaFuncs(metaPayloads(ml), func(pkIdx, fnIdx uint32, pd *decodemeta.CoverageMetaDataDecoder, fd *coverage.FuncDesc) error {
+		bi.NumInstrumentedFunctions++
+		bi.NumInstrumentedBlocks += len(fd.Units)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return bi, nil
+}
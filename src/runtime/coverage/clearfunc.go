@@ -0,0 +1,47 @@
+// Copyright 2022 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package coverage
+
+import (
+	"fmt"
+	"internal/coverage"
+)
+
+// ClearFunctionCoverageCounters clears/resets the coverage counter
+// variables for the single instrumented function 'fnName' (the name
+// as recorded in the meta-data, for example "F" or "*T.Method") in the
+// package with import path 'pkgPath', leaving all other counters
+// untouched. As with ClearCoverageCounters, the program must be built
+// with "-covermode=atomic". Clearing the counters of a function that
+// is executing concurrently is safe, but increments that race with
+// the clear may or may not survive it, so the function's counters can
+// be left partly cleared. A *FuncNotFoundError is returned if the
+// program has no such instrumented function.
+//
+// The meta-data is decoded on the first call, and the location of a
+// function's counters is remembered once found, so that repeated
+// calls for the same function are cheap.
+func ClearFunctionCoverageCounters(pkgPath, fnName string) error {
+	cl := getCovCounterList()
+	if len(cl) == 0 {
+		return fmt.Errorf("program not built with -cover")
+	}
+	if err := ensureFinalHash(); err != nil {
+		return err
+	}
+	if cmode != coverage.CtrModeAtomic {
+		return fmt.Errorf("ClearFunctionCoverageCounters invoked for program build with -covermode=%s (please use -covermode=atomic)", cmode.String())
+	}
+	key, err := lookupFunc(pkgPath, fnName)
+	if err != nil {
+		return err
+	}
+	// If the function has not executed, its counters are all zero.
+	sd := funcLiveCounters(cl, key)
+	for i := range sd {
+		sd[i].Store(0)
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+// Copyright 2022 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package coverage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+)
+
+// combinedMagic holds the magic string for a combined coverage data
+// stream, as written by EmitCombinedDataToWriter.
+var combinedMagic = [4]byte{'\x00', '\x63', '\x76', '\x62'}
+
+// combinedVersion is the current version of the combined stream
+// format.
+const combinedVersion = 1
+
+// combinedHeader is the fixed-size header of a combined coverage data
+// stream. It is followed by MetaLen bytes of meta-data file content
+// and then CounterLen bytes of counter data file content.
+type combinedHeader struct {
+	Magic      [4]byte
+	Version    uint32
+	MetaHash   [16]byte
+	MetaLen    uint64
+	CounterLen uint64
+}
+
+// captureCombined returns the meta-data file content for the currently
+// running program, together with a snapshot of its counters taken
+// immediately afterwards.
+func captureCombined() ([]byte, *CounterSnapshot, error) {
+	cl := getCovCounterList()
+	if len(cl) == 0 {
+		return nil, nil, fmt.Errorf("error: no counter data available (binary not built with -cover?)")
+	}
+	if err := ensureFinalHash(); err != nil {
+		return nil, nil, fmt.Errorf("error: meta-data not available: %v", err)
+	}
+	ml := getCovMetaList()
+	if len(ml) == 0 {
+		return nil, nil, fmt.Errorf("error: no instrumented packages (check the -coverpkg setting)")
+	}
+	var mb bytes.Buffer
+	if err := writeMetaData(&mb, ml, cmode, cgran, finalHash); err != nil {
+		return nil, nil, err
+	}
+	snap := &CounterSnapshot{}
+	snap.fill(cl)
+	return mb.Bytes(), snap, nil
+}
+
+// EmitCombinedDataToWriter writes the meta-data and counter data for
+// the currently running program to 'w' as a single stream: a header
+// identifying the stream and giving the length of each part, followed
+// by the meta-data file content and then the counter data file
+// content. Both parts are captured together, so the counter data is
+// guaranteed to match the meta-data. Use SplitCombinedDataToDir to
+// turn the stream into files that can be read by "go tool covdata".
+// An error will be returned if 'w' is nil, if the currently running
+// program was not built with "-cover", or if no packages are
+// instrumented.
+func EmitCombinedDataToWriter(w io.Writer) error {
+	if w == nil {
+		return fmt.Errorf("error: nil writer in EmitCombinedDataToWriter")
+	}
+	meta, snap, err := captureCombined()
+	if err != nil {
+		return err
+	}
+	var cb bytes.Buffer
+	if err := snap.write(&cb); err != nil {
+		return err
+	}
+	hdr := combinedHeader{
+		Magic:      combinedMagic,
+		Version:    combinedVersion,
+		MetaHash:   snap.metaHash,
+		MetaLen:    uint64(len(meta)),
+		CounterLen: uint64(cb.Len()),
+	}
+	if err := binary.Write(w, binary.LittleEndian, &hdr); err != nil {
+		return err
+	}
+	if _, err := w.Write(meta); err != nil {
+		return err
+	}
+	_, err = w.Write(cb.Bytes())
+	return err
+}
+
+// EmitCombinedDataToDir writes a meta-data file and a counter data
+// file for the currently running program to the directory 'dir',
+// capturing both together as EmitCombinedDataToWriter does. The files
+// use the same names and format as EmitMetaDataToDir and
+// EmitCounterDataToDir, so the directory can be read directly by "go
+// tool covdata".
+func EmitCombinedDataToDir(dir string) error {
+	meta, snap, err := captureCombined()
+	if err != nil {
+		return err
+	}
+	if err := writeMetaFileToDir(dir, snap.metaHash, meta); err != nil {
+		return err
+	}
+	return snap.writeToDir(dir)
+}
+
+// SplitCombinedDataToDir reads a combined stream written by
+// EmitCombinedDataToWriter from 'r' and writes its meta-data and
+// counter data parts to the directory 'dir' as separate files, in the
+// layout expected by "go tool covdata".
+func SplitCombinedDataToDir(r io.Reader, dir string) error {
+	var hdr combinedHeader
+	if err := binary.Read(r, binary.LittleEndian, &hdr); err != nil {
+		return fmt.Errorf("reading combined data header: %v", err)
+	}
+	if hdr.Magic != combinedMagic {
+		return fmt.Errorf("invalid combined data magic %q", hdr.Magic[:])
+	}
+	if hdr.Version != combinedVersion {
+		return fmt.Errorf("unsupported combined data version %d", hdr.Version)
+	}
+	var meta, counters bytes.Buffer
+	if _, err := io.CopyN(&meta, r, int64(hdr.MetaLen)); err != nil {
+		return fmt.Errorf("reading combined meta-data: %v", err)
+	}
+	if _, err := io.CopyN(&counters, r, int64(hdr.CounterLen)); err != nil {
+		return fmt.Errorf("reading combined counter data: %v", err)
+	}
+	snap, err := readCounterData(bytes.NewReader(counters.Bytes()))
+	if err != nil {
+		return err
+	}
+	if snap.metaHash != hdr.MetaHash {
+		return fmt.Errorf("counter data meta-data hash %x does not match combined header hash %x", snap.metaHash, hdr.MetaHash)
+	}
+	if err := writeMetaFileToDir(dir, hdr.MetaHash, meta.Bytes()); err != nil {
+		return err
+	}
+	return snap.writeToDir(dir)
+}
+
+// writeMetaFileToDir writes 'meta' as the meta-data file for
+// 'metaHash' in 'dir', unless a file of the same size is already
+// present, using the same naming and write-to-temp-then-rename
+// strategy as EmitMetaDataToDir.
+func writeMetaFileToDir(dir string, metaHash [16]byte, meta []byte) error {
+	s := &emitState{outdir: dir}
+	if err := s.openOutputFiles(metaHash, uint64(len(meta)), metaDataFile); err != nil {
+		return err
+	}
+	if !s.needMetaDataFile() {
+		return nil
+	}
+	_, err := s.mf.Write(meta)
+	if cerr := s.mf.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(s.mftmp)
+		return fmt.Errorf("writing %s: %v", s.mftmp, err)
+	}
+	if err := os.Rename(s.mftmp, s.mfname); err != nil {
+		return fmt.Errorf("writing %s: rename from %s failed: %v", s.mfname, s.mftmp, err)
+	}
+	return nil
+}
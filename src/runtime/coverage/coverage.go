@@ -0,0 +1,141 @@
+// Copyright 2022 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package coverage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"internal/saferio"
+	"io"
+)
+
+// Coverage holds a complete view of the coverage state of a
+// coverage-instrumented program: meta-data, counter values, and
+// summary statistics, all captured at the same instant. A Coverage
+// value is not affected by subsequent execution of the program; it is
+// the preferred type for clients that don't need to work with
+// meta-data and counter data independently.
+type Coverage struct {
+	Meta     *MetaDataInfo
+	Counters *CounterSnapshot
+	Stats    *CoverageStats
+
+	// Encoded meta-data file content.
+	meta []byte
+}
+
+// covStreamMagic holds the magic string for a combined coverage data
+// stream, as written by Coverage.Write.
+var covStreamMagic = [4]byte{'\x00', '\x63', '\x76', '\x73'}
+
+// covStreamVersion is the current version of the combined coverage
+// data stream format.
+const covStreamVersion = 1
+
+// covStreamHeader is the header for a combined coverage data stream.
+// It is followed by the meta-data payload (in meta-data file format)
+// and then the counter data payload (in counter data file format).
+type covStreamHeader struct {
+	Magic      [4]byte
+	Version    uint32
+	MetaLen    uint64
+	CounterLen uint64
+}
+
+// NewCoverage captures the coverage state of the currently running
+// program. An error will be returned if the program was not built
+// with "-cover", or if the meta-data for the program has not yet been
+// finalized.
+func NewCoverage() (*Coverage, error) {
+	snap, err := ReadCounterSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	ml := getCovMetaList()
+	var mb bytes.Buffer
+	if err := writeMetaData(&mb, ml, cmode, cgran, finalHash); err != nil {
+		return nil, err
+	}
+	payloads := metaPayloads(ml)
+	mi, err := newMetaDataInfo(finalHash, cmode, cgran, payloads)
+	if err != nil {
+		return nil, err
+	}
+	st, err := computeStats(payloads, cgran, snap.counterMap())
+	if err != nil {
+		return nil, err
+	}
+	return &Coverage{Meta: mi, Counters: snap, Stats: st, meta: mb.Bytes()}, nil
+}
+
+// Write writes the coverage state 'c' to 'w' as a single stream
+// containing both the meta-data and the counter data. The stream can
+// be decoded using ReadCoverage.
+func (c *Coverage) Write(w io.Writer) error {
+	var cb bytes.Buffer
+	if err := c.Counters.write(&cb); err != nil {
+		return err
+	}
+	hdr := covStreamHeader{
+		Magic:      covStreamMagic,
+		Version:    covStreamVersion,
+		MetaLen:    uint64(len(c.meta)),
+		CounterLen: uint64(cb.Len()),
+	}
+	if err := binary.Write(w, binary.LittleEndian, hdr); err != nil {
+		return err
+	}
+	if _, err := w.Write(c.meta); err != nil {
+		return err
+	}
+	if _, err := w.Write(cb.Bytes()); err != nil {
+		return err
+	}
+	return nil
+}
+
+// ReadCoverage decodes a coverage data stream (as written by
+// Coverage.Write) from 'r'.
+func ReadCoverage(r io.Reader) (*Coverage, error) {
+	var hdr covStreamHeader
+	if err := binary.Read(r, binary.LittleEndian, &hdr); err != nil {
+		return nil, fmt.Errorf("reading coverage stream header: %v", err)
+	}
+	if hdr.Magic != covStreamMagic {
+		return nil, fmt.Errorf("invalid magic string: not a coverage data stream")
+	}
+	if hdr.Version > covStreamVersion {
+		return nil, fmt.Errorf("version data incompatibility: reader is %d data is %d", covStreamVersion, hdr.Version)
+	}
+	mb, err := saferio.ReadData(r, hdr.MetaLen)
+	if err != nil {
+		return nil, fmt.Errorf("reading meta-data: %v", err)
+	}
+	cb, err := saferio.ReadData(r, hdr.CounterLen)
+	if err != nil {
+		return nil, fmt.Errorf("reading counter data: %v", err)
+	}
+	hash, cm, cg, payloads, err := readMetaData(mb)
+	if err != nil {
+		return nil, err
+	}
+	snap, err := readCounterData(bytes.NewReader(cb))
+	if err != nil {
+		return nil, err
+	}
+	if snap.metaHash != hash {
+		return nil, fmt.Errorf("counter data meta-hash %x does not match meta-data hash %x", snap.metaHash, hash)
+	}
+	mi, err := newMetaDataInfo(hash, cm, cg, payloads)
+	if err != nil {
+		return nil, err
+	}
+	st, err := computeStats(payloads, cg, snap.counterMap())
+	if err != nil {
+		return nil, err
+	}
+	return &Coverage{Meta: mi, Counters: snap, Stats: st, meta: mb}, nil
+}
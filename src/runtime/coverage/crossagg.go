@@ -0,0 +1,333 @@
+// Copyright 2022 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package coverage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+// CrossBinaryAggregator publishes the coverage counters of the
+// running program in a named shared memory segment, from which
+// another process (for example a test driver exercising several
+// cooperating instrumented binaries) can read them at any time with
+// ReadCrossAggregator, without waiting for the program to write
+// counter data files. Use NewCrossAggregator to create and start one,
+// and Close to stop it.
+//
+// The segment holds the program's meta-data as well as its counters,
+// so a reader needs no other files. Shared memory segments are only
+// supported on Linux and Darwin; elsewhere a CrossBinaryAggregator
+// does nothing.
+//
+// The ErrorHandler field must be set before the first update interval
+// elapses, and not changed afterwards.
+type CrossBinaryAggregator struct {
+	// ErrorHandler, if non-nil, is called with any error that
+	// occurs during a periodic update. Errors are otherwise
+	// ignored; the aggregator keeps running.
+	ErrorHandler func(error)
+
+	mu     sync.Mutex // guards seg and buf
+	seg    *shmSegment
+	meta   []byte
+	buf    bytes.Buffer
+	ticker *time.Ticker
+	done   chan struct{}
+	exited chan struct{}
+	closed sync.Once
+}
+
+// defaultCrossInterval is the initial update interval of a
+// CrossBinaryAggregator.
+const defaultCrossInterval = time.Second
+
+// Layout of a shared memory segment. The header is followed by the
+// encoded meta-data, which is followed by the encoded counter data
+// (in counter data file format). The sequence number is odd while
+// the counter data is being rewritten; a reader retries if it sees an
+// odd number, or if the number changes while it copies the data.
+const (
+	crossMagic      = "\x00cxa"
+	crossSeqOff     = 4  // uint32 sequence number
+	crossMetaLenOff = 8  // uint32 length of meta-data
+	crossCtrLenOff  = 12 // uint32 length of counter data
+	crossHashOff    = 16 // [16]byte meta-data hash
+	crossHdrSize    = 32
+)
+
+// NewCrossAggregator creates the shared memory segment 'name' (or
+// replaces an existing segment with that name), copies the program's
+// meta-data and current counter values into it, and starts updating
+// the counter values in the segment once a second (see
+// SetUpdateInterval). The segment remains after the program exits,
+// until removed with RemoveCrossAggregator. The name must be non-empty
+// and must not contain a slash. An error is returned if the program
+// was not built with "-cover", or if the segment can't be created.
+func NewCrossAggregator(name string) (*CrossBinaryAggregator, error) {
+	if err := checkCrossName(name); err != nil {
+		return nil, err
+	}
+	if len(getCovCounterList()) == 0 {
+		return nil, fmt.Errorf("program not built with -cover")
+	}
+	if err := ensureFinalHash(); err != nil {
+		return nil, err
+	}
+	a := &CrossBinaryAggregator{
+		done:   make(chan struct{}),
+		exited: make(chan struct{}),
+	}
+	meta, err := GetCoverageMetaRaw()
+	if err != nil {
+		return nil, err
+	}
+	a.meta = meta
+	if err := a.fillBuf(); err != nil {
+		return nil, err
+	}
+	seg, err := createShmSegment(name, func(w io.Writer) error {
+		var hdr [crossHdrSize]byte
+		copy(hdr[:], crossMagic)
+		binary.LittleEndian.PutUint32(hdr[crossMetaLenOff:], uint32(len(a.meta)))
+		binary.LittleEndian.PutUint32(hdr[crossCtrLenOff:], uint32(a.buf.Len()))
+		copy(hdr[crossHashOff:], finalHash[:])
+		for _, b := range [][]byte{hdr[:], a.meta, a.buf.Bytes()} {
+			if _, err := w.Write(b); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if seg == nil {
+		// Shared memory is not supported.
+		return a, nil
+	}
+	a.seg = seg
+	a.ticker = time.NewTicker(defaultCrossInterval)
+	go a.run()
+	return a, nil
+}
+
+// checkCrossName returns an error if 'name' is not a valid shared
+// memory segment name.
+func checkCrossName(name string) error {
+	if name == "" || strings.Contains(name, "/") {
+		return fmt.Errorf("invalid shared memory segment name %q", name)
+	}
+	return nil
+}
+
+// run updates the segment on each tick until the aggregator is closed.
+func (a *CrossBinaryAggregator) run() {
+	defer close(a.exited)
+	for {
+		select {
+		case <-a.done:
+			return
+		case <-a.ticker.C:
+		}
+		if err := a.Update(); err != nil && a.ErrorHandler != nil {
+			a.ErrorHandler(err)
+		}
+	}
+}
+
+// SetUpdateInterval changes the interval at which the counter values
+// in the segment are updated. An error is returned if 'interval' is
+// not positive.
+func (a *CrossBinaryAggregator) SetUpdateInterval(interval time.Duration) error {
+	if interval <= 0 {
+		return fmt.Errorf("non-positive update interval %v", interval)
+	}
+	if a.ticker != nil {
+		a.ticker.Reset(interval)
+	}
+	return nil
+}
+
+// fillBuf encodes the current counter values into a.buf.
+func (a *CrossBinaryAggregator) fillBuf() error {
+	snap, err := ReadCounterSnapshot()
+	if err != nil {
+		return err
+	}
+	a.buf.Reset()
+	return snap.write(&a.buf)
+}
+
+// Update copies the current counter values into the segment
+// immediately, without waiting for the next periodic update. An error
+// is returned if the aggregator has been closed.
+func (a *CrossBinaryAggregator) Update() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.ticker == nil {
+		// Shared memory is not supported.
+		return nil
+	}
+	if a.seg == nil {
+		return fmt.Errorf("CrossBinaryAggregator already closed")
+	}
+	if err := a.fillBuf(); err != nil {
+		return err
+	}
+	need := crossHdrSize + len(a.meta) + a.buf.Len()
+	if need > len(a.seg.mem) {
+		// Grow by at least a factor of two, so that a program
+		// whose coverage is still increasing doesn't resize the
+		// segment on every update.
+		n := 2 * len(a.seg.mem)
+		if n < need {
+			n = need
+		}
+		if err := a.seg.grow(n); err != nil {
+			return err
+		}
+	}
+	mem := a.seg.mem
+	seq := (*uint32)(unsafe.Pointer(&mem[crossSeqOff]))
+	atomic.AddUint32(seq, 1)
+	binary.LittleEndian.PutUint32(mem[crossCtrLenOff:], uint32(a.buf.Len()))
+	copy(mem[crossHdrSize+len(a.meta):], a.buf.Bytes())
+	atomic.AddUint32(seq, 1)
+	return nil
+}
+
+// Close stops the periodic updates, waits for any update in progress
+// to finish, copies the final counter values into the segment, and
+// releases the process's mapping of the segment, returning any error
+// from the final update. The segment itself is left in place for
+// readers. Calls to Close after the first return an error.
+func (a *CrossBinaryAggregator) Close() error {
+	err := fmt.Errorf("CrossBinaryAggregator already closed")
+	a.closed.Do(func() {
+		if a.ticker == nil {
+			err = nil
+			return
+		}
+		a.ticker.Stop()
+		close(a.done)
+		<-a.exited
+		err = a.Update()
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		if cerr := a.seg.close(); err == nil {
+			err = cerr
+		}
+		a.seg = nil
+	})
+	return err
+}
+
+// ReadCrossAggregator reads the shared memory segment 'name' written
+// by a CrossBinaryAggregator, possibly in another process, and returns
+// the counter values it holds. The meta-data hash recorded in the
+// segment is checked against the meta-data and counter data it
+// describes, and is returned in the MetaHash field of the result,
+// so callers can check that the segment belongs to the binary they
+// expect. An error is returned if the segment does not exist, is
+// malformed, or is being updated too often to be read consistently.
+func ReadCrossAggregator(name string) (*CounterDataSet, error) {
+	if err := checkCrossName(name); err != nil {
+		return nil, err
+	}
+	const maxAttempts = 100
+	for i := 0; i < maxAttempts; i++ {
+		mem, err := mapShmSegment(name)
+		if err != nil {
+			return nil, err
+		}
+		hash, meta, ctrs, ok, err := readCrossSegment(mem)
+		if uerr := unmapShmSegment(mem); err == nil {
+			err = uerr
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading shared memory segment %s: %v", name, err)
+		}
+		if ok {
+			ds, err := parseCrossSegment(hash, meta, ctrs)
+			if err != nil {
+				return nil, fmt.Errorf("reading shared memory segment %s: %v", name, err)
+			}
+			return ds, nil
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return nil, fmt.Errorf("reading shared memory segment %s: no consistent copy after %d attempts", name, maxAttempts)
+}
+
+// readCrossSegment copies the meta-data hash, meta-data and counter
+// data out of the mapped segment 'mem'. If the segment is being
+// updated, or has grown beyond 'mem', it returns ok == false, and the
+// caller should map the segment again and retry.
+func readCrossSegment(mem []byte) (hash [16]byte, meta, ctrs []byte, ok bool, err error) {
+	if len(mem) < crossHdrSize || string(mem[:len(crossMagic)]) != crossMagic {
+		return hash, nil, nil, false, fmt.Errorf("not a coverage counter segment")
+	}
+	seq := (*uint32)(unsafe.Pointer(&mem[crossSeqOff]))
+	s1 := atomic.LoadUint32(seq)
+	if s1%2 != 0 {
+		return hash, nil, nil, false, nil
+	}
+	metaLen := uint64(binary.LittleEndian.Uint32(mem[crossMetaLenOff:]))
+	ctrLen := uint64(binary.LittleEndian.Uint32(mem[crossCtrLenOff:]))
+	if crossHdrSize+metaLen+ctrLen > uint64(len(mem)) {
+		return hash, nil, nil, false, nil
+	}
+	copy(hash[:], mem[crossHashOff:])
+	meta = append([]byte(nil), mem[crossHdrSize:crossHdrSize+metaLen]...)
+	ctrs = append([]byte(nil), mem[crossHdrSize+metaLen:crossHdrSize+metaLen+ctrLen]...)
+	if atomic.LoadUint32(seq) != s1 {
+		return hash, nil, nil, false, nil
+	}
+	return hash, meta, ctrs, true, nil
+}
+
+// parseCrossSegment decodes the meta-data and counter data copied out
+// of a segment with header hash 'hash'.
+func parseCrossSegment(hash [16]byte, meta, ctrs []byte) (*CounterDataSet, error) {
+	mhash, mode, gran, payloads, err := readMetaData(meta)
+	if err != nil {
+		return nil, err
+	}
+	if mhash != hash {
+		return nil, fmt.Errorf("segment hash %x does not match meta-data hash %x", hash, mhash)
+	}
+	snap, err := readCounterData(bytes.NewReader(ctrs))
+	if err != nil {
+		return nil, err
+	}
+	if snap.metaHash != hash {
+		return nil, fmt.Errorf("segment hash %x does not match counter data hash %x", hash, snap.metaHash)
+	}
+	ds, err := newCounterDataSetFromMeta(hash, mode, gran, payloads)
+	if err != nil {
+		return nil, err
+	}
+	if err := ds.setCounters(snap); err != nil {
+		return nil, err
+	}
+	return ds, nil
+}
+
+// RemoveCrossAggregator removes the shared memory segment 'name'.
+// Processes that have the segment open are not affected.
+func RemoveCrossAggregator(name string) error {
+	if err := checkCrossName(name); err != nil {
+		return err
+	}
+	return removeShmSegment(name)
+}
@@ -0,0 +1,44 @@
+// Copyright 2022 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !linux && !darwin
+
+package coverage
+
+import (
+	"fmt"
+	"io"
+)
+
+// shmSegment is not used on platforms without shared memory segment
+// support; CrossBinaryAggregator does nothing there.
+type shmSegment struct {
+	mem []byte
+}
+
+func createShmSegment(name string, write func(w io.Writer) error) (*shmSegment, error) {
+	return nil, nil
+}
+
+func (s *shmSegment) grow(n int) error {
+	return errShmUnsupported
+}
+
+func (s *shmSegment) close() error {
+	return nil
+}
+
+func mapShmSegment(name string) ([]byte, error) {
+	return nil, errShmUnsupported
+}
+
+func unmapShmSegment(mem []byte) error {
+	return nil
+}
+
+func removeShmSegment(name string) error {
+	return errShmUnsupported
+}
+
+var errShmUnsupported = fmt.Errorf("shared memory segments not supported on this platform")
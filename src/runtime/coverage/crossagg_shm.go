@@ -0,0 +1,126 @@
+// Copyright 2022 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build linux || darwin
+
+package coverage
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"syscall"
+)
+
+// shmSegment is a shared memory segment mapped into the process.
+type shmSegment struct {
+	f   *os.File
+	mem []byte
+}
+
+// shmPath returns the path of the file backing the shared memory
+// segment 'name'. On Linux this is in the tmpfs at /dev/shm, where
+// shm_open places its segments; elsewhere (or if /dev/shm is missing)
+// the temporary directory is used.
+func shmPath(name string) string {
+	dir := "/dev/shm"
+	if fi, err := os.Stat(dir); runtime.GOOS != "linux" || err != nil || !fi.IsDir() {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, "go-coverage-"+name)
+}
+
+// createShmSegment creates the segment 'name' with initial content
+// produced by 'write', replacing any existing segment, and maps it
+// for reading and writing.
+func createShmSegment(name string, write func(w io.Writer) error) (*shmSegment, error) {
+	path := shmPath(name)
+	if err := writeFileAtomically(path, write); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	s := &shmSegment{f: f}
+	if err := s.mmap(int(fi.Size())); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *shmSegment) mmap(n int) error {
+	mem, err := syscall.Mmap(int(s.f.Fd()), 0, n, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		return os.NewSyscallError("mmap", err)
+	}
+	s.mem = mem
+	return nil
+}
+
+// grow extends the segment to 'n' bytes and remaps it. The segment is
+// never shrunk, since a reader accessing a mapping beyond the end of
+// the file would fault.
+func (s *shmSegment) grow(n int) error {
+	if err := s.f.Truncate(int64(n)); err != nil {
+		return err
+	}
+	if err := syscall.Munmap(s.mem); err != nil {
+		return os.NewSyscallError("munmap", err)
+	}
+	s.mem = nil
+	return s.mmap(n)
+}
+
+// close unmaps the segment and closes its file.
+func (s *shmSegment) close() error {
+	err := syscall.Munmap(s.mem)
+	s.mem = nil
+	if cerr := s.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// mapShmSegment maps the whole of the existing segment 'name' for
+// reading.
+func mapShmSegment(name string) ([]byte, error) {
+	f, err := os.Open(shmPath(name))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if fi.Size() == 0 {
+		return nil, nil
+	}
+	mem, err := syscall.Mmap(int(f.Fd()), 0, int(fi.Size()), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, os.NewSyscallError("mmap", err)
+	}
+	return mem, nil
+}
+
+// unmapShmSegment releases a mapping returned by mapShmSegment.
+func unmapShmSegment(mem []byte) error {
+	if mem == nil {
+		return nil
+	}
+	return syscall.Munmap(mem)
+}
+
+// removeShmSegment removes the segment 'name'.
+func removeShmSegment(name string) error {
+	return os.Remove(shmPath(name))
+}
@@ -0,0 +1,219 @@
+// Copyright 2022 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package coverage
+
+import (
+	"bytes"
+	"fmt"
+	"internal/coverage"
+	"internal/coverage/cmerge"
+	"internal/coverage/decodemeta"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// CounterDataSet holds the contents of a counter data file, with the
+// counter values keyed by function name rather than by the package
+// and function indices used in the file.
+type CounterDataSet struct {
+	// Hash of the meta-data for the program the counters belong to.
+	MetaHash [16]byte
+
+	// Counter mode of the program ("set", "count" or "atomic").
+	Mode string
+
+	// Counter values for each function with at least one non-zero
+	// counter, keyed by "pkgpath.FuncName", where FuncName is the
+	// name recorded in the meta-data (for example
+	// "example.com/pkg.*T.Method", or "example.com/pkg.func.L12.C5"
+	// for a function literal). If a package has several functions
+	// with the same name, the second and subsequent ones have
+	// "#<n>" appended, where n is the function's index within the
+	// package.
+	Counters map[string][]uint32
+
+	cmode coverage.CounterMode
+	cgran coverage.CounterGranularity
+	args  map[string]string
+	funcs map[string]pkfunc // maps keys in Counters to indices
+}
+
+// ParseCounterDataFile reads the counter data file 'path' (for
+// example one written by EmitCounterDataToWriter, or by
+// EmitCompressedCounterDataToWriter) and returns its contents. Function names are taken from the meta-data of the
+// currently running program if the file belongs to it, and otherwise
+// from the meta-data file for the file's meta-data hash, which must
+// be present in the same directory. An error is returned if the file
+// is malformed or if no meta-data for it can be found.
+func ParseCounterDataFile(path string) (*CounterDataSet, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if b, err = decompressCounterData(b); err != nil {
+		return nil, fmt.Errorf("reading counter data file %s: %v", path, err)
+	}
+	snap, err := readCounterData(bytes.NewReader(b))
+	if err != nil {
+		return nil, fmt.Errorf("reading counter data file %s: %v", path, err)
+	}
+	ds, err := newCounterDataSet(snap.metaHash, filepath.Dir(path))
+	if err != nil {
+		return nil, fmt.Errorf("reading counter data file %s: %v", path, err)
+	}
+	if err := ds.setCounters(snap); err != nil {
+		return nil, fmt.Errorf("reading counter data file %s: %v", path, err)
+	}
+	return ds, nil
+}
+
+// setCounters fills in the args and counter values of 'ds' from
+// 'snap', which must be for the same program.
+func (ds *CounterDataSet) setCounters(snap *CounterSnapshot) error {
+	ds.args = snap.args
+	keys := make(map[pkfunc]string, len(ds.funcs))
+	for k, pf := range ds.funcs {
+		keys[pf] = k
+	}
+	return snap.visitFuncs(func(pkgId, funcId uint32, counters []uint32) error {
+		k, ok := keys[pkfunc{pk: pkgId, fcn: funcId}]
+		if !ok {
+			return fmt.Errorf("function %d in package %d not found in meta-data", funcId, pkgId)
+		}
+		ds.Counters[k] = append([]uint32(nil), counters...)
+		return nil
+	})
+}
+
+// newCounterDataSet returns an empty CounterDataSet for the program
+// with meta-data hash 'hash', using the meta-data of the running
+// program if the hash matches it, and otherwise the meta-data file
+// for 'hash' in the directory 'dir'.
+func newCounterDataSet(hash [16]byte, dir string) (*CounterDataSet, error) {
+	if len(getCovMetaList()) != 0 && ensureFinalHash() == nil && hash == finalHash {
+		return newCounterDataSetFromMeta(hash, cmode, cgran, metaPayloads(getCovMetaList()))
+	}
+	mf := filepath.Join(dir, fmt.Sprintf("%s.%x", coverage.MetaFilePref, hash))
+	b, err := os.ReadFile(mf)
+	if err != nil {
+		return nil, fmt.Errorf("no meta-data for hash %x: %v", hash, err)
+	}
+	mhash, mode, gran, payloads, err := readMetaData(b)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %v", mf, err)
+	}
+	if mhash != hash {
+		return nil, fmt.Errorf("meta-data file %s has hash %x", mf, mhash)
+	}
+	return newCounterDataSetFromMeta(hash, mode, gran, payloads)
+}
+
+// newCounterDataSetFromMeta returns an empty CounterDataSet for the
+// program with meta-data hash 'hash', counter mode 'mode',
+// granularity 'gran' and package meta-data 'payloads'.
+func newCounterDataSetFromMeta(hash [16]byte, mode coverage.CounterMode, gran coverage.CounterGranularity, payloads [][]byte) (*CounterDataSet, error) {
+	ds := &CounterDataSet{
+		MetaHash: hash,
+		Mode:     mode.String(),
+		Counters: make(map[string][]uint32),
+		cmode:    mode,
+		cgran:    gran,
+		funcs:    make(map[string]pkfunc),
+	}
+	err := visitMetaFuncs(payloads, func(pkIdx, fnIdx uint32, pd *decodemeta.CoverageMetaDataDecoder, fd *coverage.FuncDesc) error {
+		k := pd.PackagePath() + "." + fd.Funcname
+		if _, ok := ds.funcs[k]; ok {
+			k = fmt.Sprintf("%s#%d", k, fnIdx)
+		}
+		ds.funcs[k] = pkfunc{pk: pkIdx, fcn: fnIdx}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ds, nil
+}
+
+// Add merges the counter values in 'other' into 'ds', in the manner
+// of "go tool covdata merge": counters are combined according to the
+// counter mode (saturating addition for "count" and "atomic" modes).
+// An error is returned if the two sets are for different programs
+// (have different meta-data hashes), or if a function's counters in
+// the two sets differ in length.
+func (ds *CounterDataSet) Add(other *CounterDataSet) error {
+	if ds.MetaHash != other.MetaHash {
+		return fmt.Errorf("meta-data hash mismatch: %x vs %x", ds.MetaHash, other.MetaHash)
+	}
+	var cm cmerge.Merger
+	if err := cm.SetModeAndGranularity("<counter data set>", ds.cmode, ds.cgran); err != nil {
+		return err
+	}
+	for k, src := range other.Counters {
+		dst, ok := ds.Counters[k]
+		if !ok {
+			ds.Counters[k] = append([]uint32(nil), src...)
+			continue
+		}
+		if err, _ := cm.MergeCounters(dst, src); err != nil {
+			return fmt.Errorf("merging counters for %s: %v", k, err)
+		}
+	}
+	if !equalArgs(ds.args, other.args) {
+		ds.args = map[string]string{}
+	}
+	return nil
+}
+
+// WriteCounterDataFile writes the counter values in 'ds' to a counter
+// data file at 'path', replacing any existing file. The args section
+// (os.Args, GOOS and GOARCH) of the file parsed into 'ds' is written
+// too, unless sets with differing args were merged into it with Add.
+// To be read by "go tool covdata", the file must be placed alongside
+// the program's meta-data file, and its name should follow the usual
+// counter data file naming scheme. An error is returned if 'ds' holds
+// counters for a function not in the program's meta-data.
+func (ds *CounterDataSet) WriteCounterDataFile(path string) error {
+	snap, err := ds.snapshot()
+	if err != nil {
+		return err
+	}
+	return writeFileAtomically(path, snap.write)
+}
+
+// WriteTo writes the counter values in 'ds' to 'w' in counter data
+// file format, as WriteCounterDataFile does, implementing io.WriterTo.
+// The output can be passed to MergeCoverageCounters, for example to
+// restore counters captured with ResetAndSnapshot:
+//
+//	var buf bytes.Buffer
+//	if _, err := ds.WriteTo(&buf); err != nil {
+//		...
+//	}
+//	err := coverage.MergeCoverageCounters(&buf)
+func (ds *CounterDataSet) WriteTo(w io.Writer) (int64, error) {
+	snap, err := ds.snapshot()
+	if err != nil {
+		return 0, err
+	}
+	cw := &countingWriter{w: w}
+	err = snap.write(cw)
+	return cw.n, err
+}
+
+// snapshot returns the counter values in 'ds' as a snapshot, or an
+// error if 'ds' holds counters for a function not in the program's
+// meta-data.
+func (ds *CounterDataSet) snapshot() (*CounterSnapshot, error) {
+	funcs := make(map[pkfunc][]uint32, len(ds.Counters))
+	for k, c := range ds.Counters {
+		pf, ok := ds.funcs[k]
+		if !ok {
+			return nil, fmt.Errorf("function %s not found in meta-data", k)
+		}
+		funcs[pf] = c
+	}
+	return newSnapshotFromFuncs(ds.MetaHash, ds.args, funcs), nil
+}
@@ -0,0 +1,305 @@
+// Copyright 2022 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package debughttp serves the live coverage data of the running
+// program over HTTP, in the manner of net/http/pprof. It is kept
+// separate from package runtime/coverage so that instrumented
+// programs that don't use it do not depend on net/http.
+//
+// Importing the package registers a handler (see HTTPHandler) for the
+// "/debug/coverage/" tree on http.DefaultServeMux:
+//
+//	import _ "runtime/coverage/debughttp"
+//
+// Since coverage.CoverageEnabled only reports true once package
+// initialization is complete, the registration can't depend on it;
+// instead, the registered handler responds with 404 Not Found, as if
+// it were absent, in a program that was not built with "-cover".
+package debughttp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"net/url"
+	"runtime/coverage"
+	"sort"
+	"strings"
+)
+
+func init() {
+	h := http.StripPrefix("/debug/coverage", HTTPHandler())
+	http.HandleFunc("/debug/coverage/", func(w http.ResponseWriter, r *http.Request) {
+		if !coverage.CoverageEnabled() {
+			http.NotFound(w, r)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// HTTPHandler returns a handler that serves the coverage data of the
+// currently running program. It responds to GET (and HEAD) requests
+// for the following paths, relative to where it is installed:
+//
+//	/          HTML page showing the block coverage of each package
+//	/counters  counter data, as written by coverage.EmitCounterDataToWriter
+//	/meta      meta-data, as written by coverage.EmitMetaDataToWriter
+//	/profile   text profile for "go tool cover", as written by
+//	           coverage.WriteCoverageProfile
+//	/json      JSON summary of the block coverage of each package
+//
+// The query parameter "pkg" restricts the response to the packages
+// whose import path begins with its value (see
+// coverage.PkgPrefixFilter). The meta-data is always that of the
+// whole program, since counter data files refer to it as a whole.
+//
+// The JSON summary is an object of the form
+//
+//	{
+//	  "packages": [
+//	    {"importPath": "example.com/svc/api", "totalBlocks": 415, "coveredBlocks": 205, "blockCoveragePercent": 49.4},
+//	    ...
+//	  ],
+//	  "totalBlocks": 1702,
+//	  "coveredBlocks": 1234,
+//	  "blockCoveragePercent": 72.5
+//	}
+//
+// with packages in import path order. A request fails with status 500
+// if the program was not built with "-cover".
+func HTTPHandler() http.Handler {
+	return http.HandlerFunc(serve)
+}
+
+func serve(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	prefix := r.URL.Query().Get("pkg")
+	// Write the response to a buffer first, so that an error can
+	// still be reported with an error status.
+	var b bytes.Buffer
+	var ctype string
+	var err error
+	switch r.URL.Path {
+	case "/", "":
+		ctype = "text/html; charset=utf-8"
+		err = writeIndex(&b, prefix)
+	case "/counters":
+		ctype = "application/octet-stream"
+		if prefix == "" {
+			err = coverage.EmitCounterDataToWriter(&b)
+		} else {
+			err = coverage.EmitFilteredCounterData(&b, coverage.PkgPrefixFilter(prefix))
+		}
+	case "/meta":
+		ctype = "application/octet-stream"
+		err = coverage.EmitMetaDataToWriter(&b)
+	case "/profile":
+		ctype = "text/plain; charset=utf-8"
+		err = writeProfile(&b, prefix)
+	case "/json":
+		ctype = "application/json"
+		err = writeJSON(&b, prefix)
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", ctype)
+	w.Write(b.Bytes())
+}
+
+// document mirrors the parts of the output of
+// coverage.WriteCoverageToJSON used here.
+type document struct {
+	Meta struct {
+		Packages []struct {
+			ImportPath string
+			Functions  []struct {
+				File string
+			}
+		}
+	}
+	Counters []struct {
+		Package string
+		Hits    []uint64
+	}
+}
+
+// readDocument returns the current coverage state of the program.
+func readDocument() (*document, error) {
+	var b bytes.Buffer
+	if err := coverage.WriteCoverageToJSON(&b, false); err != nil {
+		return nil, err
+	}
+	doc := new(document)
+	if err := json.Unmarshal(b.Bytes(), doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// pkgSummary is the block coverage of a package, or of a set of
+// packages.
+type pkgSummary struct {
+	ImportPath           string  `json:"importPath,omitempty"`
+	TotalBlocks          int     `json:"totalBlocks"`
+	CoveredBlocks        int     `json:"coveredBlocks"`
+	BlockCoveragePercent float64 `json:"blockCoveragePercent"`
+}
+
+// summary is the document written to "/json".
+type summary struct {
+	Packages []*pkgSummary `json:"packages"`
+	pkgSummary
+}
+
+// summarize returns the block coverage of the packages whose import
+// path begins with 'prefix', in import path order, and their total.
+func summarize(prefix string) (*summary, error) {
+	doc, err := readDocument()
+	if err != nil {
+		return nil, err
+	}
+	s := &summary{Packages: []*pkgSummary{}}
+	pkgs := make(map[string]*pkgSummary)
+	for _, c := range doc.Counters {
+		if !strings.HasPrefix(c.Package, prefix) {
+			continue
+		}
+		ps := pkgs[c.Package]
+		if ps == nil {
+			ps = &pkgSummary{ImportPath: c.Package}
+			pkgs[c.Package] = ps
+			s.Packages = append(s.Packages, ps)
+		}
+		for _, h := range c.Hits {
+			ps.TotalBlocks++
+			if h != 0 {
+				ps.CoveredBlocks++
+			}
+		}
+	}
+	sort.Slice(s.Packages, func(i, j int) bool {
+		return s.Packages[i].ImportPath < s.Packages[j].ImportPath
+	})
+	for _, ps := range s.Packages {
+		ps.BlockCoveragePercent = percent(ps.CoveredBlocks, ps.TotalBlocks)
+		s.TotalBlocks += ps.TotalBlocks
+		s.CoveredBlocks += ps.CoveredBlocks
+	}
+	s.BlockCoveragePercent = percent(s.CoveredBlocks, s.TotalBlocks)
+	return s, nil
+}
+
+// percent returns n/d as a percentage, truncated to one decimal place
+// (so that only complete coverage is shown as 100%), or 0 if d is 0.
+func percent(n, d int) float64 {
+	if d == 0 {
+		return 0
+	}
+	return float64(1000*n/d) / 10
+}
+
+func writeJSON(w io.Writer, prefix string) error {
+	s, err := summarize(prefix)
+	if err != nil {
+		return err
+	}
+	return json.NewEncoder(w).Encode(s)
+}
+
+// writeProfile writes the text profile of the packages whose import
+// path begins with 'prefix'. The profile identifies blocks by source
+// file, so the files of the selected packages are looked up in the
+// meta-data.
+func writeProfile(w io.Writer, prefix string) error {
+	if prefix == "" {
+		return coverage.WriteCoverageProfile(w)
+	}
+	doc, err := readDocument()
+	if err != nil {
+		return err
+	}
+	files := make(map[string]bool)
+	for _, p := range doc.Meta.Packages {
+		if !strings.HasPrefix(p.ImportPath, prefix) {
+			continue
+		}
+		for _, f := range p.Functions {
+			files[f.File] = true
+		}
+	}
+	var b bytes.Buffer
+	if err := coverage.WriteCoverageProfile(&b); err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(w)
+	sc := bufio.NewScanner(&b)
+	for first := true; sc.Scan(); first = false {
+		line := sc.Text()
+		// The first line gives the counter mode; each of the others
+		// has the form "file:start,end nstmts count".
+		if i := strings.LastIndexByte(line, ':'); first || i >= 0 && files[line[:i]] {
+			bw.WriteString(line)
+			bw.WriteByte('\n')
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// writeIndex writes the HTML page served for "/".
+func writeIndex(w io.Writer, prefix string) error {
+	s, err := summarize(prefix)
+	if err != nil {
+		return err
+	}
+	query := ""
+	if prefix != "" {
+		query = "?pkg=" + url.QueryEscape(prefix)
+	}
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, `<!DOCTYPE html>
+<html>
+<head>
+<title>/debug/coverage/</title>
+<style>
+table { border-collapse: collapse; font-family: monospace; }
+td { padding: 0 1em 0 0; }
+.bar { width: 200px; height: 1em; background: #c00; }
+.bar div { height: 100%%; background: #0a0; }
+</style>
+</head>
+<body>
+<h1>Coverage</h1>
+<p>%.1f%% of %d blocks covered`, s.BlockCoveragePercent, s.TotalBlocks)
+	if prefix != "" {
+		fmt.Fprintf(bw, ` in packages with prefix %s (<a href="./">all packages</a>)`, html.EscapeString(prefix))
+	}
+	fmt.Fprintf(bw, `.</p>
+<p>Download: <a href="counters%[1]s">counter data</a>, <a href="meta">meta-data</a>, <a href="profile%[1]s">profile</a>, <a href="json%[1]s">JSON summary</a></p>
+<table>
+`, html.EscapeString(query))
+	for _, ps := range s.Packages {
+		fmt.Fprintf(bw, "<tr><td><div class=\"bar\"><div style=\"width: %.1f%%\"></div></div></td><td>%5.1f%%</td><td>%d/%d</td><td><a href=\"./?pkg=%s\">%s</a></td></tr>\n",
+			ps.BlockCoveragePercent, ps.BlockCoveragePercent, ps.CoveredBlocks, ps.TotalBlocks,
+			html.EscapeString(url.QueryEscape(ps.ImportPath)), html.EscapeString(ps.ImportPath))
+	}
+	fmt.Fprintf(bw, "</table>\n</body>\n</html>\n")
+	return bw.Flush()
+}
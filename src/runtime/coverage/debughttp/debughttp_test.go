@@ -0,0 +1,106 @@
+// Copyright 2022 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package debughttp
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func get(t *testing.T, url string) (*http.Response, string) {
+	t.Helper()
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("GET %s: %v", url, err)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("GET %s: reading body: %v", url, err)
+	}
+	return resp, string(b)
+}
+
+func TestHandler(t *testing.T) {
+	srv := httptest.NewServer(HTTPHandler())
+	defer srv.Close()
+
+	resp, _ := get(t, srv.URL+"/nosuchpath")
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("GET /nosuchpath: status %s, want 404", resp.Status)
+	}
+	resp, err := http.Post(srv.URL+"/json", "text/plain", strings.NewReader(""))
+	if err != nil {
+		t.Fatalf("POST /json: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed || resp.Header.Get("Allow") != "GET, HEAD" {
+		t.Errorf("POST /json: status %s, Allow %q", resp.Status, resp.Header.Get("Allow"))
+	}
+
+	resp, body := get(t, srv.URL+"/json?pkg=runtime/coverage/debughttp")
+	if testing.CoverMode() == "" {
+		if resp.StatusCode != http.StatusInternalServerError {
+			t.Errorf("GET /json without -cover: status %s, want 500", resp.Status)
+		}
+		return
+	}
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/json" {
+		t.Fatalf("GET /json: status %s, content type %q", resp.Status, resp.Header.Get("Content-Type"))
+	}
+	var s summary
+	if err := json.Unmarshal([]byte(body), &s); err != nil {
+		t.Fatalf("GET /json: decoding %s: %v", body, err)
+	}
+	if len(s.Packages) != 1 || s.Packages[0].ImportPath != "runtime/coverage/debughttp" ||
+		s.TotalBlocks == 0 || s.CoveredBlocks == 0 || s.TotalBlocks != s.Packages[0].TotalBlocks {
+		t.Errorf("GET /json: unexpected summary %s", body)
+	}
+
+	resp, body = get(t, srv.URL+"/")
+	if resp.StatusCode != http.StatusOK || !strings.Contains(body, `<a href="./?pkg=runtime%2Fcoverage%2Fdebughttp">runtime/coverage/debughttp</a>`) {
+		t.Errorf("GET /: status %s, body:\n%s", resp.Status, body)
+	}
+	resp, body = get(t, srv.URL+"/profile")
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(body, "mode: "+testing.CoverMode()+"\n") {
+		t.Errorf("GET /profile: status %s, body:\n%s", resp.Status, body)
+	}
+}
+
+func TestDefaultServeMux(t *testing.T) {
+	srv := httptest.NewServer(http.DefaultServeMux)
+	defer srv.Close()
+	resp, _ := get(t, srv.URL+"/debug/coverage/json")
+	want := http.StatusOK
+	if testing.CoverMode() == "" {
+		want = http.StatusNotFound
+	}
+	if resp.StatusCode != want {
+		t.Errorf("GET /debug/coverage/json: status %s, want %d", resp.Status, want)
+	}
+}
+
+func TestPercent(t *testing.T) {
+	for _, tc := range []struct {
+		n, d int
+		want float64
+	}{
+		{0, 0, 0},
+		{0, 7, 0},
+		{1, 3, 33.3},
+		{2, 3, 66.6},
+		{999, 1000, 99.9},
+		{9999, 10000, 99.9},
+		{5, 5, 100},
+	} {
+		if got := percent(tc.n, tc.d); got != tc.want {
+			t.Errorf("percent(%d, %d) = %v, want %v", tc.n, tc.d, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+// Copyright 2022 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package coverage
+
+import (
+	"fmt"
+	"internal/coverage"
+	"internal/coverage/decodemeta"
+	"sync"
+)
+
+// DecayTracker maintains exponentially-decayed execution counts for
+// the coverage counters of the currently running program, so that
+// recent executions carry more weight than old ones. Weights are
+// updated by calls to Tick. Since the weights are computed from
+// counter increments, DecayTracker is most useful in programs built
+// with "-covermode=count" or "-covermode=atomic"; in "set" mode a
+// block contributes a single increment the first time it executes.
+// A DecayTracker is safe for concurrent use.
+type DecayTracker struct {
+	mu        sync.Mutex
+	decay     float64
+	threshold float64
+	prev      *CounterSnapshot
+	weights   map[pkfunc][]float64
+}
+
+// CoverageDecayTracker returns a DecayTracker that multiplies each
+// weight by 'decayFactor' on every tick. 'decayFactor' must be in
+// the range (0, 1]; a factor of 1 means no decay, in which case the
+// weights are cumulative counts. CoverageDecayTracker panics if
+// 'decayFactor' is out of range. Increments are measured from the
+// point of the call.
+func CoverageDecayTracker(decayFactor float64) *DecayTracker {
+	if !(decayFactor > 0 && decayFactor <= 1) {
+		panic(fmt.Sprintf("coverage: invalid decay factor %v", decayFactor))
+	}
+	dt := &DecayTracker{
+		decay:   decayFactor,
+		weights: make(map[pkfunc][]float64),
+	}
+	dt.prev, _ = ReadCounterSnapshot()
+	return dt
+}
+
+// SetThreshold sets the weight that a block's decayed count must
+// exceed for the block to be considered covered by
+// WeightedCoveragePercent. The default threshold is 0.
+func (dt *DecayTracker) SetThreshold(threshold float64) {
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+	dt.threshold = threshold
+}
+
+// Tick decays all weights by the tracker's decay factor, then adds
+// the counter increments made since the previous tick (or since the
+// tracker was created). An error is returned if the program was not
+// built with "-cover".
+func (dt *DecayTracker) Tick() error {
+	snap, err := ReadCounterSnapshot()
+	if err != nil {
+		return err
+	}
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+	var before map[pkfunc][]uint32
+	if dt.prev != nil {
+		before = dt.prev.counterMap()
+	}
+	for _, w := range dt.weights {
+		for i := range w {
+			w[i] *= dt.decay
+		}
+	}
+	for key, dc := range deltaCounters(before, snap.counterMap()) {
+		w := dt.weights[key]
+		if len(w) < len(dc) {
+			w = append(w, make([]float64, len(dc)-len(w))...)
+			dt.weights[key] = w
+		}
+		for i, d := range dc {
+			w[i] += float64(d)
+		}
+	}
+	dt.prev = snap
+	return nil
+}
+
+// WeightedCoveragePercent returns the percentage, in the range
+// [0, 100], of instrumented blocks whose decayed count exceeds the
+// tracker's threshold. It returns 0 if the program was not built
+// with "-cover".
+func (dt *DecayTracker) WeightedCoveragePercent() float64 {
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+	var blocks, covered int
+	err := visitMetaFuncs(metaPayloads(getCovMetaList()), func(pkIdx, fnIdx uint32, pd *decodemeta.CoverageMetaDataDecoder, fd *coverage.FuncDesc) error {
+		w := dt.weights[pkfunc{pk: pkIdx, fcn: fnIdx}]
+		for i, u := range fd.Units {
+			if u.Parent != 0 {
+				continue
+			}
+			blocks++
+			slot := i
+			if cgran == coverage.CtrGranularityPerFunc {
+				slot = 0
+			}
+			if slot < len(w) && w[slot] > dt.threshold {
+				covered++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0
+	}
+	return percent(covered, blocks)
+}
@@ -0,0 +1,205 @@
+// Copyright 2022 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package coverage
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+)
+
+// deltaCountsKey is the args-section key that marks counter data
+// written by EmitDeltaCounterDataToWriter, whose counter values are
+// differences from a baseline rather than totals.
+const deltaCountsKey = "coverage.delta.counts"
+
+// deltaUnchangedKey is the args-section key under which
+// EmitCounterDataToWriterDeltaFrom records the packages omitted from
+// a delta, as a hex-encoded bitmask indexed by package index.
+const deltaUnchangedKey = "coverage.delta.unchanged"
+
+// EmitCounterDataToWriterDeltaFrom writes counter data for the
+// currently running program to 'w', as EmitCounterDataToWriter, but
+// omitting the packages whose counters are unchanged since the
+// snapshot 'base'. Packages that are written carry their full current
+// counter values, not the difference from 'base'. The omitted packages
+// are recorded as a bitmask in the args section of the output, so the
+// result remains a well-formed counter data file; use
+// ReconstructFromDelta with the same base to recover the full
+// counter data. An error is returned if 'base' was not captured from
+// the currently running program.
+func EmitCounterDataToWriterDeltaFrom(w io.Writer, base *CounterSnapshot) error {
+	if w == nil {
+		return fmt.Errorf("error: nil writer in EmitCounterDataToWriterDeltaFrom")
+	}
+	if base == nil {
+		return fmt.Errorf("error: nil base snapshot in EmitCounterDataToWriterDeltaFrom")
+	}
+	snap, err := ReadCounterSnapshot()
+	if err != nil {
+		return err
+	}
+	if base.metaHash != snap.metaHash {
+		return fmt.Errorf("base snapshot meta-data hash %x does not match program meta-data hash %x", base.metaHash, snap.metaHash)
+	}
+	bm, cm := base.counterMap(), snap.counterMap()
+	changed := make(map[uint32]bool)
+	for key, cc := range cm {
+		if !equalCounters(bm[key], cc) {
+			changed[key.pk] = true
+		}
+	}
+	for key, bc := range bm {
+		if _, ok := cm[key]; !ok && anyNonZero(bc) {
+			changed[key.pk] = true
+		}
+	}
+	npkgs := len(getCovMetaList())
+	mask := make([]byte, (npkgs+7)/8)
+	for pk := 0; pk < npkgs; pk++ {
+		if !changed[uint32(pk)] {
+			mask[pk/8] |= 1 << (pk % 8)
+		}
+	}
+	funcs := make(map[pkfunc][]uint32)
+	for key, cc := range cm {
+		if changed[key.pk] {
+			funcs[key] = cc
+		}
+	}
+	args := make(map[string]string, len(snap.args)+1)
+	for k, v := range snap.args {
+		args[k] = v
+	}
+	args[deltaUnchangedKey] = fmt.Sprintf("%x", mask)
+	return newSnapshotFromFuncs(snap.metaHash, args, funcs).write(w)
+}
+
+// ReconstructFromDelta reads counter data written by
+// EmitCounterDataToWriterDeltaFrom from 'delta' and combines it with
+// 'base', which must be the snapshot the delta was computed from,
+// returning a snapshot holding the full counter values at the time
+// the delta was written. Counter data not produced by
+// EmitCounterDataToWriterDeltaFrom is treated as a delta in which no
+// package is omitted.
+func ReconstructFromDelta(base *CounterSnapshot, delta io.Reader) (*CounterSnapshot, error) {
+	if base == nil {
+		return nil, fmt.Errorf("error: nil base snapshot in ReconstructFromDelta")
+	}
+	ds, err := readCounterStream(delta)
+	if err != nil {
+		return nil, fmt.Errorf("reading delta: %v", err)
+	}
+	if ds.metaHash != base.metaHash {
+		return nil, fmt.Errorf("delta meta-data hash %x does not match base meta-data hash %x", ds.metaHash, base.metaHash)
+	}
+	var mask []byte
+	if s, ok := ds.args[deltaUnchangedKey]; ok && s != "" {
+		if _, err := fmt.Sscanf(s, "%x", &mask); err != nil {
+			return nil, fmt.Errorf("malformed unchanged-package mask %q: %v", s, err)
+		}
+	}
+	unchanged := func(pk uint32) bool {
+		return int(pk/8) < len(mask) && mask[pk/8]&(1<<(pk%8)) != 0
+	}
+	funcs := make(map[pkfunc][]uint32)
+	for key, bc := range base.counterMap() {
+		if unchanged(key.pk) {
+			funcs[key] = bc
+		}
+	}
+	for key, dc := range ds.counterMap() {
+		if !unchanged(key.pk) {
+			funcs[key] = dc
+		}
+	}
+	delete(ds.args, deltaUnchangedKey)
+	return newSnapshotFromFuncs(ds.metaHash, ds.args, funcs), nil
+}
+
+// EmitDeltaCounterDataToWriter writes to 'w' the difference between
+// the current counter values of the running program and the counter
+// data read from 'baseline' (in the format written by
+// EmitCounterDataToWriter). Only functions with at least one changed
+// counter are written, each with its per-block increase since the
+// baseline. The output is an ordinary counter data file, marked as a
+// delta in its args section; since "go tool covdata merge" adds
+// counter values, merging it with the baseline yields the current
+// counter data, as does MergeDeltaCounterData. An error is returned
+// if the baseline was not produced by the currently running program.
+func EmitDeltaCounterDataToWriter(w io.Writer, baseline io.Reader) error {
+	if w == nil {
+		return fmt.Errorf("error: nil writer in EmitDeltaCounterDataToWriter")
+	}
+	base, err := readCounterStream(baseline)
+	if err != nil {
+		return fmt.Errorf("reading baseline: %v", err)
+	}
+	snap, err := ReadCounterSnapshot()
+	if err != nil {
+		return err
+	}
+	if base.metaHash != snap.metaHash {
+		return fmt.Errorf("baseline meta-data hash %x does not match program meta-data hash %x", base.metaHash, snap.metaHash)
+	}
+	args := make(map[string]string, len(snap.args)+1)
+	for k, v := range snap.args {
+		args[k] = v
+	}
+	args[deltaCountsKey] = "1"
+	delta := deltaCounters(base.counterMap(), snap.counterMap())
+	return newSnapshotFromFuncs(snap.metaHash, args, delta).write(w)
+}
+
+// MergeDeltaCounterData reads baseline counter data from 'base' and
+// a delta written by EmitDeltaCounterDataToWriter for that baseline
+// from 'delta', and writes the reconstructed full counter data to
+// 'out'. Counter values are added, saturating at the maximum counter
+// value. The args section of the output is that of the delta, without
+// the delta marker.
+func MergeDeltaCounterData(base, delta io.Reader, out io.Writer) error {
+	bs, err := readCounterStream(base)
+	if err != nil {
+		return fmt.Errorf("reading baseline: %v", err)
+	}
+	ds, err := readCounterStream(delta)
+	if err != nil {
+		return fmt.Errorf("reading delta: %v", err)
+	}
+	if bs.metaHash != ds.metaHash {
+		return fmt.Errorf("delta meta-data hash %x does not match baseline meta-data hash %x", ds.metaHash, bs.metaHash)
+	}
+	if _, ok := ds.args[deltaCountsKey]; !ok {
+		return fmt.Errorf("counter data is not a delta")
+	}
+	funcs := bs.counterMap()
+	for key, dc := range ds.counterMap() {
+		bc := funcs[key]
+		mc := make([]uint32, len(dc))
+		for i, d := range dc {
+			mc[i] = d
+			if i < len(bc) {
+				if bc[i] > math.MaxUint32-d {
+					mc[i] = math.MaxUint32
+				} else {
+					mc[i] = bc[i] + d
+				}
+			}
+		}
+		funcs[key] = mc
+	}
+	delete(ds.args, deltaCountsKey)
+	return newSnapshotFromFuncs(bs.metaHash, ds.args, funcs).write(out)
+}
+
+// readCounterStream reads a counter data file payload from 'r'.
+func readCounterStream(r io.Reader) (*CounterSnapshot, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return readCounterData(bytes.NewReader(data))
+}
@@ -0,0 +1,229 @@
+// Copyright 2022 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package coverage
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"internal/coverage"
+	"internal/coverage/decodemeta"
+	"io"
+)
+
+// CounterDiff describes the changes in coverage counter values
+// between two points in the execution of a program, on a
+// per-function basis.
+type CounterDiff struct {
+	Gained  []DiffEntry // functions executed only after the first point
+	Lost    []DiffEntry // functions whose counters were reset to zero
+	Changed []DiffEntry // functions whose counter values changed
+}
+
+// DiffEntry describes the change in counter values for a single
+// function. Before and After hold the sum of the function's counter
+// values at the first and second point respectively.
+type DiffEntry struct {
+	PackagePath  string
+	FunctionName string
+	Before       uint64
+	After        uint64
+}
+
+// diffSnapshots compares the counter values in 'before' and 'after',
+// using the package meta-data blobs in 'payloads' to resolve
+// function names. Entries in the resulting diff are ordered by
+// package and function index.
+func diffSnapshots(payloads [][]byte, before, after *CounterSnapshot) (*CounterDiff, error) {
+	if before.metaHash != after.metaHash {
+		return nil, fmt.Errorf("counter snapshots are for different programs (meta-data hash %x vs %x)", before.metaHash, after.metaHash)
+	}
+	bm, am := before.counterMap(), after.counterMap()
+	d := &CounterDiff{}
+	err := visitMetaFuncs(payloads, func(pkIdx, fnIdx uint32, pd *decodemeta.CoverageMetaDataDecoder, fd *coverage.FuncDesc) error {
+		key := pkfunc{pk: pkIdx, fcn: fnIdx}
+		bc, ac := bm[key], am[key]
+		if equalCounters(bc, ac) {
+			return nil
+		}
+		e := DiffEntry{
+			PackagePath:  pd.PackagePath(),
+			FunctionName: fd.Funcname,
+			Before:       sumCounters(bc),
+			After:        sumCounters(ac),
+		}
+		switch {
+		case !anyNonZero(bc):
+			d.Gained = append(d.Gained, e)
+		case !anyNonZero(ac):
+			d.Lost = append(d.Lost, e)
+		default:
+			d.Changed = append(d.Changed, e)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// BinaryDiff reads two blobs of counter data for the currently
+// running program (as written by EmitCounterDataToWriter or
+// EmitCompressedCounterDataToWriter) from 'a' and 'b', and returns
+// the per-function changes in counter values from 'a' to 'b'. An
+// error is returned if the program was not built with "-cover", if
+// either blob can't be read, or if the two blobs (or the program)
+// have different meta-data hashes.
+func BinaryDiff(a, b io.Reader) (*CounterDiff, error) {
+	if err := ensureFinalHash(); err != nil {
+		return nil, err
+	}
+	var snaps [2]*CounterSnapshot
+	for i, r := range []io.Reader{a, b} {
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+		if data, err = decompressCounterData(data); err != nil {
+			return nil, err
+		}
+		if snaps[i], err = readCounterData(bytes.NewReader(data)); err != nil {
+			return nil, err
+		}
+	}
+	if snaps[0].metaHash == snaps[1].metaHash && snaps[0].metaHash != finalHash {
+		return nil, fmt.Errorf("counter data is for a different program (meta-data hash %x vs %x)", snaps[0].metaHash, finalHash)
+	}
+	return diffSnapshots(metaPayloads(getCovMetaList()), snaps[0], snaps[1])
+}
+
+// DiffToText writes a human-readable report of the changes in 'd' to
+// 'w', in the style of a unified diff: one line per function, giving
+// the sum of its counter values before and after, marked with "+"
+// for functions that gained coverage, "-" for functions that lost it,
+// and "!" for functions whose counters changed.
+func DiffToText(d *CounterDiff, w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "--- before\n+++ after\n")
+	for _, s := range []struct {
+		mark    string
+		entries []DiffEntry
+	}{
+		{"-", d.Lost},
+		{"+", d.Gained},
+		{"!", d.Changed},
+	} {
+		for _, e := range s.entries {
+			fmt.Fprintf(bw, "%s %s.%s: %d -> %d\n", s.mark, e.PackagePath, e.FunctionName, e.Before, e.After)
+		}
+	}
+	return bw.Flush()
+}
+
+// deltaCounters returns the per-function counter increments between
+// 'before' and 'after'. If a counter decreased (meaning that counters
+// were cleared in the interim) its value in 'after' is used as the
+// increment. Functions with no increments are omitted.
+func deltaCounters(before, after map[pkfunc][]uint32) map[pkfunc][]uint32 {
+	m := make(map[pkfunc][]uint32)
+	for key, ac := range after {
+		bc := before[key]
+		dc := make([]uint32, len(ac))
+		for i, a := range ac {
+			dc[i] = a
+			if i < len(bc) && bc[i] <= a {
+				dc[i] = a - bc[i]
+			}
+		}
+		if anyNonZero(dc) {
+			m[key] = dc
+		}
+	}
+	return m
+}
+
+func equalCounters(a, b []uint32) bool {
+	if !anyNonZero(a) || !anyNonZero(b) {
+		return !anyNonZero(a) && !anyNonZero(b)
+	}
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func sumCounters(counters []uint32) uint64 {
+	var tot uint64
+	for _, c := range counters {
+		tot += uint64(c)
+	}
+	return tot
+}
+
+// IterateCounterChanges compares the counter values in 'prev' with
+// the current counter values of the running program, invoking 'fn'
+// once for each counter whose value has changed. The current values
+// are captured in a snapshot at the start of the call, so 'fn' sees a
+// consistent view regardless of concurrent execution. A nil 'prev' is
+// treated as a snapshot in which all counters are zero. If 'fn'
+// panics, the panic is recovered and iteration continues with the
+// remaining changes.
+//
+// IterateCounterChanges returns an error if the program was not built
+// with "-cover", or was built with a counter mode other than
+// "atomic" (other modes do not guarantee a consistent view of the
+// counters; see ClearCoverageCounters).
+func IterateCounterChanges(prev *CounterSnapshot, fn func(pkg, funcName string, blockIdx int, oldVal, newVal uint32)) error {
+	cur, err := ReadCounterSnapshot()
+	if err != nil {
+		return err
+	}
+	if cmode != coverage.CtrModeAtomic {
+		return fmt.Errorf("IterateCounterChanges invoked for program built with -covermode=%s (please use -covermode=atomic)", cmode.String())
+	}
+	var pm map[pkfunc][]uint32
+	if prev != nil {
+		if prev.metaHash != cur.metaHash {
+			return fmt.Errorf("counter snapshot is for a different program (meta-data hash %x vs %x)", prev.metaHash, cur.metaHash)
+		}
+		pm = prev.counterMap()
+	}
+	cm := cur.counterMap()
+	return visitMetaFuncs(metaPayloads(getCovMetaList()), func(pkIdx, fnIdx uint32, pd *decodemeta.CoverageMetaDataDecoder, fd *coverage.FuncDesc) error {
+		key := pkfunc{pk: pkIdx, fcn: fnIdx}
+		pc, cc := pm[key], cm[key]
+		n := len(cc)
+		if len(pc) > n {
+			n = len(pc)
+		}
+		for i := 0; i < n; i++ {
+			var oldVal, newVal uint32
+			if i < len(pc) {
+				oldVal = pc[i]
+			}
+			if i < len(cc) {
+				newVal = cc[i]
+			}
+			if oldVal != newVal {
+				callChangeFn(fn, pd.PackagePath(), fd.Funcname, i, oldVal, newVal)
+			}
+		}
+		return nil
+	})
+}
+
+// callChangeFn invokes 'fn', recovering from any panic it raises.
+func callChangeFn(fn func(pkg, funcName string, blockIdx int, oldVal, newVal uint32), pkg, funcName string, blockIdx int, oldVal, newVal uint32) {
+	defer func() {
+		recover()
+	}()
+	fn(pkg, funcName, blockIdx, oldVal, newVal)
+}
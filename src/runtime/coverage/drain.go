@@ -0,0 +1,90 @@
+// Copyright 2022 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package coverage
+
+import (
+	"context"
+	"internal/coverage"
+	"internal/coverage/decodemeta"
+	"time"
+)
+
+// PackageCounterData holds the counter values for the functions in a
+// single instrumented package, as sent by DrainCountersToChan.
+type PackageCounterData struct {
+	PackagePath string
+	Functions   []FunctionCounterData
+	Timestamp   time.Time // time at which the counters were captured
+}
+
+// FunctionCounterData holds the counter values for a single
+// function. Counters is nil if the function has not been executed.
+type FunctionCounterData struct {
+	FunctionName string
+	Counters     []uint32
+}
+
+// DrainCountersToChan captures a snapshot of the coverage counters of
+// the running program and sends one PackageCounterData value to 'ch'
+// for each instrumented package, blocking if 'ch' is full. Counter
+// values are copied, so they may be used freely by the receiver. The
+// channel is not closed by DrainCountersToChan. An error is returned
+// if the program was not built with "-cover".
+func DrainCountersToChan(ch chan<- PackageCounterData) error {
+	return DrainCountersToChanContext(context.Background(), ch)
+}
+
+// DrainCountersToChanContext is like DrainCountersToChan, but stops
+// (returning the context's error) if 'ctx' is canceled while waiting
+// to send to 'ch'.
+func DrainCountersToChanContext(ctx context.Context, ch chan<- PackageCounterData) error {
+	pkgs, err := packageCounterData()
+	if err != nil {
+		return err
+	}
+	for _, p := range pkgs {
+		select {
+		case ch <- p:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// packageCounterData captures a snapshot of the program's counters
+// and returns it organized by package, in meta-data order.
+func packageCounterData() ([]PackageCounterData, error) {
+	snap, err := ReadCounterSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	counters := snap.counterMap()
+	payloads := metaPayloads(getCovMetaList())
+	pkgs := make([]PackageCounterData, len(payloads))
+	for pkIdx, p := range payloads {
+		pcd := &pkgs[pkIdx]
+		err := visitPkgMetaFuncs(p, uint32(pkIdx), func(pd *decodemeta.CoverageMetaDataDecoder) {
+			pcd.PackagePath = pd.PackagePath()
+			pcd.Timestamp = now
+			pcd.Functions = make([]FunctionCounterData, 0, pd.NumFuncs())
+		}, func(pkIdx, fnIdx uint32, _ *decodemeta.CoverageMetaDataDecoder, fd *coverage.FuncDesc) error {
+			var ctrs []uint32
+			if c, ok := counters[pkfunc{pk: pkIdx, fcn: fnIdx}]; ok {
+				ctrs = append([]uint32(nil), c...)
+			}
+			pcd.Functions = append(pcd.Functions, FunctionCounterData{
+				FunctionName: fd.Funcname,
+				Counters:     ctrs,
+			})
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return pkgs, nil
+}
@@ -0,0 +1,92 @@
+// Copyright 2022 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package coverage
+
+import (
+	"bufio"
+	"fmt"
+	"internal/coverage"
+	"internal/coverage/decodemeta"
+	"io"
+	"sort"
+)
+
+// dumpBufSize is the size of the buffer used by DumpCountersToText.
+const dumpBufSize = 64 << 10
+
+// DumpCountersToText writes the current counter values of every
+// instrumented function in the running program to 'w' as text, one
+// line per function, sorted by package path and then by function
+// name, for example
+//
+//	example.com/svc	*Server.Handle	block0=12 block1=0 block2=12
+//	example.com/svc	unused	block0=0 block1=0	[UNCOVERED]
+//
+// The package path, function name (as recorded in the meta-data) and
+// counter values are separated by tabs, and functions whose counters
+// are all zero are marked with a final "[UNCOVERED]" field. The values
+// are the raw counters: one per block, or a single "block0" value
+// with per-function granularity. Output is buffered in 64 KB chunks
+// and flushed after each package. An error is returned if the program
+// was not built with "-cover", or if a write fails.
+func DumpCountersToText(w io.Writer) error {
+	snap, err := ReadCounterSnapshot()
+	if err != nil {
+		return err
+	}
+	counters := snap.counterMap()
+	payloads := metaPayloads(getCovMetaList())
+	paths, err := metaPackagePaths(payloads)
+	if err != nil {
+		return err
+	}
+	order := make([]int, len(payloads))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool { return paths[order[i]] < paths[order[j]] })
+
+	type dumpFunc struct {
+		name string
+		vals []uint32
+	}
+	bw := bufio.NewWriterSize(w, dumpBufSize)
+	var funcs []dumpFunc
+	for _, pkIdx := range order {
+		funcs = funcs[:0]
+		err := visitPkgMetaFuncs(payloads[pkIdx], uint32(pkIdx), nil, func(pk, fnIdx uint32, _ *decodemeta.CoverageMetaDataDecoder, fd *coverage.FuncDesc) error {
+			n := len(fd.Units)
+			if cgran == coverage.CtrGranularityPerFunc && n > 0 {
+				n = 1
+			}
+			ctrs := counters[pkfunc{pk: pk, fcn: fnIdx}]
+			vals := make([]uint32, n)
+			copy(vals, ctrs)
+			funcs = append(funcs, dumpFunc{name: fd.Funcname, vals: vals})
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		sort.SliceStable(funcs, func(i, j int) bool { return funcs[i].name < funcs[j].name })
+		for _, f := range funcs {
+			fmt.Fprintf(bw, "%s\t%s\t", paths[pkIdx], f.name)
+			for i, v := range f.vals {
+				if i != 0 {
+					bw.WriteByte(' ')
+				}
+				fmt.Fprintf(bw, "block%d=%d", i, v)
+			}
+			if !anyNonZero(f.vals) {
+				bw.WriteString("\t[UNCOVERED]")
+			}
+			bw.WriteByte('\n')
+		}
+		if err := bw.Flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
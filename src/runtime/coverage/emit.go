@@ -16,7 +16,7 @@ import (
 	"path/filepath"
 	"reflect"
 	"runtime"
-	"sync/atomic"
+	"sync"
 	"time"
 	"unsafe"
 )
@@ -30,10 +30,24 @@ import (
 // runtime.
 func getCovMetaList() []rtcov.CovMetaBlob
 
+// runtimeCovCounterList returns a list of counter-data blobs
+// registered for the currently executing instrumented program. It is
+// defined in the runtime.
+func runtimeCovCounterList() []rtcov.CovCounterBlob
+
+// testCounterList, if non-nil, is returned by getCovCounterList in
+// place of the runtime's list. It is set only by tests and benchmarks
+// that need a counter list of a particular shape.
+var testCounterList []rtcov.CovCounterBlob
+
 // getCovCounterList returns a list of counter-data blobs registered
-// for the currently executing instrumented program. It is defined in the
-// runtime.
-func getCovCounterList() []rtcov.CovCounterBlob
+// for the currently executing instrumented program.
+func getCovCounterList() []rtcov.CovCounterBlob {
+	if testCounterList != nil {
+		return testCounterList
+	}
+	return runtimeCovCounterList()
+}
 
 // getCovPkgMap returns a map storing the remapped package IDs for
 // hard-coded runtime packages (see internal/coverage/pkgid.go for
@@ -41,6 +55,18 @@ func getCovCounterList() []rtcov.CovCounterBlob
 // is defined in the runtime.
 func getCovPkgMap() map[int]int
 
+// stopTheWorld and startTheWorld suspend and resume execution of all
+// goroutines other than the caller's. They are defined in the
+// runtime.
+func stopTheWorld()
+func startTheWorld()
+
+// procPin and procUnpin disable and re-enable preemption of the
+// calling goroutine, keeping it on its current P. They are defined in
+// the runtime.
+func procPin() int
+func procUnpin()
+
 // emitState holds useful state information during the emit process.
 //
 // When an instrumented program finishes execution and starts the
@@ -69,6 +95,7 @@ type emitState struct {
 	cftmp  string   // path to counter data temp file
 	cf     *os.File // open os.File for counter data file
 	outdir string   // output directory
+	cfbase string   // base name for counter data file (if not default)
 
 	// List of meta-data symbols obtained from the runtime
 	metalist []rtcov.CovMetaBlob
@@ -81,6 +108,9 @@ type emitState struct {
 
 	// emit debug trace output
 	debug bool
+
+	// Copy of the counters being written (see emitCounterDataFile).
+	snap *CounterSnapshot
 }
 
 var (
@@ -104,6 +134,10 @@ var (
 	capturedOsArgs map[string]string
 	// Flag used in tests to signal that coverage data already written.
 	covProfileAlreadyEmitted bool
+	// Labels to be added to the args section of counter data files
+	// (see SetCoverageLabel), protected by covLabelsMu.
+	covLabels   map[string]string
+	covLabelsMu sync.Mutex
 )
 
 // fileType is used to select between counter-data files and
@@ -136,12 +170,13 @@ func emitMetaData() {
 	}
 
 	goCoverDir = os.Getenv("GOCOVERDIR")
-	if goCoverDir == "" {
+	outdir := GetCoverageOutputDir()
+	if outdir == "" {
 		fmt.Fprintf(os.Stderr, "warning: GOCOVERDIR not set, no coverage data emitted\n")
 		return
 	}
 
-	if err := emitMetaDataToDirectory(goCoverDir, ml); err != nil {
+	if err := emitMetaDataToDirectory(outdir, ml); err != nil {
 		fmt.Fprintf(os.Stderr, "error: coverage meta-data emit failed: %v\n", err)
 		if os.Getenv("GOCOVERDEBUG") != "" {
 			panic("meta-data write failure")
@@ -237,6 +272,7 @@ func prepareForMetaEmit() ([]rtcov.CovMetaBlob, error) {
 	copy(finalHash[:], fh)
 	finalHashComputed = true
 	finalMetaLen = tlen
+	notifyFinalHash(finalHash)
 
 	return ml, nil
 }
@@ -278,10 +314,30 @@ func emitMetaDataToDirectory(outdir string, ml []rtcov.CovMetaBlob) error {
 // This entry point is intended to be invoked by the runtime when an
 // instrumented program is terminating or calling os.Exit().
 func emitCounterData() {
-	if goCoverDir == "" || !finalHashComputed || covProfileAlreadyEmitted {
+	runFlushHooks()
+	emitCounterDataAtExit()
+	enforceMinCoverageAtExit()
+}
+
+// emitCounterDataAtExit writes the counter data file (and, if needed,
+// the meta-data file) to the coverage output directory on behalf of
+// emitCounterData.
+func emitCounterDataAtExit() {
+	outdir := GetCoverageOutputDir()
+	if outdir == "" || !finalHashComputed || covProfileAlreadyEmitted {
 		return
 	}
-	if err := emitCounterDataToDirectory(goCoverDir); err != nil {
+	if outdir != goCoverDir {
+		// The directory was set with SetCoverageOutputDir, so the
+		// meta-data file may not have been written there yet.
+		if err := emitMetaDataToDirectory(outdir, getCovMetaList()); err != nil {
+			fmt.Fprintf(os.Stderr, "error: coverage meta-data emit failed: %v\n", err)
+			if os.Getenv("GOCOVERDEBUG") != "" {
+				panic("meta-data write failure")
+			}
+		}
+	}
+	if err := emitCounterDataToDirectory(outdir); err != nil {
 		fmt.Fprintf(os.Stderr, "error: coverage counter data emit failed: %v\n", err)
 		if os.Getenv("GOCOVERDEBUG") != "" {
 			panic("counter-data write failure")
@@ -291,6 +347,13 @@ func emitCounterData() {
 
 // emitMetaData emits the counter-data output file for this coverage run.
 func emitCounterDataToDirectory(outdir string) error {
+	return emitCounterDataToDirectoryAs(outdir, "")
+}
+
+// emitCounterDataToDirectoryAs is like emitCounterDataToDirectory, but
+// uses 'cfbase' as the base name of the counter data file, if it is
+// not empty.
+func emitCounterDataToDirectoryAs(outdir, cfbase string) error {
 	// Ask the runtime for the list of coverage counter symbols.
 	cl := getCovCounterList()
 	if len(cl) == 0 {
@@ -308,6 +371,7 @@ func emitCounterDataToDirectory(outdir string) error {
 		counterlist: cl,
 		pkgmap:      pm,
 		outdir:      outdir,
+		cfbase:      cfbase,
 		debug:       os.Getenv("GOCOVERDEBUG") != "",
 	}
 
@@ -332,10 +396,63 @@ func emitCounterDataToDirectory(outdir string) error {
 	if err := os.Rename(s.cftmp, s.cfname); err != nil {
 		return fmt.Errorf("writing %s: rename from %s failed: %v\n", s.cfname, s.cftmp, err)
 	}
+	applyRetentionPolicy(outdir, finalHash)
 
 	return nil
 }
 
+// emitCounterDataToDirectoryAtomic writes a counter data file to
+// 'outdir' via a uniquely named temporary file, which is synced
+// before being renamed into place and removed on failure.
+func emitCounterDataToDirectoryAtomic(outdir string) (err error) {
+	cl := getCovCounterList()
+	if len(cl) == 0 {
+		return fmt.Errorf("program not built with -cover")
+	}
+	if !finalHashComputed {
+		return fmt.Errorf("error: meta-data not available (binary not built with -cover?)")
+	}
+	if err := checkOutputDir(outdir); err != nil {
+		return err
+	}
+	fn, err := counterFileName(finalHash)
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(outdir, "."+fn+".*")
+	if err != nil {
+		return fmt.Errorf("creating counter data file: %v", err)
+	}
+	tmp := f.Name()
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(tmp)
+		}
+	}()
+	s := &emitState{
+		counterlist: cl,
+		pkgmap:      getCovPkgMap(),
+		outdir:      outdir,
+		debug:       os.Getenv("GOCOVERDEBUG") != "",
+	}
+	if err := s.emitCounterDataFile(finalHash, f); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("syncing counter data file %s: %v", tmp, err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("closing counter data file %s: %v", tmp, err)
+	}
+	dst := filepath.Join(outdir, fn)
+	if err := os.Rename(tmp, dst); err != nil {
+		return fmt.Errorf("writing %s: rename from %s failed: %v", dst, tmp, err)
+	}
+	applyRetentionPolicy(outdir, finalHash)
+	return nil
+}
+
 // emitMetaData emits counter data for this coverage run to an io.Writer.
 func (s *emitState) emitCounterDataToWriter(w io.Writer) error {
 	if err := s.emitCounterDataFile(finalHash, w); err != nil {
@@ -371,11 +488,15 @@ func (s *emitState) openMetaFile(metaHash [16]byte, metaLen uint64) error {
 // of a test coverage run. If updates the 'cfname' and 'cf' fields in
 // 's', returning an error if something went wrong.
 func (s *emitState) openCounterFile(metaHash [16]byte) error {
-	processID := os.Getpid()
-	fn := fmt.Sprintf(coverage.CounterFileTempl, coverage.CounterFilePref, metaHash, processID, time.Now().UnixNano())
+	var err error
+	fn := s.cfbase
+	if fn == "" {
+		if fn, err = counterFileName(metaHash); err != nil {
+			return err
+		}
+	}
 	s.cfname = filepath.Join(s.outdir, fn)
 	s.cftmp = filepath.Join(s.outdir, "tmp."+fn)
-	var err error
 	s.cf, err = os.Create(s.cftmp)
 	if err != nil {
 		return fmt.Errorf("creating counter data file %s: %v", s.cftmp, err)
@@ -420,7 +541,10 @@ func (s *emitState) openOutputFiles(metaHash [16]byte, metaLen uint64, which fil
 // temporary file (s.mftmp), then renames the generated file to the
 // final path (s.mfname).
 func (s *emitState) emitMetaDataFile(finalHash [16]byte, tlen uint64) error {
-	if err := writeMetaData(s.mf, s.metalist, cmode, cgran, finalHash); err != nil {
+	err := writeWithPlugins(s.mf, metaDataFile, func(w io.Writer) error {
+		return writeMetaData(w, s.metalist, cmode, cgran, finalHash)
+	})
+	if err != nil {
 		return fmt.Errorf("writing %s: %v\n", s.mftmp, err)
 	}
 	if err := s.mf.Close(); err != nil {
@@ -445,7 +569,12 @@ func (s *emitState) needMetaDataFile() bool {
 
 func writeMetaData(w io.Writer, metalist []rtcov.CovMetaBlob, cmode coverage.CounterMode, gran coverage.CounterGranularity, finalHash [16]byte) error {
 	mfw := encodemeta.NewCoverageMetaFileWriter("<io.Writer>", w)
+	return mfw.Write(finalHash, metaPayloads(metalist), cmode, gran)
+}
 
+// metaPayloads returns a list of byte slices viewing the (read-only)
+// meta-data blobs in 'metalist', one per instrumented package.
+func metaPayloads(metalist []rtcov.CovMetaBlob) [][]byte {
 	// Note: "sd" is re-initialized on each iteration of the loop
 	// below, and would normally be declared inside the loop, but
 	// placed here escape analysis since we capture it in bufHdr.
@@ -459,98 +588,35 @@ func writeMetaData(w io.Writer, metalist []rtcov.CovMetaBlob, cmode coverage.Cou
 		bufHdr.Cap = int(e.Len)
 		blobs = append(blobs, sd)
 	}
-	return mfw.Write(finalHash, blobs, cmode, gran)
+	return blobs
 }
 
+// NumFuncs returns the number of live functions in 's.snap'.
 func (s *emitState) NumFuncs() (int, error) {
-	var sd []atomic.Uint32
-	bufHdr := (*reflect.SliceHeader)(unsafe.Pointer(&sd))
-
-	totalFuncs := 0
-	for _, c := range s.counterlist {
-		bufHdr.Data = uintptr(unsafe.Pointer(c.Counters))
-		bufHdr.Len = int(c.Len)
-		bufHdr.Cap = int(c.Len)
-		for i := 0; i < len(sd); i++ {
-			// Skip ahead until the next non-zero value.
-			sdi := sd[i].Load()
-			if sdi == 0 {
-				continue
-			}
-
-			// We found a function that was executed.
-			nCtrs := sdi
-
-			// Check to make sure that we have at least one live
-			// counter. See the implementation note in ClearCoverageCounters
-			// for a description of why this is needed.
-			isLive := false
-			st := i + coverage.FirstCtrOffset
-			counters := sd[st : st+int(nCtrs)]
-			for i := 0; i < len(counters); i++ {
-				if counters[i].Load() != 0 {
-					isLive = true
-					break
-				}
-			}
-			if !isLive {
-				// Skip this function.
-				i += coverage.FirstCtrOffset + int(nCtrs) - 1
-				continue
-			}
-
-			totalFuncs++
-
-			// Move to the next function.
-			i += coverage.FirstCtrOffset + int(nCtrs) - 1
-		}
-	}
-	return totalFuncs, nil
+	return snapshotVisitor{s.snap}.NumFuncs()
 }
 
+// VisitFuncs invokes 'f' for each live function in 's.snap'.
 func (s *emitState) VisitFuncs(f encodecounter.CounterVisitorFn) error {
-	var sd []atomic.Uint32
-	var tcounters []uint32
-	bufHdr := (*reflect.SliceHeader)(unsafe.Pointer(&sd))
-
-	rdCounters := func(actrs []atomic.Uint32, ctrs []uint32) []uint32 {
-		ctrs = ctrs[:0]
-		for i := range actrs {
-			ctrs = append(ctrs, actrs[i].Load())
-		}
-		return ctrs
-	}
-
 	dpkg := uint32(0)
-	for _, c := range s.counterlist {
-		bufHdr.Data = uintptr(unsafe.Pointer(c.Counters))
-		bufHdr.Len = int(c.Len)
-		bufHdr.Cap = int(c.Len)
+	for _, sd := range s.snap.slabs {
 		for i := 0; i < len(sd); i++ {
 			// Skip ahead until the next non-zero value.
-			sdi := sd[i].Load()
-			if sdi == 0 {
+			nCtrs := sd[i]
+			if nCtrs == 0 {
 				continue
 			}
 
 			// We found a function that was executed.
-			nCtrs := sd[i+coverage.NumCtrsOffset].Load()
-			pkgId := sd[i+coverage.PkgIdOffset].Load()
-			funcId := sd[i+coverage.FuncIdOffset].Load()
+			pkgId := sd[i+coverage.PkgIdOffset]
+			funcId := sd[i+coverage.FuncIdOffset]
 			cst := i + coverage.FirstCtrOffset
 			counters := sd[cst : cst+int(nCtrs)]
 
 			// Check to make sure that we have at least one live
 			// counter. See the implementation note in ClearCoverageCounters
 			// for a description of why this is needed.
-			isLive := false
-			for i := 0; i < len(counters); i++ {
-				if counters[i].Load() != 0 {
-					isLive = true
-					break
-				}
-			}
-			if !isLive {
+			if !anyNonZero(counters) {
 				// Skip this function.
 				i += coverage.FirstCtrOffset + int(nCtrs) - 1
 				continue
@@ -565,34 +631,9 @@ func (s *emitState) VisitFuncs(f encodecounter.CounterVisitorFn) error {
 				fmt.Fprintf(os.Stderr, " {i=%d F%d NC%d}", i, funcId, nCtrs)
 			}
 
-			// Vet and/or fix up package ID. A package ID of zero
-			// indicates that there is some new package X that is a
-			// runtime dependency, and this package has code that
-			// executes before its corresponding init package runs.
-			// This is a fatal error that we should only see during
-			// Go development (e.g. tip).
-			ipk := int32(pkgId)
-			if ipk == 0 {
-				fmt.Fprintf(os.Stderr, "\n")
-				reportErrorInHardcodedList(int32(i), ipk, funcId, nCtrs)
-			} else if ipk < 0 {
-				if newId, ok := s.pkgmap[int(ipk)]; ok {
-					pkgId = uint32(newId)
-				} else {
-					fmt.Fprintf(os.Stderr, "\n")
-					reportErrorInHardcodedList(int32(i), ipk, funcId, nCtrs)
-				}
-			} else {
-				// The package ID value stored in the counter array
-				// has 1 added to it (so as to preclude the
-				// possibility of a zero value ; see
-				// runtime.addCovMeta), so subtract off 1 here to form
-				// the real package ID.
-				pkgId--
-			}
+			pkgId = remapPkgID(s.snap.pkgmap, i, pkgId, funcId, nCtrs)
 
-			tcounters = rdCounters(counters, tcounters)
-			if err := f(pkgId, funcId, tcounters); err != nil {
+			if err := f(pkgId, funcId, counters); err != nil {
 				return err
 			}
 
@@ -606,6 +647,36 @@ func (s *emitState) VisitFuncs(f encodecounter.CounterVisitorFn) error {
 	return nil
 }
 
+// remapPkgID vets and/or fixes up the package ID 'pkgId' read from
+// the prolog of the function at slot 'slot' in a counter array,
+// returning the index of the package within the meta-data list. A
+// package ID of zero indicates that there is some new package X that
+// is a runtime dependency, and this package has code that executes
+// before its corresponding init package runs. This is a fatal error
+// that we should only see during Go development (e.g. tip).
+func remapPkgID(pkgmap map[int]int, slot int, pkgId, funcId, nCtrs uint32) uint32 {
+	ipk := int32(pkgId)
+	if ipk == 0 {
+		fmt.Fprintf(os.Stderr, "\n")
+		reportErrorInHardcodedList(int32(slot), ipk, funcId, nCtrs)
+	} else if ipk < 0 {
+		if newId, ok := pkgmap[int(ipk)]; ok {
+			pkgId = uint32(newId)
+		} else {
+			fmt.Fprintf(os.Stderr, "\n")
+			reportErrorInHardcodedList(int32(slot), ipk, funcId, nCtrs)
+		}
+	} else {
+		// The package ID value stored in the counter array
+		// has 1 added to it (so as to preclude the
+		// possibility of a zero value ; see
+		// runtime.addCovMeta), so subtract off 1 here to form
+		// the real package ID.
+		pkgId--
+	}
+	return pkgId
+}
+
 // captureOsArgs converts os.Args() into the format we use to store
 // this info in the counter data file (counter data file "args"
 // section is a generic key-value collection). See the 'args' section
@@ -622,14 +693,70 @@ func captureOsArgs() map[string]string {
 	return m
 }
 
+// counterFileArgs returns the key-value pairs to be written to the
+// args section of a counter data file: the captured os.Args (along
+// with GOOS and GOARCH), plus any labels set with SetCoverageLabel.
+func counterFileArgs() map[string]string {
+	covLabelsMu.Lock()
+	defer covLabelsMu.Unlock()
+	if len(covLabels) == 0 {
+		return capturedOsArgs
+	}
+	m := make(map[string]string, len(capturedOsArgs)+len(covLabels))
+	for k, v := range capturedOsArgs {
+		m[k] = v
+	}
+	for k, v := range covLabels {
+		m[k] = v
+	}
+	return m
+}
+
 // emitCounterDataFile emits the counter data portion of a
 // coverage output file (to the file 's.cf').
 func (s *emitState) emitCounterDataFile(finalHash [16]byte, w io.Writer) error {
-	cfw := encodecounter.NewCoverageDataWriter(w, coverage.CtrULeb128)
-	if err := cfw.Write(finalHash, capturedOsArgs, s); err != nil {
-		return err
-	}
-	return nil
+	// Write from a copy of the counters rather than from the live
+	// counter arrays. The function count in the file header is
+	// computed before the functions are visited, and with -coverpkg
+	// covering library packages, code run while writing the file can
+	// make new functions live in between; the header would then
+	// undercount, and readers would drop the trailing functions.
+	snap := s.snapshotCounters(finalHash)
+	return writeCounterData(w, snap, getEmitProgressWriter(), func(snap *CounterSnapshot) encodecounter.CounterVisitor {
+		s.snap = snap
+		return s
+	})
+}
+
+// writeCounterData writes the counters in 'snap' to 'w' in the counter
+// data file format. All emission of the running program's counter
+// data goes through here, so that it is treated the same way
+// everywhere: 'snap' is first reduced to the limit set with
+// SetMaxCounterFileSize, then written, and the output is passed
+// through the registered plugins. If 'pw' is not nil, the data is
+// written with progress reports to 'pw'; otherwise the functions are
+// supplied to the encoder by the visitor that 'visitor' returns for
+// the reduced snapshot.
+func writeCounterData(w io.Writer, snap *CounterSnapshot, pw ProgressWriter, visitor func(snap *CounterSnapshot) encodecounter.CounterVisitor) error {
+	if limit := GetMaxCounterFileSize(); limit != -1 {
+		snap = snap.limitSize(limit)
+	}
+	return writeWithPlugins(w, counterDataFile, func(w io.Writer) error {
+		if pw != nil {
+			return snap.writeWithProgress(w, pw)
+		}
+		cfw := encodecounter.NewCoverageDataWriter(w, coverage.CtrULeb128)
+		return cfw.Write(snap.metaHash, snap.args, visitor(snap))
+	})
+}
+
+// snapshotCounters returns a copy of the counters in 's.counterlist'.
+func (s *emitState) snapshotCounters(finalHash [16]byte) *CounterSnapshot {
+	snap := &CounterSnapshot{}
+	snap.fill(s.counterlist)
+	snap.metaHash = finalHash
+	snap.pkgmap = s.pkgmap
+	return snap
 }
 
 // markProfileEmitted signals the runtime/coverage machinery that
@@ -0,0 +1,296 @@
+// Copyright 2022 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package coverage
+
+import (
+	"compress/gzip"
+	"fmt"
+	"internal/coverage"
+	"internal/coverage/rtcov"
+	"io"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"unsafe"
+)
+
+// injectTestCounterList arranges for the emit APIs to see the counter
+// list 'cl' in place of the program's own, as if the program had
+// been built with -covermode=atomic. It returns a function that
+// undoes the change.
+func injectTestCounterList(cl []rtcov.CovCounterBlob) (restore func()) {
+	oldList, oldComputed, oldMode := testCounterList, finalHashComputed, cmode
+	testCounterList = cl
+	finalHashComputed = true
+	cmode = coverage.CtrModeAtomic
+	return func() {
+		testCounterList, finalHashComputed, cmode = oldList, oldComputed, oldMode
+	}
+}
+
+// syntheticCounterList returns a counter list for a fake program with
+// 'npkgs' packages of 'nfuncs' functions each, every one of which has
+// executed, along with the counter slabs the list refers to (which
+// must be kept alive while the list is in use).
+func syntheticCounterList(npkgs, nfuncs int) ([]rtcov.CovCounterBlob, [][]atomic.Uint32) {
+	const nctrs = 2
+	cl := make([]rtcov.CovCounterBlob, 0, npkgs)
+	slabs := make([][]atomic.Uint32, 0, npkgs)
+	for pk := 0; pk < npkgs; pk++ {
+		slab := make([]atomic.Uint32, nfuncs*(coverage.FirstCtrOffset+nctrs))
+		for fn := 0; fn < nfuncs; fn++ {
+			f := slab[fn*(coverage.FirstCtrOffset+nctrs):]
+			f[coverage.NumCtrsOffset].Store(nctrs)
+			// Package IDs are stored with 1 added (see
+			// runtime.addCovMeta).
+			f[coverage.PkgIdOffset].Store(uint32(pk + 1))
+			f[coverage.FuncIdOffset].Store(uint32(fn))
+			for c := 0; c < nctrs; c++ {
+				f[coverage.FirstCtrOffset+c].Store(uint32(fn%7 + 1))
+			}
+		}
+		cl = append(cl, rtcov.CovCounterBlob{
+			Counters: (*uint32)(unsafe.Pointer(&slab[0])),
+			Len:      uint64(len(slab)),
+		})
+		slabs = append(slabs, slab)
+	}
+	return cl, slabs
+}
+
+// injectTestFuncIndex adds the functions of the program described by
+// syntheticCounterList(npkgs, nfuncs) to the function index used by
+// lookupFunc, under the package paths "synthetic/p<n>" and function
+// names "F<n>", along with one function "synthetic/p0.Unexecuted" that
+// has no counters. It returns a function that undoes the change.
+func injectTestFuncIndex(npkgs, nfuncs int) (restore func()) {
+	// Build the real index first, so that it is not built later
+	// from the wrong counter list.
+	lookupFunc("", "")
+	clearCache := func() {
+		funcCounters.Range(func(k, v any) bool {
+			funcCounters.Delete(k)
+			return true
+		})
+	}
+	clearCache()
+	var names []funcName
+	add := func(fn funcName, key pkfunc) {
+		funcIndex.Store(fn, key)
+		names = append(names, fn)
+	}
+	for pk := 0; pk < npkgs; pk++ {
+		for fn := 0; fn < nfuncs; fn++ {
+			add(funcName{fmt.Sprintf("synthetic/p%d", pk), fmt.Sprintf("F%d", fn)}, pkfunc{pk: uint32(pk), fcn: uint32(fn)})
+		}
+	}
+	add(funcName{"synthetic/p0", "Unexecuted"}, pkfunc{pk: 0, fcn: uint32(nfuncs)})
+	return func() {
+		for _, fn := range names {
+			funcIndex.Delete(fn)
+		}
+		clearCache()
+	}
+}
+
+type byteCounter struct{ n int64 }
+
+func (c *byteCounter) Write(p []byte) (int, error) {
+	c.n += int64(len(p))
+	return len(p), nil
+}
+
+func benchmarkEmitCounterData(b *testing.B, npkgs, nfuncs int) {
+	if npkgs*nfuncs > 1e6 && testing.Short() {
+		b.Skip("skipping large synthetic program in short mode")
+	}
+	cl, slabs := syntheticCounterList(npkgs, nfuncs)
+	defer injectTestCounterList(cl)()
+	var bc byteCounter
+	if err := EmitCounterDataToWriter(&bc); err != nil {
+		b.Fatalf("EmitCounterDataToWriter: %v", err)
+	}
+	b.SetBytes(bc.n)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := EmitCounterDataToWriter(io.Discard); err != nil {
+			b.Fatalf("EmitCounterDataToWriter: %v", err)
+		}
+	}
+	runtime.KeepAlive(slabs)
+}
+
+func BenchmarkEmitCounterDataToWriter_Small(b *testing.B) {
+	benchmarkEmitCounterData(b, 100, 10)
+}
+
+func BenchmarkEmitCounterDataToWriter_Medium(b *testing.B) {
+	benchmarkEmitCounterData(b, 1000, 100)
+}
+
+func BenchmarkEmitCounterDataToWriter_Large(b *testing.B) {
+	benchmarkEmitCounterData(b, 10000, 1000)
+}
+
+// BenchmarkEmitCompressedCounterData measures the time taken to emit
+// the counter data for a program with 100,000 executed functions, and
+// the size of the result, at several compression levels.
+func BenchmarkEmitCompressedCounterData(b *testing.B) {
+	cl, slabs := syntheticCounterList(1000, 100)
+	defer injectTestCounterList(cl)()
+	var raw byteCounter
+	if err := EmitCounterDataToWriter(&raw); err != nil {
+		b.Fatalf("EmitCounterDataToWriter: %v", err)
+	}
+	b.Logf("uncompressed counter data: %d bytes", raw.n)
+	for _, level := range []int{gzip.BestSpeed, gzip.DefaultCompression, gzip.BestCompression} {
+		b.Run(fmt.Sprintf("level=%d", level), func(b *testing.B) {
+			var bc byteCounter
+			if err := EmitCompressedCounterDataToWriter(&bc, level); err != nil {
+				b.Fatalf("EmitCompressedCounterDataToWriter: %v", err)
+			}
+			b.SetBytes(raw.n)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := EmitCompressedCounterDataToWriter(io.Discard, level); err != nil {
+					b.Fatalf("EmitCompressedCounterDataToWriter: %v", err)
+				}
+			}
+			b.ReportMetric(float64(raw.n)/float64(bc.n), "ratio")
+		})
+	}
+	runtime.KeepAlive(slabs)
+}
+
+func benchmarkClearCoverageCounters(b *testing.B, npkgs, nfuncs int) {
+	if npkgs*nfuncs > 1e6 && testing.Short() {
+		b.Skip("skipping large synthetic program in short mode")
+	}
+	cl, slabs := syntheticCounterList(npkgs, nfuncs)
+	defer injectTestCounterList(cl)()
+	n := int64(0)
+	for _, c := range cl {
+		n += int64(c.Len) * 4
+	}
+	b.SetBytes(n)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := ClearCoverageCounters(); err != nil {
+			b.Fatalf("ClearCoverageCounters: %v", err)
+		}
+	}
+	runtime.KeepAlive(slabs)
+}
+
+func BenchmarkClearCoverageCounters_Small(b *testing.B) {
+	benchmarkClearCoverageCounters(b, 100, 10)
+}
+
+func BenchmarkClearCoverageCounters_Medium(b *testing.B) {
+	benchmarkClearCoverageCounters(b, 1000, 100)
+}
+
+func BenchmarkClearCoverageCounters_Large(b *testing.B) {
+	benchmarkClearCoverageCounters(b, 10000, 1000)
+}
+
+// BenchmarkFunctionCoveragePercent measures the cost of looking up a
+// single function's coverage in a program with 10,000 executed
+// functions, for a function that has executed (whose counters are
+// found once and then cached) and for one that has not (for which
+// the counter arrays are searched on every call).
+func BenchmarkFunctionCoveragePercent(b *testing.B) {
+	const npkgs, nfuncs = 100, 100
+	cl, slabs := syntheticCounterList(npkgs, nfuncs)
+	defer injectTestCounterList(cl)()
+	defer injectTestFuncIndex(npkgs, nfuncs)()
+	for _, tc := range []struct {
+		name, pkg, fn string
+		want          float64
+	}{
+		{"executed", fmt.Sprintf("synthetic/p%d", npkgs-1), fmt.Sprintf("F%d", nfuncs-1), 1},
+		{"unexecuted", "synthetic/p0", "Unexecuted", 0},
+	} {
+		b.Run(tc.name, func(b *testing.B) {
+			if got, err := FunctionCoveragePercent(tc.pkg, tc.fn); err != nil || got != tc.want {
+				b.Fatalf("FunctionCoveragePercent(%q, %q) = %v, %v, want %v, nil", tc.pkg, tc.fn, got, err, tc.want)
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				FunctionCoveragePercent(tc.pkg, tc.fn)
+			}
+		})
+	}
+	runtime.KeepAlive(slabs)
+}
+
+// BenchmarkSwapCounterSlab measures the cost of the swap loop used by
+// ResetAndSnapshot for a program with 10 million counters.
+func BenchmarkSwapCounterSlab(b *testing.B) {
+	if testing.Short() {
+		b.Skip("skipping large synthetic program in short mode")
+	}
+	cl, slabs := syntheticCounterList(5000, 1000)
+	dsts := make([][]uint32, len(cl))
+	n := int64(0)
+	for k, c := range cl {
+		dsts[k] = make([]uint32, c.Len)
+		n += int64(c.Len) * 4
+	}
+	b.SetBytes(n)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for k, c := range cl {
+			dsts[k] = swapCounterSlab(c, dsts[k])
+		}
+	}
+	runtime.KeepAlive(slabs)
+}
+
+// BenchmarkFuzzCoverageSnapshot measures the cost of taking a fuzzer
+// feedback snapshot of a program with 100,000 counters.
+func BenchmarkFuzzCoverageSnapshot(b *testing.B) {
+	cl, slabs := syntheticCounterList(1000, 50)
+	defer injectTestCounterList(cl)()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		FuzzCoverageSnapshot()
+	}
+	runtime.KeepAlive(slabs)
+}
+
+// BenchmarkFuzzCoverageReset measures the cost of clearing the
+// counters of a program with 100,000 counters.
+func BenchmarkFuzzCoverageReset(b *testing.B) {
+	cl, slabs := syntheticCounterList(1000, 50)
+	defer injectTestCounterList(cl)()
+	for i := 0; i < b.N; i++ {
+		FuzzCoverageReset()
+	}
+	runtime.KeepAlive(slabs)
+}
+
+// BenchmarkFuzzCoverageNew measures the cost of comparing two
+// snapshots of a program with 100,000 counters that differ only in
+// their last byte.
+func BenchmarkFuzzCoverageNew(b *testing.B) {
+	cl, slabs := syntheticCounterList(1000, 50)
+	defer injectTestCounterList(cl)()
+	x := FuzzCoverageSnapshot()
+	y := append([]uint8(nil), x...)
+	y[len(y)-1] = 1
+	x[len(x)-1] = 0
+	b.SetBytes(int64(len(x)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if !FuzzCoverageNew(x, y) {
+			b.Fatal("FuzzCoverageNew returns false")
+		}
+	}
+	runtime.KeepAlive(slabs)
+}
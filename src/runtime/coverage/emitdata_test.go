@@ -5,6 +5,8 @@
 package coverage
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"internal/coverage"
 	"internal/goexperiment"
@@ -53,6 +55,38 @@ func TestCoverageApis(t *testing.T) {
 		t.Parallel()
 		testEmitToWriter(t, harnessPath, dir)
 	})
+	t.Run("coveragePlugin", func(t *testing.T) {
+		t.Parallel()
+		testCoveragePlugin(t, harnessPath, dir)
+	})
+	t.Run("emitter", func(t *testing.T) {
+		t.Parallel()
+		testEmitter(t, harnessPath, dir)
+	})
+	t.Run("emitSnapshotToDir", func(t *testing.T) {
+		t.Parallel()
+		testEmitSnapshotToDir(t, harnessPath, dir)
+	})
+	t.Run("mergeDirs", func(t *testing.T) {
+		t.Parallel()
+		testMergeDirs(t, harnessPath, dir)
+	})
+	t.Run("emitDeterministic", func(t *testing.T) {
+		t.Parallel()
+		testEmitDeterministic(t, dir)
+	})
+	t.Run("combinedData", func(t *testing.T) {
+		t.Parallel()
+		testCombinedData(t, harnessPath, dir)
+	})
+	t.Run("flushHook", func(t *testing.T) {
+		t.Parallel()
+		testFlushHook(t, harnessPath, dir)
+	})
+	t.Run("outputDir", func(t *testing.T) {
+		t.Parallel()
+		testOutputDir(t, harnessPath, dir)
+	})
 	t.Run("emitToNonexistentDir", func(t *testing.T) {
 		t.Parallel()
 		testEmitToNonexistentDir(t, harnessPath, dir)
@@ -69,6 +103,97 @@ func TestCoverageApis(t *testing.T) {
 		t.Parallel()
 		testEmitWithCounterClear(t, harnessPath, dir)
 	})
+	t.Run("lowCoverageExit", func(t *testing.T) {
+		t.Parallel()
+		testLowCoverageExit(t, harnessPath, dir)
+	})
+
+	// Sub-tests for APIs whose checks are carried out entirely
+	// within the harness.
+	for _, tp := range []string{
+		"counterSummary",
+		"runWithCoverage",
+		"iterateCounterChanges",
+		"emitWithProgress",
+		"drainCounters",
+		"lazyMetaDecoder",
+		"metaRaw",
+		"writeJSON",
+		"hashChain",
+		"uniformCoveragePackages",
+		"coverageProfile",
+		"testCoverageReporter",
+		"printCoverageReport",
+		"emitWithTimeout",
+		"gzipFile",
+		"snapshotPool",
+		"decayTracker",
+		"counterDataStats",
+		"coverageBarrier",
+		"lineProfiler",
+		"coverageAssertions",
+		"counterProfileToSVG",
+		"eventBus",
+		"deltaStream",
+		"pinnedResult",
+		"clearUnsafe",
+		"coverageEnabled",
+		"coveredFunctions",
+		"packageStats",
+		"jsonWrapper",
+		"lcovData",
+		"mergeCounters",
+		"deltaCounts",
+		"queryBlockHits",
+		"counterFileNamer",
+		"streamWriter",
+		"periodicFlusher",
+		"textProfile",
+		"counterSnapshotMap",
+		"concurrentMerge",
+		"atomicEmitToDir",
+		"granularity",
+		"uncoveredFuncs",
+		"finalHashCallback",
+		"progressWriter",
+		"validateFiles",
+		"appendToFile",
+		"packageList",
+		"contextEmitAll",
+		"recorder",
+		"queryLineHits",
+		"maxCounterFileSize",
+		"counterDataSet",
+		"parseMetaDataFile",
+		"emitHooks",
+		"compressedEmit",
+		"binaryDiff",
+		"testScopedRecorder",
+		"clearFunction",
+		"crossAggregator",
+		"functionCoveragePercent",
+		"coverageOverhead",
+		"watchCounterFile",
+		"filteredEmit",
+		"pkgCoverageMap",
+		"assertMinCoverage",
+		"dumpCounters",
+		"resetAndSnapshot",
+		"annotateSource",
+		"lowCoverageDisabled",
+		"sonarQubeXML",
+		"counterFileRetention",
+		"fuzzFeedback",
+		"buildInfo",
+		"debugHTTP",
+		"emitOnSignal",
+	} {
+		tp := tp
+		t.Run(tp, func(t *testing.T) {
+			t.Parallel()
+			testHarnessTestpoint(t, harnessPath, dir, tp)
+		})
+	}
 
 }
 
@@ -261,6 +386,255 @@ func testEmitToWriter(t *testing.T, harnessPath string, dir string) {
 	})
 }
 
+func testCoveragePlugin(t *testing.T, harnessPath string, dir string) {
+	withAndWithoutRunner(func(setGoCoverDir bool, tag string) {
+		tp := "coveragePlugin"
+		rdir, edir := mktestdirs(t, tag, tp, dir)
+		output, err := runHarness(t, harnessPath, tp, setGoCoverDir, rdir, edir)
+		if err != nil {
+			t.Logf("%s", output)
+			t.Fatalf("running 'harness -tp %s': %v", tp, err)
+		}
+		// The files written after the plugin is unregistered should
+		// be readable as usual.
+		want := []string{"main", tp}
+		if msg := testForSpecificFunctions(t, edir, want, nil); msg != "" {
+			t.Errorf("coverage data from %q output match failed: %s", tp, msg)
+		}
+		upmergeCoverData(t, edir)
+		upmergeCoverData(t, rdir)
+	})
+}
+
+func testEmitter(t *testing.T, harnessPath string, dir string) {
+	withAndWithoutRunner(func(setGoCoverDir bool, tag string) {
+		tp := "emitter"
+		rdir, edir := mktestdirs(t, tag, tp, dir)
+		output, err := runHarness(t, harnessPath, tp, setGoCoverDir, rdir, edir)
+		if err != nil {
+			t.Logf("%s", output)
+			t.Fatalf("running 'harness -tp %s': %v", tp, err)
+		}
+		want := []string{"main", tp}
+		avoid := []string{"final"}
+		if msg := testForSpecificFunctions(t, edir, want, avoid); msg != "" {
+			t.Errorf("coverage data from %q output match failed: %s", tp, msg)
+		}
+		upmergeCoverData(t, edir)
+		upmergeCoverData(t, rdir)
+	})
+}
+
+func testEmitSnapshotToDir(t *testing.T, harnessPath string, dir string) {
+	withAndWithoutRunner(func(setGoCoverDir bool, tag string) {
+		tp := "emitSnapshotToDir"
+		rdir, edir := mktestdirs(t, tag, tp, dir)
+		output, err := runHarness(t, harnessPath, tp, setGoCoverDir, rdir, edir)
+		if err != nil {
+			t.Logf("%s", output)
+			t.Fatalf("running 'harness -tp %s': %v", tp, err)
+		}
+		// Functions executed after the snapshot was taken should
+		// not appear in the emitted data.
+		want := []string{"main", tp}
+		avoid := []string{"postSnapshot", "final"}
+		if msg := testForSpecificFunctions(t, edir, want, avoid); msg != "" {
+			t.Errorf("coverage data from %q output match failed: %s", tp, msg)
+		}
+		upmergeCoverData(t, edir)
+		upmergeCoverData(t, rdir)
+	})
+}
+
+func testCombinedData(t *testing.T, harnessPath string, dir string) {
+	withAndWithoutRunner(func(setGoCoverDir bool, tag string) {
+		tp := "combinedData"
+		rdir, edir := mktestdirs(t, tag, tp, dir)
+		output, err := runHarness(t, harnessPath, tp, setGoCoverDir, rdir, edir)
+		if err != nil {
+			t.Logf("%s", output)
+			t.Fatalf("running 'harness -tp %s': %v", tp, err)
+		}
+		// The split stream was captured before postCombined ran;
+		// the directly emitted data was captured after.
+		want := []string{"main", tp}
+		avoid := []string{"postCombined"}
+		if msg := testForSpecificFunctions(t, filepath.Join(edir, "split"), want, avoid); msg != "" {
+			t.Errorf("coverage data from split stream match failed: %s", msg)
+		}
+		want = append(want, "postCombined")
+		if msg := testForSpecificFunctions(t, filepath.Join(edir, "direct"), want, nil); msg != "" {
+			t.Errorf("coverage data from EmitCombinedDataToDir match failed: %s", msg)
+		}
+		upmergeCoverData(t, rdir)
+	})
+}
+
+func testFlushHook(t *testing.T, harnessPath string, dir string) {
+	withAndWithoutRunner(func(setGoCoverDir bool, tag string) {
+		tp := "flushHook"
+		rdir, edir := mktestdirs(t, tag, tp, dir)
+		output, err := runHarness(t, harnessPath, tp, setGoCoverDir, rdir, edir)
+		if err != nil {
+			t.Logf("%s", output)
+			t.Fatalf("running 'harness -tp %s': %v", tp, err)
+		}
+		// The hooks run at exit, in registration order, and
+		// a panic in one hook doesn't prevent the others from
+		// running.
+		want := []string{
+			"flush hook 1 ran",
+			"coverage flush hook 1 panicked: flush hook 2 failed",
+			"flush hook 3 ran, RegisterFlushHook returns coverage data flush already started",
+		}
+		pos := 0
+		for _, w := range want {
+			i := strings.Index(output[pos:], w)
+			if i < 0 {
+				t.Fatalf("harness output does not contain %q after offset %d: %s", w, pos, output)
+			}
+			pos += i + len(w)
+		}
+		// The counter data must still have been written.
+		if setGoCoverDir {
+			if msg := testForSpecificFunctions(t, rdir, []string{tp}, nil); msg != "" {
+				t.Errorf("coverage data from %q output match failed: %s", tp, msg)
+			}
+		}
+		upmergeCoverData(t, rdir)
+	})
+}
+
+func testLowCoverageExit(t *testing.T, harnessPath string, dir string) {
+	withAndWithoutRunner(func(setGoCoverDir bool, tag string) {
+		tp := "lowCoverageExit"
+		rdir, edir := mktestdirs(t, tag, tp, dir)
+		output, err := runHarness(t, harnessPath, tp, setGoCoverDir, rdir, edir)
+		var ee *exec.ExitError
+		if !errors.As(err, &ee) || ee.ExitCode() != 2 {
+			t.Logf("%s", output)
+			t.Fatalf("running 'harness -tp %s': got %v, want exit status 2", tp, err)
+		}
+		if !strings.Contains(output, "minimum 100.0%") {
+			t.Fatalf("harness output does not report the threshold: %s", output)
+		}
+		if n := strings.Count(output, "\nuncovered: pkg="); n == 0 || n > 5 {
+			t.Fatalf("harness output lists %d uncovered packages, want 1 to 5: %s", n, output)
+		}
+		// The counter data must have been written before the
+		// check.
+		if setGoCoverDir {
+			if msg := testForSpecificFunctions(t, rdir, []string{tp}, nil); msg != "" {
+				t.Errorf("coverage data from %q output match failed: %s", tp, msg)
+			}
+		}
+		upmergeCoverData(t, rdir)
+
+		// A run that is already failing keeps its exit status.
+		tp = "lowCoverageFailingRun"
+		rdir, edir = mktestdirs(t, tag, tp, dir)
+		output, err = runHarness(t, harnessPath, tp, setGoCoverDir, rdir, edir)
+		if !errors.As(err, &ee) || ee.ExitCode() != 3 {
+			t.Logf("%s", output)
+			t.Fatalf("running 'harness -tp %s': got %v, want exit status 3", tp, err)
+		}
+		upmergeCoverData(t, rdir)
+	})
+}
+
+func testOutputDir(t *testing.T, harnessPath string, dir string) {
+	withAndWithoutRunner(func(setGoCoverDir bool, tag string) {
+		tp := "outputDir"
+		rdir, edir := mktestdirs(t, tag, tp, dir)
+		output, err := runHarness(t, harnessPath, tp, setGoCoverDir, rdir, edir)
+		if err != nil {
+			t.Logf("%s", output)
+			t.Fatalf("running 'harness -tp %s': %v", tp, err)
+		}
+		// The exit-time data goes to the directory set by the
+		// harness, whether or not GOCOVERDIR is set, and includes
+		// a meta-data file.
+		xdir := filepath.Join(edir, "exit")
+		if msg := testForSpecificFunctions(t, xdir, []string{tp}, nil); msg != "" {
+			t.Errorf("coverage data from %q output match failed: %s", tp, msg)
+		}
+		upmergeCoverData(t, xdir)
+	})
+}
+
+func testMergeDirs(t *testing.T, harnessPath string, dir string) {
+	withAndWithoutRunner(func(setGoCoverDir bool, tag string) {
+		tp := "mergeDirs"
+		rdir, edir := mktestdirs(t, tag, tp, dir)
+		output, err := runHarness(t, harnessPath, tp, setGoCoverDir, rdir, edir)
+		if err != nil {
+			t.Logf("%s", output)
+			t.Fatalf("running 'harness -tp %s': %v", tp, err)
+		}
+		if !strings.Contains(output, "warning: skipping coverage data") {
+			t.Errorf("harness output does not contain expected warning: %s", output)
+		}
+
+		// The merge output should consist of a single meta-data file
+		// and a single counter data file.
+		dents, err := os.ReadDir(edir)
+		if err != nil {
+			t.Fatalf("os.ReadDir(%s) failed: %v", edir, err)
+		}
+		mfc, cdc := 0, 0
+		for _, e := range dents {
+			if strings.HasPrefix(e.Name(), coverage.MetaFilePref) {
+				mfc++
+			} else if strings.HasPrefix(e.Name(), coverage.CounterFilePref) {
+				cdc++
+			}
+		}
+		if mfc != 1 || cdc != 1 {
+			t.Errorf("want 1 meta-data and 1 counter data file, got %d and %d", mfc, cdc)
+		}
+		want := []string{"main", tp}
+		avoid := []string{"final"}
+		if msg := testForSpecificFunctions(t, edir, want, avoid); msg != "" {
+			t.Errorf("coverage data from %q output match failed: %s", tp, msg)
+		}
+		upmergeCoverData(t, rdir)
+	})
+}
+
+func testEmitDeterministic(t *testing.T, dir string) {
+	// Counter values in library packages can vary from run to run,
+	// so use a harness in which only package main is instrumented.
+	bdir := mkdir(t, filepath.Join(dir, "build-deterministic"))
+	hargs := []string{"-cover", "-coverpkg=command-line-arguments"}
+	if testing.CoverMode() != "" {
+		hargs = append(hargs, "-covermode="+testing.CoverMode())
+	}
+	harnessPath := buildHarness(t, bdir, hargs)
+	withAndWithoutRunner(func(setGoCoverDir bool, tag string) {
+		tp := "emitDeterministic"
+		_, edir := mktestdirs(t, tag, tp, dir)
+		// Run the harness twice with identical arguments, each
+		// time from a different directory, and compare the output.
+		var outputs [][]byte
+		for i := 0; i < 2; i++ {
+			rdir := mkdir(t, filepath.Join(dir, fmt.Sprintf("%s-rdir%d-%s", tp, i, tag)))
+			output, err := runHarness(t, harnessPath, tp, setGoCoverDir, rdir, edir)
+			if err != nil {
+				t.Logf("%s", output)
+				t.Fatalf("running 'harness -tp %s': %v", tp, err)
+			}
+			b, err := os.ReadFile(filepath.Join(rdir, "deterministic.dat"))
+			if err != nil {
+				t.Fatalf("reading deterministic output: %v", err)
+			}
+			outputs = append(outputs, b)
+		}
+		if !bytes.Equal(outputs[0], outputs[1]) {
+			t.Errorf("EmitDeterministicCounterData output differs between identical runs")
+		}
+	})
+}
+
 func testEmitToNonexistentDir(t *testing.T, harnessPath string, dir string) {
 	withAndWithoutRunner(func(setGoCoverDir bool, tag string) {
 		tp := "emitToNonexistentDir"
@@ -377,6 +751,58 @@ func testEmitWithCounterClear(t *testing.T, harnessPath string, dir string) {
 			t.Errorf("coverage data from %q output match failed: %s", tp, msg)
 		}
 
+		// Now the same for ClearCountersAndEmitTo, which emits two
+		// checkpoints into subdirectories "a" and "b" of the output
+		// dir.
+		tp = "clearAndEmit"
+		rdir3, edir3 := mktestdirs(t, tag, tp+"1", dir)
+		output, err = runHarness(t, nonatomicHarnessPath, tp,
+			setGoCoverDir, rdir3, edir3)
+		if err == nil {
+			t.Logf("%s", output)
+			t.Fatalf("running '%s -tp %s': unexpected success",
+				nonatomicHarnessPath, tp)
+		}
+		rdir4, edir4 := mktestdirs(t, tag, tp+"2", dir)
+		output, err = runHarness(t, atomicHarnessPath, tp,
+			setGoCoverDir, rdir4, edir4)
+		if err != nil {
+			t.Logf("%s", output)
+			t.Fatalf("running 'harness -tp %s': %v", tp, err)
+		}
+		checkpoints := []struct {
+			sub         string
+			want, avoid []string
+		}{
+			{"a", []string{"clearTarget1"}, []string{"clearTarget2"}},
+			{"b", []string{"clearTarget2"}, []string{"clearTarget1"}},
+		}
+		for _, cp := range checkpoints {
+			if msg := testForSpecificFunctions(t, filepath.Join(edir4, cp.sub), cp.want, cp.avoid); msg != "" {
+				t.Logf("%s", output)
+				t.Errorf("coverage data from %q checkpoint %s match failed: %s", tp, cp.sub, msg)
+			}
+		}
+
+		// ClearPackageCoverageCounters also requires atomic mode;
+		// its checks are carried out within the harness.
+		tp = "clearPackage"
+		rdir5, edir5 := mktestdirs(t, tag, tp+"1", dir)
+		output, err = runHarness(t, nonatomicHarnessPath, tp,
+			setGoCoverDir, rdir5, edir5)
+		if err == nil {
+			t.Logf("%s", output)
+			t.Fatalf("running '%s -tp %s': unexpected success",
+				nonatomicHarnessPath, tp)
+		}
+		rdir6, edir6 := mktestdirs(t, tag, tp+"2", dir)
+		output, err = runHarness(t, atomicHarnessPath, tp,
+			setGoCoverDir, rdir6, edir6)
+		if err != nil {
+			t.Logf("%s", output)
+			t.Fatalf("running 'harness -tp %s': %v", tp, err)
+		}
+
 		if testing.CoverMode() == "atomic" {
 			upmergeCoverData(t, edir2)
 			upmergeCoverData(t, rdir2)
@@ -387,6 +813,21 @@ func testEmitWithCounterClear(t *testing.T, harnessPath string, dir string) {
 	})
 }
 
+// testHarnessTestpoint runs the harness testpoint 'tp' with and
+// without GOCOVERDIR set, failing if the harness reports an error.
+func testHarnessTestpoint(t *testing.T, harnessPath string, dir string, tp string) {
+	withAndWithoutRunner(func(setGoCoverDir bool, tag string) {
+		rdir, edir := mktestdirs(t, tag, tp, dir)
+		output, err := runHarness(t, harnessPath, tp, setGoCoverDir, rdir, edir)
+		if err != nil {
+			t.Logf("%s", output)
+			t.Fatalf("running 'harness -tp %s': %v", tp, err)
+		}
+		upmergeCoverData(t, edir)
+		upmergeCoverData(t, rdir)
+	})
+}
+
 func TestApisOnNocoverBinary(t *testing.T) {
 	testenv.MustHaveGoBuild(t)
 	dir := t.TempDir()
@@ -403,6 +844,15 @@ func TestApisOnNocoverBinary(t *testing.T) {
 	if !strings.Contains(output, want) {
 		t.Errorf("error output does not contain %q: %s", want, output)
 	}
+
+	output, err = runHarness(t, harnessPath, "coverageEnabled", false, edir, edir)
+	if err == nil {
+		t.Fatalf("expected error on TestApisOnNocoverBinary harness run")
+	}
+	const wantDisabled = "CoverageEnabled() = false"
+	if !strings.Contains(output, wantDisabled) {
+		t.Errorf("error output does not contain %q: %s", wantDisabled, output)
+	}
 }
 
 func TestIssue56006EmitDataRaceCoverRunningGoroutine(t *testing.T) {
@@ -433,3 +883,44 @@ func TestIssue56006EmitDataRaceCoverRunningGoroutine(t *testing.T) {
 		}
 	}
 }
+
+func TestConcurrentEmitDataRace(t *testing.T) {
+	// This test requires "go test -race -cover", meaning that we need
+	// go build, go run, and "-race" support.
+	testenv.MustHaveGoRun(t)
+	if !platform.RaceDetectorSupported(runtime.GOOS, runtime.GOARCH) ||
+		!testenv.HasCGO() {
+		t.Skip("skipped due to lack of race detector support / CGO")
+	}
+
+	// Run a test that writes meta-data and counter data from several
+	// goroutines at once, with the race detector enabled. Note that
+	// -race requires -covermode=atomic.
+	cmd := exec.Command(testenv.GoToolPath(t), "test", "-cover", "-race")
+	cmd.Dir = filepath.Join("testdata", "concurrentemit")
+	b, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Logf("%s\n", string(b))
+		t.Fatalf("go test -cover -race failed: %v", err)
+	}
+	if strings.Contains(string(b), "DATA RACE") {
+		t.Logf("%s\n", string(b))
+		t.Fatalf("found DATA RACE in test output, not permitted")
+	}
+}
+
+func TestConcurrentEmitNonAtomic(t *testing.T) {
+	testenv.MustHaveGoRun(t)
+
+	// The race detector requires -covermode=atomic, so run the
+	// concurrent emit test without it in the other counter modes.
+	for _, mode := range []string{"set", "count"} {
+		cmd := exec.Command(testenv.GoToolPath(t), "test", "-cover", "-covermode="+mode)
+		cmd.Dir = filepath.Join("testdata", "concurrentemit")
+		b, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Logf("%s\n", string(b))
+			t.Fatalf("go test -cover -covermode=%s failed: %v", mode, err)
+		}
+	}
+}
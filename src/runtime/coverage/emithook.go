@@ -0,0 +1,80 @@
+// Copyright 2022 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package coverage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Hook is the interface implemented by custom destinations for
+// coverage data, for example a service to which the data is uploaded
+// (see package runtime/coverage/httphook). Each method receives the
+// complete encoded data (as would otherwise be written to a meta-data
+// or counter data file), after processing by any plugins registered
+// with RegisterCoveragePlugin. The reader is backed by an in-memory
+// buffer and also implements io.Seeker, so a hook can seek back to
+// the start to retry a failed transfer.
+type Hook interface {
+	EmitMeta(meta io.Reader) error
+	EmitCounters(counters io.Reader) error
+}
+
+var (
+	emitHooksMu sync.Mutex
+	emitHooks   []Hook
+)
+
+// RegisterEmitHook installs the hook 'h'. While any hooks are
+// installed, EmitMetaDataToDir and EmitCounterDataToDir pass their
+// output to the hooks, in registration order, after writing it to
+// the directory given to them. Data written at program exit to
+// GOCOVERDIR is not affected; use RegisterFlushHook to call
+// EmitCounterDataToDir at exit if the hooks should receive that data
+// too.
+func RegisterEmitHook(h Hook) error {
+	if h == nil {
+		return fmt.Errorf("error: nil hook in RegisterEmitHook")
+	}
+	emitHooksMu.Lock()
+	defer emitHooksMu.Unlock()
+	emitHooks = append(emitHooks, h)
+	return nil
+}
+
+// getEmitHooks returns the hooks installed with RegisterEmitHook.
+func getEmitHooks() []Hook {
+	emitHooksMu.Lock()
+	defer emitHooksMu.Unlock()
+	return emitHooks
+}
+
+// emitToHooks invokes 'write' to produce coverage data of the kind
+// selected by 'which' into a buffer, then passes the data to each of
+// 'hooks' in turn. Every hook is called even if an earlier one fails;
+// the errors are joined.
+func emitToHooks(hooks []Hook, which fileType, write func(w io.Writer) error) error {
+	var buf bytes.Buffer
+	if err := write(&buf); err != nil {
+		return err
+	}
+	var errs []error
+	for i, h := range hooks {
+		r := bytes.NewReader(buf.Bytes())
+		var err error
+		if which == metaDataFile {
+			err = h.EmitMeta(r)
+		} else {
+			err = h.EmitCounters(r)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("emit hook %d: %v", i, err))
+		}
+	}
+	return errors.Join(errs...)
+}
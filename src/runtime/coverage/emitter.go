@@ -0,0 +1,293 @@
+// Copyright 2022 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package coverage
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"internal/coverage/encodecounter"
+	"io"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Emitter is the interface implemented by types that write coverage
+// data for the currently running program. It allows code that emits
+// coverage data to be decoupled from the concrete mechanism used.
+type Emitter interface {
+	// EmitCounterData writes counter data content to 'w', as
+	// EmitCounterDataToWriterContext.
+	EmitCounterData(ctx context.Context, w io.Writer) error
+	// EmitMetaData writes meta-data content to 'w', as
+	// EmitMetaDataToWriter, stopping if 'ctx' is canceled.
+	EmitMetaData(ctx context.Context, w io.Writer) error
+}
+
+// EmitCounterDataToWriterContext is like EmitCounterDataToWriter, but
+// stops and returns the context's error if 'ctx' is canceled before
+// the counter data has been encoded. Cancellation is checked before
+// encoding starts and at each package boundary. The data is encoded
+// into memory and written to 'w' only once encoding is complete, so
+// on cancellation nothing at all is written to 'w'; once writing to
+// 'w' has started, it is not interrupted.
+func EmitCounterDataToWriterContext(ctx context.Context, w io.Writer) error {
+	if w == nil {
+		return fmt.Errorf("error: nil writer in EmitCounterDataToWriterContext")
+	}
+	b, err := encodeCounterDataContext(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+// EmitCounterDataToDirContext is like EmitCounterDataToDir, but stops
+// and returns the context's error if 'ctx' is canceled before the
+// counter data has been encoded (see EmitCounterDataToWriterContext).
+// The file is written via a temporary file that is renamed into
+// place, so on cancellation or error no counter data file is left in
+// 'dir'.
+func EmitCounterDataToDirContext(ctx context.Context, dir string) error {
+	if err := checkOutputDir(dir); err != nil {
+		return err
+	}
+	b, err := encodeCounterDataContext(ctx)
+	if err != nil {
+		return err
+	}
+	fn, err := counterFileName(finalHash)
+	if err != nil {
+		return err
+	}
+	err = writeFileAtomically(filepath.Join(dir, fn), func(w io.Writer) error {
+		_, err := w.Write(b)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	applyRetentionPolicy(dir, finalHash)
+	return nil
+}
+
+// encodeCounterDataContext returns the encoded counter data for the
+// running program, with packages in index order, or the error of
+// 'ctx' if it is done before encoding starts or at a package boundary.
+func encodeCounterDataContext(ctx context.Context) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	snap, err := ReadCounterSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	var b bytes.Buffer
+	err = writeCounterData(&b, snap, nil, func(snap *CounterSnapshot) encodecounter.CounterVisitor {
+		return newDeadlineVisitor(ctx, snap)
+	})
+	if cerr := ctx.Err(); cerr != nil {
+		return nil, cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// ctxWriter is an io.Writer that fails once its context is canceled.
+type ctxWriter struct {
+	ctx context.Context
+	w   io.Writer
+}
+
+func (cw ctxWriter) Write(p []byte) (int, error) {
+	if err := cw.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cw.w.Write(p)
+}
+
+// EmitCounterDataToWriterWithTimeout is like EmitCounterDataToWriter,
+// but gives up and returns context.DeadlineExceeded if the write has
+// not completed within 'timeout'. The counter data written will be a
+// snapshot taken at the point of the call. The deadline is checked
+// before anything is written and then after each package's counter
+// records have been encoded (not after each byte), so a single slow
+// write to 'w' is not interrupted. On timeout, the data already
+// written to 'w' is incomplete and should be discarded by the caller.
+func EmitCounterDataToWriterWithTimeout(w io.Writer, timeout time.Duration) error {
+	if w == nil {
+		return fmt.Errorf("error: nil writer in EmitCounterDataToWriterWithTimeout")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	snap, err := ReadCounterSnapshot()
+	if err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	err = writeCounterData(w, snap, nil, func(snap *CounterSnapshot) encodecounter.CounterVisitor {
+		return newDeadlineVisitor(ctx, snap)
+	})
+	if err != nil {
+		if cerr := ctx.Err(); cerr != nil {
+			return cerr
+		}
+		return err
+	}
+	return nil
+}
+
+// EmitMetaDataToWriterWithTimeout is like EmitMetaDataToWriter, but
+// gives up and returns context.DeadlineExceeded if the write has not
+// completed within 'timeout'. The deadline is checked before each
+// write to 'w'; since meta-data is buffered before being written,
+// this happens once per buffer-full rather than per package. On
+// timeout, the data already written to 'w' is incomplete and should
+// be discarded by the caller.
+func EmitMetaDataToWriterWithTimeout(w io.Writer, timeout time.Duration) error {
+	if w == nil {
+		return fmt.Errorf("error: nil writer in EmitMetaDataToWriterWithTimeout")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := EmitMetaDataToWriter(ctxWriter{ctx: ctx, w: w}); err != nil {
+		if cerr := ctx.Err(); cerr != nil {
+			return cerr
+		}
+		return err
+	}
+	return nil
+}
+
+// deadlineVisitor is a counter visitor that stops with the context's
+// error if 'ctx' is done when it moves on from one package to the
+// next.
+type deadlineVisitor struct {
+	snapshotVisitor
+	ctx    context.Context
+	curPkg uint32
+}
+
+// newDeadlineVisitor returns a deadlineVisitor for the functions in
+// 'snap', laid out in package order so that 'ctx' can be checked at
+// package boundaries.
+func newDeadlineVisitor(ctx context.Context, snap *CounterSnapshot) *deadlineVisitor {
+	sorted := newSnapshotFromFuncs(snap.metaHash, snap.args, snap.counterMap())
+	return &deadlineVisitor{snapshotVisitor: snapshotVisitor{sorted}, ctx: ctx}
+}
+
+func (v *deadlineVisitor) VisitFuncs(f encodecounter.CounterVisitorFn) error {
+	return v.s.visitFuncs(func(pkgId, funcId uint32, counters []uint32) error {
+		if pkgId != v.curPkg {
+			if err := v.ctx.Err(); err != nil {
+				return err
+			}
+			v.curPkg = pkgId
+		}
+		return f(pkgId, funcId, counters)
+	})
+}
+
+// NewEmitter returns the default Emitter, which writes coverage data
+// for the running program to the writers it is given.
+func NewEmitter() Emitter {
+	return defaultEmitter{}
+}
+
+type defaultEmitter struct{}
+
+func (defaultEmitter) EmitCounterData(ctx context.Context, w io.Writer) error {
+	return EmitCounterDataToWriterContext(ctx, w)
+}
+
+func (defaultEmitter) EmitMetaData(ctx context.Context, w io.Writer) error {
+	if w == nil {
+		return fmt.Errorf("error: nil writer in EmitMetaData")
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return EmitMetaDataToWriter(ctxWriter{ctx: ctx, w: w})
+}
+
+// NewDryRunEmitter returns an Emitter that encodes coverage data as
+// the default Emitter does, but discards the result instead of
+// writing it to the writer it is given (which may be nil). It is
+// useful for measuring the cost of encoding coverage data without
+// the cost of I/O.
+func NewDryRunEmitter() Emitter {
+	return dryRunEmitter{}
+}
+
+type dryRunEmitter struct{}
+
+func (dryRunEmitter) EmitCounterData(ctx context.Context, w io.Writer) error {
+	return defaultEmitter{}.EmitCounterData(ctx, io.Discard)
+}
+
+func (dryRunEmitter) EmitMetaData(ctx context.Context, w io.Writer) error {
+	return defaultEmitter{}.EmitMetaData(ctx, io.Discard)
+}
+
+// EmittedRecord describes a single successful emission made by an
+// Emitter returned by NewRecordingEmitter.
+type EmittedRecord struct {
+	Kind string // "meta-data" or "counter-data"
+	Data []byte // the content written
+}
+
+// NewRecordingEmitter returns an Emitter that behaves like the
+// default Emitter but also records each successful emission, along
+// with a function that returns a copy of the records made so far.
+// The returned Emitter is safe for concurrent use.
+func NewRecordingEmitter() (Emitter, func() []EmittedRecord) {
+	re := &recordingEmitter{}
+	return re, re.records
+}
+
+type recordingEmitter struct {
+	mu   sync.Mutex
+	recs []EmittedRecord
+}
+
+func (re *recordingEmitter) EmitCounterData(ctx context.Context, w io.Writer) error {
+	return re.record(ctx, w, "counter-data", defaultEmitter{}.EmitCounterData)
+}
+
+func (re *recordingEmitter) EmitMetaData(ctx context.Context, w io.Writer) error {
+	return re.record(ctx, w, "meta-data", defaultEmitter{}.EmitMetaData)
+}
+
+func (re *recordingEmitter) record(ctx context.Context, w io.Writer, kind string, emit func(context.Context, io.Writer) error) error {
+	if w == nil {
+		return fmt.Errorf("error: nil writer in recording emitter")
+	}
+	var b bytes.Buffer
+	if err := emit(ctx, &b); err != nil {
+		return err
+	}
+	if _, err := w.Write(b.Bytes()); err != nil {
+		return err
+	}
+	re.mu.Lock()
+	defer re.mu.Unlock()
+	re.recs = append(re.recs, EmittedRecord{Kind: kind, Data: b.Bytes()})
+	return nil
+}
+
+func (re *recordingEmitter) records() []EmittedRecord {
+	re.mu.Lock()
+	defer re.mu.Unlock()
+	return append([]EmittedRecord(nil), re.recs...)
+}
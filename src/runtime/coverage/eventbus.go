@@ -0,0 +1,126 @@
+// Copyright 2022 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package coverage
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// CoverageEventKind identifies the kind of a CoverageEvent.
+type CoverageEventKind int
+
+const (
+	// CoverageChangedEvent is published by CoverageEventBus.StartPolling
+	// when the program's coverage counters have changed.
+	CoverageChangedEvent CoverageEventKind = iota + 1
+)
+
+// CoverageEvent is a notification delivered by a CoverageEventBus.
+type CoverageEvent struct {
+	Kind  CoverageEventKind
+	Time  time.Time      // time at which the event was generated
+	Stats *CoverageStats // coverage statistics, if any
+}
+
+// CoverageEventBus delivers coverage events to a set of subscribers.
+// Delivery never blocks: an event is dropped for any subscriber whose
+// channel is full. A CoverageEventBus is safe for concurrent use.
+type CoverageEventBus struct {
+	mu      sync.Mutex
+	subs    map[int]chan<- CoverageEvent
+	nextID  int
+	dropped atomic.Int64
+}
+
+// NewCoverageEventBus returns a CoverageEventBus with no subscribers.
+func NewCoverageEventBus() *CoverageEventBus {
+	return &CoverageEventBus{subs: make(map[int]chan<- CoverageEvent)}
+}
+
+// Subscribe registers 'ch' to receive the events published on the
+// bus, returning a function that cancels the subscription. The bus
+// never closes 'ch'.
+func (b *CoverageEventBus) Subscribe(ch chan<- CoverageEvent) func() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	id := b.nextID
+	b.nextID++
+	b.subs[id] = ch
+	return func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		delete(b.subs, id)
+	}
+}
+
+// Publish delivers 'event' to each subscriber whose channel has room
+// for it, counting a dropped event for each subscriber whose channel
+// does not.
+func (b *CoverageEventBus) Publish(event CoverageEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, ch := range b.subs {
+		select {
+		case ch <- event:
+		default:
+			b.dropped.Add(1)
+		}
+	}
+}
+
+// DroppedEvents returns the number of events that could not be
+// delivered because a subscriber's channel was full.
+func (b *CoverageEventBus) DroppedEvents() int64 {
+	return b.dropped.Load()
+}
+
+// StartPolling starts a goroutine that computes CoverageCounterChecksum
+// every 'interval' and, whenever the result differs from the previous
+// one, publishes a CoverageChangedEvent carrying the current coverage
+// statistics. It returns a function that stops the polling and waits
+// for the goroutine to exit. Polling stops by itself if coverage data
+// cannot be read (for example, if the program was not built with
+// "-cover").
+func (b *CoverageEventBus) StartPolling(interval time.Duration) func() {
+	done := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		prev, err := CoverageCounterChecksum()
+		if err != nil {
+			return
+		}
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			snap, err := ReadCounterSnapshot()
+			if err != nil {
+				return
+			}
+			sum := counterDigest(nil, snap)
+			if sum == prev {
+				continue
+			}
+			prev = sum
+			st, err := computeStats(metaPayloads(getCovMetaList()), cgran, snap.counterMap())
+			if err != nil {
+				return
+			}
+			b.Publish(CoverageEvent{Kind: CoverageChangedEvent, Time: time.Now(), Stats: st})
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(done) })
+		<-exited
+	}
+}
@@ -0,0 +1,25 @@
+// Copyright 2022 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package coverage_test
+
+import (
+	"log"
+	"runtime/coverage"
+)
+
+// This example logs the coverage configuration of a server when it
+// starts, so that unexpected coverage results can be traced back to
+// the way the binary was built.
+func ExampleBuildInfo() {
+	bi, err := coverage.BuildInfo()
+	if err != nil {
+		// Not built with -cover.
+		return
+	}
+	log.Printf("coverage: mode=%s granularity=%s go=%s packages=%d functions=%d blocks=%d meta-hash=%x",
+		bi.Mode, bi.Granularity, bi.GoVersion,
+		bi.NumInstrumentedPackages, bi.NumInstrumentedFunctions, bi.NumInstrumentedBlocks,
+		bi.FinalMetaHash)
+}
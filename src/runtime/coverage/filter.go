@@ -0,0 +1,63 @@
+// Copyright 2022 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package coverage
+
+import (
+	"fmt"
+	"internal/coverage"
+	"internal/coverage/decodemeta"
+	"io"
+	"strings"
+)
+
+// EmitFilteredCounterData writes counter data for the currently
+// running program to 'w', as EmitCounterDataToWriter, but including
+// only the functions for which 'filter' returns true. 'filter' is
+// called once for each instrumented function, with the function's
+// package path and its name as recorded in the meta-data (see
+// GetAllFunctions). The output is an ordinary counter data file for
+// the program's meta-data, which "go tool covdata" reads as if the
+// excluded functions had not executed. An error is returned if the
+// program was not built with "-cover".
+func EmitFilteredCounterData(w io.Writer, filter func(pkgPath, funcName string) bool) error {
+	if w == nil {
+		return fmt.Errorf("error: nil writer in EmitFilteredCounterData")
+	}
+	if filter == nil {
+		return fmt.Errorf("error: nil filter in EmitFilteredCounterData")
+	}
+	snap, err := ReadCounterSnapshot()
+	if err != nil {
+		return err
+	}
+	cm := snap.counterMap()
+	funcs := make(map[pkfunc][]uint32)
+	err = visitMetaFuncs(metaPayloads(getCovMetaList()), func(pkIdx, fnIdx uint32, pd *decodemeta.CoverageMetaDataDecoder, fd *coverage.FuncDesc) error {
+		if !filter(pd.PackagePath(), fd.Funcname) {
+			return nil
+		}
+		key := pkfunc{pk: pkIdx, fcn: fnIdx}
+		if c, ok := cm[key]; ok {
+			funcs[key] = c
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return newSnapshotFromFuncs(snap.metaHash, snap.args, funcs).write(w)
+}
+
+// PkgPrefixFilter returns a filter for EmitFilteredCounterData that
+// selects the functions in packages whose import path begins with
+// 'prefix'. The match is a plain string prefix match, so the prefix
+// "example.com/svc" selects "example.com/svcutil" as well as
+// "example.com/svc/api"; end the prefix with a slash to select only
+// the packages below a directory.
+func PkgPrefixFilter(prefix string) func(pkgPath, funcName string) bool {
+	return func(pkgPath, funcName string) bool {
+		return strings.HasPrefix(pkgPath, prefix)
+	}
+}
@@ -0,0 +1,71 @@
+// Copyright 2022 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package coverage
+
+import (
+	"fmt"
+	"sync"
+)
+
+var (
+	// finalHashCbMu protects finalHashCb and finalHashNotified.
+	finalHashCbMu sync.Mutex
+	// Callback registered with SetFinalHashCallback.
+	finalHashCb func([16]byte)
+	// Set once the final meta-data hash has been passed to
+	// notifyFinalHash.
+	finalHashNotified bool
+)
+
+// SetFinalHashCallback registers 'fn' to be called with the meta-data
+// hash of the currently running program (the value that identifies
+// its coverage instrumentation, and that appears in the names of its
+// coverage data files) once the hash has been computed. For a regular
+// program the hash is computed during initialization of package main;
+// a callback registered from the init function of another package is
+// called synchronously at that point. If the hash has already been
+// computed, 'fn' is called immediately, on the calling goroutine.
+// Since 'fn' may run while the meta-data is being finalized, it
+// should not call other functions in this package.
+// Only one callback may be registered: an error is returned if one
+// already has been, if 'fn' is nil, or if the program was not built
+// with "-cover".
+func SetFinalHashCallback(fn func([16]byte)) error {
+	if fn == nil {
+		return fmt.Errorf("error: nil callback in SetFinalHashCallback")
+	}
+	if len(getCovCounterList()) == 0 {
+		return fmt.Errorf("program not built with -cover")
+	}
+	finalHashCbMu.Lock()
+	if finalHashCb != nil {
+		finalHashCbMu.Unlock()
+		return fmt.Errorf("final hash callback already registered")
+	}
+	finalHashCb = fn
+	notified := finalHashNotified
+	finalHashCbMu.Unlock()
+	if notified {
+		fn(finalHash)
+	}
+	return nil
+}
+
+// notifyFinalHash passes the final meta-data hash 'h' to the callback
+// registered with SetFinalHashCallback, if any. Only the first call
+// has any effect.
+func notifyFinalHash(h [16]byte) {
+	finalHashCbMu.Lock()
+	if finalHashNotified {
+		finalHashCbMu.Unlock()
+		return
+	}
+	finalHashNotified = true
+	fn := finalHashCb
+	finalHashCbMu.Unlock()
+	if fn != nil {
+		fn(h)
+	}
+}
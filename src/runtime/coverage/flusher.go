@@ -0,0 +1,126 @@
+// Copyright 2022 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package coverage
+
+import (
+	"fmt"
+	"internal/coverage"
+	"os"
+	"sync"
+	"time"
+)
+
+// PeriodicFlusher writes counter data files for the running program
+// to a directory at a fixed interval, so that a long-running process
+// that crashes or is killed loses at most one interval's worth of
+// coverage data. Use NewPeriodicFlusher to create and start one, and
+// Stop to stop it.
+//
+// Each file written by a flusher has a distinct name: the final field
+// of the default naming scheme is replaced by the time at which the
+// flusher was started followed by a six-digit sequence number, so the
+// files are still recognized by "go tool covdata" and sort in the
+// order in which they were written.
+//
+// The ResetAfterFlush and ErrorHandler fields must be set before the
+// first interval elapses, and not changed afterwards.
+type PeriodicFlusher struct {
+	// ResetAfterFlush causes the coverage counters to be cleared
+	// (see ClearCoverageCounters) after each periodic write, so
+	// that each file holds only the counts accumulated during one
+	// interval. This requires "-covermode=atomic". Counter updates
+	// made between a write and the reset that follows it are lost;
+	// use ClearCountersAndEmitTo where exact checkpoints are needed.
+	ResetAfterFlush bool
+
+	// ErrorHandler, if non-nil, is called with any error that
+	// occurs during a periodic write or reset. Errors are otherwise
+	// ignored; the flusher keeps running.
+	ErrorHandler func(error)
+
+	dir     string
+	ticker  *time.Ticker
+	start   int64 // time the flusher was started, in ns since the epoch
+	seq     int
+	done    chan struct{}
+	exited  chan struct{}
+	stopped sync.Once
+}
+
+// NewPeriodicFlusher starts a PeriodicFlusher that writes a counter
+// data file to the directory 'dir' every 'interval', and returns it.
+// A meta-data file is written to 'dir' immediately, if one is not
+// already present, so that the counter data files can be read on
+// their own. An error is returned if the program was not built with
+// "-cover", if 'dir' is not a writable directory, or if 'interval'
+// is not positive.
+func NewPeriodicFlusher(dir string, interval time.Duration) (*PeriodicFlusher, error) {
+	if interval <= 0 {
+		return nil, fmt.Errorf("non-positive flush interval %v", interval)
+	}
+	if len(getCovCounterList()) == 0 {
+		return nil, fmt.Errorf("program not built with -cover")
+	}
+	if err := checkOutputDir(dir); err != nil {
+		return nil, err
+	}
+	if err := ensureFinalHash(); err != nil {
+		return nil, err
+	}
+	if err := emitMetaDataToDirectory(dir, getCovMetaList()); err != nil {
+		return nil, err
+	}
+	f := &PeriodicFlusher{
+		dir:    dir,
+		ticker: time.NewTicker(interval),
+		start:  time.Now().UnixNano(),
+		done:   make(chan struct{}),
+		exited: make(chan struct{}),
+	}
+	go f.run()
+	return f, nil
+}
+
+// run writes counter data on each tick until the flusher is stopped.
+func (f *PeriodicFlusher) run() {
+	defer close(f.exited)
+	for {
+		select {
+		case <-f.done:
+			return
+		case <-f.ticker.C:
+		}
+		err := f.flush()
+		if err == nil && f.ResetAfterFlush {
+			err = ClearCoverageCounters()
+		}
+		if err != nil && f.ErrorHandler != nil {
+			f.ErrorHandler(err)
+		}
+	}
+}
+
+// flush writes a counter data file with the next name in the
+// flusher's sequence.
+func (f *PeriodicFlusher) flush() error {
+	f.seq++
+	name := fmt.Sprintf("%s.%x.%d.%d%06d", coverage.CounterFilePref, finalHash, os.Getpid(), f.start, f.seq)
+	return emitCounterDataToDirectoryAs(f.dir, name)
+}
+
+// Stop stops the flusher, waits for any write in progress to finish,
+// and then writes one final counter data file, returning any error
+// from that write. The counters are not reset after the final write.
+// Calls to Stop after the first return an error.
+func (f *PeriodicFlusher) Stop() error {
+	err := fmt.Errorf("PeriodicFlusher already stopped")
+	f.stopped.Do(func() {
+		f.ticker.Stop()
+		close(f.done)
+		<-f.exited
+		err = f.flush()
+	})
+	return err
+}
@@ -0,0 +1,94 @@
+// Copyright 2022 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package coverage
+
+import (
+	"fmt"
+	"internal/coverage"
+	"internal/coverage/decodemeta"
+	"internal/coverage/rtcov"
+	"sync"
+	"sync/atomic"
+)
+
+// FuncNotFoundError is the error returned by per-function APIs such
+// as ClearFunctionCoverageCounters for a function that is not among
+// the instrumented functions of the program.
+type FuncNotFoundError struct {
+	PkgPath  string
+	FuncName string
+}
+
+func (e *FuncNotFoundError) Error() string {
+	return fmt.Sprintf("function %s.%s is not instrumented", e.PkgPath, e.FuncName)
+}
+
+// funcName identifies an instrumented function by package path and
+// function name.
+type funcName struct {
+	pkg, fn string
+}
+
+var (
+	// funcIndexOnce guards the construction of funcIndex.
+	funcIndexOnce sync.Once
+	funcIndexErr  error
+	// Maps a funcName to the function's pkfunc.
+	funcIndex sync.Map
+	// Maps a pkfunc to the function's counters in the live counter
+	// arrays ([]atomic.Uint32), once the function has executed.
+	funcCounters sync.Map
+)
+
+// lookupFunc returns the package and function indices of the
+// function 'fnName' in the package 'pkgPath', decoding the meta-data
+// into funcIndex on the first call. A *FuncNotFoundError is returned
+// if there is no such instrumented function.
+func lookupFunc(pkgPath, fnName string) (pkfunc, error) {
+	funcIndexOnce.Do(func() {
+		funcIndexErr = visitMetaFuncs(metaPayloads(getCovMetaList()), func(pkIdx, fnIdx uint32, pd *decodemeta.CoverageMetaDataDecoder, fd *coverage.FuncDesc) error {
+			funcIndex.LoadOrStore(funcName{pd.PackagePath(), fd.Funcname}, pkfunc{pk: pkIdx, fcn: fnIdx})
+			return nil
+		})
+	})
+	if funcIndexErr != nil {
+		return pkfunc{}, funcIndexErr
+	}
+	v, ok := funcIndex.Load(funcName{pkgPath, fnName})
+	if !ok {
+		return pkfunc{}, &FuncNotFoundError{PkgPath: pkgPath, FuncName: fnName}
+	}
+	return v.(pkfunc), nil
+}
+
+// funcLiveCounters returns the live counters in 'cl' of the function
+// 'key', or nil if the function has not executed (and so has no
+// counters in 'cl' yet). Once found, the location of a function's
+// counters is remembered in funcCounters.
+func funcLiveCounters(cl []rtcov.CovCounterBlob, key pkfunc) []atomic.Uint32 {
+	if v, ok := funcCounters.Load(key); ok {
+		return v.([]atomic.Uint32)
+	}
+	pm := getCovPkgMap()
+	for _, c := range cl {
+		sd := counterSlab(c)
+		for i := 0; i < len(sd); i++ {
+			// Skip ahead until the next function prolog.
+			nCtrs := sd[i].Load()
+			if nCtrs == 0 {
+				continue
+			}
+			pkgId := sd[i+coverage.PkgIdOffset].Load()
+			funcId := sd[i+coverage.FuncIdOffset].Load()
+			if funcId == key.fcn && remapPkgID(pm, i, pkgId, funcId, nCtrs) == key.pk {
+				cst := i + coverage.FirstCtrOffset
+				v, _ := funcCounters.LoadOrStore(key, sd[cst:cst+int(nCtrs)])
+				return v.([]atomic.Uint32)
+			}
+			i += coverage.FirstCtrOffset + int(nCtrs) - 1
+		}
+	}
+	return nil
+}
@@ -0,0 +1,202 @@
+// Copyright 2022 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package coverage
+
+import (
+	"fmt"
+	"internal/coverage"
+	"internal/coverage/decodemeta"
+	"math"
+)
+
+// CoveredFunction describes an instrumented function together with
+// the execution count recorded for it. HitCount is the sum of the
+// function's counter values: in "set" mode this is the number of its
+// blocks that have executed, and in "count" and "atomic" modes the
+// total number of block executions.
+type CoveredFunction struct {
+	PackagePath  string
+	FunctionName string
+	StartLine    int
+	EndLine      int
+	HitCount     uint64
+}
+
+// GetCoveredFunctions returns the instrumented functions in the
+// currently running program that have executed at least once (that
+// is, whose HitCount is non-zero), in meta-data order (by package,
+// then by position of the function within the package). An error is
+// returned if the program was not built with "-cover".
+func GetCoveredFunctions() ([]CoveredFunction, error) {
+	return coveredFunctions(true)
+}
+
+// GetAllFunctions returns all instrumented functions in the currently
+// running program, whether or not they have executed, in the same
+// order as GetCoveredFunctions. An error is returned if the program
+// was not built with "-cover".
+func GetAllFunctions() ([]CoveredFunction, error) {
+	return coveredFunctions(false)
+}
+
+// coveredFunctions returns the functions in the running program,
+// omitting those that have not executed if 'liveOnly' is true.
+func coveredFunctions(liveOnly bool) ([]CoveredFunction, error) {
+	snap, err := ReadCounterSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	counters := snap.counterMap()
+	funcs := []CoveredFunction{}
+	err = visitMetaFuncs(metaPayloads(getCovMetaList()), func(pkIdx, fnIdx uint32, pd *decodemeta.CoverageMetaDataDecoder, fd *coverage.FuncDesc) error {
+		hits := sumCounters(counters[pkfunc{pk: pkIdx, fcn: fnIdx}])
+		if liveOnly && hits == 0 {
+			return nil
+		}
+		fm := newFuncMeta(fd)
+		funcs = append(funcs, CoveredFunction{
+			PackagePath:  pd.PackagePath(),
+			FunctionName: fm.Name,
+			StartLine:    fm.StartLine,
+			EndLine:      fm.EndLine,
+			HitCount:     hits,
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return funcs, nil
+}
+
+// CoverageCounterSnapshot returns the current counter values of every
+// instrumented function in the running program, keyed by package path
+// and function name joined with a dot (for example "main.main"), with
+// one value per coverable block in meta-data order. Functions that
+// have not executed have all-zero values; with per-function counter
+// granularity, each block has the function's count. Counters are read
+// with atomic loads, so CoverageCounterSnapshot may be called from
+// multiple goroutines, but the values are not captured at a single
+// instant: blocks executing concurrently with the call may or may not
+// be reflected. No files are read or written. An error is returned if
+// the program was not built with "-cover".
+func CoverageCounterSnapshot() (map[string][]uint64, error) {
+	snap, err := ReadCounterSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	counters := snap.counterMap()
+	m := make(map[string][]uint64)
+	err = visitMetaFuncs(metaPayloads(getCovMetaList()), func(pkIdx, fnIdx uint32, pd *decodemeta.CoverageMetaDataDecoder, fd *coverage.FuncDesc) error {
+		ctrs := counters[pkfunc{pk: pkIdx, fcn: fnIdx}]
+		vals := make([]uint64, len(fd.Units))
+		for i := range vals {
+			vals[i] = uint64(unitCount(cgran, ctrs, i))
+		}
+		m[pd.PackagePath()+"."+fd.Funcname] = vals
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// FunctionCoveragePercent returns the fraction, in the range [0, 1],
+// of the coverable blocks of the function 'funcName' in the package
+// 'pkgPath' that have executed. Function names are as recorded in the
+// coverage meta-data (and reported by GetAllFunctions). The result is
+// 0 for a function that has not executed; with per-function counter
+// granularity, a function has a single counter, so the result is
+// either 0 or 1. The meta-data is decoded on the first call and the
+// location of a function's counters is remembered once found, so the
+// call is cheap enough for use in test assertions. An error, along
+// with a NaN result, is returned if the program was not built with
+// "-cover", or (a *FuncNotFoundError) if there is no such
+// instrumented function.
+func FunctionCoveragePercent(pkgPath, funcName string) (float64, error) {
+	cl := getCovCounterList()
+	if len(cl) == 0 {
+		return math.NaN(), fmt.Errorf("program not built with -cover")
+	}
+	key, err := lookupFunc(pkgPath, funcName)
+	if err != nil {
+		return math.NaN(), err
+	}
+	ctrs := funcLiveCounters(cl, key)
+	if len(ctrs) == 0 {
+		return 0, nil
+	}
+	covered := 0
+	for i := range ctrs {
+		if ctrs[i].Load() != 0 {
+			covered++
+		}
+	}
+	return float64(covered) / float64(len(ctrs)), nil
+}
+
+// UncoveredFunction describes an instrumented function that has not
+// executed, or has executed fewer times than a given threshold.
+type UncoveredFunction struct {
+	PackagePath  string
+	FunctionName string
+	SourceFile   string
+	StartLine    int
+	EndLine      int
+}
+
+// GetUncoveredFunctions returns the instrumented functions in the
+// currently running program that have not executed (that is, whose
+// counter values are all zero), in meta-data order. If every function
+// has executed, the result is an empty, non-nil slice. An error is
+// returned if the program was not built with "-cover".
+func GetUncoveredFunctions() ([]UncoveredFunction, error) {
+	return uncoveredFunctions(func(ctrs []uint32) bool {
+		return sumCounters(ctrs) == 0
+	})
+}
+
+// GetUncoveredFunctionsThreshold is like GetUncoveredFunctions, but
+// returns the functions that have been invoked fewer than 'minHits'
+// times, as counted by the counter for the function's entry block.
+// Invocations are only counted in "count" and "atomic" modes; in
+// "set" mode a function that has executed counts as invoked once.
+// GetUncoveredFunctionsThreshold(1) returns the same functions as
+// GetUncoveredFunctions.
+func GetUncoveredFunctionsThreshold(minHits uint64) ([]UncoveredFunction, error) {
+	return uncoveredFunctions(func(ctrs []uint32) bool {
+		return uint64(unitCount(cgran, ctrs, 0)) < minHits
+	})
+}
+
+// uncoveredFunctions returns the functions in the running program for
+// whose counter values 'include' returns true.
+func uncoveredFunctions(include func(ctrs []uint32) bool) ([]UncoveredFunction, error) {
+	snap, err := ReadCounterSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	counters := snap.counterMap()
+	funcs := []UncoveredFunction{}
+	err = visitMetaFuncs(metaPayloads(getCovMetaList()), func(pkIdx, fnIdx uint32, pd *decodemeta.CoverageMetaDataDecoder, fd *coverage.FuncDesc) error {
+		if !include(counters[pkfunc{pk: pkIdx, fcn: fnIdx}]) {
+			return nil
+		}
+		fm := newFuncMeta(fd)
+		funcs = append(funcs, UncoveredFunction{
+			PackagePath:  pd.PackagePath(),
+			FunctionName: fm.Name,
+			SourceFile:   fm.SourceFile,
+			StartLine:    fm.StartLine,
+			EndLine:      fm.EndLine,
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return funcs, nil
+}
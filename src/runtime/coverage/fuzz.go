@@ -0,0 +1,141 @@
+// Copyright 2022 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package coverage
+
+import (
+	"encoding/binary"
+	"internal/coverage"
+	"reflect"
+	"unsafe"
+)
+
+// FuzzCoverageSnapshot returns a compact record of which coverage
+// counters in the currently running program are non-zero, for use as
+// feedback by a coverage-guided fuzzer. The result holds one byte,
+// 0 or 1, for each slot of the program's counter arrays. The position
+// of a counter in the result never changes while the program runs,
+// so snapshots taken at different times can be compared with
+// FuzzCoverageNew. Slots that are not counters (function prologs, and
+// the counters of functions that have not executed, whose positions
+// are not yet known) are always 0. The result is nil if the program
+// was not built with "-cover".
+//
+// FuzzCoverageSnapshot does not decode the meta-data, and allocates
+// only the result, so it is much cheaper than emitting counter data;
+// use it together with FuzzCoverageReset in a loop that resets the
+// counters, runs one input, and takes a snapshot.
+func FuzzCoverageSnapshot() []uint8 {
+	cl := getCovCounterList()
+	n := 0
+	for _, c := range cl {
+		n += int(c.Len)
+	}
+	if n == 0 {
+		return nil
+	}
+	v := make([]uint8, n)
+	off := 0
+	for _, c := range cl {
+		fuzzSnapshotSlab(fuzzCounterSlab(c.Counters, c.Len), v[off:off+int(c.Len)])
+		off += int(c.Len)
+	}
+	return v
+}
+
+// fuzzSnapshotSlab sets dst[i] to 1 for each non-zero counter sd[i]
+// in the counter array 'sd', leaving the other elements of 'dst'
+// (which must be zero) unchanged.
+func fuzzSnapshotSlab(sd []uint32, dst []uint8) {
+	for i := 0; i < len(sd); i++ {
+		// Skip ahead until the next function prolog.
+		nCtrs := int(sd[i])
+		if nCtrs == 0 {
+			continue
+		}
+		cst := i + coverage.FirstCtrOffset
+		if cst+nCtrs > len(sd) {
+			break
+		}
+		ctrs, out := sd[cst:cst+nCtrs], dst[cst:cst+nCtrs]
+		for j, c := range ctrs {
+			// The top bit of c|-c is set iff c is non-zero.
+			out[j] = uint8((c | -c) >> 31)
+		}
+		i = cst + nCtrs - 1
+	}
+}
+
+// FuzzCoverageReset zeroes the counter values (but not the function
+// prologs) in the currently running program, as
+// ClearCoverageCountersUnsafe does, but faster and without pinning the
+// goroutine: each function's counters are cleared with a single
+// memory clear. As with ClearCoverageCountersUnsafe, the caller must
+// ensure that no other goroutine is executing instrumented code while
+// it runs, or increments may survive the reset. It does nothing if the
+// program was not built with "-cover".
+func FuzzCoverageReset() {
+	for _, c := range getCovCounterList() {
+		sd := fuzzCounterSlab(c.Counters, c.Len)
+		for i := 0; i < len(sd); i++ {
+			nCtrs := int(sd[i])
+			if nCtrs == 0 {
+				continue
+			}
+			cst := i + coverage.FirstCtrOffset
+			if cst+nCtrs > len(sd) {
+				break
+			}
+			ctrs := sd[cst : cst+nCtrs]
+			// The compiler turns this loop into a call to
+			// runtime.memclrNoHeapPointers.
+			for j := range ctrs {
+				ctrs[j] = 0
+			}
+			i = cst + nCtrs - 1
+		}
+	}
+}
+
+// fuzzCounterSlab returns the counter array at 'p' of length 'n' as
+// a plain []uint32, for the unsynchronized accesses made by the fuzz
+// APIs.
+func fuzzCounterSlab(p *uint32, n uint64) []uint32 {
+	var sd []uint32
+	bufHdr := (*reflect.SliceHeader)(unsafe.Pointer(&sd))
+	bufHdr.Data = uintptr(unsafe.Pointer(p))
+	bufHdr.Len = int(n)
+	bufHdr.Cap = int(n)
+	return sd
+}
+
+// FuzzCoverageNew reports whether the snapshot 'b' (see
+// FuzzCoverageSnapshot) has a non-zero byte at a position where 'a'
+// has a zero byte, that is, whether 'b' records coverage not
+// recorded in 'a'. Bytes beyond the end of the shorter snapshot are
+// taken to be zero. The snapshots are compared eight bytes at a time.
+func FuzzCoverageNew(a, b []uint8) bool {
+	n := len(a)
+	if len(b) < n {
+		n = len(b)
+	}
+	i := 0
+	for ; i+8 <= n; i += 8 {
+		x, y := binary.LittleEndian.Uint64(a[i:]), binary.LittleEndian.Uint64(b[i:])
+		if (x^y)&y != 0 {
+			return true
+		}
+	}
+	for ; i < n; i++ {
+		if (a[i]^b[i])&b[i] != 0 {
+			return true
+		}
+	}
+	for _, y := range b[n:] {
+		if y != 0 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,170 @@
+// Copyright 2022 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package coverage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// CounterDataGZIPFile is a gzip-compressed file that is created
+// atomically: data is written to a temporary file alongside the final
+// path, which is renamed into place only when Commit is called. It is
+// intended for archiving coverage data, for example by passing the
+// result of Writer to EmitCounterDataToWriter.
+type CounterDataGZIPFile struct {
+	name string // final path
+	tmp  string // temporary path
+	f    *os.File
+	zw   *gzip.Writer
+	done bool
+}
+
+// NewCounterDataGZIPFile creates a temporary file in the directory of
+// 'filename' and returns a CounterDataGZIPFile that compresses data
+// written to it. A ".gz" extension is appended to 'filename' if it
+// does not already have one; the resulting path is where the file is
+// placed by Commit.
+func NewCounterDataGZIPFile(filename string) (*CounterDataGZIPFile, error) {
+	if !strings.HasSuffix(filename, ".gz") {
+		filename += ".gz"
+	}
+	dir, base := filepath.Split(filename)
+	tmp := filepath.Join(dir, fmt.Sprintf("tmp.%s%d", base, time.Now().UnixNano()))
+	f, err := os.Create(tmp)
+	if err != nil {
+		return nil, fmt.Errorf("creating gzip file %s: %v", tmp, err)
+	}
+	return &CounterDataGZIPFile{
+		name: filename,
+		tmp:  tmp,
+		f:    f,
+		zw:   gzip.NewWriter(f),
+	}, nil
+}
+
+// Name returns the path at which the file will be placed by Commit.
+func (g *CounterDataGZIPFile) Name() string {
+	return g.name
+}
+
+// Writer returns the writer through which uncompressed data should
+// be written.
+func (g *CounterDataGZIPFile) Writer() io.Writer {
+	return g.zw
+}
+
+// Commit flushes the compressed data, syncs the temporary file to
+// stable storage and renames it to its final path. The temporary file
+// is removed if any step fails.
+func (g *CounterDataGZIPFile) Commit() error {
+	if g.done {
+		return fmt.Errorf("gzip file %s already committed or aborted", g.name)
+	}
+	g.done = true
+	err := g.zw.Close()
+	if err == nil {
+		err = g.f.Sync()
+	}
+	if cerr := g.f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(g.tmp)
+		return fmt.Errorf("writing %s: %v", g.tmp, err)
+	}
+	if err := os.Rename(g.tmp, g.name); err != nil {
+		os.Remove(g.tmp)
+		return fmt.Errorf("writing %s: rename from %s failed: %v", g.name, g.tmp, err)
+	}
+	return nil
+}
+
+// Abort discards the data written so far and deletes the temporary
+// file, leaving nothing at the final path.
+func (g *CounterDataGZIPFile) Abort() error {
+	if g.done {
+		return fmt.Errorf("gzip file %s already committed or aborted", g.name)
+	}
+	g.done = true
+	g.f.Close()
+	return os.Remove(g.tmp)
+}
+
+// compressedCounterMagic is the prefix written by
+// EmitCompressedCounterDataToWriter ahead of the gzip stream, to
+// distinguish compressed counter data from the uncompressed format
+// (which starts with coverage.CovCounterMagic).
+var compressedCounterMagic = [4]byte{'\x00', '\x63', '\x77', '\x7a'}
+
+// EmitCompressedCounterDataToWriter writes counter data for the
+// currently running program to 'w' as EmitCounterDataToWriter does,
+// but compressed with gzip at compression level 'level' (for example
+// gzip.DefaultCompression, gzip.BestSpeed or gzip.BestCompression)
+// and preceded by a 4-byte magic string that marks it as compressed.
+// ParseCounterDataFile recognizes and decompresses such data; other
+// readers, such as "go tool covdata", do not.
+//
+// Compression is worthwhile mainly for large programs. For a
+// synthetic program of 100,000 executed functions (see
+// BenchmarkEmitCompressedCounterData), the 0.6 MB of counter data
+// shrinks about 2.6x at BestSpeed, taking about 1.4 times as long to
+// emit as the uncompressed data; DefaultCompression and
+// BestCompression gain little more (about 2.7x) but take about 5
+// times as long.
+//
+// An error is returned if the program was not built with "-cover",
+// if 'level' is not a valid compression level, or if a write fails.
+func EmitCompressedCounterDataToWriter(w io.Writer, level int) error {
+	if w == nil {
+		return fmt.Errorf("error: nil writer in EmitCompressedCounterDataToWriter")
+	}
+	cl := getCovCounterList()
+	if len(cl) == 0 {
+		return fmt.Errorf("program not built with -cover")
+	}
+	if !finalHashComputed {
+		return fmt.Errorf("meta-data not written yet, unable to write counter data")
+	}
+	zw, err := gzip.NewWriterLevel(w, level)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(compressedCounterMagic[:]); err != nil {
+		return err
+	}
+	s := &emitState{
+		counterlist: cl,
+		pkgmap:      getCovPkgMap(),
+	}
+	if err := s.emitCounterDataToWriter(zw); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// decompressCounterData returns the uncompressed form of the counter
+// data 'b', which may have been written by either
+// EmitCounterDataToWriter or EmitCompressedCounterDataToWriter.
+func decompressCounterData(b []byte) ([]byte, error) {
+	if !bytes.HasPrefix(b, compressedCounterMagic[:]) {
+		return b, nil
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(b[len(compressedCounterMagic):]))
+	if err != nil {
+		return nil, fmt.Errorf("reading compressed counter data: %v", err)
+	}
+	d, err := io.ReadAll(zr)
+	if err != nil {
+		return nil, fmt.Errorf("reading compressed counter data: %v", err)
+	}
+	return d, nil
+}
@@ -0,0 +1,140 @@
+// Copyright 2022 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package coverage
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"sort"
+	"sync"
+)
+
+// hashLink records a result from CounterDataHashChain along with the
+// result of the call before it.
+type hashLink struct {
+	prev, curr [32]byte
+}
+
+// hashChainHistory is the number of links of the hash chain retained
+// for VerifyHashChain.
+const hashChainHistory = 1024
+
+var (
+	// hashChainMu protects the links below, and serializes calls to
+	// CounterDataHashChain so that each result is chained to the one
+	// before it.
+	hashChainMu sync.Mutex
+	// Ring buffer of the most recent links in the hash chain, at most
+	// hashChainHistory long, so the memory used does not grow without
+	// bound with the number of calls. hashChainNext is the index in
+	// hashChainLinks of the next link to be overwritten once the ring
+	// is full.
+	hashChainLinks []hashLink
+	hashChainNext  int
+	// Most recent result of CounterDataHashChain, or all zeros if it
+	// has not been called.
+	hashChainHead [32]byte
+)
+
+// CounterDataHashChain returns a SHA-256 hash of the current coverage
+// counter values of the running program, combined with the program's
+// meta-data hash and the result of the previous call to
+// CounterDataHashChain (all zeros for the first call). Successive
+// results thus form a hash chain recording the evolution of the
+// program's coverage state; see VerifyHashChain. An error is returned
+// if the program was not built with "-cover".
+func CounterDataHashChain() ([32]byte, error) {
+	snap, err := ReadCounterSnapshot()
+	if err != nil {
+		return [32]byte{}, err
+	}
+	return appendHashLink(snap), nil
+}
+
+// appendHashLink adds a link for the counter values in 'snap' to the
+// hash chain, returning the new head of the chain.
+func appendHashLink(snap *CounterSnapshot) [32]byte {
+	hashChainMu.Lock()
+	defer hashChainMu.Unlock()
+	l := hashLink{prev: hashChainHead, curr: counterDigest(hashChainHead[:], snap)}
+	if len(hashChainLinks) < hashChainHistory {
+		hashChainLinks = append(hashChainLinks, l)
+	} else {
+		hashChainLinks[hashChainNext] = l
+		hashChainNext = (hashChainNext + 1) % hashChainHistory
+	}
+	hashChainHead = l.curr
+	return l.curr
+}
+
+// VerifyHashChain reports whether 'curr' was returned by the call to
+// CounterDataHashChain immediately following the call that returned
+// 'prev' (or, if 'prev' is all zeros, by the first call). The most
+// recent 1024 links of the chain are retained, so a link can be
+// verified at any point until 1024 further calls to
+// CounterDataHashChain have been made; after that VerifyHashChain
+// reports false for it.
+func VerifyHashChain(prev, curr [32]byte) bool {
+	hashChainMu.Lock()
+	defer hashChainMu.Unlock()
+	for _, l := range hashChainLinks {
+		if l.curr == curr && l.prev == prev {
+			return true
+		}
+	}
+	return false
+}
+
+// CoverageCounterChecksum returns a SHA-256 hash of the program's
+// meta-data hash and current coverage counter values. Unlike
+// CounterDataHashChain, it has no dependence on earlier calls, so
+// equal results indicate equal counter values. An error is returned
+// if the program was not built with "-cover".
+func CoverageCounterChecksum() ([32]byte, error) {
+	snap, err := ReadCounterSnapshot()
+	if err != nil {
+		return [32]byte{}, err
+	}
+	return counterDigest(nil, snap), nil
+}
+
+// counterDigest returns a SHA-256 hash of 'prefix' followed by the
+// meta-data hash and counter values of 'snap'.
+func counterDigest(prefix []byte, snap *CounterSnapshot) [32]byte {
+	// Visit functions in a fixed order, so that the hash depends only
+	// on the counter values and not on the layout of the counters.
+	counters := snap.counterMap()
+	keys := make([]pkfunc, 0, len(counters))
+	for k := range counters {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].pk != keys[j].pk {
+			return keys[i].pk < keys[j].pk
+		}
+		return keys[i].fcn < keys[j].fcn
+	})
+
+	h := sha256.New()
+	h.Write(prefix)
+	h.Write(snap.metaHash[:])
+	var buf [4]byte
+	wr := func(v uint32) {
+		binary.LittleEndian.PutUint32(buf[:], v)
+		h.Write(buf[:])
+	}
+	for _, k := range keys {
+		c := counters[k]
+		wr(k.pk)
+		wr(k.fcn)
+		wr(uint32(len(c)))
+		for _, v := range c {
+			wr(v)
+		}
+	}
+	var sum [32]byte
+	h.Sum(sum[:0])
+	return sum
+}
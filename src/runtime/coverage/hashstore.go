@@ -0,0 +1,127 @@
+// Copyright 2022 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package coverage
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// HashIndexedStore is a content-addressed store for coverage counter
+// data, holding one entry per meta-data hash. Entries are kept in a
+// two-level directory structure, with the first byte of the hash (in
+// hex) selecting a subdirectory and the remaining bytes naming the
+// file within it, so that no single directory grows too large.
+type HashIndexedStore struct {
+	dir string
+}
+
+// NewHashIndexedStore returns a store rooted at the directory 'dir'.
+// The directory is created when the first entry is stored.
+func NewHashIndexedStore(dir string) *HashIndexedStore {
+	return &HashIndexedStore{dir: dir}
+}
+
+// path returns the path of the entry for 'metaHash'.
+func (hs *HashIndexedStore) path(metaHash [16]byte) string {
+	return filepath.Join(hs.dir, fmt.Sprintf("%02x", metaHash[0]), fmt.Sprintf("%x", metaHash[1:]))
+}
+
+// Put stores the content of 'counterData' as the entry for
+// 'metaHash', replacing any existing entry. The entry is written to a
+// temporary file and then renamed into place, so that readers never
+// observe a partially-written entry.
+func (hs *HashIndexedStore) Put(metaHash [16]byte, counterData io.Reader) error {
+	path := hs.path(metaHash)
+	dir, base := filepath.Split(path)
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return fmt.Errorf("creating store directory: %v", err)
+	}
+	tmp := filepath.Join(dir, fmt.Sprintf("tmp.%s%d", base, time.Now().UnixNano()))
+	f, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("creating store entry %s: %v", tmp, err)
+	}
+	_, err = io.Copy(f, counterData)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("writing %s: %v", tmp, err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("writing %s: rename from %s failed: %v", path, tmp, err)
+	}
+	return nil
+}
+
+// Get opens the entry for 'metaHash' for reading. The caller must
+// close the returned reader.
+func (hs *HashIndexedStore) Get(metaHash [16]byte) (io.ReadCloser, error) {
+	return os.Open(hs.path(metaHash))
+}
+
+// Has reports whether the store holds an entry for 'metaHash'.
+func (hs *HashIndexedStore) Has(metaHash [16]byte) bool {
+	fi, err := os.Stat(hs.path(metaHash))
+	return err == nil && fi.Mode().IsRegular()
+}
+
+// GarbageCollect deletes each entry whose meta-data hash is rejected
+// by 'keep', returning the number of entries deleted. Files in the
+// store directory that are not entries are left alone.
+func (hs *HashIndexedStore) GarbageCollect(keep func([16]byte) bool) (int, error) {
+	subs, err := os.ReadDir(hs.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	n := 0
+	for _, sub := range subs {
+		if !sub.IsDir() || len(sub.Name()) != 2 {
+			continue
+		}
+		ents, err := os.ReadDir(filepath.Join(hs.dir, sub.Name()))
+		if err != nil {
+			return n, err
+		}
+		for _, e := range ents {
+			h, ok := parseStoreName(sub.Name(), e.Name())
+			if !ok || !e.Type().IsRegular() || keep(h) {
+				continue
+			}
+			if err := os.Remove(filepath.Join(hs.dir, sub.Name(), e.Name())); err != nil {
+				return n, err
+			}
+			n++
+		}
+	}
+	return n, nil
+}
+
+// parseStoreName recovers the meta-data hash for the store entry with
+// subdirectory 'sub' and file name 'name', reporting whether the
+// names are those of a valid entry.
+func parseStoreName(sub, name string) ([16]byte, bool) {
+	var h [16]byte
+	s := sub + name
+	if len(s) != 2*len(h) || strings.ToLower(s) != s {
+		return h, false
+	}
+	var b []byte
+	if _, err := fmt.Sscanf(s, "%x", &b); err != nil || len(b) != len(h) {
+		return h, false
+	}
+	copy(h[:], b)
+	return h, true
+}
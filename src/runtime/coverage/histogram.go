@@ -0,0 +1,78 @@
+// Copyright 2022 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package coverage
+
+import (
+	"fmt"
+	"math"
+)
+
+// CounterSamplerHistogram computes an 'n'-bucket histogram of the
+// non-zero coverage counter values of the currently running program.
+// The returned slices each have 'n' entries: buckets[i] is the
+// (inclusive) upper bound of bucket i and counts[i] the number of
+// counters whose value is greater than buckets[i-1] and at most
+// buckets[i]. Bounds are spaced on a log scale from 1 to the largest
+// counter value M, with bucket i bounded by M^(i/(n-1)) rounded to the
+// nearest integer; when M is 2^(n-1) the bounds are thus 1, 2, 4, 8
+// and so on. If M is small relative to 'n', adjacent buckets may share
+// a bound, in which case all matching counters are attributed to the
+// first of them. Counters with value zero are not included.
+func CounterSamplerHistogram(n int) (buckets []uint32, counts []int, err error) {
+	if n <= 0 {
+		return nil, nil, fmt.Errorf("invalid bucket count %d", n)
+	}
+	snap, err := ReadCounterSnapshot()
+	if err != nil {
+		return nil, nil, err
+	}
+	var vals []uint32
+	for _, c := range snap.counterMap() {
+		for _, v := range c {
+			if v != 0 {
+				vals = append(vals, v)
+			}
+		}
+	}
+	buckets, counts = counterHistogram(vals, n)
+	return buckets, counts, nil
+}
+
+// counterHistogram computes the histogram described by
+// CounterSamplerHistogram for the non-zero values 'vals'.
+func counterHistogram(vals []uint32, n int) ([]uint32, []int) {
+	max := uint32(1)
+	for _, v := range vals {
+		if v > max {
+			max = v
+		}
+	}
+	buckets := make([]uint32, n)
+	for i := range buckets {
+		if i == n-1 {
+			buckets[i] = max
+			continue
+		}
+		b := math.Round(math.Pow(float64(max), float64(i)/float64(n-1)))
+		buckets[i] = uint32(b)
+		if i > 0 && buckets[i] < buckets[i-1] {
+			buckets[i] = buckets[i-1]
+		}
+	}
+	counts := make([]int, n)
+	for _, v := range vals {
+		lo, hi := 0, n-1
+		for lo < hi {
+			mid := (lo + hi) / 2
+			if v <= buckets[mid] {
+				hi = mid
+			} else {
+				lo = mid + 1
+			}
+		}
+		counts[lo]++
+	}
+	return buckets, counts
+}
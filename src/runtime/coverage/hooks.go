@@ -4,7 +4,12 @@
 
 package coverage
 
-import _ "unsafe"
+import (
+	"fmt"
+	"os"
+	"sync"
+	_ "unsafe"
+)
 
 // initHook is invoked from the main package "init" routine in
 // programs built with "-cover". This function is intended to be
@@ -40,3 +45,56 @@ func initHook(istest bool) {
 
 //go:linkname runtime_addExitHook runtime.addExitHook
 func runtime_addExitHook(f func(), runOnNonZeroExit bool)
+
+var (
+	flushHooksMu      sync.Mutex
+	flushHooks        []func()
+	flushHooksStarted bool
+)
+
+// RegisterFlushHook registers 'fn' to be called when the program
+// exits (normally or via os.Exit), just before the coverage counter
+// data is written out. Hooks run synchronously, in registration
+// order, whether or not GOCOVERDIR is set; they can be used, for
+// example, to log a coverage summary or to emit counter data to a
+// different destination. If a hook panics, the panic is recovered
+// and reported on standard error, and the remaining hooks and the
+// counter data write still take place. An error is returned if the
+// exit-time flush has already begun.
+func RegisterFlushHook(fn func()) error {
+	if fn == nil {
+		return fmt.Errorf("error: nil hook in RegisterFlushHook")
+	}
+	flushHooksMu.Lock()
+	defer flushHooksMu.Unlock()
+	if flushHooksStarted {
+		return fmt.Errorf("coverage data flush already started")
+	}
+	flushHooks = append(flushHooks, fn)
+	return nil
+}
+
+// runFlushHooks invokes the hooks registered with RegisterFlushHook.
+// It is called on the exit path, and runs the hooks at most once.
+func runFlushHooks() {
+	flushHooksMu.Lock()
+	if flushHooksStarted {
+		flushHooksMu.Unlock()
+		return
+	}
+	flushHooksStarted = true
+	hooks := flushHooks
+	flushHooks = nil
+	flushHooksMu.Unlock()
+
+	for i, fn := range hooks {
+		func() {
+			defer func() {
+				if v := recover(); v != nil {
+					fmt.Fprintf(os.Stderr, "error: coverage flush hook %d panicked: %v\n", i, v)
+				}
+			}()
+			fn()
+		}()
+	}
+}
@@ -0,0 +1,70 @@
+// Copyright 2022 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package httphook provides a coverage.Hook that uploads coverage
+// data to an HTTP endpoint. It is kept separate from package
+// runtime/coverage so that instrumented programs that don't use it do
+// not depend on net/http.
+package httphook
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"runtime/coverage"
+)
+
+// KindHeader is the request header that tells the endpoint which kind
+// of coverage data a request carries: "meta" for meta-data, or
+// "counters" for counter data.
+const KindHeader = "X-Go-Coverage-Kind"
+
+type hook struct {
+	endpoint string
+	headers  map[string]string
+}
+
+// New returns a hook (see coverage.RegisterEmitHook) that sends each
+// piece of coverage data to 'endpoint' in the body of a POST request
+// with content type "application/octet-stream", the additional
+// request headers 'headers', and KindHeader set to indicate the kind
+// of data. A request fails if the endpoint does not respond with a
+// 2xx status code.
+func New(endpoint string, headers map[string]string) coverage.Hook {
+	h := &hook{endpoint: endpoint, headers: make(map[string]string, len(headers))}
+	for k, v := range headers {
+		h.headers[k] = v
+	}
+	return h
+}
+
+func (h *hook) EmitMeta(meta io.Reader) error {
+	return h.post("meta", meta)
+}
+
+func (h *hook) EmitCounters(counters io.Reader) error {
+	return h.post("counters", counters)
+}
+
+func (h *hook) post(kind string, body io.Reader) error {
+	req, err := http.NewRequest("POST", h.endpoint, body)
+	if err != nil {
+		return err
+	}
+	for k, v := range h.headers {
+		req.Header.Set(k, v)
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set(KindHeader, kind)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("POST %s: %s", h.endpoint, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+// Copyright 2022 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package httphook
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHook(t *testing.T) {
+	type request struct {
+		method, kind, ctype, token, body string
+	}
+	var reqs []request
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("reading request body: %v", err)
+		}
+		reqs = append(reqs, request{
+			method: r.Method,
+			kind:   r.Header.Get(KindHeader),
+			ctype:  r.Header.Get("Content-Type"),
+			token:  r.Header.Get("X-Token"),
+			body:   string(b),
+		})
+		if r.URL.Path == "/fail" {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+
+	headers := map[string]string{"X-Token": "secret"}
+	h := New(srv.URL+"/upload", headers)
+	// Later changes to the caller's map don't affect the hook.
+	headers["X-Token"] = "changed"
+	if err := h.EmitMeta(strings.NewReader("meta-data")); err != nil {
+		t.Fatalf("EmitMeta: %v", err)
+	}
+	if err := h.EmitCounters(strings.NewReader("counter-data")); err != nil {
+		t.Fatalf("EmitCounters: %v", err)
+	}
+	want := []request{
+		{"POST", "meta", "application/octet-stream", "secret", "meta-data"},
+		{"POST", "counters", "application/octet-stream", "secret", "counter-data"},
+	}
+	if len(reqs) != len(want) {
+		t.Fatalf("got %d requests, want %d", len(reqs), len(want))
+	}
+	for i := range want {
+		if reqs[i] != want[i] {
+			t.Errorf("request %d = %+v, want %+v", i, reqs[i], want[i])
+		}
+	}
+
+	err := New(srv.URL+"/fail", nil).EmitCounters(strings.NewReader("x"))
+	if err == nil || !strings.Contains(err.Error(), "503") {
+		t.Errorf("EmitCounters to failing endpoint returns %v, want 503 error", err)
+	}
+}
@@ -0,0 +1,320 @@
+// Copyright 2022 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package coverage
+
+import (
+	"fmt"
+	"internal/coverage"
+	"internal/coverage/decodemeta"
+	"io"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// This file contains support for writing coverage data as JSON. Note
+// that encoding/json is not used here, since this package is linked
+// into every coverage-instrumented program (go/build's deps_test
+// enforces this); instead coverage data is converted to a tree of
+// jsonObject, []any, string and numeric values which is then encoded
+// by writeJSON. This is the only JSON encoder in the package: it is
+// shared by WriteCoverageToJSON, PinnedCoverageResult.JSON and the
+// TestCoverageReporter report, and package runtime/coverage/json
+// builds on its output.
+
+// WriteCoverageToJSON writes the coverage state of the currently
+// running program to 'w' as a JSON document with three top-level
+// fields: "meta" (the instrumented packages, functions and blocks),
+// "counters" (per-block hit counts for each function) and "stats"
+// (summary statistics). The structure of the document is described
+// by the JSON Schema returned by JSONSchema. If 'pretty' is true, the
+// output is indented using two spaces per level.
+func WriteCoverageToJSON(w io.Writer, pretty bool) error {
+	snap, err := ReadCounterSnapshot()
+	if err != nil {
+		return err
+	}
+	doc, err := coverageJSONDoc(snap)
+	if err != nil {
+		return err
+	}
+	var sb strings.Builder
+	writeJSON(&sb, doc, pretty, 0)
+	sb.WriteByte('\n')
+	_, err = io.WriteString(w, sb.String())
+	return err
+}
+
+// coverageJSONDoc returns the JSON document written by
+// WriteCoverageToJSON for the counter values in 'snap', which must
+// have been captured from the currently running program.
+func coverageJSONDoc(snap *CounterSnapshot) (jsonObject, error) {
+	payloads := metaPayloads(getCovMetaList())
+	counters := snap.counterMap()
+	st, err := computeStats(payloads, cgran, counters)
+	if err != nil {
+		return nil, err
+	}
+
+	pkgs, ctrs := make([]any, 0, len(payloads)), []any{}
+	for pkIdx, p := range payloads {
+		var funcs []any
+		var pkg jsonObject
+		err := visitPkgMetaFuncs(p, uint32(pkIdx), func(pd *decodemeta.CoverageMetaDataDecoder) {
+			funcs = make([]any, 0, pd.NumFuncs())
+			pkg = jsonObject{
+				{"importPath", pd.PackagePath()},
+				{"modulePath", pd.ModulePath()},
+			}
+		}, func(pkIdx, fnIdx uint32, pd *decodemeta.CoverageMetaDataDecoder, fd *coverage.FuncDesc) error {
+			fm := newFuncMeta(fd)
+			fc := counters[pkfunc{pk: pkIdx, fcn: fnIdx}]
+			blocks := make([]any, 0, len(fd.Units))
+			hits := make([]any, 0, len(fd.Units))
+			for i, u := range fd.Units {
+				blocks = append(blocks, jsonObject{
+					{"startLine", u.StLine},
+					{"startCol", u.StCol},
+					{"endLine", u.EnLine},
+					{"endCol", u.EnCol},
+					{"numStmts", u.NxStmts},
+				})
+				hits = append(hits, unitCount(cgran, fc, i))
+			}
+			funcs = append(funcs, jsonObject{
+				{"name", fm.Name},
+				{"file", fm.SourceFile},
+				{"startLine", fm.StartLine},
+				{"endLine", fm.EndLine},
+				{"blocks", blocks},
+			})
+			ctrs = append(ctrs, jsonObject{
+				{"package", pd.PackagePath()},
+				{"function", fm.Name},
+				{"hits", hits},
+			})
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		pkgs = append(pkgs, append(pkg, jsonField{"functions", funcs}))
+	}
+
+	return jsonObject{
+		{"meta", jsonObject{
+			{"hash", fmt.Sprintf("%x", snap.metaHash)},
+			{"mode", cmode.String()},
+			{"granularity", cgran.String()},
+			{"packages", pkgs},
+		}},
+		{"counters", ctrs},
+		{"stats", jsonObject{
+			{"totalBlocks", st.TotalBlocks},
+			{"coveredBlocks", st.CoveredBlocks},
+			{"totalLines", st.TotalLines},
+			{"coveredLines", st.CoveredLines},
+			{"blockCoveragePercent", st.BlockCoveragePercent},
+			{"lineCoveragePercent", st.LineCoveragePercent},
+		}},
+	}, nil
+}
+
+// JSONSchema returns a JSON Schema (draft 7) document describing the
+// output of WriteCoverageToJSON.
+func JSONSchema() string {
+	return jsonSchema
+}
+
+const jsonSchema = `{
+  "$schema": "http://json-schema.org/draft-07/schema#",
+  "title": "Go coverage data",
+  "type": "object",
+  "required": ["meta", "counters", "stats"],
+  "properties": {
+    "meta": {
+      "type": "object",
+      "required": ["hash", "mode", "granularity", "packages"],
+      "properties": {
+        "hash": {"type": "string", "description": "hex-encoded meta-data hash"},
+        "mode": {"enum": ["set", "count", "atomic"]},
+        "granularity": {"enum": ["perblock", "perfunc"]},
+        "packages": {
+          "type": "array",
+          "items": {
+            "type": "object",
+            "required": ["importPath", "modulePath", "functions"],
+            "properties": {
+              "importPath": {"type": "string"},
+              "modulePath": {"type": "string"},
+              "functions": {
+                "type": "array",
+                "items": {
+                  "type": "object",
+                  "required": ["name", "file", "startLine", "endLine", "blocks"],
+                  "properties": {
+                    "name": {"type": "string"},
+                    "file": {"type": "string"},
+                    "startLine": {"type": "integer"},
+                    "endLine": {"type": "integer"},
+                    "blocks": {
+                      "type": "array",
+                      "items": {
+                        "type": "object",
+                        "required": ["startLine", "startCol", "endLine", "endCol", "numStmts"],
+                        "properties": {
+                          "startLine": {"type": "integer"},
+                          "startCol": {"type": "integer"},
+                          "endLine": {"type": "integer"},
+                          "endCol": {"type": "integer"},
+                          "numStmts": {"type": "integer"}
+                        }
+                      }
+                    }
+                  }
+                }
+              }
+            }
+          }
+        }
+      }
+    },
+    "counters": {
+      "type": "array",
+      "description": "hit counts for each function, in meta-data order",
+      "items": {
+        "type": "object",
+        "required": ["package", "function", "hits"],
+        "properties": {
+          "package": {"type": "string"},
+          "function": {"type": "string"},
+          "hits": {
+            "type": "array",
+            "description": "hit count for each block, parallel to the function's blocks",
+            "items": {"type": "integer", "minimum": 0}
+          }
+        }
+      }
+    },
+    "stats": {
+      "type": "object",
+      "required": ["totalBlocks", "coveredBlocks", "totalLines", "coveredLines", "blockCoveragePercent", "lineCoveragePercent"],
+      "properties": {
+        "totalBlocks": {"type": "integer"},
+        "coveredBlocks": {"type": "integer"},
+        "totalLines": {"type": "integer"},
+        "coveredLines": {"type": "integer"},
+        "blockCoveragePercent": {"type": "number", "minimum": 0, "maximum": 100},
+        "lineCoveragePercent": {"type": "number", "minimum": 0, "maximum": 100}
+      }
+    }
+  }
+}
+`
+
+// jsonObject is a JSON object with fields in a fixed order.
+type jsonObject []jsonField
+
+type jsonField struct {
+	key string
+	val any
+}
+
+// writeJSON encodes the value 'v' (a jsonObject, []any, string,
+// integer, float64 or nil) to 'sb'. If 'pretty' is set, nested
+// values are placed on separate lines, indented by two spaces per
+// level starting at 'depth'.
+func writeJSON(sb *strings.Builder, v any, pretty bool, depth int) {
+	newline := func(d int) {
+		if pretty {
+			sb.WriteByte('\n')
+			for i := 0; i < d; i++ {
+				sb.WriteString("  ")
+			}
+		}
+	}
+	switch v := v.(type) {
+	case nil:
+		sb.WriteString("null")
+	case jsonObject:
+		sb.WriteByte('{')
+		for i, f := range v {
+			if i > 0 {
+				sb.WriteByte(',')
+			}
+			newline(depth + 1)
+			writeJSONString(sb, f.key)
+			sb.WriteByte(':')
+			if pretty {
+				sb.WriteByte(' ')
+			}
+			writeJSON(sb, f.val, pretty, depth+1)
+		}
+		if len(v) > 0 {
+			newline(depth)
+		}
+		sb.WriteByte('}')
+	case []any:
+		if v == nil {
+			sb.WriteString("null")
+			return
+		}
+		sb.WriteByte('[')
+		for i, e := range v {
+			if i > 0 {
+				sb.WriteByte(',')
+			}
+			newline(depth + 1)
+			writeJSON(sb, e, pretty, depth+1)
+		}
+		if len(v) > 0 {
+			newline(depth)
+		}
+		sb.WriteByte(']')
+	case string:
+		writeJSONString(sb, v)
+	case int:
+		sb.WriteString(strconv.Itoa(v))
+	case uint32:
+		sb.WriteString(strconv.FormatUint(uint64(v), 10))
+	case uint64:
+		sb.WriteString(strconv.FormatUint(v, 10))
+	case float64:
+		sb.WriteString(strconv.FormatFloat(v, 'f', -1, 64))
+	default:
+		panic("internal error: unsupported type in writeJSON")
+	}
+}
+
+// writeJSONString writes 's' to 'sb' as a quoted JSON string.
+// Invalid UTF-8 is replaced with the Unicode replacement character.
+func writeJSONString(sb *strings.Builder, s string) {
+	const hexDigits = "0123456789abcdef"
+	sb.WriteByte('"')
+	for i := 0; i < len(s); {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		i += size
+		switch {
+		case r == utf8.RuneError && size == 1:
+			sb.WriteString(`\ufffd`)
+		case r == '"' || r == '\\':
+			sb.WriteByte('\\')
+			sb.WriteRune(r)
+		case r == '\n':
+			sb.WriteString(`\n`)
+		case r == '\r':
+			sb.WriteString(`\r`)
+		case r == '\t':
+			sb.WriteString(`\t`)
+		case r < 0x20:
+			sb.WriteString(`\u00`)
+			sb.WriteByte(hexDigits[r>>4])
+			sb.WriteByte(hexDigits[r&0xf])
+		default:
+			sb.WriteRune(r)
+		}
+	}
+	sb.WriteByte('"')
+}
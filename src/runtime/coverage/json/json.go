@@ -0,0 +1,137 @@
+// Copyright 2022 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package json writes the coverage meta-data and counter data of the
+// currently running program as JSON, for debugging and for tools that
+// cannot read the binary coverage data formats. It is a thin wrapper
+// around package runtime/coverage, kept separate so that programs
+// that do not use it need not link in encoding/json.
+package json
+
+import (
+	"bytes"
+	encjson "encoding/json"
+	"io"
+	"runtime/coverage"
+)
+
+// document mirrors the structure of the output of
+// coverage.WriteCoverageToJSON.
+type document struct {
+	Meta     metaData
+	Counters []struct {
+		Package  string
+		Function string
+		Hits     []uint32
+	}
+}
+
+type metaData struct {
+	Hash        string    `json:"hash"`
+	Mode        string    `json:"mode"`
+	Granularity string    `json:"granularity"`
+	Packages    []pkgMeta `json:"packages"`
+}
+
+type pkgMeta struct {
+	ImportPath string     `json:"importPath"`
+	ModulePath string     `json:"modulePath"`
+	Functions  []funcMeta `json:"functions"`
+}
+
+type funcMeta struct {
+	Name      string      `json:"name"`
+	File      string      `json:"file"`
+	StartLine int         `json:"startLine"`
+	EndLine   int         `json:"endLine"`
+	Blocks    []blockMeta `json:"blocks"`
+}
+
+type blockMeta struct {
+	StartLine int `json:"startLine"`
+	StartCol  int `json:"startCol"`
+	EndLine   int `json:"endLine"`
+	EndCol    int `json:"endCol"`
+	NumStmts  int `json:"numStmts"`
+}
+
+// counterData is the document written by EmitCounterDataAsJSON.
+type counterData struct {
+	CoverMode   string                         `json:"covermode"`
+	Granularity string                         `json:"granularity"`
+	Packages    map[string]map[string][]uint32 `json:"packages"`
+}
+
+// readDocument captures the coverage state of the running program.
+func readDocument() (*document, error) {
+	var b bytes.Buffer
+	if err := coverage.WriteCoverageToJSON(&b, false); err != nil {
+		return nil, err
+	}
+	return decodeDocument(b.Bytes())
+}
+
+// decodeDocument decodes 'data', a document written by
+// coverage.WriteCoverageToJSON.
+func decodeDocument(data []byte) (*document, error) {
+	doc := &document{}
+	if err := encjson.Unmarshal(data, doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// EmitCounterDataAsJSON writes the counter data for the currently
+// running program to 'w' as a JSON object with the fields
+// "covermode" and "granularity", giving the counter mode and
+// granularity the program was built with, and "packages", which maps
+// each instrumented package's import path to an object mapping each
+// function name to the function's per-block hit counts. As with
+// coverage.EmitCounterDataToWriter, the counter values are a snapshot
+// taken at the point of the call. An error is returned if the program
+// was not built with "-cover".
+func EmitCounterDataAsJSON(w io.Writer) error {
+	doc, err := readDocument()
+	if err != nil {
+		return err
+	}
+	return writeCounterData(w, doc)
+}
+
+// writeCounterData writes the counter data in 'doc' to 'w' in the
+// form described for EmitCounterDataAsJSON.
+func writeCounterData(w io.Writer, doc *document) error {
+	cd := counterData{
+		CoverMode:   doc.Meta.Mode,
+		Granularity: doc.Meta.Granularity,
+		Packages:    make(map[string]map[string][]uint32),
+	}
+	for _, p := range doc.Meta.Packages {
+		cd.Packages[p.ImportPath] = make(map[string][]uint32)
+	}
+	for _, c := range doc.Counters {
+		cd.Packages[c.Package][c.Function] = c.Hits
+	}
+	return encjson.NewEncoder(w).Encode(&cd)
+}
+
+// EmitMetaDataAsJSON writes the meta-data for the currently running
+// program to 'w' as a JSON object with the fields "hash", "mode",
+// "granularity" and "packages". Each package lists its functions,
+// and each function its source file, line range and blocks, with the
+// source position and statement count of each block. An error is
+// returned if the program was not built with "-cover".
+func EmitMetaDataAsJSON(w io.Writer) error {
+	doc, err := readDocument()
+	if err != nil {
+		return err
+	}
+	return writeMetaData(w, doc)
+}
+
+// writeMetaData writes the meta-data in 'doc' to 'w' in the form
+// described for EmitMetaDataAsJSON.
+func writeMetaData(w io.Writer, doc *document) error {
+	return encjson.NewEncoder(w).Encode(&doc.Meta)
+}
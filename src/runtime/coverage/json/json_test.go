@@ -0,0 +1,67 @@
+// Copyright 2022 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package json
+
+import (
+	"bytes"
+	encjson "encoding/json"
+	"io"
+	"os"
+	"testing"
+)
+
+func TestGolden(t *testing.T) {
+	data, err := os.ReadFile("testdata/coverage.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc, err := decodeDocument(data)
+	if err != nil {
+		t.Fatalf("decodeDocument: %v", err)
+	}
+	for _, tc := range []struct {
+		golden string
+		write  func(io.Writer, *document) error
+	}{
+		{"testdata/counters.json", writeCounterData},
+		{"testdata/meta.json", writeMetaData},
+	} {
+		want, err := os.ReadFile(tc.golden)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var b bytes.Buffer
+		if err := tc.write(&b, doc); err != nil {
+			t.Fatalf("writing %s: %v", tc.golden, err)
+		}
+		if got := b.String(); got != string(want) {
+			t.Errorf("output for %s:\n%s\nwant:\n%s", tc.golden, got, want)
+		}
+	}
+}
+
+func TestEmitCounterDataAsJSON(t *testing.T) {
+	var b bytes.Buffer
+	err := EmitCounterDataAsJSON(&b)
+	if testing.CoverMode() == "" {
+		if err == nil {
+			t.Errorf("EmitCounterDataAsJSON succeeded in a program not built with -cover")
+		}
+		return
+	}
+	if err != nil {
+		t.Fatalf("EmitCounterDataAsJSON: %v", err)
+	}
+	var cd counterData
+	if err := encjson.Unmarshal(b.Bytes(), &cd); err != nil {
+		t.Fatalf("decoding EmitCounterDataAsJSON output: %v", err)
+	}
+	if cd.CoverMode != testing.CoverMode() {
+		t.Errorf("covermode = %q, want %q", cd.CoverMode, testing.CoverMode())
+	}
+	if _, ok := cd.Packages["runtime/coverage/json"]["EmitCounterDataAsJSON"]; !ok {
+		t.Errorf("no counters for EmitCounterDataAsJSON in %s", b.String())
+	}
+}
@@ -0,0 +1,68 @@
+// Copyright 2022 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package coverage
+
+import (
+	"bytes"
+	"fmt"
+	"internal/coverage/decodemeta"
+	"sync"
+)
+
+// LazyMetaDecoder provides access to the packages described by an
+// encoded meta-data file (for example the output of
+// EmitMetaDataToWriter), decoding each package only when it is first
+// requested. Decoded packages are cached. A LazyMetaDecoder is safe
+// for concurrent use by multiple goroutines.
+type LazyMetaDecoder struct {
+	mfr *decodemeta.CoverageMetaFileReader
+
+	mu   sync.Mutex
+	pkgs []*PackageMeta // decoded packages, nil if not yet decoded
+}
+
+// NewLazyMetaDecoder returns a decoder for the meta-data file content
+// in 'data'. Only the file header is examined; an error is returned
+// if it is malformed. The decoder refers to 'data' directly, so it
+// should not be modified while the decoder is in use.
+func NewLazyMetaDecoder(data []byte) (*LazyMetaDecoder, error) {
+	mfr, err := decodemeta.NewCoverageMetaFileReader(bytes.NewReader(data), data)
+	if err != nil {
+		return nil, fmt.Errorf("reading meta-data: %v", err)
+	}
+	return &LazyMetaDecoder{
+		mfr:  mfr,
+		pkgs: make([]*PackageMeta, mfr.NumPackages()),
+	}, nil
+}
+
+// NumPackages returns the number of packages in the meta-data.
+func (d *LazyMetaDecoder) NumPackages() int {
+	return len(d.pkgs)
+}
+
+// PackageAt returns the meta-data for the package with index 'idx',
+// decoding it if necessary. The returned PackageMeta is shared by all
+// callers and must not be modified.
+func (d *LazyMetaDecoder) PackageAt(idx int) (*PackageMeta, error) {
+	if idx < 0 || idx >= len(d.pkgs) {
+		return nil, fmt.Errorf("package index %d out of range [0,%d)", idx, len(d.pkgs))
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if pm := d.pkgs[idx]; pm != nil {
+		return pm, nil
+	}
+	p, err := d.mfr.GetPackagePayload(uint32(idx), nil)
+	if err != nil {
+		return nil, fmt.Errorf("reading meta-data: %v", err)
+	}
+	pm := new(PackageMeta)
+	if err := decodePackageMeta(p, idx, pm); err != nil {
+		return nil, err
+	}
+	d.pkgs[idx] = pm
+	return pm, nil
+}
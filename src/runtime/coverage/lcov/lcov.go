@@ -0,0 +1,146 @@
+// Copyright 2022 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package lcov writes the coverage data of the currently running
+// program in the LCOV trace file format, as consumed by genhtml and by
+// many IDEs.
+package lcov
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"runtime/coverage"
+	"sort"
+)
+
+// document mirrors the parts of the output of
+// coverage.WriteCoverageToJSON used here.
+type document struct {
+	Meta struct {
+		Packages []struct {
+			Functions []struct {
+				Name      string
+				File      string
+				StartLine int
+				Blocks    []struct {
+					StartLine, EndLine int
+				}
+			}
+		}
+	}
+	Counters []struct {
+		Hits []uint64
+	}
+}
+
+// lcovFunc is a function record within a source file.
+type lcovFunc struct {
+	name string
+	line int
+	hits uint64
+}
+
+// lcovFile accumulates the records for a source file.
+type lcovFile struct {
+	funcs []lcovFunc
+	lines map[int]uint64
+}
+
+// EmitLCOVData writes the coverage data for the currently running
+// program to 'w' in LCOV format, with one record (from "SF:" to
+// "end_of_record") per instrumented source file, in file name order.
+// The execution count for a line ("DA:") is the sum of the counts of
+// the blocks that overlap it, and the count for a function ("FNDA:")
+// is the count of its first block. Every instrumented line is listed,
+// including lines in files that have not been executed at all. An
+// error is returned if the program was not built with "-cover".
+func EmitLCOVData(w io.Writer) error {
+	var b bytes.Buffer
+	if err := coverage.WriteCoverageToJSON(&b, false); err != nil {
+		return err
+	}
+	return writeLCOV(w, b.Bytes())
+}
+
+// writeLCOV writes the coverage data in 'data', a document written by
+// coverage.WriteCoverageToJSON, to 'w' in LCOV format.
+func writeLCOV(w io.Writer, data []byte) error {
+	var doc document
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+
+	files := make(map[string]*lcovFile)
+	nf := 0
+	for _, p := range doc.Meta.Packages {
+		for _, fn := range p.Functions {
+			if nf >= len(doc.Counters) {
+				return fmt.Errorf("coverage data has fewer counter records than functions")
+			}
+			hits := doc.Counters[nf].Hits
+			nf++
+			f := files[fn.File]
+			if f == nil {
+				f = &lcovFile{lines: make(map[int]uint64)}
+				files[fn.File] = f
+			}
+			lf := lcovFunc{name: fn.Name, line: fn.StartLine}
+			if len(hits) != 0 {
+				lf.hits = hits[0]
+			}
+			f.funcs = append(f.funcs, lf)
+			for i, blk := range fn.Blocks {
+				var h uint64
+				if i < len(hits) {
+					h = hits[i]
+				}
+				for l := blk.StartLine; l <= blk.EndLine; l++ {
+					f.lines[l] += h
+				}
+			}
+		}
+	}
+
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	bw := bufio.NewWriter(w)
+	for _, name := range names {
+		f := files[name]
+		fmt.Fprintf(bw, "TN:\nSF:%s\n", name)
+		sort.SliceStable(f.funcs, func(i, j int) bool {
+			return f.funcs[i].line < f.funcs[j].line
+		})
+		fnh := 0
+		for _, fn := range f.funcs {
+			fmt.Fprintf(bw, "FN:%d,%s\n", fn.line, fn.name)
+		}
+		for _, fn := range f.funcs {
+			fmt.Fprintf(bw, "FNDA:%d,%s\n", fn.hits, fn.name)
+			if fn.hits != 0 {
+				fnh++
+			}
+		}
+		fmt.Fprintf(bw, "FNF:%d\nFNH:%d\n", len(f.funcs), fnh)
+		lines := make([]int, 0, len(f.lines))
+		for l := range f.lines {
+			lines = append(lines, l)
+		}
+		sort.Ints(lines)
+		lh := 0
+		for _, l := range lines {
+			fmt.Fprintf(bw, "DA:%d,%d\n", l, f.lines[l])
+			if f.lines[l] != 0 {
+				lh++
+			}
+		}
+		fmt.Fprintf(bw, "LF:%d\nLH:%d\nend_of_record\n", len(lines), lh)
+	}
+	return bw.Flush()
+}
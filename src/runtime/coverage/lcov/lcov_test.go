@@ -0,0 +1,47 @@
+// Copyright 2022 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lcov
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestWriteLCOV(t *testing.T) {
+	data, err := os.ReadFile("testdata/coverage.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := os.ReadFile("testdata/coverage.lcov")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	if err := writeLCOV(&b, data); err != nil {
+		t.Fatalf("writeLCOV: %v", err)
+	}
+	if got := b.String(); got != string(want) {
+		t.Errorf("writeLCOV output:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestEmitLCOVData(t *testing.T) {
+	var b bytes.Buffer
+	err := EmitLCOVData(&b)
+	if testing.CoverMode() == "" {
+		if err == nil {
+			t.Errorf("EmitLCOVData succeeded in a program not built with -cover")
+		}
+		return
+	}
+	if err != nil {
+		t.Fatalf("EmitLCOVData: %v", err)
+	}
+	if !strings.Contains(b.String(), "SF:runtime/coverage/lcov/lcov.go\n") {
+		t.Errorf("EmitLCOVData output has no record for lcov.go:\n%s", b.String())
+	}
+}
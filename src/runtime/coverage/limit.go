@@ -0,0 +1,112 @@
+// Copyright 2022 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package coverage
+
+import (
+	"fmt"
+	"internal/coverage"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// truncatedArgKey is the key added to the args section of a counter
+// data file when packages were left out of the file to keep it within
+// the limit set with SetMaxCounterFileSize.
+const truncatedArgKey = "truncated"
+
+var (
+	maxCounterFileSizeMu sync.Mutex
+	// Limit set with SetMaxCounterFileSize, or -1 if unlimited.
+	maxCounterFileSize int64 = -1
+)
+
+// SetMaxCounterFileSize sets a limit of 'bytes' on the estimated size
+// of the counter data written by the EmitCounterDataTo* functions,
+// EmitDeterministicCounterData and at program exit. The size of the
+// data for a package is estimated as 4 bytes for each value (counter
+// or function header field) it contributes to the file. If the data for
+// the whole program would exceed the limit, packages are written in
+// decreasing order of the sum of their counter values, skipping any
+// package that would take the total over the limit; the file's args
+// section then records the number of packages omitted under the key
+// "truncated", so that tools reading the file can warn that it
+// undercounts. A 'bytes' value of -1 removes the limit. An error is
+// returned if 'bytes' is less than 1KB (other than -1).
+func SetMaxCounterFileSize(bytes int64) error {
+	if bytes != -1 && bytes < 1<<10 {
+		return fmt.Errorf("counter file size limit %d too small (minimum %d)", bytes, 1<<10)
+	}
+	maxCounterFileSizeMu.Lock()
+	defer maxCounterFileSizeMu.Unlock()
+	maxCounterFileSize = bytes
+	return nil
+}
+
+// GetMaxCounterFileSize returns the limit set with
+// SetMaxCounterFileSize, or -1 if there is no limit.
+func GetMaxCounterFileSize() int64 {
+	maxCounterFileSizeMu.Lock()
+	defer maxCounterFileSizeMu.Unlock()
+	return maxCounterFileSize
+}
+
+// limitSize returns a snapshot holding the packages of 's' that fit
+// within 'limit' bytes, selected as described for
+// SetMaxCounterFileSize, or 's' itself if all of them fit.
+func (s *CounterSnapshot) limitSize(limit int64) *CounterSnapshot {
+	type pkgInfo struct {
+		pk   uint32
+		size int64
+		hits uint64
+	}
+	var pkgs []*pkgInfo
+	idx := make(map[uint32]*pkgInfo)
+	total := int64(0)
+	funcs := s.counterMap()
+	for k, ctrs := range funcs {
+		p := idx[k.pk]
+		if p == nil {
+			p = &pkgInfo{pk: k.pk}
+			idx[k.pk] = p
+			pkgs = append(pkgs, p)
+		}
+		sz := int64(coverage.FirstCtrOffset+len(ctrs)) * 4
+		p.size += sz
+		total += sz
+		for _, v := range ctrs {
+			p.hits += uint64(v)
+		}
+	}
+	if total <= limit {
+		return s
+	}
+	sort.Slice(pkgs, func(i, j int) bool {
+		if pkgs[i].hits != pkgs[j].hits {
+			return pkgs[i].hits > pkgs[j].hits
+		}
+		return pkgs[i].pk < pkgs[j].pk
+	})
+	keep := make(map[uint32]bool)
+	used := int64(0)
+	for _, p := range pkgs {
+		if used+p.size > limit {
+			continue
+		}
+		keep[p.pk] = true
+		used += p.size
+	}
+	for k := range funcs {
+		if !keep[k.pk] {
+			delete(funcs, k)
+		}
+	}
+	args := make(map[string]string, len(s.args)+1)
+	for k, v := range s.args {
+		args[k] = v
+	}
+	args[truncatedArgKey] = strconv.Itoa(len(pkgs) - len(keep))
+	return newSnapshotFromFuncs(s.metaHash, args, funcs)
+}
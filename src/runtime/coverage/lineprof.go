@@ -0,0 +1,115 @@
+// Copyright 2022 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package coverage
+
+import (
+	"bufio"
+	"fmt"
+	"internal/coverage"
+	"internal/coverage/decodemeta"
+	"io"
+	"sort"
+	"sync"
+)
+
+// LineProfiler accumulates per-source-line execution counts from
+// counter snapshots of the currently running program. Within a single
+// snapshot, the count for a line is the largest count of the blocks
+// that overlap it; counts from successive snapshots are added, so
+// callers that sample the same process repeatedly will typically want
+// to add the difference between snapshots rather than the cumulative
+// values. A LineProfiler is safe for concurrent use.
+type LineProfiler struct {
+	mu    sync.Mutex
+	lines map[string]map[int]uint64 // file -> line -> count
+}
+
+// NewLineProfiler returns an empty LineProfiler.
+func NewLineProfiler() *LineProfiler {
+	return &LineProfiler{lines: make(map[string]map[int]uint64)}
+}
+
+// Add folds the block counts in 'snap' into the profiler's line
+// counts. An error is returned if 'snap' was not captured from the
+// currently running program.
+func (lp *LineProfiler) Add(snap *CounterSnapshot) error {
+	if err := ensureFinalHash(); err != nil {
+		return err
+	}
+	if snap.metaHash != finalHash {
+		return fmt.Errorf("snapshot meta-data hash %x does not match program meta-data hash %x", snap.metaHash, finalHash)
+	}
+	counters := snap.counterMap()
+	add := make(map[srcLine]uint32)
+	err := visitMetaFuncs(metaPayloads(getCovMetaList()), func(pkIdx, fnIdx uint32, pd *decodemeta.CoverageMetaDataDecoder, fd *coverage.FuncDesc) error {
+		ctrs := counters[pkfunc{pk: pkIdx, fcn: fnIdx}]
+		for i, u := range fd.Units {
+			if u.Parent != 0 {
+				continue
+			}
+			count := unitCount(cgran, ctrs, i)
+			for l := u.StLine; l <= u.EnLine; l++ {
+				sl := srcLine{file: fd.Srcfile, line: l}
+				if c, ok := add[sl]; !ok || count > c {
+					add[sl] = count
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+	for sl, c := range add {
+		m := lp.lines[sl.file]
+		if m == nil {
+			m = make(map[int]uint64)
+			lp.lines[sl.file] = m
+		}
+		m[int(sl.line)] += uint64(c)
+	}
+	return nil
+}
+
+// EmitTextProfile writes the accumulated line counts to 'w' in the
+// text format produced by "go test -coverprofile", treating each
+// source line as a block containing a single statement. Lines are
+// written in file and line order.
+func (lp *LineProfiler) EmitTextProfile(w io.Writer) error {
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+	bw := bufio.NewWriter(w)
+	mode := cmode
+	if mode == coverage.CtrModeInvalid {
+		mode = coverage.CtrModeCount
+	}
+	fmt.Fprintf(bw, "mode: %s\n", mode.String())
+	files := make([]string, 0, len(lp.lines))
+	for f := range lp.lines {
+		files = append(files, f)
+	}
+	sort.Strings(files)
+	for _, f := range files {
+		m := lp.lines[f]
+		lines := make([]int, 0, len(m))
+		for l := range m {
+			lines = append(lines, l)
+		}
+		sort.Ints(lines)
+		for _, l := range lines {
+			fmt.Fprintf(bw, "%s:%d.1,%d.1 1 %d\n", f, l, l+1, m[l])
+		}
+	}
+	return bw.Flush()
+}
+
+// Reset discards the accumulated line counts.
+func (lp *LineProfiler) Reset() {
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+	lp.lines = make(map[string]map[int]uint64)
+}
@@ -0,0 +1,21 @@
+// Copyright 2022 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !windows
+
+package coverage
+
+import "os"
+
+// lockFile does nothing on platforms without advisory file locking
+// support in package syscall.
+func lockFile(f *os.File) error {
+	return nil
+}
+
+// unlockFile does nothing on platforms without advisory file locking
+// support in package syscall.
+func unlockFile(f *os.File) error {
+	return nil
+}
@@ -0,0 +1,24 @@
+// Copyright 2022 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package coverage
+
+import (
+	"internal/syscall/windows"
+	"os"
+	"syscall"
+)
+
+// lockFile places an exclusive lock on 'f', waiting until the lock
+// is available.
+func lockFile(f *os.File) error {
+	ol := new(syscall.Overlapped)
+	return windows.LockFileEx(syscall.Handle(f.Fd()), windows.LOCKFILE_EXCLUSIVE_LOCK, 0, ^uint32(0), ^uint32(0), ol)
+}
+
+// unlockFile releases a lock taken by lockFile.
+func unlockFile(f *os.File) error {
+	ol := new(syscall.Overlapped)
+	return windows.UnlockFileEx(syscall.Handle(f.Fd()), 0, ^uint32(0), ^uint32(0), ol)
+}
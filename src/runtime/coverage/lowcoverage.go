@@ -0,0 +1,87 @@
+// Copyright 2022 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package coverage
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+)
+
+// maxLowCoveragePackages is the number of least-covered packages
+// listed in the diagnostic written when SetPanicOnLowCoverage's
+// threshold is not met.
+const maxLowCoveragePackages = 5
+
+// lowCoverageExitCode is the exit status of a program that fails the
+// check enabled by SetPanicOnLowCoverage.
+const lowCoverageExitCode = 2
+
+var (
+	// lowCoverageThreshold holds the math.Float64bits of the
+	// threshold set with SetPanicOnLowCoverage; zero disables the
+	// check.
+	lowCoverageThreshold atomic.Uint64
+
+	// exitingWithZero is set by an exit hook that the runtime only
+	// runs when the program exits with status 0.
+	exitingWithZero     atomic.Bool
+	lowCoverageHookOnce sync.Once
+)
+
+// SetPanicOnLowCoverage arranges for the program to fail if its block
+// coverage (see ProgramCoveragePercent) is below 'threshold', on a
+// scale of 0 to 100, when it exits. The check happens after the
+// counter data has been written out (and after any hooks registered
+// with RegisterFlushHook have run), so the data for the failing run is
+// still available. If the threshold is not met, a diagnostic giving
+// the coverage, the threshold and the (at most five) packages with the
+// most uncovered blocks, in the format used by AssertMinCoverage, is
+// written to standard error, and the program exits with status 2, so
+// that CI scripts can tell a coverage failure from a test failure.
+//
+// The check is only made when the program is exiting with status 0;
+// a program that is already failing keeps its exit status. A
+// threshold of 0 disables the check, and a later call replaces the
+// threshold set by an earlier one. SetPanicOnLowCoverage panics if
+// 'threshold' is out of range. It has no effect if the program was not
+// built with "-cover", and it must not be called while the program is
+// exiting.
+func SetPanicOnLowCoverage(threshold float64) {
+	if err := checkMinPercent(threshold); err != nil {
+		panic(fmt.Sprintf("SetPanicOnLowCoverage: %v", err))
+	}
+	lowCoverageThreshold.Store(math.Float64bits(threshold))
+	if threshold == 0 || len(getCovMetaList()) == 0 {
+		return
+	}
+	lowCoverageHookOnce.Do(func() {
+		// Hooks run in reverse registration order, so this one
+		// runs before emitCounterData, which was registered at
+		// startup.
+		runOnNonZeroExit := false
+		runtime_addExitHook(func() { exitingWithZero.Store(true) }, runOnNonZeroExit)
+	})
+}
+
+// enforceMinCoverageAtExit carries out the check enabled by
+// SetPanicOnLowCoverage. It is called by emitCounterData, the last
+// coverage exit hook to run. Since an exit hook may not call os.Exit,
+// a failing program is terminated with syscall.Exit.
+func enforceMinCoverageAtExit() {
+	threshold := math.Float64frombits(lowCoverageThreshold.Load())
+	if threshold == 0 || !exitingWithZero.Load() {
+		return
+	}
+	err := minCoverageError(threshold, maxLowCoveragePackages)
+	if err == nil {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "error: coverage below threshold set with SetPanicOnLowCoverage\n%v\n", err)
+	syscall.Exit(lowCoverageExitCode)
+}
@@ -0,0 +1,377 @@
+// Copyright 2022 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package coverage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"internal/coverage"
+	"internal/coverage/cmerge"
+	"internal/coverage/pods"
+	"internal/coverage/rtcov"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+// MergeCounterDataDirs merges the coverage data files found in the
+// directories 'srcDirs' into a single meta-data file and a single
+// counter data file written to the existing directory 'dstDir', in
+// the manner of "go tool covdata merge". Counter values are combined
+// according to the counter mode of the data (saturating addition for
+// "count" and "atomic" modes).
+//
+// Only data for a single program can be merged: if the source
+// directories contain data for several programs (meta-data hashes),
+// the data for the program with the most counter data files is
+// merged, and the remaining files are skipped with a warning written
+// to standard error. Note that 'dstDir' should not be one of the
+// source directories, since the merged data would then be counted
+// twice by subsequent readers of that directory.
+func MergeCounterDataDirs(srcDirs []string, dstDir string) error {
+	podlist, err := pods.CollectPods(srcDirs, false)
+	if err != nil {
+		return fmt.Errorf("reading coverage data: %v", err)
+	}
+	if len(podlist) == 0 {
+		return fmt.Errorf("no coverage data files found in %v", srcDirs)
+	}
+	best := 0
+	for i, p := range podlist {
+		if len(p.CounterDataFiles) > len(podlist[best].CounterDataFiles) {
+			best = i
+		}
+	}
+	for i, p := range podlist {
+		if i != best {
+			fmt.Fprintf(os.Stderr, "warning: skipping coverage data for %s (%d counter data files): meta-data hash does not match that of %s\n", p.MetaFile, len(p.CounterDataFiles), podlist[best].MetaFile)
+		}
+	}
+	return mergePod(podlist[best], dstDir)
+}
+
+// mergePod merges the files in the pod 'p', writing the results to
+// 'dstDir'.
+func mergePod(p pods.Pod, dstDir string) error {
+	mb, err := os.ReadFile(p.MetaFile)
+	if err != nil {
+		return err
+	}
+	hash, cmode, cgran, _, err := readMetaData(mb)
+	if err != nil {
+		return fmt.Errorf("reading %s: %v", p.MetaFile, err)
+	}
+	var cm cmerge.Merger
+	if err := cm.SetModeAndGranularity(p.MetaFile, cmode, cgran); err != nil {
+		return err
+	}
+
+	merged := make(map[pkfunc][]uint32)
+	var args map[string]string
+	first := true
+	for _, cdf := range p.CounterDataFiles {
+		snap, err := readCounterFile(cdf)
+		if err != nil {
+			return err
+		}
+		if snap.metaHash != hash {
+			fmt.Fprintf(os.Stderr, "warning: skipping counter data file %s: meta-data hash does not match %s\n", cdf, p.MetaFile)
+			continue
+		}
+		// Keep the args section only if it is the same for all files.
+		if first {
+			args, first = snap.args, false
+		} else if !equalArgs(args, snap.args) {
+			args = map[string]string{}
+		}
+		err = snap.visitFuncs(func(pkgId, funcId uint32, counters []uint32) error {
+			key := pkfunc{pk: pkgId, fcn: funcId}
+			dst, ok := merged[key]
+			if !ok {
+				merged[key] = append([]uint32(nil), counters...)
+				return nil
+			}
+			err, _ := cm.MergeCounters(dst, counters)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("merging counter data file %s: %v", cdf, err)
+		}
+	}
+
+	if err := copyMetaFile(p.MetaFile, hash, int64(len(mb)), dstDir); err != nil {
+		return err
+	}
+	return newSnapshotFromFuncs(hash, args, merged).writeToDir(dstDir)
+}
+
+// readCounterFile reads the counter data file 'path' into a snapshot.
+func readCounterFile(path string) (*CounterSnapshot, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	snap, err := readCounterData(f)
+	if err != nil {
+		return nil, fmt.Errorf("reading counter data file %s: %v", path, err)
+	}
+	return snap, nil
+}
+
+// copyMetaFile copies the meta-data file 'src' (with hash 'hash' and
+// size 'size') into the directory 'dstDir', unless an identically
+// named file of the same size is already present there.
+func copyMetaFile(src string, hash [16]byte, size int64, dstDir string) error {
+	fn := fmt.Sprintf("%s.%x", coverage.MetaFilePref, hash)
+	dst := filepath.Join(dstDir, fn)
+	if fi, err := os.Stat(dst); err == nil && fi.Size() == size {
+		return nil
+	}
+	sf, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer sf.Close()
+	tmp := filepath.Join(dstDir, "tmp."+fn+fmt.Sprintf("%d", time.Now().UnixNano()))
+	df, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("creating meta-data file %s: %v", tmp, err)
+	}
+	if _, err := io.Copy(df, sf); err != nil {
+		df.Close()
+		os.Remove(tmp)
+		return fmt.Errorf("writing %s: %v", tmp, err)
+	}
+	if err := df.Close(); err != nil {
+		return fmt.Errorf("closing meta data temp file: %v", err)
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		return fmt.Errorf("writing %s: rename from %s failed: %v", dst, tmp, err)
+	}
+	return nil
+}
+
+func equalArgs(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if bv, ok := b[k]; !ok || bv != v {
+			return false
+		}
+	}
+	return true
+}
+
+// MergeCoverageCounters reads counter data in the format written by
+// EmitCounterDataToWriter from 'src' and adds its counter values into
+// the live coverage counters of the currently running program, so
+// that subsequently emitted counter data includes them. In "set" mode
+// a counter is set if it is set in either the live data or 'src'; in
+// "count" and "atomic" modes the values are added (saturating at the
+// maximum counter value), using atomic operations in "atomic" mode.
+// An error is returned if the program was not built with "-cover" or
+// if the data in 'src' was produced by a program with different
+// meta-data.
+//
+// Counter values can only be merged into functions that have already
+// executed in the current process, since the runtime does not know
+// where the counters of other functions reside until they run; data
+// for functions that have not yet executed is skipped. Data for a
+// function whose number of counters does not match the live
+// instrumentation is also skipped.
+func MergeCoverageCounters(src io.Reader) error {
+	cl := getCovCounterList()
+	if len(cl) == 0 {
+		return fmt.Errorf("program not built with -cover")
+	}
+	if err := ensureFinalHash(); err != nil {
+		return err
+	}
+	data, err := io.ReadAll(src)
+	if err != nil {
+		return fmt.Errorf("reading counter data: %v", err)
+	}
+	in, err := readCounterData(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	if in.metaHash != finalHash {
+		return fmt.Errorf("counter data meta-data hash %x does not match program meta-data hash %x", in.metaHash, finalHash)
+	}
+	incoming := in.counterMap()
+	pm := getCovPkgMap()
+
+	var sd []atomic.Uint32
+	bufHdr := (*reflect.SliceHeader)(unsafe.Pointer(&sd))
+	for _, c := range cl {
+		bufHdr.Data = uintptr(unsafe.Pointer(c.Counters))
+		bufHdr.Len = int(c.Len)
+		bufHdr.Cap = int(c.Len)
+		for i := 0; i < len(sd); i++ {
+			// Skip ahead until the next function prolog.
+			nCtrs := sd[i].Load()
+			if nCtrs == 0 {
+				continue
+			}
+			pkgId := sd[i+coverage.PkgIdOffset].Load()
+			funcId := sd[i+coverage.FuncIdOffset].Load()
+			key := pkfunc{pk: remapPkgID(pm, i, pkgId, funcId, nCtrs), fcn: funcId}
+			cst := i + coverage.FirstCtrOffset
+			i += coverage.FirstCtrOffset + int(nCtrs) - 1
+
+			vals, ok := incoming[key]
+			if !ok || len(vals) != int(nCtrs) {
+				continue
+			}
+			delete(incoming, key)
+			for j, v := range vals {
+				if v != 0 {
+					mergeCounter(&sd[cst+j], v)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// ConcurrentMergeCoverageCounters is like MergeCoverageCounters, but
+// merges counter data from several sources at once. The sources are
+// read, decoded and merged by a pool of runtime.NumCPU() goroutines,
+// each of which takes a lock on a function's counters (one of a fixed
+// set of locks, chosen by function index) while adding to them. Each
+// source is checked against the meta-data of the running program
+// independently: an error in one source does not prevent the data
+// from the others from being merged. The errors from all sources, if
+// any, are returned together once every source has been processed,
+// combined with errors.Join.
+func ConcurrentMergeCoverageCounters(srcs []io.Reader) error {
+	cl := getCovCounterList()
+	if len(cl) == 0 {
+		return fmt.Errorf("program not built with -cover")
+	}
+	if err := ensureFinalHash(); err != nil {
+		return err
+	}
+	live := liveFuncCounters(cl)
+
+	errs := make([]error, len(srcs))
+	work := make(chan int)
+	var wg sync.WaitGroup
+	nw := runtime.NumCPU()
+	if nw > len(srcs) {
+		nw = len(srcs)
+	}
+	for w := 0; w < nw; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for k := range work {
+				if err := mergeSource(srcs[k], live); err != nil {
+					errs[k] = fmt.Errorf("source %d: %v", k, err)
+				}
+			}
+		}()
+	}
+	for k := range srcs {
+		work <- k
+	}
+	close(work)
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// mergeLocks guards the live counters of functions during
+// ConcurrentMergeCoverageCounters; the lock for a function is
+// mergeLocks[funcId%len(mergeLocks)].
+var mergeLocks [256]sync.Mutex
+
+// mergeSource reads counter data from 'src' and merges it into the
+// live counters 'live', as returned by liveFuncCounters.
+func mergeSource(src io.Reader, live map[pkfunc][]atomic.Uint32) error {
+	data, err := io.ReadAll(src)
+	if err != nil {
+		return fmt.Errorf("reading counter data: %v", err)
+	}
+	in, err := readCounterData(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	if in.metaHash != finalHash {
+		return fmt.Errorf("counter data meta-data hash %x does not match program meta-data hash %x", in.metaHash, finalHash)
+	}
+	return in.visitFuncs(func(pkgId, funcId uint32, vals []uint32) error {
+		ctrs, ok := live[pkfunc{pk: pkgId, fcn: funcId}]
+		if !ok || len(ctrs) != len(vals) {
+			return nil
+		}
+		mu := &mergeLocks[funcId%uint32(len(mergeLocks))]
+		mu.Lock()
+		for j, v := range vals {
+			if v != 0 {
+				mergeCounter(&ctrs[j], v)
+			}
+		}
+		mu.Unlock()
+		return nil
+	})
+}
+
+// liveFuncCounters returns the counters of each function in 'cl'
+// that has executed, keyed by package and function index.
+func liveFuncCounters(cl []rtcov.CovCounterBlob) map[pkfunc][]atomic.Uint32 {
+	pm := getCovPkgMap()
+	live := make(map[pkfunc][]atomic.Uint32)
+	for _, c := range cl {
+		sd := counterSlab(c)
+		for i := 0; i < len(sd); i++ {
+			// Skip ahead until the next function prolog.
+			nCtrs := sd[i].Load()
+			if nCtrs == 0 {
+				continue
+			}
+			pkgId := sd[i+coverage.PkgIdOffset].Load()
+			funcId := sd[i+coverage.FuncIdOffset].Load()
+			key := pkfunc{pk: remapPkgID(pm, i, pkgId, funcId, nCtrs), fcn: funcId}
+			cst := i + coverage.FirstCtrOffset
+			live[key] = sd[cst : cst+int(nCtrs)]
+			i += coverage.FirstCtrOffset + int(nCtrs) - 1
+		}
+	}
+	return live
+}
+
+// mergeCounter merges the non-zero value 'v' into the live counter
+// 'ctr' according to the counter mode.
+func mergeCounter(ctr *atomic.Uint32, v uint32) {
+	sum := func(old uint32) uint32 {
+		if old > math.MaxUint32-v {
+			return math.MaxUint32
+		}
+		return old + v
+	}
+	switch cmode {
+	case coverage.CtrModeSet:
+		ctr.Store(1)
+	case coverage.CtrModeAtomic:
+		for {
+			old := ctr.Load()
+			if ctr.CompareAndSwap(old, sum(old)) {
+				return
+			}
+		}
+	default:
+		ctr.Store(sum(ctr.Load()))
+	}
+}
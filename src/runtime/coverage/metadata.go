@@ -0,0 +1,299 @@
+// Copyright 2022 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package coverage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"internal/coverage"
+	"internal/coverage/decodemeta"
+	"os"
+	"sort"
+)
+
+// MetaDataInfo describes the coverage meta-data for a
+// coverage-instrumented program: the counter mode and granularity
+// selected at build time, and the instrumented packages and functions.
+type MetaDataInfo struct {
+	Hash        [16]byte      // hash of all package meta-data blobs
+	Mode        string        // counter mode: "set", "count" or "atomic"
+	Granularity string        // counter granularity: "perblock" or "perfunc"
+	Packages    []PackageMeta // instrumented packages
+}
+
+// PackageMeta describes the coverage meta-data for a single
+// instrumented package.
+type PackageMeta struct {
+	ImportPath string
+	ModulePath string
+	Functions  []FuncMeta
+}
+
+// FuncMeta describes the coverage meta-data for a single
+// instrumented function.
+type FuncMeta struct {
+	Name       string
+	SourceFile string
+	StartLine  int
+	EndLine    int
+	NumBlocks  int // number of coverable units (blocks) in the function
+}
+
+// visitMetaFuncs decodes the package meta-data blobs in 'payloads',
+// invoking 'f' for each function with the index of the package, the
+// index of the function within the package, the package decoder, and
+// the function descriptor. The FuncDesc passed to 'f' is reused from
+// call to call and must not be retained.
+func visitMetaFuncs(payloads [][]byte, f func(pkIdx, fnIdx uint32, pd *decodemeta.CoverageMetaDataDecoder, fd *coverage.FuncDesc) error) error {
+	for pkIdx, p := range payloads {
+		if err := visitPkgMetaFuncs(p, uint32(pkIdx), nil, f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// visitPkgMetaFuncs decodes the meta-data blob 'p' for the package
+// with index 'pkIdx', invoking 'pf' (if not nil) with the package
+// decoder, then 'f' for each function as for visitMetaFuncs.
+func visitPkgMetaFuncs(p []byte, pkIdx uint32, pf func(pd *decodemeta.CoverageMetaDataDecoder), f func(pkIdx, fnIdx uint32, pd *decodemeta.CoverageMetaDataDecoder, fd *coverage.FuncDesc) error) error {
+	pd, err := decodemeta.NewCoverageMetaDataDecoder(p, true)
+	if err != nil {
+		return fmt.Errorf("reading meta-data for pkg %d: %v", pkIdx, err)
+	}
+	if pf != nil {
+		pf(pd)
+	}
+	var fd coverage.FuncDesc
+	nf := pd.NumFuncs()
+	for fnIdx := uint32(0); fnIdx < nf; fnIdx++ {
+		if err := pd.ReadFunc(fnIdx, &fd); err != nil {
+			return fmt.Errorf("reading meta-data for pkg %s: %v", pd.PackagePath(), err)
+		}
+		if err := f(pkIdx, fnIdx, pd, &fd); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// metaPackagePaths returns the import paths of the packages whose
+// meta-data blobs are in 'payloads', indexed by package index.
+func metaPackagePaths(payloads [][]byte) ([]string, error) {
+	paths := make([]string, len(payloads))
+	for pkIdx, p := range payloads {
+		pd, err := decodemeta.NewCoverageMetaDataDecoder(p, true)
+		if err != nil {
+			return nil, fmt.Errorf("reading meta-data for pkg %d: %v", pkIdx, err)
+		}
+		paths[pkIdx] = pd.PackagePath()
+	}
+	return paths, nil
+}
+
+// newFuncMeta summarizes the function descriptor 'fd'.
+func newFuncMeta(fd *coverage.FuncDesc) FuncMeta {
+	fm := FuncMeta{
+		Name:       fd.Funcname,
+		SourceFile: fd.Srcfile,
+		NumBlocks:  len(fd.Units),
+	}
+	for i, u := range fd.Units {
+		if i == 0 || int(u.StLine) < fm.StartLine {
+			fm.StartLine = int(u.StLine)
+		}
+		if int(u.EnLine) > fm.EndLine {
+			fm.EndLine = int(u.EnLine)
+		}
+	}
+	return fm
+}
+
+// newMetaDataInfo decodes the package meta-data blobs in 'payloads'
+// into a MetaDataInfo.
+func newMetaDataInfo(hash [16]byte, cmode coverage.CounterMode, cgran coverage.CounterGranularity, payloads [][]byte) (*MetaDataInfo, error) {
+	mi := &MetaDataInfo{
+		Hash:        hash,
+		Mode:        cmode.String(),
+		Granularity: cgran.String(),
+		Packages:    make([]PackageMeta, len(payloads)),
+	}
+	for pkIdx, p := range payloads {
+		if err := decodePackageMeta(p, pkIdx, &mi.Packages[pkIdx]); err != nil {
+			return nil, err
+		}
+	}
+	return mi, nil
+}
+
+// decodePackageMeta decodes the meta-data blob 'p' for the package
+// with index 'pkIdx' into 'pm'.
+func decodePackageMeta(p []byte, pkIdx int, pm *PackageMeta) error {
+	return visitPkgMetaFuncs(p, uint32(pkIdx), func(pd *decodemeta.CoverageMetaDataDecoder) {
+		pm.ImportPath = pd.PackagePath()
+		pm.ModulePath = pd.ModulePath()
+		pm.Functions = make([]FuncMeta, 0, pd.NumFuncs())
+	}, func(_, _ uint32, _ *decodemeta.CoverageMetaDataDecoder, fd *coverage.FuncDesc) error {
+		pm.Functions = append(pm.Functions, newFuncMeta(fd))
+		return nil
+	})
+}
+
+// readMetaData decodes the meta-data file content in 'b', returning
+// the file header fields of interest along with views of the
+// per-package payloads.
+func readMetaData(b []byte) (hash [16]byte, cmode coverage.CounterMode, cgran coverage.CounterGranularity, payloads [][]byte, err error) {
+	mfr, err := decodemeta.NewCoverageMetaFileReader(bytes.NewReader(b), b)
+	if err != nil {
+		return hash, cmode, cgran, nil, fmt.Errorf("reading meta-data: %v", err)
+	}
+	np := uint32(mfr.NumPackages())
+	payloads = make([][]byte, 0, np)
+	for pkIdx := uint32(0); pkIdx < np; pkIdx++ {
+		p, err := mfr.GetPackagePayload(pkIdx, nil)
+		if err != nil {
+			return hash, cmode, cgran, nil, fmt.Errorf("reading meta-data: %v", err)
+		}
+		payloads = append(payloads, p)
+	}
+	return mfr.FileHash(), mfr.CounterMode(), mfr.CounterGranularity(), payloads, nil
+}
+
+// MetaDataParseError is the error returned by ParseMetaDataFile for a
+// file that is not a well-formed meta-data file.
+type MetaDataParseError struct {
+	Path   string // path of the file
+	Reason string // description of the problem
+}
+
+func (e *MetaDataParseError) Error() string {
+	return fmt.Sprintf("malformed meta-data file %s: %s", e.Path, e.Reason)
+}
+
+// ParseMetaDataFile reads the meta-data file 'path' (for example one
+// written by EmitMetaDataToDir or EmitMetaDataToWriter) and returns
+// its contents. The file header is checked for the meta-data file
+// magic string and a supported version; if the file is malformed, the
+// error returned is a *MetaDataParseError. Other errors (for example,
+// a failure to read the file) are returned as is.
+func ParseMetaDataFile(path string) (*MetaDataInfo, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	bad := func(format string, a ...any) error {
+		return &MetaDataParseError{Path: path, Reason: fmt.Sprintf(format, a...)}
+	}
+	var hdr coverage.MetaFileHeader
+	if len(b) < binary.Size(hdr) {
+		return nil, bad("file too short (%d bytes)", len(b))
+	}
+	if err := binary.Read(bytes.NewReader(b), binary.LittleEndian, &hdr); err != nil {
+		return nil, bad("reading file header: %v", err)
+	}
+	if hdr.Magic != coverage.CovMetaMagic {
+		return nil, bad("invalid magic string: not a meta-data file")
+	}
+	if hdr.Version == 0 || hdr.Version > coverage.MetaFileVersion {
+		return nil, bad("unsupported file version %d", hdr.Version)
+	}
+	if hdr.TotalLength != uint64(len(b)) {
+		return nil, bad("header gives length %d, file is %d bytes", hdr.TotalLength, len(b))
+	}
+	hash, cmode, cgran, payloads, err := readMetaData(b)
+	if err != nil {
+		return nil, bad("%v", err)
+	}
+	mi, err := newMetaDataInfo(hash, cmode, cgran, payloads)
+	if err != nil {
+		return nil, bad("%v", err)
+	}
+	return mi, nil
+}
+
+// FindFunction returns the meta-data for the function 'funcName'
+// (the name as recorded in the meta-data, for example "F" or
+// "*T.Method") in the package with import path 'pkgPath', and true,
+// or nil and false if there is no such function. The result points
+// into 'mi.Packages'.
+func (mi *MetaDataInfo) FindFunction(pkgPath, funcName string) (*FuncMeta, bool) {
+	for i := range mi.Packages {
+		pm := &mi.Packages[i]
+		if pm.ImportPath != pkgPath {
+			continue
+		}
+		for j := range pm.Functions {
+			if pm.Functions[j].Name == funcName {
+				return &pm.Functions[j], true
+			}
+		}
+	}
+	return nil, false
+}
+
+// CoveragePackageList returns the import paths of the instrumented
+// packages in the currently running program, whether or not any of
+// their code has executed, sorted and without duplicates. An error is
+// returned if the program was not built with "-cover".
+func CoveragePackageList() ([]string, error) {
+	ml := getCovMetaList()
+	if len(ml) == 0 {
+		return nil, fmt.Errorf("program not built with -cover")
+	}
+	if err := ensureFinalHash(); err != nil {
+		return nil, err
+	}
+	paths := make([]string, 0, len(ml))
+	for _, b := range ml {
+		paths = append(paths, b.PkgPath)
+	}
+	return sortedUnique(paths), nil
+}
+
+// CoverageFileList returns the source files of the instrumented
+// package 'pkgPath' that contain instrumented functions, sorted and
+// without duplicates. An error is returned if the program was not
+// built with "-cover", or if it has no instrumented package
+// 'pkgPath'.
+func CoverageFileList(pkgPath string) ([]string, error) {
+	ml := getCovMetaList()
+	if len(ml) == 0 {
+		return nil, fmt.Errorf("program not built with -cover")
+	}
+	if err := ensureFinalHash(); err != nil {
+		return nil, err
+	}
+	var payloads [][]byte
+	for k, b := range ml {
+		if b.PkgPath == pkgPath {
+			payloads = append(payloads, metaPayloads(ml[k:k+1])...)
+		}
+	}
+	if len(payloads) == 0 {
+		return nil, fmt.Errorf("package %q is not instrumented", pkgPath)
+	}
+	files := []string{}
+	err := visitMetaFuncs(payloads, func(pkIdx, fnIdx uint32, pd *decodemeta.CoverageMetaDataDecoder, fd *coverage.FuncDesc) error {
+		files = append(files, fd.Srcfile)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return sortedUnique(files), nil
+}
+
+// sortedUnique sorts 's' in place and removes duplicate entries.
+func sortedUnique(s []string) []string {
+	sort.Strings(s)
+	out := s[:0]
+	for _, v := range s {
+		if len(out) == 0 || v != out[len(out)-1] {
+			out = append(out, v)
+		}
+	}
+	return out
+}
@@ -0,0 +1,93 @@
+// Copyright 2022 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package coverage
+
+import (
+	"encoding/binary"
+	"fmt"
+	"internal/coverage"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	_ "unsafe"
+)
+
+var (
+	counterFileNamerMu sync.Mutex
+	counterFileNamer   func(metaHash [16]byte, pid int) string
+)
+
+// SetCounterFileNamer installs 'fn' as the function used to choose
+// the base name of the counter data files written by
+// EmitCounterDataToDir and at program exit, in place of the default
+// "covcounters.<meta hash>.<pid>.<timestamp>" scheme. The default
+// scheme can collide when a process ID is reused, for example by
+// PID 1 across container restarts. 'fn' is called each time a
+// counter data file is created, and must return a file name with no
+// directory component; "go tool covdata" only reads counter data
+// files whose names have the same form as the default, with the
+// final field (and only that field) free to vary. A nil 'fn'
+// restores the default scheme. An error is returned if the exit-time
+// flush of coverage data has already begun.
+func SetCounterFileNamer(fn func(metaHash [16]byte, pid int) string) error {
+	flushHooksMu.Lock()
+	started := flushHooksStarted
+	flushHooksMu.Unlock()
+	if started {
+		return fmt.Errorf("coverage data flush already started")
+	}
+	counterFileNamerMu.Lock()
+	defer counterFileNamerMu.Unlock()
+	counterFileNamer = fn
+	return nil
+}
+
+// UUIDFileNamer returns a counter file naming function, for use with
+// SetCounterFileNamer, that replaces the timestamp in the default
+// naming scheme with a random (version 4) UUID, written as a decimal
+// integer so that the names are still recognized by "go tool
+// covdata". The random bits come from the runtime's random number
+// generator, which is seeded from the operating system at startup.
+func UUIDFileNamer() func(metaHash [16]byte, pid int) string {
+	return func(metaHash [16]byte, pid int) string {
+		var uuid [16]byte
+		binary.BigEndian.PutUint64(uuid[:8], runtime_fastrand64())
+		binary.BigEndian.PutUint64(uuid[8:], runtime_fastrand64())
+		uuid[6] = uuid[6]&0x0f | 0x40 // version 4
+		uuid[8] = uuid[8]&0x3f | 0x80 // variant 10
+		// The low half is zero-padded to the maximum width of a
+		// uint64, so that distinct UUIDs give distinct names.
+		hi, lo := binary.BigEndian.Uint64(uuid[:8]), binary.BigEndian.Uint64(uuid[8:])
+		return fmt.Sprintf("%s.%x.%d.%d%020d", coverage.CounterFilePref, metaHash, pid, hi, lo)
+	}
+}
+
+//go:linkname runtime_fastrand64 runtime.fastrand64
+func runtime_fastrand64() uint64
+
+// defaultCounterFileName returns the base name of a counter data
+// file under the default naming scheme.
+func defaultCounterFileName(metaHash [16]byte, pid int) string {
+	return fmt.Sprintf(coverage.CounterFileTempl, coverage.CounterFilePref, metaHash, pid, time.Now().UnixNano())
+}
+
+// counterFileName returns the base name to use for a new counter
+// data file, consulting the namer installed by SetCounterFileNamer
+// if there is one.
+func counterFileName(metaHash [16]byte) (string, error) {
+	counterFileNamerMu.Lock()
+	namer := counterFileNamer
+	counterFileNamerMu.Unlock()
+	pid := os.Getpid()
+	if namer == nil {
+		return defaultCounterFileName(metaHash, pid), nil
+	}
+	fn := namer(metaHash, pid)
+	if fn == "" || fn == "." || fn == ".." || strings.ContainsAny(fn, `/`+string(os.PathSeparator)) {
+		return "", fmt.Errorf("invalid counter data file name %q from counter file namer", fn)
+	}
+	return fn, nil
+}
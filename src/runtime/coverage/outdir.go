@@ -0,0 +1,80 @@
+// Copyright 2022 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package coverage
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+var (
+	outputDirMu sync.Mutex
+	// Output directory set with SetCoverageOutputDir; overrides
+	// GOCOVERDIR when non-empty.
+	outputDir string
+)
+
+// SetCoverageOutputDir sets the directory into which coverage data
+// files are written when the program exits, overriding the GOCOVERDIR
+// environment variable. This allows the directory to be chosen after
+// the program has started, for example once a volume has been
+// mounted. The directory also becomes the default for
+// EmitMetaDataToDir and EmitCounterDataToDir, which use it when
+// called with an empty directory name. If a meta-data file has not
+// already been written to the directory, one is written at exit
+// along with the counter data. An empty 'dir' reverts to the
+// GOCOVERDIR setting. An error is returned if the program was not
+// built with "-cover", or if 'dir' is not a writable directory.
+func SetCoverageOutputDir(dir string) error {
+	if len(getCovCounterList()) == 0 {
+		return fmt.Errorf("program not built with -cover")
+	}
+	if dir != "" {
+		if err := checkOutputDir(dir); err != nil {
+			return err
+		}
+	}
+	outputDirMu.Lock()
+	defer outputDirMu.Unlock()
+	outputDir = dir
+	return nil
+}
+
+// GetCoverageOutputDir returns the directory into which coverage data
+// files will be written when the program exits: the directory set
+// with SetCoverageOutputDir if there is one, and otherwise the value
+// of GOCOVERDIR (which may be empty).
+func GetCoverageOutputDir() string {
+	outputDirMu.Lock()
+	dir := outputDir
+	outputDirMu.Unlock()
+	if dir != "" {
+		return dir
+	}
+	if goCoverDir != "" {
+		return goCoverDir
+	}
+	return os.Getenv("GOCOVERDIR")
+}
+
+// checkOutputDir returns an error if 'dir' is not a writable
+// directory.
+func checkOutputDir(dir string) error {
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return fmt.Errorf("output directory %q inaccessible (err: %v)", dir, err)
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("output directory %q not a directory", dir)
+	}
+	f, err := os.CreateTemp(dir, "tmp.covdircheck")
+	if err != nil {
+		return fmt.Errorf("output directory %q not writable (err: %v)", dir, err)
+	}
+	f.Close()
+	os.Remove(f.Name())
+	return nil
+}
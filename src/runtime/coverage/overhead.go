@@ -0,0 +1,193 @@
+// Copyright 2022 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package coverage
+
+import (
+	"fmt"
+	"internal/coverage"
+	"internal/coverage/decodemeta"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// CounterDataStats describes the size of the coverage counter data
+// for the currently running program, along with estimates of the
+// cost of emitting it. See GetCounterDataStats.
+type CounterDataStats struct {
+	TotalSlots          uint64 // counter slots across all instrumented functions
+	NonZeroSlots        uint64 // counter slots with a non-zero value
+	EstimatedEmitBytes  int64  // estimated size of the counter data
+	EstimatedEmitTimeNs int64  // estimated time to encode the counter data
+	MetaBytes           int    // total size of the raw meta-data blobs
+}
+
+// GetCounterDataStats returns statistics on the coverage counter data
+// for the currently running program, intended to help decide how (or
+// whether) to emit it in latency-sensitive code. The time estimate is
+// a linear model based on the encoding throughput measured on the
+// current machine the first time GetCounterDataStats is called; it
+// does not include the cost of writing to the destination. An error
+// is returned if the program was not built with "-cover".
+func GetCounterDataStats() (*CounterDataStats, error) {
+	snap, err := ReadCounterSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	st := &CounterDataStats{}
+	payloads := metaPayloads(getCovMetaList())
+	for _, p := range payloads {
+		st.MetaBytes += len(p)
+	}
+	err = visitMetaFuncs(payloads, func(pkIdx, fnIdx uint32, pd *decodemeta.CoverageMetaDataDecoder, fd *coverage.FuncDesc) error {
+		if cgran == coverage.CtrGranularityPerFunc {
+			st.TotalSlots++
+		} else {
+			st.TotalSlots += uint64(len(fd.Units))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	funcs := snap.counterMap()
+	for _, c := range funcs {
+		for _, v := range c {
+			if v != 0 {
+				st.NonZeroSlots++
+			}
+		}
+	}
+	st.EstimatedEmitBytes = estimateCounterDataSize(snap.args, funcs)
+	st.EstimatedEmitTimeNs = int64(float64(st.EstimatedEmitBytes) / emitBytesPerNs())
+	return st, nil
+}
+
+var (
+	calibrateOnce sync.Once
+	bytesPerNs    float64
+)
+
+// emitBytesPerNs returns the measured throughput, in bytes per
+// nanosecond, of encoding counter data on the current machine.
+func emitBytesPerNs() float64 {
+	calibrateOnce.Do(func() {
+		// Encode a synthetic data set of a few hundred functions.
+		funcs := make(map[pkfunc][]uint32)
+		for i := uint32(0); i < 256; i++ {
+			c := make([]uint32, 16)
+			for j := range c {
+				c[j] = i*16 + uint32(j) + 1
+			}
+			funcs[pkfunc{pk: i / 16, fcn: i % 16}] = c
+		}
+		s := newSnapshotFromFuncs([16]byte{}, nil, funcs)
+		cw := &countingWriter{w: io.Discard}
+		start := time.Now()
+		err := s.write(cw)
+		ns := time.Since(start).Nanoseconds()
+		if err != nil || cw.n == 0 {
+			// Should not happen; fall back to a nominal rate.
+			bytesPerNs = 1
+			return
+		}
+		if ns <= 0 {
+			ns = 1
+		}
+		bytesPerNs = float64(cw.n) / float64(ns)
+	})
+	return bytesPerNs
+}
+
+// CoverageOverhead describes the runtime cost of coverage
+// instrumentation in the currently running program. See
+// ProfileCoverageOverhead.
+type CoverageOverhead struct {
+	CounterIncrementNs float64 // average time per counter update
+	EmitMetaMs         float64 // time to emit the meta-data
+	EmitCounterMs      float64 // time to emit the counter data
+	CounterMemoryBytes int64   // total size of the counter arrays
+}
+
+// overheadIterations is the number of loop iterations timed by
+// ProfileCoverageOverhead.
+const overheadIterations = 1000000
+
+// ProfileCoverageOverhead measures the cost of coverage
+// instrumentation in the currently running program. The counter
+// update cost is the difference in running time between a loop of
+// one million iterations that updates a counter in the manner of the
+// program's counter mode (a plain store for "set", an increment for
+// "count", and an atomic add for "atomic") and the same loop without
+// the update, divided by the number of iterations; it may be slightly
+// negative on a noisy machine. The emit times are those of encoding
+// the meta-data, and of snapshotting and encoding the counter data,
+// to io.Discard; registered plugins and emit hooks are not run, and
+// the size limit set with SetMaxCounterFileSize is not applied. The
+// call takes a few milliseconds and does not affect the program's
+// coverage data, so it may be used to serve a diagnostic endpoint in
+// a running server. An error is returned if the program was not built
+// with "-cover".
+func ProfileCoverageOverhead() (CoverageOverhead, error) {
+	var oh CoverageOverhead
+	cl := getCovCounterList()
+	if len(cl) == 0 {
+		return oh, fmt.Errorf("program not built with -cover")
+	}
+	if err := ensureFinalHash(); err != nil {
+		return oh, err
+	}
+	for _, c := range cl {
+		oh.CounterMemoryBytes += int64(c.Len) * 4
+	}
+
+	base := timeCounterLoop(func(ctr *uint32) {})
+	var update func(ctr *uint32)
+	switch cmode {
+	case coverage.CtrModeSet:
+		update = func(ctr *uint32) { *ctr = 1 }
+	case coverage.CtrModeAtomic:
+		update = func(ctr *uint32) { atomic.AddUint32(ctr, 1) }
+	default:
+		update = func(ctr *uint32) { *ctr++ }
+	}
+	oh.CounterIncrementNs = float64(timeCounterLoop(update)-base) / overheadIterations
+
+	start := time.Now()
+	if err := writeMetaData(io.Discard, getCovMetaList(), cmode, cgran, finalHash); err != nil {
+		return oh, err
+	}
+	oh.EmitMetaMs = float64(time.Since(start).Nanoseconds()) / 1e6
+	start = time.Now()
+	snap, err := ReadCounterSnapshot()
+	if err != nil {
+		return oh, err
+	}
+	if err := snap.write(io.Discard); err != nil {
+		return oh, err
+	}
+	oh.EmitCounterMs = float64(time.Since(start).Nanoseconds()) / 1e6
+	return oh, nil
+}
+
+// overheadSink keeps the results of timeCounterLoop live.
+var overheadSink uint32
+
+// timeCounterLoop returns the time, in nanoseconds, taken by
+// overheadIterations iterations of a loop that calls 'update' on a
+// counter.
+//
+//go:noinline
+func timeCounterLoop(update func(ctr *uint32)) int64 {
+	ctrs := new([8]uint32)
+	start := time.Now()
+	for i := 0; i < overheadIterations; i++ {
+		update(&ctrs[i%len(ctrs)])
+	}
+	ns := time.Since(start).Nanoseconds()
+	overheadSink += ctrs[0]
+	return ns
+}
@@ -0,0 +1,58 @@
+// Copyright 2022 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package coverage
+
+import (
+	"fmt"
+	"strings"
+)
+
+// PinnedCoverageResult holds a counter snapshot for as long as it is
+// needed by a long-lived consumer, such as a dashboard that serves
+// coverage results on request. Since a snapshot is a copy of the
+// counter values, a pinned result is not affected by
+// ClearCoverageCounters or by the subsequent execution of the
+// program; the reference held by the PinnedCoverageResult keeps its
+// storage from being collected until Unpin is called. A
+// PinnedCoverageResult is not safe for concurrent use with Unpin.
+type PinnedCoverageResult struct {
+	*CounterSnapshot
+}
+
+// Pin returns a PinnedCoverageResult holding 'snap'.
+func Pin(snap *CounterSnapshot) *PinnedCoverageResult {
+	return &PinnedCoverageResult{CounterSnapshot: snap}
+}
+
+// Unpin drops the result's reference to its snapshot, allowing the
+// snapshot's storage to be garbage collected once no other references
+// remain. After Unpin, JSON returns an error.
+func (p *PinnedCoverageResult) Unpin() {
+	p.CounterSnapshot = nil
+}
+
+// JSON returns the pinned snapshot encoded in the format written by
+// WriteCoverageToJSON, without indentation. An error is returned if
+// the result has been unpinned or if the snapshot was not captured
+// from the currently running program.
+func (p *PinnedCoverageResult) JSON() ([]byte, error) {
+	snap := p.CounterSnapshot
+	if snap == nil {
+		return nil, fmt.Errorf("coverage result is not pinned")
+	}
+	if err := ensureFinalHash(); err != nil {
+		return nil, err
+	}
+	if snap.metaHash != finalHash {
+		return nil, fmt.Errorf("snapshot meta-data hash %x does not match program meta-data hash %x", snap.metaHash, finalHash)
+	}
+	doc, err := coverageJSONDoc(snap)
+	if err != nil {
+		return nil, err
+	}
+	var sb strings.Builder
+	writeJSON(&sb, doc, false, 0)
+	return []byte(sb.String()), nil
+}
@@ -0,0 +1,96 @@
+// Copyright 2022 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package coverage
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+// CoveragePlugin is the interface implemented by post-processors of
+// emitted coverage data (for example to encrypt or upload the data).
+// Each method receives the encoded data and returns a reader from
+// which the processed data is read.
+type CoveragePlugin interface {
+	ProcessMetaData(r io.Reader) (io.Reader, error)
+	ProcessCounterData(r io.Reader) (io.Reader, error)
+}
+
+type namedPlugin struct {
+	name string
+	p    CoveragePlugin
+}
+
+var (
+	pluginsMu sync.Mutex
+	plugins   []namedPlugin
+)
+
+// RegisterCoveragePlugin adds the plugin 'p' under the name 'name' to
+// the chain of plugins applied to coverage data written by the
+// EmitMetaData* and EmitCounterData* functions and by the
+// end-of-execution emission to GOCOVERDIR. Plugins are applied in
+// registration order. Registering a plugin with the name of an
+// existing one replaces it, keeping its position in the chain.
+//
+// Note that data processed by plugins will in general no longer be
+// readable by "go tool covdata" and similar tools.
+func RegisterCoveragePlugin(name string, p CoveragePlugin) {
+	pluginsMu.Lock()
+	defer pluginsMu.Unlock()
+	for i := range plugins {
+		if plugins[i].name == name {
+			plugins[i].p = p
+			return
+		}
+	}
+	plugins = append(plugins, namedPlugin{name: name, p: p})
+}
+
+// UnregisterCoveragePlugin removes the plugin registered under the
+// name 'name', if any.
+func UnregisterCoveragePlugin(name string) {
+	pluginsMu.Lock()
+	defer pluginsMu.Unlock()
+	for i := range plugins {
+		if plugins[i].name == name {
+			plugins = append(plugins[:i:i], plugins[i+1:]...)
+			return
+		}
+	}
+}
+
+// writeWithPlugins invokes 'write' to produce coverage data of the
+// kind selected by 'which' (meta-data or counter data), passes the
+// data through the registered plugin chain, and writes the result to
+// 'w'. If no plugins are registered, 'write' writes directly to 'w'.
+func writeWithPlugins(w io.Writer, which fileType, write func(w io.Writer) error) error {
+	pluginsMu.Lock()
+	chain := plugins
+	pluginsMu.Unlock()
+	if len(chain) == 0 {
+		return write(w)
+	}
+
+	var buf bytes.Buffer
+	if err := write(&buf); err != nil {
+		return err
+	}
+	var r io.Reader = &buf
+	for _, np := range chain {
+		var err error
+		if which == metaDataFile {
+			r, err = np.p.ProcessMetaData(r)
+		} else {
+			r, err = np.p.ProcessCounterData(r)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	_, err := io.Copy(w, r)
+	return err
+}
@@ -0,0 +1,54 @@
+// Copyright 2022 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package coverage
+
+import "sync"
+
+// SnapshotPool is a pool of CounterSnapshot values whose counter
+// storage is recycled, reducing allocation in programs that capture
+// snapshots at a high rate (for example to measure per-request
+// coverage). The zero value is ready to use. A SnapshotPool is safe
+// for concurrent use and must not be copied after first use.
+type SnapshotPool struct {
+	p sync.Pool
+}
+
+// Get returns a snapshot of the coverage counter values for the
+// currently running program, as ReadCounterSnapshot, reusing the
+// storage of a snapshot previously passed to Put if one is available.
+// Get returns nil if the program was not built with "-cover" or if
+// its meta-data is not available.
+func (sp *SnapshotPool) Get() *CounterSnapshot {
+	cl := getCovCounterList()
+	if len(cl) == 0 {
+		return nil
+	}
+	if err := ensureFinalHash(); err != nil {
+		return nil
+	}
+	snap, _ := sp.p.Get().(*CounterSnapshot)
+	if snap == nil {
+		snap = &CounterSnapshot{}
+	}
+	snap.fill(cl)
+	return snap
+}
+
+// Put returns 'snap' to the pool for reuse by a later call to Get.
+// The snapshot's counter values are cleared, and the caller must not
+// use 'snap' after calling Put. Put ignores a nil snapshot.
+func (sp *SnapshotPool) Put(snap *CounterSnapshot) {
+	if snap == nil {
+		return
+	}
+	for _, sd := range snap.slabs {
+		for i := range sd {
+			sd[i] = 0
+		}
+	}
+	snap.args = nil
+	snap.pkgmap = nil
+	sp.p.Put(snap)
+}
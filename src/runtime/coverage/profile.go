@@ -0,0 +1,58 @@
+// Copyright 2022 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package coverage
+
+import (
+	"bufio"
+	"internal/coverage"
+	"internal/coverage/cformat"
+	"internal/coverage/decodemeta"
+	"io"
+)
+
+// WriteCoverageProfile writes the coverage data for the currently
+// running program to 'w' in the text format produced by "go test
+// -coverprofile" (and read by "go tool cover"), using the current
+// counter values. As with "go test", packages are written in import
+// path order, and the lines for each package are sorted by source
+// file and then by position within the file, so the output is
+// deterministic. If the program was built with per-function
+// counter granularity, each block reports the count for its function.
+// An error is returned if the program was not built with "-cover", or
+// if a write fails.
+func WriteCoverageProfile(w io.Writer) error {
+	snap, err := ReadCounterSnapshot()
+	if err != nil {
+		return err
+	}
+	return writeTextProfile(w, snap.counterMap())
+}
+
+// writeTextProfile writes the counter values 'counters' to 'w' in the
+// text format used by WriteCoverageProfile.
+func writeTextProfile(w io.Writer, counters map[pkfunc][]uint32) error {
+	cf := cformat.NewFormatter(cmode)
+	err := visitMetaFuncs(metaPayloads(getCovMetaList()), func(pkIdx, fnIdx uint32, pd *decodemeta.CoverageMetaDataDecoder, fd *coverage.FuncDesc) error {
+		cf.SetPackage(pd.PackagePath())
+		ctrs := counters[pkfunc{pk: pkIdx, fcn: fnIdx}]
+		for i, u := range fd.Units {
+			// Skip units with non-zero parent (no way to represent
+			// these in the existing format).
+			if u.Parent != 0 {
+				continue
+			}
+			cf.AddUnit(fd.Srcfile, fd.Funcname, fd.Lit, u, unitCount(cgran, ctrs, i))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(w)
+	if err := cf.EmitTextual(bw); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
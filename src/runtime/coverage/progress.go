@@ -0,0 +1,266 @@
+// Copyright 2022 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package coverage
+
+import (
+	"encoding/binary"
+	"fmt"
+	"internal/coverage"
+	"internal/coverage/encodecounter"
+	"io"
+	"sync"
+)
+
+// EmitProgress reports the progress of a counter data emission
+// started with EmitCounterDataToWriterWithProgress.
+type EmitProgress struct {
+	PackagesEmitted     int   // packages whose counter data has been written
+	TotalPackages       int   // packages with counter data to write
+	BytesWritten        int64 // bytes written to the destination writer so far
+	EstimatedTotalBytes int64 // estimated size of the counter data
+
+	// Err is set on the final progress event if emission failed.
+	Err error
+}
+
+// EmitCounterDataToWriterWithProgress is like EmitCounterDataToWriter,
+// but performs the write in a separate goroutine, returning a channel
+// on which progress is reported. The counter data written will be a
+// snapshot taken at the point of the call. One event is sent for each
+// package emitted, and the channel is closed once emission is
+// complete; the channel is sized so that emission never blocks
+// waiting for the receiver. An error is returned immediately if the
+// program was not built with "-cover" or if 'w' is nil.
+func EmitCounterDataToWriterWithProgress(w io.Writer) (<-chan EmitProgress, error) {
+	if w == nil {
+		return nil, fmt.Errorf("error: nil writer in EmitCounterDataToWriterWithProgress")
+	}
+	snap, err := ReadCounterSnapshot()
+	if err != nil {
+		return nil, err
+	}
+
+	// One event per package, plus one for a possible error. The
+	// number of packages written may be reduced by a size limit (see
+	// SetMaxCounterFileSize), but can't grow.
+	npkgs := len(snapshotPkgs(snap.counterMap()))
+	cw := &countingWriter{w: w}
+	pv := &progressVisitor{
+		cw: cw,
+		ch: make(chan EmitProgress, npkgs+1),
+	}
+	go func() {
+		defer close(pv.ch)
+		err := writeCounterData(cw, snap, nil, func(snap *CounterSnapshot) encodecounter.CounterVisitor {
+			// Lay out the live functions in package order, so that
+			// progress can be reported as each package is completed.
+			funcs := snap.counterMap()
+			pv.snapshotVisitor = snapshotVisitor{newSnapshotFromFuncs(snap.metaHash, snap.args, funcs)}
+			pv.p.TotalPackages = len(snapshotPkgs(funcs))
+			pv.p.EstimatedTotalBytes = estimateCounterDataSize(snap.args, funcs)
+			return pv
+		})
+		if err != nil {
+			pv.p.Err = err
+			pv.send()
+			return
+		}
+		// Report the final package only once all data has been
+		// flushed to the writer.
+		if pv.started {
+			pv.send()
+		}
+	}()
+	return pv.ch, nil
+}
+
+// snapshotPkgs returns the set of packages with functions in 'funcs'.
+func snapshotPkgs(funcs map[pkfunc][]uint32) map[uint32]bool {
+	pkgs := make(map[uint32]bool)
+	for k := range funcs {
+		pkgs[k.pk] = true
+	}
+	return pkgs
+}
+
+// progressVisitor is a counter visitor that sends a progress event
+// each time it moves on from one package to the next.
+type progressVisitor struct {
+	snapshotVisitor
+	cw      *countingWriter
+	ch      chan EmitProgress
+	p       EmitProgress
+	curPkg  uint32
+	started bool
+}
+
+func (v *progressVisitor) VisitFuncs(f encodecounter.CounterVisitorFn) error {
+	return v.s.visitFuncs(func(pkgId, funcId uint32, counters []uint32) error {
+		if v.started && pkgId != v.curPkg {
+			v.send()
+		}
+		v.curPkg, v.started = pkgId, true
+		return f(pkgId, funcId, counters)
+	})
+}
+
+func (v *progressVisitor) send() {
+	if v.p.Err == nil {
+		v.p.PackagesEmitted++
+	}
+	v.p.BytesWritten = v.cw.n
+	v.ch <- v.p
+}
+
+// countingWriter is an io.Writer that tracks the number of bytes
+// written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+// estimateCounterDataSize returns an estimate of the size of a counter
+// data file containing the args 'args' and the counter values in
+// 'funcs', written using the ULEB128 counter flavor.
+func estimateCounterDataSize(args map[string]string, funcs map[pkfunc][]uint32) int64 {
+	tot := int64(binary.Size(coverage.CounterFileHeader{}) +
+		binary.Size(coverage.CounterSegmentHeader{}) +
+		binary.Size(coverage.CounterFileFooter{}))
+	// String table entries for keys and values, plus the args
+	// table itself (string table indices).
+	for k, v := range args {
+		tot += int64(ulebSize(uint32(len(k))) + len(k) + ulebSize(uint32(len(v))) + len(v) + 2)
+	}
+	for k, c := range funcs {
+		tot += int64(ulebSize(uint32(len(c))) + ulebSize(k.pk) + ulebSize(k.fcn))
+		for _, v := range c {
+			tot += int64(ulebSize(v))
+		}
+	}
+	return tot
+}
+
+// ulebSize returns the number of bytes needed to encode 'v' in
+// ULEB128 format.
+func ulebSize(v uint32) int {
+	n := 1
+	for v >= 0x80 {
+		v >>= 7
+		n++
+	}
+	return n
+}
+
+// ProgressWriter receives progress reports while counter data is
+// written; see SetEmitProgressWriter.
+type ProgressWriter interface {
+	// ReportProgress is called after the counter data for the
+	// package with import path 'pkg' has been written, with the
+	// number of packages written so far and the total number of
+	// packages with counter data to write.
+	ReportProgress(pkg string, done, total int)
+}
+
+var (
+	// emitProgressMu protects emitProgress.
+	emitProgressMu sync.Mutex
+	// Progress writer set with SetEmitProgressWriter.
+	emitProgress ProgressWriter
+)
+
+// SetEmitProgressWriter sets a ProgressWriter to be notified as
+// counter data is written by EmitCounterDataToWriter,
+// EmitCounterDataToDir, and the counter data file written at exit.
+// When a progress writer is set, packages are written in package
+// index order and the output is flushed to the destination after each
+// package, before 'pw' is called. No locks internal to this package
+// are held during calls to 'pw'. Calling SetEmitProgressWriter(nil)
+// turns progress reporting off, which is the default.
+func SetEmitProgressWriter(pw ProgressWriter) {
+	emitProgressMu.Lock()
+	defer emitProgressMu.Unlock()
+	emitProgress = pw
+}
+
+// LogProgressWriter returns a ProgressWriter that writes a line of the
+// form "coverage: wrote pkg N/M: pkgpath" to 'w' for each package.
+func LogProgressWriter(w io.Writer) ProgressWriter {
+	return logProgressWriter{w}
+}
+
+type logProgressWriter struct {
+	w io.Writer
+}
+
+func (lw logProgressWriter) ReportProgress(pkg string, done, total int) {
+	fmt.Fprintf(lw.w, "coverage: wrote pkg %d/%d: %s\n", done, total, pkg)
+}
+
+// getEmitProgressWriter returns the ProgressWriter set with
+// SetEmitProgressWriter, or nil.
+func getEmitProgressWriter() ProgressWriter {
+	emitProgressMu.Lock()
+	defer emitProgressMu.Unlock()
+	return emitProgress
+}
+
+// writeWithProgress writes the snapshot 's' to 'w' in the counter data
+// file format, with packages in index order, flushing the output and
+// reporting to 'pw' after each package.
+func (s *CounterSnapshot) writeWithProgress(w io.Writer, pw ProgressWriter) error {
+	funcs := s.counterMap()
+	sorted := newSnapshotFromFuncs(s.metaHash, s.args, funcs)
+	pkgs := make(map[uint32]bool)
+	for k := range funcs {
+		pkgs[k.pk] = true
+	}
+	ml := getCovMetaList()
+	pkgPath := func(pk uint32) string {
+		if int(pk) < len(ml) {
+			return ml[pk].PkgPath
+		}
+		return fmt.Sprintf("<package %d>", pk)
+	}
+
+	cfw := encodecounter.NewCoverageDataWriter(w, coverage.CtrULeb128)
+	if err := cfw.BeginStream(sorted.metaHash, sorted.args, len(funcs)); err != nil {
+		return err
+	}
+	done := 0
+	finish := func(pk uint32) error {
+		if err := cfw.Flush(); err != nil {
+			return err
+		}
+		done++
+		pw.ReportProgress(pkgPath(pk), done, len(pkgs))
+		return nil
+	}
+	var curPkg uint32
+	started := false
+	err := sorted.visitFuncs(func(pkgId, funcId uint32, counters []uint32) error {
+		if started && pkgId != curPkg {
+			if err := finish(curPkg); err != nil {
+				return err
+			}
+		}
+		curPkg, started = pkgId, true
+		return cfw.WriteFunc(pkgId, funcId, counters)
+	})
+	if err != nil {
+		return err
+	}
+	if started {
+		if err := finish(curPkg); err != nil {
+			return err
+		}
+	}
+	return cfw.EndStream()
+}
@@ -0,0 +1,190 @@
+// Copyright 2022 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package coverage
+
+import (
+	"errors"
+	"fmt"
+	"internal/coverage"
+	"internal/coverage/decodemeta"
+	"internal/coverage/rtcov"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
+
+// errFuncFound is used to stop a meta-data walk once the function
+// being searched for has been located.
+var errFuncFound = errors.New("function found")
+
+// QueryBlockHits returns the current counter value for block
+// 'blockIndex' of the function 'funcName' in the instrumented package
+// with import path 'pkgPath'. Function names are as recorded in the
+// coverage meta-data (and reported by GetAllFunctions), and blocks
+// are numbered in meta-data order starting at zero. In "set" mode the
+// value is 1 if the block has executed and 0 otherwise; in "count"
+// and "atomic" modes it is the number of times the block has
+// executed. The value is a point-in-time read of a counter that other
+// goroutines may be updating, so it may already be stale by the time
+// the caller uses it. An error is returned if the program was not
+// built with "-cover", if the package or function is not
+// instrumented, or if 'blockIndex' is out of range for the function.
+func QueryBlockHits(pkgPath, funcName string, blockIndex int) (uint64, error) {
+	cl := getCovCounterList()
+	if len(cl) == 0 {
+		return 0, fmt.Errorf("program not built with -cover")
+	}
+	var pkIdx, fnIdx uint32
+	nBlocks := -1
+	sawPkg := false
+	err := visitMetaFuncs(metaPayloads(getCovMetaList()), func(pk, fn uint32, pd *decodemeta.CoverageMetaDataDecoder, fd *coverage.FuncDesc) error {
+		if pd.PackagePath() != pkgPath {
+			return nil
+		}
+		sawPkg = true
+		if fd.Funcname != funcName {
+			return nil
+		}
+		pkIdx, fnIdx, nBlocks = pk, fn, len(fd.Units)
+		return errFuncFound
+	})
+	if err != nil && err != errFuncFound {
+		return 0, err
+	}
+	if !sawPkg {
+		return 0, fmt.Errorf("package %s is not instrumented", pkgPath)
+	}
+	if nBlocks < 0 {
+		return 0, fmt.Errorf("function %s not found in package %s", funcName, pkgPath)
+	}
+	if blockIndex < 0 || blockIndex >= nBlocks {
+		return 0, fmt.Errorf("block index %d out of range for function %s.%s (%d blocks)", blockIndex, pkgPath, funcName, nBlocks)
+	}
+	return uint64(loadBlockCounter(cl, getCovPkgMap(), pkIdx, fnIdx, blockIndex)), nil
+}
+
+// loadBlockCounter returns the value of counter 'blockIndex' for the
+// function with index 'fnIdx' in the package with index 'pkIdx', or
+// zero if the function has no counters in 'cl' (which is the case
+// until the function first executes). Counters are read using atomic
+// loads, so the read is safe regardless of the counter mode.
+func loadBlockCounter(cl []rtcov.CovCounterBlob, pm map[int]int, pkIdx, fnIdx uint32, blockIndex int) uint32 {
+	var sd []atomic.Uint32
+
+	bufHdr := (*reflect.SliceHeader)(unsafe.Pointer(&sd))
+	for _, c := range cl {
+		bufHdr.Data = uintptr(unsafe.Pointer(c.Counters))
+		bufHdr.Len = int(c.Len)
+		bufHdr.Cap = int(c.Len)
+		for i := 0; i < len(sd); i++ {
+			// Skip ahead until the next non-zero value.
+			nCtrs := sd[i].Load()
+			if nCtrs == 0 {
+				continue
+			}
+			pkgId := sd[i+coverage.PkgIdOffset].Load()
+			funcId := sd[i+coverage.FuncIdOffset].Load()
+			if funcId == fnIdx && blockIndex < int(nCtrs) && remapPkgID(pm, i, pkgId, funcId, nCtrs) == pkIdx {
+				return sd[i+coverage.FirstCtrOffset+blockIndex].Load()
+			}
+			// Move to next function.
+			i += coverage.FirstCtrOffset + int(nCtrs) - 1
+		}
+	}
+	return 0
+}
+
+// blockRef identifies a block of an instrumented function by package
+// index, function index, and block index.
+type blockRef struct {
+	pk, fn uint32
+	blk    int
+}
+
+// lineKey is the key type for lineBlocks.
+type lineKey struct {
+	file string
+	line int
+}
+
+// lineBlocks caches the results of meta-data lookups made by
+// QueryLineHits, mapping each lineKey to the []blockRef of the blocks
+// whose source range includes that line.
+var lineBlocks sync.Map
+
+// QueryLineHits returns the sum of the current counter values of the
+// blocks whose source range includes line 'line' of the source file
+// 'file'. The file name is compared with the source file names
+// recorded in the coverage meta-data (see CoverageFileList); a
+// relative name also matches any recorded name that ends with it
+// (after a path separator), so "pkg/file.go" matches
+// "/src/pkg/file.go". If no block includes the line (for example, if
+// it is blank or a comment), the result is zero and no error is
+// returned. The blocks for a given file and line are looked up in the
+// meta-data only once; the counter values are read on each call. An
+// error is returned if the program was not built with "-cover".
+func QueryLineHits(file string, line int) (uint64, error) {
+	cl := getCovCounterList()
+	if len(cl) == 0 {
+		return 0, fmt.Errorf("program not built with -cover")
+	}
+	if err := ensureFinalHash(); err != nil {
+		return 0, err
+	}
+	key := lineKey{file: file, line: line}
+	v, ok := lineBlocks.Load(key)
+	if !ok {
+		blocks, err := findLineBlocks(file, line)
+		if err != nil {
+			return 0, err
+		}
+		v, _ = lineBlocks.LoadOrStore(key, blocks)
+	}
+	pm := getCovPkgMap()
+	var tot uint64
+	for _, b := range v.([]blockRef) {
+		blk := b.blk
+		if cgran == coverage.CtrGranularityPerFunc {
+			blk = 0
+		}
+		tot += uint64(loadBlockCounter(cl, pm, b.pk, b.fn, blk))
+	}
+	return tot, nil
+}
+
+// findLineBlocks returns the blocks whose source range includes line
+// 'line' of the source file 'file' (see QueryLineHits for how file
+// names are matched).
+func findLineBlocks(file string, line int) ([]blockRef, error) {
+	rel := !filepath.IsAbs(file)
+	suffix := "/" + filepath.ToSlash(file)
+	match := func(src string) bool {
+		return src == file || rel && strings.HasSuffix(filepath.ToSlash(src), suffix)
+	}
+	blocks := []blockRef{}
+	err := visitMetaFuncs(metaPayloads(getCovMetaList()), func(pk, fn uint32, pd *decodemeta.CoverageMetaDataDecoder, fd *coverage.FuncDesc) error {
+		if !match(fd.Srcfile) {
+			return nil
+		}
+		for i, u := range fd.Units {
+			// Skip units with non-zero parent, as the text
+			// profile format does.
+			if u.Parent != 0 {
+				continue
+			}
+			if int(u.StLine) <= line && line <= int(u.EnLine) {
+				blocks = append(blocks, blockRef{pk: pk, fn: fn, blk: i})
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return blocks, nil
+}
@@ -0,0 +1,168 @@
+// Copyright 2022 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package coverage
+
+import (
+	"context"
+	"fmt"
+	"internal/coverage"
+	"internal/coverage/decodemeta"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Recorder records the coverage counter increments that take place
+// between calls to its Start and Stop methods, for example to obtain
+// the coverage of a single test. Note that counter updates made
+// concurrently by other goroutines are included. Each Recorder keeps
+// its own copy of the counter values taken at Start, so any number of
+// Recorders may be in use at the same time. A Recorder is safe for
+// concurrent use.
+type Recorder struct {
+	mu      sync.Mutex
+	shadow  *CounterSnapshot // counter values at Start
+	started bool
+}
+
+// RecorderSnapshot holds the counter increments recorded by a
+// Recorder between a call to Start and the following call to Stop.
+type RecorderSnapshot struct {
+	delta map[pkfunc][]uint32
+	fresh map[pkfunc]bool // functions first executed after Start
+}
+
+// NewRecorder returns a new Recorder, with storage for a copy of the
+// counters of the currently running program. An error is returned if
+// the program was not built with "-cover".
+func NewRecorder() (*Recorder, error) {
+	cl := getCovCounterList()
+	if len(cl) == 0 {
+		return nil, fmt.Errorf("program not built with -cover")
+	}
+	if err := ensureFinalHash(); err != nil {
+		return nil, err
+	}
+	shadow := &CounterSnapshot{slabs: make([][]uint32, len(cl))}
+	for k, c := range cl {
+		shadow.slabs[k] = make([]uint32, 0, c.Len)
+	}
+	return &Recorder{shadow: shadow}, nil
+}
+
+// Start copies the current counter values of the program into the
+// Recorder. Calling Start on a started Recorder starts it afresh.
+func (r *Recorder) Start() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.shadow.fill(getCovCounterList())
+	r.started = true
+}
+
+// Stop returns the counter increments since the last call to Start,
+// and resets the Recorder. An error is returned if the Recorder has
+// not been started. In "set" mode, the increments include only blocks
+// that were first executed after the call to Start.
+func (r *Recorder) Stop() (*RecorderSnapshot, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.started {
+		return nil, fmt.Errorf("Recorder.Stop called without Start")
+	}
+	r.started = false
+	after := &CounterSnapshot{}
+	after.fill(getCovCounterList())
+	before := r.shadow.counterMap()
+	rs := &RecorderSnapshot{
+		delta: deltaCounters(before, after.counterMap()),
+		fresh: make(map[pkfunc]bool),
+	}
+	for k := range rs.delta {
+		if _, ok := before[k]; !ok {
+			rs.fresh[k] = true
+		}
+	}
+	return rs, nil
+}
+
+// WriteCoverageProfile writes the recorded counter increments to 'w'
+// in the text format read by "go tool cover", as WriteCoverageProfile
+// does for the program's full counter values.
+func (rs *RecorderSnapshot) WriteCoverageProfile(w io.Writer) error {
+	return writeTextProfile(w, rs.delta)
+}
+
+// funcNames returns the names, in the form "pkgpath.FuncName" and
+// sorted, of the functions in the snapshot for which 'keep' returns
+// true.
+func (rs *RecorderSnapshot) funcNames(keep func(k pkfunc) bool) ([]string, error) {
+	names := []string{}
+	err := visitMetaFuncs(metaPayloads(getCovMetaList()), func(pkIdx, fnIdx uint32, pd *decodemeta.CoverageMetaDataDecoder, fd *coverage.FuncDesc) error {
+		if k := (pkfunc{pk: pkIdx, fcn: fnIdx}); rs.delta[k] != nil && keep(k) {
+			names = append(names, pd.PackagePath()+"."+fd.Funcname)
+		}
+		return nil
+	})
+	sort.Strings(names)
+	return names, err
+}
+
+// NewTestScopedRecorder returns a Recorder that has been started for
+// the test 't', and is stopped when the test completes (via
+// t.Cleanup). When it is stopped, the recorder logs the functions
+// first executed during the test if the test passed, or all of the
+// functions executed during the test if it failed, to help trace the
+// code path that led to the failure. Note that functions executed
+// concurrently by other tests (for example those calling t.Parallel)
+// are included. The test binary must be built with "-cover"; if it
+// is not, the test is stopped with t.Fatalf.
+func NewTestScopedRecorder(t TestingTB) *Recorder {
+	t.Helper()
+	r, err := NewRecorder()
+	if err != nil {
+		t.Fatalf("coverage: %v", err)
+		return nil
+	}
+	r.Start()
+	t.Cleanup(func() {
+		rs, err := r.Stop()
+		if err != nil {
+			// Stopped by the test itself.
+			return
+		}
+		failed := t.Failed()
+		names, err := rs.funcNames(func(k pkfunc) bool { return failed || rs.fresh[k] })
+		if err != nil {
+			t.Logf("coverage: %v", err)
+			return
+		}
+		what := "newly covered functions"
+		if failed {
+			what = "functions executed during failed test"
+		}
+		if len(names) == 0 {
+			t.Logf("coverage: no %s", what)
+			return
+		}
+		t.Logf("coverage: %s:\n\t%s", what, strings.Join(names, "\n\t"))
+	})
+	return r
+}
+
+type recorderKey struct{}
+
+// ContextWithRecorder returns a copy of 'ctx' that carries the
+// Recorder 'r', for retrieval with RecorderFromContext.
+func ContextWithRecorder(ctx context.Context, r *Recorder) context.Context {
+	return context.WithValue(ctx, recorderKey{}, r)
+}
+
+// RecorderFromContext returns the Recorder carried by 'ctx' (see
+// ContextWithRecorder), and whether there is one.
+func RecorderFromContext(ctx context.Context) (*Recorder, bool) {
+	r, ok := ctx.Value(recorderKey{}).(*Recorder)
+	return r, ok
+}
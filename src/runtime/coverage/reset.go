@@ -0,0 +1,89 @@
+// Copyright 2022 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package coverage
+
+import (
+	"fmt"
+	"internal/coverage"
+	"internal/coverage/rtcov"
+)
+
+// ResetAndSnapshot captures the current coverage counter values of
+// the running program and clears the counters, returning the captured
+// values. Each counter is read and zeroed in a single atomic swap, so
+// every counter update made by any goroutine is reflected either in
+// the result or in the counters afterwards, never lost between the two
+// (as can happen when calling ReadCounterSnapshot and then
+// ClearCoverageCounters). Unlike ClearCountersAndEmitTo, the world is
+// not stopped: the swaps of different counters happen at slightly
+// different times, so the result is not an instantaneous view of the
+// whole program. The cost is proportional to the number of counters,
+// since each swap is a separate atomic exchange: swapping 10 million
+// counters takes on the order of 100 milliseconds (see
+// BenchmarkSwapCounterSlab), so this is meant for tests and monitoring
+// code rather than latency-sensitive paths.
+// Use CounterDataSet.WriteTo to turn the result back into counter
+// data for MergeCoverageCounters.
+//
+// As with ClearCoverageCounters, the program must be built with
+// "-covermode=atomic".
+func ResetAndSnapshot() (*CounterDataSet, error) {
+	cl := getCovCounterList()
+	if len(cl) == 0 {
+		return nil, fmt.Errorf("program not built with -cover")
+	}
+	if err := ensureFinalHash(); err != nil {
+		return nil, err
+	}
+	if cmode != coverage.CtrModeAtomic {
+		return nil, fmt.Errorf("ResetAndSnapshot invoked for program build with -covermode=%s (please use -covermode=atomic)", cmode.String())
+	}
+	snap := &CounterSnapshot{
+		metaHash: finalHash,
+		args:     counterFileArgs(),
+		pkgmap:   getCovPkgMap(),
+		slabs:    make([][]uint32, len(cl)),
+	}
+	for k, c := range cl {
+		snap.slabs[k] = swapCounterSlab(c, nil)
+	}
+	ds, err := newCounterDataSet(finalHash, "")
+	if err != nil {
+		return nil, err
+	}
+	if err := ds.setCounters(snap); err != nil {
+		return nil, err
+	}
+	return ds, nil
+}
+
+// swapCounterSlab copies the counter array 'c' into 'dst' (which is
+// reallocated if too small), as readCounterSlab does, but atomically
+// swapping each counter value (not the function prologs) with zero.
+// It returns the resulting slice.
+func swapCounterSlab(c rtcov.CovCounterBlob, dst []uint32) []uint32 {
+	sd := counterSlab(c)
+	if cap(dst) < len(sd) {
+		dst = make([]uint32, len(sd))
+	}
+	dst = dst[:len(sd)]
+	for i := 0; i < len(sd); i++ {
+		// Skip ahead until the next function prolog.
+		nCtrs := sd[i].Load()
+		if nCtrs == 0 {
+			dst[i] = 0
+			continue
+		}
+		dst[i] = nCtrs
+		dst[i+coverage.PkgIdOffset] = sd[i+coverage.PkgIdOffset].Load()
+		dst[i+coverage.FuncIdOffset] = sd[i+coverage.FuncIdOffset].Load()
+		cst := i + coverage.FirstCtrOffset
+		for j := cst; j < cst+int(nCtrs); j++ {
+			dst[j] = sd[j].Swap(0)
+		}
+		i += coverage.FirstCtrOffset + int(nCtrs) - 1
+	}
+	return dst
+}
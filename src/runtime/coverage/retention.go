@@ -0,0 +1,165 @@
+// Copyright 2022 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package coverage
+
+import (
+	"fmt"
+	"internal/coverage"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	retentionMu sync.Mutex
+	// Number of counter data files to keep, keyed by absolute
+	// directory path; see SetCounterFileRetentionPolicy.
+	retentionPolicies map[string]int
+)
+
+// SetCounterFileRetentionPolicy limits the number of counter data
+// files for the running program that are kept in the directory 'dir'.
+// After each successful write of a counter data file to 'dir' (by
+// EmitCounterDataToDir, a PeriodicFlusher, the write at program exit,
+// or any other API that writes counter data files to a directory),
+// the program's counter data files in 'dir' are listed, and all but
+// the 'keep' most recently modified are deleted. Each deletion is
+// reported on standard error with the name and size of the file, so
+// that the effect on disk usage can be audited. A later call for the
+// same directory replaces the earlier policy.
+//
+// Counter data files are recognized by their contents rather than
+// their names: only files that start with the counter data file magic
+// number and that record the meta-data hash of the running program
+// are considered, so files written by other programs, and files that
+// aren't coverage data at all, are left alone, as are the temporary
+// files in which counter data is written before being renamed into
+// place. Several processes may write to and prune the same directory
+// concurrently; a file removed by another process is simply skipped.
+//
+// An error is returned if 'dir' is empty or 'keep' is less than 1.
+func SetCounterFileRetentionPolicy(dir string, keep int) error {
+	if dir == "" {
+		return fmt.Errorf("empty directory in SetCounterFileRetentionPolicy")
+	}
+	if keep < 1 {
+		return fmt.Errorf("counter file retention count %d is less than 1", keep)
+	}
+	key, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	retentionMu.Lock()
+	defer retentionMu.Unlock()
+	if retentionPolicies == nil {
+		retentionPolicies = make(map[string]int)
+	}
+	retentionPolicies[key] = keep
+	return nil
+}
+
+// applyRetentionPolicy prunes the counter data files with meta-data
+// hash 'metaHash' in 'dir' according to the policy set for it with
+// SetCounterFileRetentionPolicy, if any. It is called after a counter
+// data file has been written to 'dir'. Errors are reported on
+// standard error rather than returned, since the write itself has
+// succeeded.
+func applyRetentionPolicy(dir string, metaHash [16]byte) {
+	key, err := filepath.Abs(dir)
+	if err != nil {
+		return
+	}
+	retentionMu.Lock()
+	keep, ok := retentionPolicies[key]
+	retentionMu.Unlock()
+	if !ok {
+		return
+	}
+	files, err := listCounterFiles(dir, metaHash)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: applying coverage counter file retention policy: %v\n", err)
+		return
+	}
+	if len(files) <= keep {
+		return
+	}
+	sort.Slice(files, func(i, j int) bool {
+		if !files[i].modTime.Equal(files[j].modTime) {
+			return files[i].modTime.After(files[j].modTime)
+		}
+		return files[i].name > files[j].name
+	})
+	for _, f := range files[keep:] {
+		path := filepath.Join(dir, f.name)
+		if err := os.Remove(path); err != nil {
+			if !os.IsNotExist(err) {
+				fmt.Fprintf(os.Stderr, "error: applying coverage counter file retention policy: %v\n", err)
+			}
+			continue
+		}
+		fmt.Fprintf(os.Stderr, "coverage: removed old counter data file %s (%d bytes)\n", path, f.size)
+	}
+}
+
+// counterFileInfo describes a counter data file found by
+// listCounterFiles.
+type counterFileInfo struct {
+	name    string
+	modTime time.Time
+	size    int64
+}
+
+// listCounterFiles returns the counter data files in 'dir' that
+// record the meta-data hash 'metaHash'. Temporary files, and files
+// that disappear while the directory is being read, are skipped.
+func listCounterFiles(dir string, metaHash [16]byte) ([]counterFileInfo, error) {
+	ents, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []counterFileInfo
+	for _, ent := range ents {
+		name := ent.Name()
+		if !ent.Type().IsRegular() || strings.HasPrefix(name, ".") || strings.HasPrefix(name, "tmp.") {
+			continue
+		}
+		fi, err := ent.Info()
+		if err != nil {
+			continue
+		}
+		if h, ok := readCounterFileHash(filepath.Join(dir, name)); !ok || h != metaHash {
+			continue
+		}
+		files = append(files, counterFileInfo{name: name, modTime: fi.ModTime(), size: fi.Size()})
+	}
+	return files, nil
+}
+
+// readCounterFileHash returns the meta-data hash recorded in the
+// header of the counter data file 'path', or ok == false if the file
+// can't be read or does not start with the counter data file magic
+// number.
+func readCounterFileHash(path string) (hash [16]byte, ok bool) {
+	f, err := os.Open(path)
+	if err != nil {
+		return hash, false
+	}
+	defer f.Close()
+	// The header starts with the magic number, a uint32 version
+	// and the meta-data hash (see coverage.CounterFileHeader).
+	var hdr [len(coverage.CovCounterMagic) + 4 + len(hash)]byte
+	if _, err := io.ReadFull(f, hdr[:]); err != nil {
+		return hash, false
+	}
+	if string(hdr[:4]) != string(coverage.CovCounterMagic[:]) {
+		return hash, false
+	}
+	copy(hash[:], hdr[8:])
+	return hash, true
+}
@@ -0,0 +1,158 @@
+// Copyright 2022 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package coverage
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// RunWithCoverage invokes 'fn' and returns a description of the
+// coverage counter changes that took place while it was running.
+// Note that counter updates made concurrently by other goroutines are
+// also included in the result. If a coverage output directory is set
+// (see GetCoverageOutputDir), the counter increments are also written
+// to that directory as a counter data file, with the coverage label
+// "runLabel" set to 'label' (see SetCoverageLabel).
+//
+// If 'fn' panics, RunWithCoverage captures (and if possible, emits)
+// the coverage for the partial execution, then re-panics with the
+// original value.
+func RunWithCoverage(fn func(), label string) (diff *CounterDiff, err error) {
+	before, err := ReadCounterSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	finish := func() (*CounterDiff, error) {
+		after, err := ReadCounterSnapshot()
+		if err != nil {
+			return nil, err
+		}
+		diff, err := diffSnapshots(metaPayloads(getCovMetaList()), before, after)
+		if err != nil {
+			return nil, err
+		}
+		if dir := GetCoverageOutputDir(); dir != "" {
+			if err := emitCounterDelta(dir, "runLabel", label, before, after); err != nil {
+				return nil, err
+			}
+		}
+		return diff, nil
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			finish()
+			panic(r)
+		}
+	}()
+	fn()
+	return finish()
+}
+
+// emitCounterDelta writes a counter data file to 'dir' containing the
+// counter increments between 'before' and 'after', with the coverage
+// label 'key' set to 'label'. A meta-data file is also written to
+// 'dir' if needed.
+func emitCounterDelta(dir, key, label string, before, after *CounterSnapshot) error {
+	if err := emitMetaDataToDirectory(dir, getCovMetaList()); err != nil {
+		return err
+	}
+	// Add the label to a copy of the args rather than with
+	// SetCoverageLabel, which would affect concurrent emits.
+	args := make(map[string]string)
+	for k, v := range counterFileArgs() {
+		args[k] = v
+	}
+	if label != "" {
+		args[key] = label
+	} else {
+		delete(args, key)
+	}
+	delta := deltaCounters(before.counterMap(), after.counterMap())
+	snap := newSnapshotFromFuncs(after.metaHash, args, delta)
+	return snap.writeToDir(dir)
+}
+
+// profileSession is an active coverage profile started with
+// StartCoverageProfile.
+type profileSession struct {
+	before  *CounterSnapshot
+	stopped atomic.Bool
+}
+
+// coverageProfiles maps the names of active coverage profiles to
+// their *profileSession.
+var coverageProfiles sync.Map
+
+// StartCoverageProfile starts a named coverage profiling session,
+// capturing a snapshot of the program's coverage counters, and
+// returns a function that stops the session. When called, the stop
+// function captures a second snapshot and, if a coverage output
+// directory is set (see GetCoverageOutputDir), writes the counter
+// increments between the two snapshots to that directory as a
+// counter data file, with the coverage label "profileName" set to
+// 'name' (see SetCoverageLabel). Any number of sessions with
+// different names may be active at the same time. An error is
+// returned if a session with the given name is already active, or if
+// the program was not built with "-cover".
+func StartCoverageProfile(name string) (stop func() error, err error) {
+	before, err := ReadCounterSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	ps := &profileSession{before: before}
+	if _, loaded := coverageProfiles.LoadOrStore(name, ps); loaded {
+		return nil, fmt.Errorf("coverage profile %q already active", name)
+	}
+	return func() error {
+		return stopCoverageProfile(name, ps)
+	}, nil
+}
+
+// stopCoverageProfile stops the session 'ps' named 'name'.
+func stopCoverageProfile(name string, ps *profileSession) error {
+	if !ps.stopped.CompareAndSwap(false, true) {
+		return fmt.Errorf("coverage profile %q not active", name)
+	}
+	// No other session can be registered under 'name' while 'ps'
+	// is still in the map, so it is safe to delete it here.
+	coverageProfiles.Delete(name)
+	after, err := ReadCounterSnapshot()
+	if err != nil {
+		return err
+	}
+	if dir := GetCoverageOutputDir(); dir != "" {
+		return emitCounterDelta(dir, "profileName", name, ps.before, after)
+	}
+	return nil
+}
+
+// ListActiveCoverageProfiles returns the sorted names of the active
+// coverage profiling sessions.
+func ListActiveCoverageProfiles() []string {
+	var names []string
+	coverageProfiles.Range(func(k, v any) bool {
+		names = append(names, k.(string))
+		return true
+	})
+	sort.Strings(names)
+	return names
+}
+
+// StopAllCoverageProfiles stops all active coverage profiling
+// sessions, returning the errors (if any) from stopping them.
+func StopAllCoverageProfiles() error {
+	var errs []error
+	coverageProfiles.Range(func(k, v any) bool {
+		if err := stopCoverageProfile(k.(string), v.(*profileSession)); err != nil {
+			errs = append(errs, err)
+		}
+		return true
+	})
+	return errors.Join(errs...)
+}
@@ -0,0 +1,142 @@
+// Copyright 2022 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package signals arranges for the coverage counter data of a
+// long-running program to be written out when the program receives a
+// signal, so that coverage can be collected without restarting it. It
+// is kept separate from package runtime/coverage so that instrumented
+// programs that don't use it do not depend on os/signal.
+package signals
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"runtime/coverage"
+	"sync"
+)
+
+// handler listens for one signal.
+type handler struct {
+	ch   chan os.Signal
+	done chan struct{}
+}
+
+var (
+	mu       sync.Mutex
+	handlers = make(map[os.Signal]*handler)
+
+	// Directory used when no coverage output directory is set,
+	// created on first use.
+	fallbackDir string
+
+	// testHookEmit, if non-nil, is called with the outcome of each
+	// emission.
+	testHookEmit func(err error)
+)
+
+// MustEmitOnSignal arranges for the counter data of the currently
+// running program to be written each time the program receives the
+// signal 'sig'. The data is written by a goroutine, to the directory
+// given by coverage.GetCoverageOutputDir (that is, GOCOVERDIR unless
+// changed with coverage.SetCoverageOutputDir), along with a meta-data
+// file if the directory doesn't have one yet. If no directory is set,
+// a temporary directory is created on the first signal and used from
+// then on. Success or failure, and the name of a temporary directory
+// when one is created, are reported on standard error.
+//
+// Each signal has at most one handler: calling MustEmitOnSignal for a
+// signal that already has one replaces it, while handlers for
+// different signals are independent. Once a handler is installed, the
+// signal no longer has its default effect (see signal.Notify).
+// MustEmitOnSignal panics if 'sig' is nil.
+func MustEmitOnSignal(sig os.Signal) {
+	if sig == nil {
+		panic("signals: MustEmitOnSignal called with nil signal")
+	}
+	h := &handler{
+		ch:   make(chan os.Signal, 1),
+		done: make(chan struct{}),
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if old := handlers[sig]; old != nil {
+		old.stop()
+	}
+	handlers[sig] = h
+	signal.Notify(h.ch, sig)
+	go h.run()
+}
+
+// StopSignalEmit removes the handler installed for 'sig' by
+// MustEmitOnSignal, if any, and restores the signal's default
+// behavior (see signal.Reset). A write already in progress is not
+// interrupted.
+func StopSignalEmit(sig os.Signal) {
+	mu.Lock()
+	defer mu.Unlock()
+	if h := handlers[sig]; h != nil {
+		h.stop()
+		delete(handlers, sig)
+		signal.Reset(sig)
+	}
+}
+
+// stop stops delivery of signals to 'h' and ends its goroutine. It is
+// called with mu held.
+func (h *handler) stop() {
+	signal.Stop(h.ch)
+	close(h.done)
+}
+
+// run writes the counter data for each signal received, until the
+// handler is stopped. Signals that arrive during a write are coalesced.
+func (h *handler) run() {
+	for {
+		select {
+		case <-h.done:
+			return
+		case sig := <-h.ch:
+			emit(sig)
+		}
+	}
+}
+
+// emit writes the counter data on receipt of 'sig'.
+func emit(sig os.Signal) {
+	dir, err := outputDir()
+	if err == nil {
+		err = coverage.EmitMetaDataToDir(dir)
+	}
+	if err == nil {
+		err = coverage.EmitCounterDataToDir(dir)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: coverage data emit on signal %v failed: %v\n", sig, err)
+	} else {
+		fmt.Fprintf(os.Stderr, "coverage: counter data written to %s on signal %v\n", dir, sig)
+	}
+	if testHookEmit != nil {
+		testHookEmit(err)
+	}
+}
+
+// outputDir returns the directory to write to, creating the fallback
+// directory if needed.
+func outputDir() (string, error) {
+	if dir := coverage.GetCoverageOutputDir(); dir != "" {
+		return dir, nil
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if fallbackDir == "" {
+		dir, err := os.MkdirTemp("", "gocoverdir")
+		if err != nil {
+			return "", err
+		}
+		fallbackDir = dir
+		fmt.Fprintf(os.Stderr, "coverage: GOCOVERDIR not set, writing coverage data on signal to %s\n", dir)
+	}
+	return fallbackDir, nil
+}
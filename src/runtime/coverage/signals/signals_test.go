@@ -0,0 +1,18 @@
+// Copyright 2022 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package signals
+
+import (
+	"testing"
+)
+
+func TestMustEmitOnSignalNil(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Errorf("MustEmitOnSignal(nil) did not panic")
+		}
+	}()
+	MustEmitOnSignal(nil)
+}
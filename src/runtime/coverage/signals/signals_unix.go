@@ -0,0 +1,16 @@
+// Copyright 2022 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build unix
+
+package signals
+
+import "syscall"
+
+// MustEmitOnUSR1 is shorthand for MustEmitOnSignal(syscall.SIGUSR1),
+// so that the coverage data of a running program can be collected
+// with "kill -USR1 <pid>".
+func MustEmitOnUSR1() {
+	MustEmitOnSignal(syscall.SIGUSR1)
+}
@@ -0,0 +1,76 @@
+// Copyright 2022 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build unix
+
+package signals
+
+import (
+	"os"
+	"path/filepath"
+	"runtime/coverage"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestEmitOnSignal(t *testing.T) {
+	dir := t.TempDir()
+	if testing.CoverMode() != "" {
+		// Test binaries compute the meta-data hash lazily, on first
+		// use; reading the counters makes the meta-data available.
+		if _, err := coverage.ReadCounterSnapshot(); err != nil {
+			t.Fatal(err)
+		}
+		if err := coverage.SetCoverageOutputDir(dir); err != nil {
+			t.Fatal(err)
+		}
+		defer coverage.SetCoverageOutputDir("")
+	}
+	emitted := make(chan error, 1)
+	testHookEmit = func(err error) { emitted <- err }
+	defer func() { testHookEmit = nil }()
+
+	// Installing a second handler replaces the first, so each signal
+	// causes a single emission.
+	MustEmitOnUSR1()
+	MustEmitOnUSR1()
+	defer StopSignalEmit(syscall.SIGUSR1)
+	mu.Lock()
+	n := len(handlers)
+	mu.Unlock()
+	if n != 1 {
+		t.Fatalf("%d handlers installed, want 1", n)
+	}
+
+	if err := syscall.Kill(os.Getpid(), syscall.SIGUSR1); err != nil {
+		t.Fatal(err)
+	}
+	var err error
+	select {
+	case err = <-emitted:
+	case <-time.After(time.Minute):
+		t.Fatalf("no emission after signal")
+	}
+	select {
+	case err := <-emitted:
+		t.Fatalf("second emission after one signal (err %v)", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if testing.CoverMode() == "" {
+		if err == nil {
+			t.Errorf("emission succeeded in a program not built with -cover")
+		}
+		return
+	}
+	if err != nil {
+		t.Fatalf("emission failed: %v", err)
+	}
+	for _, pat := range []string{"covmeta.*", "covcounters.*"} {
+		if m, _ := filepath.Glob(filepath.Join(dir, pat)); len(m) == 0 {
+			t.Errorf("no %s file written to %s", pat, dir)
+		}
+	}
+}
@@ -0,0 +1,305 @@
+// Copyright 2022 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package coverage
+
+import (
+	"fmt"
+	"internal/coverage"
+	"internal/coverage/decodecounter"
+	"internal/coverage/encodecounter"
+	"internal/coverage/rtcov"
+	"io"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
+
+// CounterSnapshot holds a copy of the coverage counter values for a
+// coverage-instrumented program, captured at a specific point in
+// time. A snapshot is not affected by the subsequent execution of
+// the program, nor by calls to ClearCoverageCounters.
+type CounterSnapshot struct {
+	// Hash of the meta-data for the program the counters belong to.
+	metaHash [16]byte
+
+	// Key-value annotations (os.Args, GOOS, GOARCH) to be written
+	// into the args section of a counter data file.
+	args map[string]string
+
+	// Table to use for remapping hard-coded pkg ids.
+	pkgmap map[int]int
+
+	// Copies of the counter arrays, one per counter-data symbol
+	// registered with the runtime. The layout of each slab mirrors
+	// that of the live counter array (function prologs followed by
+	// counter values).
+	slabs [][]uint32
+}
+
+// ReadCounterSnapshot captures a snapshot of the coverage counter
+// values for the currently running program. An error will be
+// returned if the program was not built with "-cover".
+func ReadCounterSnapshot() (*CounterSnapshot, error) {
+	cl := getCovCounterList()
+	if len(cl) == 0 {
+		return nil, fmt.Errorf("program not built with -cover")
+	}
+	if err := ensureFinalHash(); err != nil {
+		return nil, err
+	}
+	snap := &CounterSnapshot{}
+	snap.fill(cl)
+	return snap, nil
+}
+
+// fill populates 's' with the current values of the counters in
+// 'cl', reusing the storage of any existing slabs in 's'.
+func (s *CounterSnapshot) fill(cl []rtcov.CovCounterBlob) {
+	s.metaHash = finalHash
+	s.args = counterFileArgs()
+	s.pkgmap = getCovPkgMap()
+	if cap(s.slabs) < len(cl) {
+		s.slabs = append(s.slabs[:cap(s.slabs)], make([][]uint32, len(cl)-cap(s.slabs))...)
+	}
+	s.slabs = s.slabs[:len(cl)]
+	for k, c := range cl {
+		s.slabs[k] = readCounterSlab(c, s.slabs[k])
+	}
+}
+
+// finalHashMu serializes calls to prepareForMetaEmit made by
+// ensureFinalHash.
+var finalHashMu sync.Mutex
+
+// ensureFinalHash computes the final meta-data hash (along with the
+// counter mode and granularity) if this has not already been done.
+// For regular programs this happens at startup, but for test binaries
+// meta-data emission is deferred until the program exits, which would
+// otherwise prevent counters from being read while tests are running.
+func ensureFinalHash() error {
+	finalHashMu.Lock()
+	defer finalHashMu.Unlock()
+	if finalHashComputed {
+		return nil
+	}
+	if _, err := prepareForMetaEmit(); err != nil {
+		return err
+	}
+	if !finalHashComputed {
+		return fmt.Errorf("meta-data not available, unable to capture counter data")
+	}
+	return nil
+}
+
+// readCounterSlab copies the current values of the counters in 'c'
+// into 'dst', returning the resulting slice. Values are read using
+// atomic loads, since the counters may be updated concurrently by
+// other goroutines.
+func readCounterSlab(c rtcov.CovCounterBlob, dst []uint32) []uint32 {
+	var sd []atomic.Uint32
+	bufHdr := (*reflect.SliceHeader)(unsafe.Pointer(&sd))
+	bufHdr.Data = uintptr(unsafe.Pointer(c.Counters))
+	bufHdr.Len = int(c.Len)
+	bufHdr.Cap = int(c.Len)
+	// Allocate up front rather than growing 'dst' while copying: the
+	// first execution of a runtime function used to grow the slice
+	// would fill in that function's counters after its entry's
+	// length field had already been copied (as zero), leaving a
+	// malformed entry in the copy.
+	if cap(dst) < len(sd) {
+		dst = make([]uint32, 0, len(sd))
+	}
+	dst = dst[:0]
+	for i := range sd {
+		dst = append(dst, sd[i].Load())
+	}
+	return dst
+}
+
+// visitFuncs invokes 'f' for each live function (a function with at
+// least one non-zero counter) recorded in the snapshot, passing the
+// package index (position within the meta-data list), the function
+// index within the package, and the function's counter values. The
+// counter slice passed to 'f' aliases the snapshot and must not be
+// modified or retained.
+func (s *CounterSnapshot) visitFuncs(f encodecounter.CounterVisitorFn) error {
+	for _, sd := range s.slabs {
+		for i := 0; i < len(sd); i++ {
+			// Skip ahead until the next non-zero value.
+			nCtrs := sd[i]
+			if nCtrs == 0 {
+				continue
+			}
+			slot := i
+			pkgId := sd[i+coverage.PkgIdOffset]
+			funcId := sd[i+coverage.FuncIdOffset]
+			cst := i + coverage.FirstCtrOffset
+			counters := sd[cst : cst+int(nCtrs)]
+
+			// Skip over this function for the next iteration.
+			i += coverage.FirstCtrOffset + int(nCtrs) - 1
+
+			// Check to make sure that we have at least one live
+			// counter. See the implementation note in
+			// ClearCoverageCounters for a description of why this
+			// is needed.
+			if !anyNonZero(counters) {
+				continue
+			}
+			pkgId = remapPkgID(s.pkgmap, slot, pkgId, funcId, nCtrs)
+			if err := f(pkgId, funcId, counters); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// counterMap returns a map from package/function index to counter
+// values for each live function in the snapshot. The slices in the
+// map alias the snapshot.
+func (s *CounterSnapshot) counterMap() map[pkfunc][]uint32 {
+	m := make(map[pkfunc][]uint32)
+	s.visitFuncs(func(pkgId, funcId uint32, counters []uint32) error {
+		m[pkfunc{pk: pkgId, fcn: funcId}] = counters
+		return nil
+	})
+	return m
+}
+
+// write emits the snapshot in counter data file format to 'w'.
+func (s *CounterSnapshot) write(w io.Writer) error {
+	cfw := encodecounter.NewCoverageDataWriter(w, coverage.CtrULeb128)
+	return cfw.Write(s.metaHash, s.args, snapshotVisitor{s})
+}
+
+// writeToDir writes the snapshot as a counter data file to the
+// directory 'outdir', using the same file naming conventions (and the
+// same write-to-temp-then-rename strategy) as EmitCounterDataToDir.
+func (s *CounterSnapshot) writeToDir(outdir string) error {
+	es := &emitState{outdir: outdir}
+	if err := es.openOutputFiles(s.metaHash, 0, counterDataFile); err != nil {
+		return err
+	}
+	err := writeWithPlugins(es.cf, counterDataFile, s.write)
+	if err != nil {
+		es.cf.Close()
+		os.Remove(es.cftmp)
+		return fmt.Errorf("writing %s: %v", es.cftmp, err)
+	}
+	if err := es.cf.Close(); err != nil {
+		return fmt.Errorf("closing counter data file: %v", err)
+	}
+	if err := os.Rename(es.cftmp, es.cfname); err != nil {
+		return fmt.Errorf("writing %s: rename from %s failed: %v", es.cfname, es.cftmp, err)
+	}
+	applyRetentionPolicy(outdir, s.metaHash)
+	return nil
+}
+
+// snapshotVisitor adapts a CounterSnapshot to the
+// encodecounter.CounterVisitor interface.
+type snapshotVisitor struct {
+	s *CounterSnapshot
+}
+
+func (v snapshotVisitor) NumFuncs() (int, error) {
+	n := 0
+	err := v.s.visitFuncs(func(pkgId, funcId uint32, counters []uint32) error {
+		n++
+		return nil
+	})
+	return n, err
+}
+
+func (v snapshotVisitor) VisitFuncs(f encodecounter.CounterVisitorFn) error {
+	return v.s.visitFuncs(f)
+}
+
+func anyNonZero(counters []uint32) bool {
+	for _, c := range counters {
+		if c != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// newSnapshotFromFuncs creates a snapshot from a collection of
+// per-function counter values (for example, data read back from a
+// counter data file). The snapshot is given a single synthesized
+// counter slab with the functions laid out in package/function order.
+func newSnapshotFromFuncs(metaHash [16]byte, args map[string]string, funcs map[pkfunc][]uint32) *CounterSnapshot {
+	keys := make([]pkfunc, 0, len(funcs))
+	tot := 0
+	for k, c := range funcs {
+		keys = append(keys, k)
+		tot += coverage.FirstCtrOffset + len(c)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].pk != keys[j].pk {
+			return keys[i].pk < keys[j].pk
+		}
+		return keys[i].fcn < keys[j].fcn
+	})
+	slab := make([]uint32, 0, tot)
+	for _, k := range keys {
+		c := funcs[k]
+		// Package IDs are stored with 1 added, as in the live
+		// counter array (see runtime.addCovMeta).
+		slab = append(slab, uint32(len(c)), k.pk+1, k.fcn)
+		slab = append(slab, c...)
+	}
+	return &CounterSnapshot{
+		metaHash: metaHash,
+		args:     args,
+		slabs:    [][]uint32{slab},
+	}
+}
+
+// readCounterData reads a counter data file payload from 'r' and
+// returns its contents as a snapshot.
+func readCounterData(r io.ReadSeeker) (*CounterSnapshot, error) {
+	cdr, err := decodecounter.NewCounterDataReader("<io.Reader>", r)
+	if err != nil {
+		return nil, err
+	}
+	funcs := make(map[pkfunc][]uint32)
+	var data decodecounter.FuncPayload
+	for {
+		ok, err := cdr.NextFunc(&data)
+		if err != nil {
+			return nil, fmt.Errorf("reading counter data: %v", err)
+		}
+		if !ok {
+			break
+		}
+		key := pkfunc{pk: data.PkgIdx, fcn: data.FuncIdx}
+		funcs[key] = append([]uint32(nil), data.Counters...)
+	}
+
+	// Reconstruct the args section in the same format used by
+	// captureOsArgs, preserving any other annotations.
+	args := make(map[string]string)
+	for k, v := range cdr.Args() {
+		args[k] = v
+	}
+	osargs := cdr.OsArgs()
+	args["argc"] = strconv.Itoa(len(osargs))
+	for k, a := range osargs {
+		args["argv"+strconv.Itoa(k)] = a
+	}
+	if goos := cdr.Goos(); goos != "" {
+		args["GOOS"] = goos
+	}
+	if goarch := cdr.Goarch(); goarch != "" {
+		args["GOARCH"] = goarch
+	}
+	return newSnapshotFromFuncs(cdr.MetaHash(), args, funcs), nil
+}
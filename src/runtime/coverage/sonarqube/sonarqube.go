@@ -0,0 +1,130 @@
+// Copyright 2022 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package sonarqube writes the coverage data of the currently running
+// program in SonarQube's generic test coverage XML format, for use
+// with the sonar.coverageReportPaths analysis parameter.
+package sonarqube
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"runtime/coverage"
+	"sort"
+)
+
+// document mirrors the parts of the output of
+// coverage.WriteCoverageToJSON used here.
+type document struct {
+	Meta struct {
+		Packages []struct {
+			Functions []struct {
+				File   string
+				Blocks []struct {
+					StartLine, EndLine int
+				}
+			}
+		}
+	}
+	Counters []struct {
+		Hits []uint64
+	}
+}
+
+// The XML elements of the generic coverage format.
+type (
+	xmlCoverage struct {
+		XMLName xml.Name  `xml:"coverage"`
+		Version int       `xml:"version,attr"`
+		Files   []xmlFile `xml:"file"`
+	}
+	xmlFile struct {
+		Path  string    `xml:"path,attr"`
+		Lines []xmlLine `xml:"lineToCover"`
+	}
+	xmlLine struct {
+		LineNumber int  `xml:"lineNumber,attr"`
+		Covered    bool `xml:"covered,attr"`
+	}
+)
+
+// WriteSonarQubeXML writes the coverage data for the currently running
+// program to 'w' as a SonarQube generic coverage report: a "coverage"
+// element holding one "file" element per instrumented source file, in
+// file name order, each of which holds one "lineToCover" element per
+// instrumented line, in line order. A line is reported as covered if
+// any of the blocks that overlap it has executed. File paths are the
+// source file names recorded in the coverage meta-data; SonarQube
+// accepts absolute paths or paths relative to the project base
+// directory. An error is returned if the program was not built with
+// "-cover".
+func WriteSonarQubeXML(w io.Writer) error {
+	var b bytes.Buffer
+	if err := coverage.WriteCoverageToJSON(&b, false); err != nil {
+		return err
+	}
+	return writeXML(w, b.Bytes())
+}
+
+// writeXML writes the coverage data in 'data', a document written by
+// coverage.WriteCoverageToJSON, to 'w' as a SonarQube generic
+// coverage report.
+func writeXML(w io.Writer, data []byte) error {
+	var doc document
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+
+	files := make(map[string]map[int]bool) // file -> line -> covered
+	nf := 0
+	for _, p := range doc.Meta.Packages {
+		for _, fn := range p.Functions {
+			if nf >= len(doc.Counters) {
+				return fmt.Errorf("coverage data has fewer counter records than functions")
+			}
+			hits := doc.Counters[nf].Hits
+			nf++
+			lines := files[fn.File]
+			if lines == nil {
+				lines = make(map[int]bool)
+				files[fn.File] = lines
+			}
+			for i, blk := range fn.Blocks {
+				covered := i < len(hits) && hits[i] != 0
+				for l := blk.StartLine; l <= blk.EndLine; l++ {
+					lines[l] = lines[l] || covered
+				}
+			}
+		}
+	}
+
+	cov := xmlCoverage{Version: 1, Files: make([]xmlFile, 0, len(files))}
+	for name, lines := range files {
+		f := xmlFile{Path: name, Lines: make([]xmlLine, 0, len(lines))}
+		for l, covered := range lines {
+			f.Lines = append(f.Lines, xmlLine{LineNumber: l, Covered: covered})
+		}
+		sort.Slice(f.Lines, func(i, j int) bool {
+			return f.Lines[i].LineNumber < f.Lines[j].LineNumber
+		})
+		cov.Files = append(cov.Files, f)
+	}
+	sort.Slice(cov.Files, func(i, j int) bool {
+		return cov.Files[i].Path < cov.Files[j].Path
+	})
+
+	bw := bufio.NewWriter(w)
+	bw.WriteString(xml.Header)
+	enc := xml.NewEncoder(bw)
+	enc.Indent("", "  ")
+	if err := enc.Encode(cov); err != nil {
+		return err
+	}
+	bw.WriteByte('\n')
+	return bw.Flush()
+}
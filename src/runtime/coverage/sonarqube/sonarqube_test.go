@@ -0,0 +1,47 @@
+// Copyright 2022 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sonarqube
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestWriteXML(t *testing.T) {
+	data, err := os.ReadFile("testdata/coverage.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := os.ReadFile("testdata/coverage.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	if err := writeXML(&b, data); err != nil {
+		t.Fatalf("writeXML: %v", err)
+	}
+	if got := b.String(); got != string(want) {
+		t.Errorf("writeXML output:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestWriteSonarQubeXML(t *testing.T) {
+	var b bytes.Buffer
+	err := WriteSonarQubeXML(&b)
+	if testing.CoverMode() == "" {
+		if err == nil {
+			t.Errorf("WriteSonarQubeXML succeeded in a program not built with -cover")
+		}
+		return
+	}
+	if err != nil {
+		t.Fatalf("WriteSonarQubeXML: %v", err)
+	}
+	if !strings.Contains(b.String(), `<file path="runtime/coverage/sonarqube/sonarqube.go">`) {
+		t.Errorf("WriteSonarQubeXML output has no element for sonarqube.go:\n%s", b.String())
+	}
+}
@@ -0,0 +1,484 @@
+// Copyright 2022 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package coverage
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"internal/coverage"
+	"internal/coverage/decodemeta"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// CoverageStats summarizes the block and line coverage for a set of
+// instrumented packages. Percentages are in the range [0, 100].
+type CoverageStats struct {
+	TotalBlocks   int
+	CoveredBlocks int
+	TotalLines    int
+	CoveredLines  int
+
+	BlockCoveragePercent float64
+	LineCoveragePercent  float64
+}
+
+// covStatsMagic holds the magic string for the binary encoding of a
+// CoverageStats, as written by CoverageStats.WriteTo.
+var covStatsMagic = [4]byte{'\x00', '\x63', '\x76', '\x74'}
+
+// covStatsVersion is the current version of the CoverageStats binary
+// encoding.
+const covStatsVersion = 1
+
+// covStatsRecord is the binary encoding of a CoverageStats.
+type covStatsRecord struct {
+	Magic         [4]byte
+	Version       uint8
+	TotalBlocks   int64
+	CoveredBlocks int64
+	TotalLines    int64
+	CoveredLines  int64
+
+	BlockCoveragePercent float64
+	LineCoveragePercent  float64
+}
+
+// WriteTo writes a binary encoding of 'st' to 'w', implementing
+// io.WriterTo. The encoding can be decoded with ReadFrom.
+func (st *CoverageStats) WriteTo(w io.Writer) (int64, error) {
+	rec := covStatsRecord{
+		Magic:                covStatsMagic,
+		Version:              covStatsVersion,
+		TotalBlocks:          int64(st.TotalBlocks),
+		CoveredBlocks:        int64(st.CoveredBlocks),
+		TotalLines:           int64(st.TotalLines),
+		CoveredLines:         int64(st.CoveredLines),
+		BlockCoveragePercent: st.BlockCoveragePercent,
+		LineCoveragePercent:  st.LineCoveragePercent,
+	}
+	if err := binary.Write(w, binary.LittleEndian, &rec); err != nil {
+		return 0, err
+	}
+	return int64(binary.Size(&rec)), nil
+}
+
+// ReadFrom decodes a CoverageStats (as written by WriteTo) from 'r'
+// into 'st', implementing io.ReaderFrom.
+func (st *CoverageStats) ReadFrom(r io.Reader) (int64, error) {
+	var rec covStatsRecord
+	if err := binary.Read(r, binary.LittleEndian, &rec); err != nil {
+		return 0, fmt.Errorf("reading coverage stats: %v", err)
+	}
+	n := int64(binary.Size(&rec))
+	if rec.Magic != covStatsMagic {
+		return n, fmt.Errorf("invalid magic string: not encoded coverage stats")
+	}
+	if rec.Version > covStatsVersion {
+		return n, fmt.Errorf("version data incompatibility: reader is %d data is %d", covStatsVersion, rec.Version)
+	}
+	*st = CoverageStats{
+		TotalBlocks:          int(rec.TotalBlocks),
+		CoveredBlocks:        int(rec.CoveredBlocks),
+		TotalLines:           int(rec.TotalLines),
+		CoveredLines:         int(rec.CoveredLines),
+		BlockCoveragePercent: rec.BlockCoveragePercent,
+		LineCoveragePercent:  rec.LineCoveragePercent,
+	}
+	return n, nil
+}
+
+// srcLine identifies a single line within a source file.
+type srcLine struct {
+	file string
+	line uint32
+}
+
+// computeStats computes coverage statistics for the packages whose
+// meta-data blobs appear in 'payloads', using the counter values in
+// 'counters' (keyed by package and function index). Functions that
+// do not appear in 'counters' are treated as not executed.
+func computeStats(payloads [][]byte, cgran coverage.CounterGranularity, counters map[pkfunc][]uint32) (*CoverageStats, error) {
+	st, _, err := computeStatsMatching(payloads, cgran, counters, nil)
+	return st, err
+}
+
+// computeStatsMatching is like computeStats, but considers only the
+// packages whose import paths are accepted by 'match' (all packages,
+// if 'match' is nil). It also reports whether any package matched.
+func computeStatsMatching(payloads [][]byte, cgran coverage.CounterGranularity, counters map[pkfunc][]uint32, match func(pkgPath string) bool) (*CoverageStats, bool, error) {
+	st := &CoverageStats{}
+	lines := make(map[srcLine]bool)
+	matched := false
+	err := visitMetaFuncs(payloads, func(pkIdx, fnIdx uint32, pd *decodemeta.CoverageMetaDataDecoder, fd *coverage.FuncDesc) error {
+		if match != nil && !match(pd.PackagePath()) {
+			return nil
+		}
+		matched = true
+		ctrs := counters[pkfunc{pk: pkIdx, fcn: fnIdx}]
+		for i, u := range fd.Units {
+			// Skip units with non-zero parent (these are not
+			// blocks in their own right).
+			if u.Parent != 0 {
+				continue
+			}
+			covered := unitCount(cgran, ctrs, i) != 0
+			st.TotalBlocks++
+			if covered {
+				st.CoveredBlocks++
+			}
+			for l := u.StLine; l <= u.EnLine; l++ {
+				sl := srcLine{file: fd.Srcfile, line: l}
+				lines[sl] = lines[sl] || covered
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	st.TotalLines = len(lines)
+	for _, covered := range lines {
+		if covered {
+			st.CoveredLines++
+		}
+	}
+	st.BlockCoveragePercent = percent(st.CoveredBlocks, st.TotalBlocks)
+	st.LineCoveragePercent = percent(st.CoveredLines, st.TotalLines)
+	return st, matched, nil
+}
+
+// PackageCoverageStats returns the block and line coverage statistics
+// for the instrumented package with import path 'pkgPath' in the
+// currently running program. An error is returned if the program was
+// not built with "-cover" or if the package is not instrumented. It
+// is safe to call PackageCoverageStats from multiple goroutines.
+func PackageCoverageStats(pkgPath string) (CoverageStats, error) {
+	st, err := liveStats(func(p string) bool { return p == pkgPath })
+	if err == errNoMatchingPackage {
+		err = fmt.Errorf("package %s is not instrumented", pkgPath)
+	}
+	return st, err
+}
+
+// ProgramCoverageStats returns the block and line coverage statistics
+// aggregated over all instrumented packages in the currently running
+// program. An error is returned if the program was not built with
+// "-cover". It is safe to call ProgramCoverageStats from multiple
+// goroutines.
+func ProgramCoverageStats() (CoverageStats, error) {
+	st, err := liveStats(nil)
+	if err == errNoMatchingPackage {
+		err = nil
+	}
+	return st, err
+}
+
+// PkgCoverageMap returns the block coverage of each instrumented
+// package in the currently running program, keyed by import path, as
+// a fraction in the range [0, 1] (that is, BlockCoveragePercent of
+// PackageCoverageStats divided by 100), for example to publish as a
+// per-package gauge. The blocks of an external test package
+// ("path_test") are counted with those of the package it tests, if
+// that package is also instrumented, and packages without any blocks
+// map to 0. The meta-data and counters are read in a single pass, so
+// the cost is proportional to the total number of blocks in the
+// program. An error is returned if the program was not built with
+// "-cover".
+func PkgCoverageMap() (map[string]float64, error) {
+	total, covered, err := liveBlockCounts()
+	if err != nil {
+		return nil, err
+	}
+	m := make(map[string]float64, len(total))
+	for p, n := range total {
+		m[p] = percent(covered[p], n) / 100
+	}
+	return m, nil
+}
+
+// ProgramCoveragePercent returns the block coverage of the currently
+// running program as a fraction in the range [0, 1]: the proportion of
+// the blocks in all instrumented packages that have executed, so each
+// package is weighted by its number of blocks. The cost is
+// proportional to the total number of blocks in the program. An error
+// is returned if the program was not built with "-cover".
+func ProgramCoveragePercent() (float64, error) {
+	total, covered, err := liveBlockCounts()
+	if err != nil {
+		return 0, err
+	}
+	nt, nc := 0, 0
+	for p, n := range total {
+		nt += n
+		nc += covered[p]
+	}
+	return percent(nc, nt) / 100, nil
+}
+
+// liveBlockCounts returns the number of blocks, and the number of
+// covered blocks, in each instrumented package of the running
+// program, counting blocks as computeStats does and keyed by
+// canonical import path (see PkgCoverageMap).
+func liveBlockCounts() (total, covered map[string]int, err error) {
+	snap, err := ReadCounterSnapshot()
+	if err != nil {
+		return nil, nil, err
+	}
+	counters := snap.counterMap()
+	ml := getCovMetaList()
+	// Every package gets an entry, including those without any
+	// functions.
+	paths := make([]string, len(ml))
+	instrumented := make(map[string]bool, len(ml))
+	for i, b := range ml {
+		paths[i] = strings.TrimSuffix(b.PkgPath, "/")
+		instrumented[paths[i]] = true
+	}
+	total, covered = make(map[string]int), make(map[string]int)
+	for i, p := range paths {
+		// Fold "path_test" into "path" only if "path" is an
+		// instrumented package in this program; otherwise it is a
+		// package whose name just happens to end in "_test".
+		if tp := strings.TrimSuffix(p, "_test"); tp != p && instrumented[tp] {
+			paths[i] = tp
+		}
+		total[paths[i]] += 0
+	}
+	err = visitMetaFuncs(metaPayloads(ml), func(pkIdx, fnIdx uint32, pd *decodemeta.CoverageMetaDataDecoder, fd *coverage.FuncDesc) error {
+		pkgPath := paths[pkIdx]
+		ctrs := counters[pkfunc{pk: pkIdx, fcn: fnIdx}]
+		for i, u := range fd.Units {
+			if u.Parent != 0 {
+				continue
+			}
+			total[pkgPath]++
+			if unitCount(cgran, ctrs, i) != 0 {
+				covered[pkgPath]++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return total, covered, nil
+}
+
+var errNoMatchingPackage = errors.New("no matching package")
+
+// liveStats computes coverage statistics from the current counter
+// values for the packages accepted by 'match' (all packages, if
+// 'match' is nil).
+func liveStats(match func(pkgPath string) bool) (CoverageStats, error) {
+	snap, err := ReadCounterSnapshot()
+	if err != nil {
+		return CoverageStats{}, err
+	}
+	st, matched, err := computeStatsMatching(metaPayloads(getCovMetaList()), cgran, snap.counterMap(), match)
+	if err != nil {
+		return CoverageStats{}, err
+	}
+	if !matched {
+		return *st, errNoMatchingPackage
+	}
+	return *st, nil
+}
+
+// unitCount returns the counter value for the i-th coverable unit of
+// a function whose counters are 'ctrs' (nil if the function was
+// never executed). With per-function granularity there is a single
+// counter shared by all units in the function.
+func unitCount(cgran coverage.CounterGranularity, ctrs []uint32, i int) uint32 {
+	if cgran == coverage.CtrGranularityPerFunc {
+		i = 0
+	}
+	if i >= len(ctrs) {
+		return 0
+	}
+	return ctrs[i]
+}
+
+func percent(n, d int) float64 {
+	if d == 0 {
+		return 0
+	}
+	return 100 * float64(n) / float64(d)
+}
+
+// CounterSummary returns a one-line summary of the block and function
+// coverage for the currently running program, suitable for logging,
+// of the form
+//
+//	coverage: 72.5% (1234/1700 blocks covered, 45/52 functions fully covered)
+//
+// An empty string is returned if the program was not built with
+// "-cover" (or if coverage data is not yet available), so it is safe
+// to call CounterSummary unconditionally.
+func CounterSummary() string {
+	return counterSummary(func(string) bool { return true })
+}
+
+// CounterSummaryForPackage is like CounterSummary, but summarizes
+// coverage only for the package with import path 'pkgPath'. An
+// empty string is returned if the package is not instrumented.
+func CounterSummaryForPackage(pkgPath string) string {
+	return counterSummary(func(p string) bool { return p == pkgPath })
+}
+
+func counterSummary(match func(pkgPath string) bool) string {
+	snap, err := ReadCounterSnapshot()
+	if err != nil {
+		return ""
+	}
+	counters := snap.counterMap()
+	var blocks, covBlocks, funcs, fullFuncs int
+	matched := false
+	err = visitMetaFuncs(metaPayloads(getCovMetaList()), func(pkIdx, fnIdx uint32, pd *decodemeta.CoverageMetaDataDecoder, fd *coverage.FuncDesc) error {
+		if !match(pd.PackagePath()) {
+			return nil
+		}
+		matched = true
+		ctrs := counters[pkfunc{pk: pkIdx, fcn: fnIdx}]
+		full := true
+		for i, u := range fd.Units {
+			if u.Parent != 0 {
+				continue
+			}
+			blocks++
+			if unitCount(cgran, ctrs, i) != 0 {
+				covBlocks++
+			} else {
+				full = false
+			}
+		}
+		funcs++
+		if full {
+			fullFuncs++
+		}
+		return nil
+	})
+	if err != nil || !matched {
+		return ""
+	}
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "coverage: %.1f%% (%d/%d blocks covered, %d/%d functions fully covered)",
+		percent(covBlocks, blocks), covBlocks, blocks, fullFuncs, funcs)
+	return sb.String()
+}
+
+// ZeroCoveragePackages returns the sorted import paths of the
+// instrumented packages in which no block has been executed.
+// Packages with no instrumented blocks are not included. An error is
+// returned if the program was not built with "-cover".
+func ZeroCoveragePackages() ([]string, error) {
+	return packagesWithUniformCoverage(false)
+}
+
+// FullyCoveredPackages returns the sorted import paths of the
+// instrumented packages in which every block has been executed.
+// Packages with no instrumented blocks are not included. An error is
+// returned if the program was not built with "-cover".
+func FullyCoveredPackages() ([]string, error) {
+	return packagesWithUniformCoverage(true)
+}
+
+// packagesWithUniformCoverage returns the sorted import paths of the
+// packages with at least one block in which every block is covered
+// (if 'covered' is true) or every block is uncovered (if 'covered' is
+// false).
+func packagesWithUniformCoverage(covered bool) ([]string, error) {
+	snap, err := ReadCounterSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	counters := snap.counterMap()
+	payloads := metaPayloads(getCovMetaList())
+	paths := make([]string, len(payloads))
+	nblocks := make([]int, len(payloads))
+	mixed := make([]bool, len(payloads))
+	err = visitMetaFuncs(payloads, func(pkIdx, fnIdx uint32, pd *decodemeta.CoverageMetaDataDecoder, fd *coverage.FuncDesc) error {
+		paths[pkIdx] = pd.PackagePath()
+		if mixed[pkIdx] {
+			return nil
+		}
+		ctrs := counters[pkfunc{pk: pkIdx, fcn: fnIdx}]
+		for i, u := range fd.Units {
+			if u.Parent != 0 {
+				continue
+			}
+			nblocks[pkIdx]++
+			if (unitCount(cgran, ctrs, i) != 0) != covered {
+				mixed[pkIdx] = true
+				break
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	pkgs := []string{}
+	for pkIdx, path := range paths {
+		if !mixed[pkIdx] && nblocks[pkIdx] != 0 {
+			pkgs = append(pkgs, path)
+		}
+	}
+	sort.Strings(pkgs)
+	return pkgs, nil
+}
+
+// PrintCoverageReport prints the statement coverage percentage for
+// the currently running program to os.Stdout, in the same format
+// used by "go test -cover":
+//
+//	coverage: 85.3% of statements
+//
+// It is intended to be called at the end of TestMain in test binaries
+// that are built with "-cover" but run outside of "go test".
+// PrintCoverageReport prints nothing if there is no coverage output
+// directory (see GetCoverageOutputDir) or if coverage data is not
+// available.
+func PrintCoverageReport() {
+	if GetCoverageOutputDir() == "" {
+		return
+	}
+	printCoverageReport(os.Stdout)
+}
+
+// printCoverageReport is an io.Writer version of PrintCoverageReport
+// that does not check for a coverage output directory.
+func printCoverageReport(w io.Writer) {
+	snap, err := ReadCounterSnapshot()
+	if err != nil {
+		return
+	}
+	counters := snap.counterMap()
+	var stmts, covStmts uint64
+	err = visitMetaFuncs(metaPayloads(getCovMetaList()), func(pkIdx, fnIdx uint32, pd *decodemeta.CoverageMetaDataDecoder, fd *coverage.FuncDesc) error {
+		ctrs := counters[pkfunc{pk: pkIdx, fcn: fnIdx}]
+		for i, u := range fd.Units {
+			if u.Parent != 0 {
+				continue
+			}
+			stmts += uint64(u.NxStmts)
+			if unitCount(cgran, ctrs, i) != 0 {
+				covStmts += uint64(u.NxStmts)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return
+	}
+	pct := 0.0
+	if stmts != 0 {
+		pct = 100 * float64(covStmts) / float64(stmts)
+	}
+	fmt.Fprintf(w, "coverage: %.1f%% of statements\n", pct)
+}
@@ -0,0 +1,188 @@
+// Copyright 2022 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package coverage
+
+import (
+	"fmt"
+	"internal/coverage"
+	"internal/coverage/encodecounter"
+	"internal/coverage/rtcov"
+	"io"
+	"reflect"
+	"sync/atomic"
+	"unsafe"
+)
+
+// CounterDataWriter writes counter data for the currently running
+// program to an io.Writer one package at a time, without first
+// collecting the counter values for the whole program in memory. Use
+// NewCounterDataWriter to create one, then call WriteHeader, then
+// WritePackage for each package of interest, then Close.
+//
+// The set of functions written is fixed by WriteHeader: it covers
+// the functions that have executed at least once at that point,
+// with the counter values current when their package is written.
+// The result is a complete counter data file, holding the same
+// functions and counter values that EmitCounterDataToWriter would
+// write for the same counter state, though possibly in a different
+// order.
+type CounterDataWriter struct {
+	// FlushInterval, if positive, causes the output buffered by the
+	// writer to be flushed to the underlying io.Writer after every
+	// FlushInterval calls to WritePackage. Flush can also be called
+	// directly between packages.
+	FlushInterval int
+
+	cfw      *encodecounter.CoverageDataWriter
+	cl       []rtcov.CovCounterBlob
+	funcs    [][]funcLoc // per package, live functions at WriteHeader time
+	written  []bool
+	nwritten int
+	started  bool
+	closed   bool
+	tmp      []uint32
+}
+
+// funcLoc records the location of a function's prolog within the
+// counter arrays: the index of the array and the offset within it.
+type funcLoc struct {
+	slab, off int
+}
+
+// NewCounterDataWriter returns a CounterDataWriter that writes
+// counter data for the currently running program to 'w'. An error
+// is returned if 'w' is nil, if the program was not built with
+// "-cover", or if its meta-data is not yet available.
+func NewCounterDataWriter(w io.Writer) (*CounterDataWriter, error) {
+	if w == nil {
+		return nil, fmt.Errorf("error: nil writer in NewCounterDataWriter")
+	}
+	cl := getCovCounterList()
+	if len(cl) == 0 {
+		return nil, fmt.Errorf("program not built with -cover")
+	}
+	if !finalHashComputed {
+		return nil, fmt.Errorf("meta-data not written yet, unable to write counter data")
+	}
+	return &CounterDataWriter{
+		cfw: encodecounter.NewCoverageDataWriter(w, coverage.CtrULeb128),
+		cl:  cl,
+	}, nil
+}
+
+// WriteHeader writes the file header, the meta-data hash and the
+// args section. It must be called once, before any call to
+// WritePackage.
+func (cw *CounterDataWriter) WriteHeader() error {
+	if cw.started {
+		return fmt.Errorf("WriteHeader called more than once")
+	}
+	cw.started = true
+	npkgs := len(getCovMetaList())
+	cw.funcs = make([][]funcLoc, npkgs)
+	cw.written = make([]bool, npkgs)
+	nf := 0
+	pm := getCovPkgMap()
+	for k, c := range cw.cl {
+		sd := counterSlab(c)
+		for i := 0; i < len(sd); i++ {
+			// Skip ahead until the next non-zero value.
+			nCtrs := sd[i].Load()
+			if nCtrs == 0 {
+				continue
+			}
+			pkgId := sd[i+coverage.PkgIdOffset].Load()
+			funcId := sd[i+coverage.FuncIdOffset].Load()
+			counters := sd[i+coverage.FirstCtrOffset : i+coverage.FirstCtrOffset+int(nCtrs)]
+			for j := range counters {
+				if counters[j].Load() != 0 {
+					pk := remapPkgID(pm, i, pkgId, funcId, nCtrs)
+					if int(pk) < npkgs {
+						cw.funcs[pk] = append(cw.funcs[pk], funcLoc{slab: k, off: i})
+						nf++
+					}
+					break
+				}
+			}
+			// Move to next function.
+			i += coverage.FirstCtrOffset + int(nCtrs) - 1
+		}
+	}
+	return cw.cfw.BeginStream(finalHash, counterFileArgs(), nf)
+}
+
+// WritePackage writes the counter data for the package with index
+// 'pkgIdx' (its position in the meta-data, as used by the other APIs
+// in this package). Each package can be written at most once.
+func (cw *CounterDataWriter) WritePackage(pkgIdx int) error {
+	if !cw.started {
+		return fmt.Errorf("WritePackage called before WriteHeader")
+	}
+	if cw.closed {
+		return fmt.Errorf("WritePackage called after Close")
+	}
+	if pkgIdx < 0 || pkgIdx >= len(cw.funcs) {
+		return fmt.Errorf("package index %d out of range (%d packages)", pkgIdx, len(cw.funcs))
+	}
+	if cw.written[pkgIdx] {
+		return fmt.Errorf("package %d already written", pkgIdx)
+	}
+	cw.written[pkgIdx] = true
+	for _, fl := range cw.funcs[pkgIdx] {
+		sd := counterSlab(cw.cl[fl.slab])
+		nCtrs := sd[fl.off].Load()
+		funcId := sd[fl.off+coverage.FuncIdOffset].Load()
+		counters := sd[fl.off+coverage.FirstCtrOffset : fl.off+coverage.FirstCtrOffset+int(nCtrs)]
+		cw.tmp = cw.tmp[:0]
+		for i := range counters {
+			cw.tmp = append(cw.tmp, counters[i].Load())
+		}
+		if err := cw.cfw.WriteFunc(uint32(pkgIdx), funcId, cw.tmp); err != nil {
+			return err
+		}
+	}
+	cw.nwritten++
+	if cw.FlushInterval > 0 && cw.nwritten%cw.FlushInterval == 0 {
+		return cw.Flush()
+	}
+	return nil
+}
+
+// Flush writes any buffered output to the underlying io.Writer.
+func (cw *CounterDataWriter) Flush() error {
+	return cw.cfw.Flush()
+}
+
+// Close writes the counter data for any packages not yet written by
+// WritePackage, in package index order, followed by the file footer,
+// and flushes the output. It does not close the underlying
+// io.Writer.
+func (cw *CounterDataWriter) Close() error {
+	if !cw.started {
+		return fmt.Errorf("Close called before WriteHeader")
+	}
+	if cw.closed {
+		return fmt.Errorf("Close called more than once")
+	}
+	for pk := range cw.funcs {
+		if !cw.written[pk] {
+			if err := cw.WritePackage(pk); err != nil {
+				return err
+			}
+		}
+	}
+	cw.closed = true
+	return cw.cfw.EndStream()
+}
+
+// counterSlab returns a view of the counter array 'c'.
+func counterSlab(c rtcov.CovCounterBlob) []atomic.Uint32 {
+	var sd []atomic.Uint32
+	bufHdr := (*reflect.SliceHeader)(unsafe.Pointer(&sd))
+	bufHdr.Data = uintptr(unsafe.Pointer(c.Counters))
+	bufHdr.Len = int(c.Len)
+	bufHdr.Cap = int(c.Len)
+	return sd
+}
@@ -0,0 +1,119 @@
+// Copyright 2022 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package coverage
+
+import (
+	"bufio"
+	"fmt"
+	"internal/coverage"
+	"internal/coverage/decodemeta"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Layout parameters for CounterProfileToSVG.
+const (
+	svgWidth     = 1200 // width of the bar area, in pixels
+	svgBarHeight = 24   // height of a bar, in pixels
+	svgMargin    = 10   // margin around the bar area, in pixels
+	svgMinLabel  = 60   // minimum bar width for an inline label
+)
+
+// svgFunc holds the per-function data plotted by CounterProfileToSVG.
+type svgFunc struct {
+	name          string
+	hits          uint64
+	blocks, cover int
+}
+
+// CounterProfileToSVG writes to 'w' a self-contained SVG image in the
+// style of a flame graph, showing the functions of the package with
+// import path 'pkgPath' as a single row of bars, ordered by
+// descending total counter value ("hits") in the snapshot 'snap'. The
+// width of each bar is proportional to the function's hits, and its
+// color ranges from blue (no blocks covered) to green (all blocks
+// covered). Hovering over a bar shows the function name, its hits and
+// its block coverage percentage. An error is returned if 'snap' was
+// not captured from the currently running program or if the package
+// is not instrumented.
+func CounterProfileToSVG(snap *CounterSnapshot, pkgPath string, w io.Writer) error {
+	if err := ensureFinalHash(); err != nil {
+		return err
+	}
+	if snap.metaHash != finalHash {
+		return fmt.Errorf("snapshot meta-data hash %x does not match program meta-data hash %x", snap.metaHash, finalHash)
+	}
+	counters := snap.counterMap()
+	var funcs []svgFunc
+	found := false
+	err := visitMetaFuncs(metaPayloads(getCovMetaList()), func(pkIdx, fnIdx uint32, pd *decodemeta.CoverageMetaDataDecoder, fd *coverage.FuncDesc) error {
+		if pd.PackagePath() != pkgPath {
+			return nil
+		}
+		found = true
+		ctrs := counters[pkfunc{pk: pkIdx, fcn: fnIdx}]
+		f := svgFunc{name: fd.Funcname, hits: sumCounters(ctrs)}
+		for i, u := range fd.Units {
+			if u.Parent != 0 {
+				continue
+			}
+			f.blocks++
+			if unitCount(cgran, ctrs, i) != 0 {
+				f.cover++
+			}
+		}
+		funcs = append(funcs, f)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("package %s is not instrumented", pkgPath)
+	}
+	sort.SliceStable(funcs, func(i, j int) bool {
+		return funcs[i].hits > funcs[j].hits
+	})
+	var total uint64
+	for _, f := range funcs {
+		total += f.hits
+	}
+
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n")
+	fmt.Fprintf(bw, "<svg xmlns=\"http://www.w3.org/2000/svg\" width=\"%d\" height=\"%d\" font-family=\"monospace\" font-size=\"12\">\n",
+		svgWidth+2*svgMargin, svgBarHeight+3*svgMargin+12)
+	fmt.Fprintf(bw, "<text x=\"%d\" y=\"%d\">%s (%d hits)</text>\n", svgMargin, svgMargin+12, svgEscape(pkgPath), total)
+	x := 0.0
+	y := 2*svgMargin + 12
+	for _, f := range funcs {
+		width := 0.0
+		if total != 0 {
+			width = float64(f.hits) / float64(total) * svgWidth
+		}
+		pct := percent(f.cover, f.blocks)
+		green := int(255 * pct / 100)
+		fmt.Fprintf(bw, "<g><title>%s\nhits: %d\nblocks covered: %.1f%%</title>", svgEscape(f.name), f.hits, pct)
+		fmt.Fprintf(bw, "<rect x=\"%.2f\" y=\"%d\" width=\"%.2f\" height=\"%d\" fill=\"rgb(0,%d,%d)\" stroke=\"white\"/>",
+			float64(svgMargin)+x, y, width, svgBarHeight, green, 255-green)
+		if width >= svgMinLabel {
+			label := f.name
+			if max := int(width / 7); len(label) > max {
+				label = label[:max-2] + ".."
+			}
+			fmt.Fprintf(bw, "<text x=\"%.2f\" y=\"%d\" fill=\"white\">%s</text>", float64(svgMargin)+x+3, y+16, svgEscape(label))
+		}
+		fmt.Fprintf(bw, "</g>\n")
+		x += width
+	}
+	fmt.Fprintf(bw, "</svg>\n")
+	return bw.Flush()
+}
+
+// svgEscape escapes 's' for use as XML character data.
+func svgEscape(s string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", "\"", "&quot;").Replace(s)
+}
@@ -0,0 +1,9 @@
+package emit
+
+//go:noinline
+func work(x int) int {
+	if x != 0 {
+		return x + 42
+	}
+	return x - 42
+}
@@ -0,0 +1,46 @@
+package emit
+
+import (
+	"io"
+	"runtime/coverage"
+	"sync"
+	"testing"
+)
+
+// TestConcurrentEmit writes meta-data and counter data from several
+// goroutines at once, while another goroutine updates counters.
+func TestConcurrentEmit(t *testing.T) {
+	// Make sure the meta-data is finalized.
+	if _, err := coverage.GetCoverageGranularity(); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				work(1)
+				work(0)
+			}
+		}
+	}()
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				if err := coverage.EmitCounterDataToWriter(io.Discard); err != nil {
+					t.Error(err)
+				}
+				if err := coverage.EmitMetaDataToWriter(io.Discard); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(done)
+}
@@ -5,15 +5,40 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
 	"flag"
 	"fmt"
+	icov "internal/coverage"
+	"internal/coverage/decodecounter"
+	"internal/coverage/pods"
 	"internal/coverage/slicewriter"
 	"io"
 	"io/ioutil"
 	"log"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
 	"path/filepath"
+	"reflect"
+	"runtime"
 	"runtime/coverage"
+	"runtime/coverage/debughttp"
+	"runtime/coverage/httphook"
+	covjson "runtime/coverage/json"
+	"runtime/coverage/lcov"
+	"runtime/coverage/signals"
+	"runtime/coverage/sonarqube"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 var verbflag = flag.Int("v", 0, "Verbose trace output level")
@@ -223,6 +248,4582 @@ func emitWithCounterClear() {
 	}
 }
 
+func clearTarget1() int {
+	return 1
+}
+
+func clearTarget2() int {
+	return 2
+}
+
+func clearAndEmit() {
+	log.SetPrefix("clearAndEmit: ")
+	for _, sub := range []string{"a", "b"} {
+		if err := os.Mkdir(filepath.Join(*outdirflag, sub), 0777); err != nil {
+			log.Fatalf("error: %v", err)
+		}
+	}
+	clearTarget1()
+	if err := coverage.ClearCountersAndEmitTo(filepath.Join(*outdirflag, "a")); err != nil {
+		log.Fatalf("clear and emit failed: %v", err)
+	}
+	clearTarget2()
+	if err := coverage.ClearCountersAndEmitTo(filepath.Join(*outdirflag, "b")); err != nil {
+		log.Fatalf("clear and emit failed: %v", err)
+	}
+}
+
+// mainPackageIndex returns the index of package main in the
+// program's coverage meta-data.
+func mainPackageIndex() uint32 {
+	c, err := coverage.NewCoverage()
+	if err != nil {
+		log.Fatalf("error: NewCoverage returns %v", err)
+	}
+	for i, p := range c.Meta.Packages {
+		if p.ImportPath == "main" {
+			return uint32(i)
+		}
+	}
+	log.Fatalf("error: package main not found in meta-data")
+	return 0
+}
+
+func clearPackage() {
+	log.SetPrefix("clearPackage: ")
+	if err := coverage.ClearPackageCoverageCounters("no/such/package"); err == nil {
+		log.Fatalf("error: ClearPackageCoverageCounters of unknown package succeeded")
+	}
+	mainIdx := mainPackageIndex()
+	clearTarget1()
+
+	// No code in package main runs between the clear and the
+	// read, so all of its counters must be zero.
+	cerr := coverage.ClearPackageCoverageCounters("main")
+	snap, err := coverage.ReadCounterSnapshot()
+	if cerr != nil {
+		log.Fatalf("error: ClearPackageCoverageCounters returns %v", cerr)
+	}
+	if err != nil {
+		log.Fatalf("error: ReadCounterSnapshot returns %v", err)
+	}
+	for fn, ctrs := range mainCounters(snap, "cleared", mainIdx) {
+		for _, v := range ctrs {
+			if v != 0 {
+				log.Fatalf("error: counters for function %d not cleared: %v", fn, ctrs)
+			}
+		}
+	}
+	st, err := coverage.PackageCoverageStats("runtime/coverage")
+	if err != nil {
+		log.Fatalf("error: PackageCoverageStats returns %v", err)
+	}
+	if st.CoveredBlocks == 0 {
+		log.Fatalf("error: counters for runtime/coverage were cleared")
+	}
+}
+
+func counterSummary() {
+	log.SetPrefix("counterSummary: ")
+	s := coverage.CounterSummary()
+	if !strings.HasPrefix(s, "coverage: ") || !strings.Contains(s, "blocks covered") {
+		log.Fatalf("unexpected CounterSummary output %q", s)
+	}
+	if s := coverage.CounterSummaryForPackage("main"); !strings.Contains(s, "functions fully covered") {
+		log.Fatalf("unexpected CounterSummaryForPackage output %q", s)
+	}
+	if s := coverage.CounterSummaryForPackage("no/such/pkg"); s != "" {
+		log.Fatalf("CounterSummaryForPackage for bad package returns %q", s)
+	}
+}
+
+func runWithCoverageTarget() int {
+	return 42
+}
+
+func hasDiffEntry(entries []coverage.DiffEntry, pkg, fn string) bool {
+	for _, e := range entries {
+		if e.PackagePath == pkg && e.FunctionName == fn {
+			return true
+		}
+	}
+	return false
+}
+
+func runWithCoverage() {
+	log.SetPrefix("runWithCoverage: ")
+	diff, err := coverage.RunWithCoverage(func() { runWithCoverageTarget() }, "rwc")
+	if err != nil {
+		log.Fatalf("error: RunWithCoverage returns %v", err)
+	}
+	if !hasDiffEntry(diff.Gained, "main", "runWithCoverageTarget") {
+		log.Fatalf("runWithCoverageTarget not in gained functions: %+v", diff)
+	}
+	if hasDiffEntry(diff.Gained, "main", "main") || hasDiffEntry(diff.Changed, "main", "main") {
+		log.Fatalf("unexpected entry for main in diff: %+v", diff)
+	}
+
+	// A panic in the function should be propagated.
+	func() {
+		defer func() {
+			if r := recover(); r != "boom" {
+				log.Fatalf("unexpected recover value %v", r)
+			}
+		}()
+		coverage.RunWithCoverage(func() { panic("boom") }, "rwc-panic")
+		log.Fatalf("RunWithCoverage did not re-panic")
+	}()
+}
+
+func iterateTarget() int {
+	return 42
+}
+
+func iterateCounterChanges() {
+	log.SetPrefix("iterateCounterChanges: ")
+	c, err := coverage.NewCoverage()
+	if err != nil {
+		log.Fatalf("error: NewCoverage returns %v", err)
+	}
+	err = coverage.IterateCounterChanges(c.Counters, func(pkg, funcName string, blockIdx int, oldVal, newVal uint32) {})
+	if c.Meta.Mode != "atomic" {
+		if err == nil {
+			log.Fatalf("expected error from IterateCounterChanges in mode %s", c.Meta.Mode)
+		}
+		return
+	}
+	if err != nil {
+		log.Fatalf("error: IterateCounterChanges returns %v", err)
+	}
+	iterateTarget()
+	found, calls := false, 0
+	err = coverage.IterateCounterChanges(c.Counters, func(pkg, funcName string, blockIdx int, oldVal, newVal uint32) {
+		calls++
+		if pkg == "main" && funcName == "iterateTarget" && oldVal == 0 && newVal != 0 {
+			found = true
+		}
+		panic("ignored")
+	})
+	if err != nil {
+		log.Fatalf("error: IterateCounterChanges returns %v", err)
+	}
+	if !found || calls < 2 {
+		log.Fatalf("change for iterateTarget not reported (found=%v calls=%d)", found, calls)
+	}
+}
+
+func emitWithProgress() {
+	log.SetPrefix("emitWithProgress: ")
+	var slwc slicewriter.WriteSeeker
+	ch, err := coverage.EmitCounterDataToWriterWithProgress(&slwc)
+	if err != nil {
+		log.Fatalf("error: EmitCounterDataToWriterWithProgress returns %v", err)
+	}
+	var last coverage.EmitProgress
+	n := 0
+	for p := range ch {
+		if p.Err != nil {
+			log.Fatalf("error: emission failed: %v", p.Err)
+		}
+		if p.PackagesEmitted != n+1 {
+			log.Fatalf("bad progress event %+v after %d events", p, n)
+		}
+		last = p
+		n++
+	}
+	if n == 0 || last.PackagesEmitted != last.TotalPackages {
+		log.Fatalf("bad final progress event %+v after %d events", last, n)
+	}
+	if last.BytesWritten != int64(len(slwc.BytesWritten())) || last.EstimatedTotalBytes <= 0 {
+		log.Fatalf("bad byte counts in final progress event %+v (wrote %d)", last, len(slwc.BytesWritten()))
+	}
+	if _, err := coverage.EmitCounterDataToWriterWithProgress(nil); err == nil {
+		log.Fatalf("expected error from EmitCounterDataToWriterWithProgress with nil writer")
+	}
+}
+
+func drainCounters() {
+	log.SetPrefix("drainCounters: ")
+	c, err := coverage.NewCoverage()
+	if err != nil {
+		log.Fatalf("error: NewCoverage returns %v", err)
+	}
+	ch := make(chan coverage.PackageCounterData)
+	done := make(chan error, 1)
+	go func() {
+		done <- coverage.DrainCountersToChan(ch)
+		close(ch)
+	}()
+	npkgs, found := 0, false
+	for p := range ch {
+		npkgs++
+		if p.PackagePath != "main" {
+			continue
+		}
+		for _, f := range p.Functions {
+			if f.FunctionName == "drainCounters" && len(f.Counters) != 0 {
+				found = true
+			}
+		}
+	}
+	if err := <-done; err != nil {
+		log.Fatalf("error: DrainCountersToChan returns %v", err)
+	}
+	if npkgs != len(c.Meta.Packages) || !found {
+		log.Fatalf("got %d packages (want %d), found drainCounters=%v", npkgs, len(c.Meta.Packages), found)
+	}
+
+	// A canceled context should cause a blocked send to give up.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := coverage.DrainCountersToChanContext(ctx, make(chan coverage.PackageCounterData)); err != context.Canceled {
+		log.Fatalf("DrainCountersToChanContext with canceled context returns %v", err)
+	}
+}
+
+func lazyMetaDecoder() {
+	log.SetPrefix("lazyMetaDecoder: ")
+	c, err := coverage.NewCoverage()
+	if err != nil {
+		log.Fatalf("error: NewCoverage returns %v", err)
+	}
+	var slwm slicewriter.WriteSeeker
+	if err := coverage.EmitMetaDataToWriter(&slwm); err != nil {
+		log.Fatalf("error: EmitMetaDataToWriter returns %v", err)
+	}
+	d, err := coverage.NewLazyMetaDecoder(slwm.BytesWritten())
+	if err != nil {
+		log.Fatalf("error: NewLazyMetaDecoder returns %v", err)
+	}
+	if d.NumPackages() != len(c.Meta.Packages) {
+		log.Fatalf("NumPackages() = %d, want %d", d.NumPackages(), len(c.Meta.Packages))
+	}
+	for i := d.NumPackages() - 1; i >= 0; i-- {
+		pm, err := d.PackageAt(i)
+		if err != nil {
+			log.Fatalf("error: PackageAt(%d) returns %v", i, err)
+		}
+		if !reflect.DeepEqual(*pm, c.Meta.Packages[i]) {
+			log.Fatalf("PackageAt(%d) mismatch: got %+v want %+v", i, *pm, c.Meta.Packages[i])
+		}
+		if pm2, _ := d.PackageAt(i); pm2 != pm {
+			log.Fatalf("PackageAt(%d) not cached", i)
+		}
+	}
+	if _, err := d.PackageAt(d.NumPackages()); err == nil {
+		log.Fatalf("expected error from PackageAt with bad index")
+	}
+	if _, err := coverage.NewLazyMetaDecoder([]byte("garbage")); err == nil {
+		log.Fatalf("expected error from NewLazyMetaDecoder on bad input")
+	}
+}
+
+// tagPlugin is a coverage plugin that prefixes data with a tag.
+type tagPlugin struct{}
+
+func (tagPlugin) ProcessMetaData(r io.Reader) (io.Reader, error) {
+	return io.MultiReader(strings.NewReader("META:"), r), nil
+}
+
+func (tagPlugin) ProcessCounterData(r io.Reader) (io.Reader, error) {
+	return io.MultiReader(strings.NewReader("COUNTERS:"), r), nil
+}
+
+func coveragePlugin() {
+	log.SetPrefix("coveragePlugin: ")
+	coverage.RegisterCoveragePlugin("tag", tagPlugin{})
+	var slwm, slwc slicewriter.WriteSeeker
+	if err := coverage.EmitMetaDataToWriter(&slwm); err != nil {
+		log.Fatalf("error: EmitMetaDataToWriter returns %v", err)
+	}
+	if err := coverage.EmitCounterDataToWriter(&slwc); err != nil {
+		log.Fatalf("error: EmitCounterDataToWriter returns %v", err)
+	}
+	if !bytes.HasPrefix(slwm.BytesWritten(), []byte("META:")) {
+		log.Fatalf("meta-data not processed by plugin")
+	}
+	if !bytes.HasPrefix(slwc.BytesWritten(), []byte("COUNTERS:")) {
+		log.Fatalf("counter data not processed by plugin")
+	}
+	for _, e := range []struct {
+		name string
+		emit func(io.Writer) error
+	}{
+		{"EmitDeterministicCounterData", coverage.EmitDeterministicCounterData},
+		{"EmitCounterDataToWriterWithProgress", emitAndWaitWithProgress},
+		{"EmitCounterDataToWriterWithTimeout", emitWithMinuteTimeout},
+		{"EmitCounterDataToWriterContext", emitWithContext},
+	} {
+		var b bytes.Buffer
+		if err := e.emit(&b); err != nil {
+			log.Fatalf("error: %s returns %v", e.name, err)
+		}
+		if !bytes.HasPrefix(b.Bytes(), []byte("COUNTERS:")) {
+			log.Fatalf("%s output not processed by plugin", e.name)
+		}
+	}
+
+	// With the plugin removed, emission should be unaffected.
+	coverage.UnregisterCoveragePlugin("tag")
+	emitToWriter()
+}
+
+func metaRaw() {
+	log.SetPrefix("metaRaw: ")
+	raw, err := coverage.GetCoverageMetaRaw()
+	if err != nil {
+		log.Fatalf("error: GetCoverageMetaRaw returns %v", err)
+	}
+	var slwm slicewriter.WriteSeeker
+	if err := coverage.EmitMetaDataToWriter(&slwm); err != nil {
+		log.Fatalf("error: EmitMetaDataToWriter returns %v", err)
+	}
+	if !bytes.Equal(raw, slwm.BytesWritten()) {
+		log.Fatalf("GetCoverageMetaRaw result differs from EmitMetaDataToWriter output")
+	}
+	if _, err := coverage.NewLazyMetaDecoder(raw); err != nil {
+		log.Fatalf("error: decoding GetCoverageMetaRaw result: %v", err)
+	}
+	raw[0] ^= 0xff
+	raw2, err := coverage.GetCoverageMetaRaw()
+	if err != nil {
+		log.Fatalf("error: GetCoverageMetaRaw returns %v", err)
+	}
+	if !bytes.Equal(raw2, slwm.BytesWritten()) {
+		log.Fatalf("GetCoverageMetaRaw result affected by modification of earlier result")
+	}
+}
+
+type jsonCoverage struct {
+	Meta struct {
+		Hash        string
+		Mode        string
+		Granularity string
+		Packages    []struct {
+			ImportPath string
+			ModulePath string
+			Functions  []struct {
+				Name   string
+				File   string
+				Blocks []struct {
+					StartLine, StartCol, EndLine, EndCol, NumStmts int
+				}
+			}
+		}
+	}
+	Counters []struct {
+		Package  string
+		Function string
+		Hits     []uint32
+	}
+	Stats coverage.CoverageStats
+}
+
+func writeJSON() {
+	log.SetPrefix("writeJSON: ")
+	c, err := coverage.NewCoverage()
+	if err != nil {
+		log.Fatalf("error: NewCoverage returns %v", err)
+	}
+	for _, pretty := range []bool{false, true} {
+		var b bytes.Buffer
+		if err := coverage.WriteCoverageToJSON(&b, pretty); err != nil {
+			log.Fatalf("error: WriteCoverageToJSON returns %v", err)
+		}
+		if pretty != strings.HasPrefix(b.String(), "{\n  \"meta\": {") {
+			log.Fatalf("unexpected indentation (pretty=%v) in output: %.40q", pretty, b.String())
+		}
+		var jc jsonCoverage
+		if err := json.Unmarshal(b.Bytes(), &jc); err != nil {
+			log.Fatalf("error: decoding WriteCoverageToJSON output: %v", err)
+		}
+
+		// Check that the decoded document matches the program's
+		// meta-data, and that the stats agree with the hit counts.
+		if jc.Meta.Hash != fmt.Sprintf("%x", c.Meta.Hash) || jc.Meta.Mode != c.Meta.Mode || len(jc.Meta.Packages) != len(c.Meta.Packages) {
+			log.Fatalf("meta-data mismatch: %s %s %d", jc.Meta.Hash, jc.Meta.Mode, len(jc.Meta.Packages))
+		}
+		nf, covered := 0, 0
+		for i, p := range jc.Meta.Packages {
+			pm := c.Meta.Packages[i]
+			if p.ImportPath != pm.ImportPath || len(p.Functions) != len(pm.Functions) {
+				log.Fatalf("package %d mismatch: %s vs %s", i, p.ImportPath, pm.ImportPath)
+			}
+			for j, f := range p.Functions {
+				fm := pm.Functions[j]
+				if f.Name != fm.Name || f.File != fm.SourceFile || len(f.Blocks) != fm.NumBlocks {
+					log.Fatalf("function %s mismatch", fm.Name)
+				}
+				jctr := jc.Counters[nf]
+				if jctr.Package != p.ImportPath || jctr.Function != f.Name || len(jctr.Hits) != len(f.Blocks) {
+					log.Fatalf("counters for function %s mismatch", fm.Name)
+				}
+				for _, h := range jctr.Hits {
+					if h != 0 {
+						covered++
+					}
+				}
+				nf++
+			}
+		}
+		if nf != len(jc.Counters) || jc.Stats.TotalBlocks != c.Stats.TotalBlocks || jc.Stats.CoveredBlocks != covered {
+			log.Fatalf("stats mismatch: %+v, %d functions, %d covered blocks", jc.Stats, nf, covered)
+		}
+	}
+	if !json.Valid([]byte(coverage.JSONSchema())) {
+		log.Fatalf("JSONSchema result is not valid JSON")
+	}
+}
+
+func hashChain() {
+	log.SetPrefix("hashChain: ")
+	h1, err := coverage.CounterDataHashChain()
+	if err != nil {
+		log.Fatalf("error: CounterDataHashChain returns %v", err)
+	}
+	if !coverage.VerifyHashChain([32]byte{}, h1) {
+		log.Fatalf("VerifyHashChain rejects first link")
+	}
+	h2, err := coverage.CounterDataHashChain()
+	if err != nil {
+		log.Fatalf("error: CounterDataHashChain returns %v", err)
+	}
+	if h1 == h2 {
+		log.Fatalf("successive hash chain values are equal")
+	}
+	if !coverage.VerifyHashChain(h1, h2) {
+		log.Fatalf("VerifyHashChain rejects valid link")
+	}
+	if coverage.VerifyHashChain(h2, h1) || coverage.VerifyHashChain([32]byte{}, h2) {
+		log.Fatalf("VerifyHashChain accepts invalid links")
+	}
+	// Earlier links remain verifiable after further calls.
+	h3, err := coverage.CounterDataHashChain()
+	if err != nil {
+		log.Fatalf("error: CounterDataHashChain returns %v", err)
+	}
+	if !coverage.VerifyHashChain([32]byte{}, h1) || !coverage.VerifyHashChain(h1, h2) || !coverage.VerifyHashChain(h2, h3) {
+		log.Fatalf("VerifyHashChain rejects earlier link")
+	}
+}
+
+func emitter() {
+	log.SetPrefix("emitter: ")
+	ctx := context.Background()
+	raw, err := coverage.GetCoverageMetaRaw()
+	if err != nil {
+		log.Fatalf("error: GetCoverageMetaRaw returns %v", err)
+	}
+
+	var b bytes.Buffer
+	if err := coverage.NewEmitter().EmitMetaData(ctx, &b); err != nil {
+		log.Fatalf("error: EmitMetaData returns %v", err)
+	}
+	if !bytes.Equal(b.Bytes(), raw) {
+		log.Fatalf("EmitMetaData output differs from meta-data")
+	}
+	if err := coverage.NewDryRunEmitter().EmitCounterData(ctx, nil); err != nil {
+		log.Fatalf("error: dry run EmitCounterData returns %v", err)
+	}
+
+	// Emission should fail with a canceled context.
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := coverage.EmitCounterDataToWriterContext(cctx, &b); err != context.Canceled {
+		log.Fatalf("EmitCounterDataToWriterContext with canceled context returns %v", err)
+	}
+
+	em, records := coverage.NewRecordingEmitter()
+	var slwm, slwc slicewriter.WriteSeeker
+	if err := em.EmitMetaData(ctx, &slwm); err != nil {
+		log.Fatalf("error: recording EmitMetaData returns %v", err)
+	}
+	if err := em.EmitCounterData(ctx, &slwc); err != nil {
+		log.Fatalf("error: recording EmitCounterData returns %v", err)
+	}
+	recs := records()
+	if len(recs) != 2 || recs[0].Kind != "meta-data" || recs[1].Kind != "counter-data" {
+		log.Fatalf("unexpected records %+v", recs)
+	}
+	if !bytes.Equal(recs[0].Data, slwm.BytesWritten()) || !bytes.Equal(recs[1].Data, slwc.BytesWritten()) {
+		log.Fatalf("recorded data differs from data written")
+	}
+	mf := filepath.Join(*outdirflag, "covmeta.0abcdef")
+	if err := ioutil.WriteFile(mf, recs[0].Data, 0666); err != nil {
+		log.Fatalf("error: writing %s: %v", mf, err)
+	}
+	cf := filepath.Join(*outdirflag, "covcounters.0abcdef.99.77")
+	if err := ioutil.WriteFile(cf, recs[1].Data, 0666); err != nil {
+		log.Fatalf("error: writing %s: %v", cf, err)
+	}
+}
+
+func postSnapshot() int {
+	return 42
+}
+
+func emitSnapshotToDir() {
+	log.SetPrefix("emitSnapshotToDir: ")
+	snap, err := coverage.ReadCounterSnapshot()
+	if err != nil {
+		log.Fatalf("error: ReadCounterSnapshot returns %v", err)
+	}
+	postSnapshot()
+	if err := coverage.EmitMetaDataToDir(*outdirflag); err != nil {
+		log.Fatalf("error: EmitMetaDataToDir returns %v", err)
+	}
+	if err := coverage.EmitCounterDataSnapshotToDir(snap, *outdirflag); err != nil {
+		log.Fatalf("error: EmitCounterDataSnapshotToDir returns %v", err)
+	}
+	if err := coverage.EmitCounterDataSnapshotToDir(nil, *outdirflag); err == nil {
+		log.Fatalf("expected error from EmitCounterDataSnapshotToDir with nil snapshot")
+	}
+}
+
+func uniformCoveragePackages() {
+	log.SetPrefix("uniformCoveragePackages: ")
+	zero, err := coverage.ZeroCoveragePackages()
+	if err != nil {
+		log.Fatalf("error: ZeroCoveragePackages returns %v", err)
+	}
+	full, err := coverage.FullyCoveredPackages()
+	if err != nil {
+		log.Fatalf("error: FullyCoveredPackages returns %v", err)
+	}
+	if !sort.StringsAreSorted(zero) || !sort.StringsAreSorted(full) {
+		log.Fatalf("results not sorted: %v %v", zero, full)
+	}
+	seen := make(map[string]bool)
+	for _, p := range append(zero, full...) {
+		// Package main is partially covered, and no package can be
+		// both fully covered and not covered at all.
+		if p == "main" || seen[p] {
+			log.Fatalf("unexpected package %s in results: %v %v", p, zero, full)
+		}
+		seen[p] = true
+	}
+}
+
+func mergeDirs() {
+	log.SetPrefix("mergeDirs: ")
+	mkdir := func(name string) string {
+		d := filepath.Join(*outdirflag, name)
+		if err := os.Mkdir(d, 0777); err != nil {
+			log.Fatalf("error: %v", err)
+		}
+		return d
+	}
+	src1, src2, src3 := mkdir("src1"), mkdir("src2"), mkdir("src3")
+	for _, d := range []string{src1, src1, src2} {
+		if err := coverage.EmitMetaDataToDir(d); err != nil {
+			log.Fatalf("error: EmitMetaDataToDir returns %v", err)
+		}
+		if err := coverage.EmitCounterDataToDir(d); err != nil {
+			log.Fatalf("error: EmitCounterDataToDir returns %v", err)
+		}
+	}
+
+	// Add a meta-data file and counter data file for a "different"
+	// program, which should be skipped by the merge.
+	raw, err := coverage.GetCoverageMetaRaw()
+	if err != nil {
+		log.Fatalf("error: GetCoverageMetaRaw returns %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(src3, "covmeta.0abcdef"), raw, 0666); err != nil {
+		log.Fatalf("error: %v", err)
+	}
+	var slwc slicewriter.WriteSeeker
+	if err := coverage.EmitCounterDataToWriter(&slwc); err != nil {
+		log.Fatalf("error: EmitCounterDataToWriter returns %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(src3, "covcounters.0abcdef.99.77"), slwc.BytesWritten(), 0666); err != nil {
+		log.Fatalf("error: %v", err)
+	}
+
+	if err := coverage.MergeCounterDataDirs([]string{src1, src2, src3}, *outdirflag); err != nil {
+		log.Fatalf("error: MergeCounterDataDirs returns %v", err)
+	}
+	if err := coverage.MergeCounterDataDirs([]string{mkdir("empty")}, *outdirflag); err == nil {
+		log.Fatalf("expected error from MergeCounterDataDirs with no input files")
+	}
+}
+
+func coverageProfile() {
+	log.SetPrefix("coverageProfile: ")
+	stopA, err := coverage.StartCoverageProfile("A")
+	if err != nil {
+		log.Fatalf("error: StartCoverageProfile returns %v", err)
+	}
+	if _, err := coverage.StartCoverageProfile("A"); err == nil {
+		log.Fatalf("expected error from StartCoverageProfile with active name")
+	}
+	if _, err := coverage.StartCoverageProfile("B"); err != nil {
+		log.Fatalf("error: StartCoverageProfile returns %v", err)
+	}
+	if got := coverage.ListActiveCoverageProfiles(); !reflect.DeepEqual(got, []string{"A", "B"}) {
+		log.Fatalf("ListActiveCoverageProfiles returns %v", got)
+	}
+	if err := stopA(); err != nil {
+		log.Fatalf("error: stopping profile A: %v", err)
+	}
+	if err := stopA(); err == nil {
+		log.Fatalf("expected error when stopping profile A twice")
+	}
+	if err := coverage.StopAllCoverageProfiles(); err != nil {
+		log.Fatalf("error: StopAllCoverageProfiles returns %v", err)
+	}
+	if got := coverage.ListActiveCoverageProfiles(); len(got) != 0 {
+		log.Fatalf("ListActiveCoverageProfiles returns %v after StopAllCoverageProfiles", got)
+	}
+}
+
+// fakeT is a stand-in for *testing.T, recording failures and cleanups.
+type fakeT struct {
+	errors, fatals []string
+	logs           []string
+	cleanups       []func()
+	dir            string
+}
+
+func (t *fakeT) Helper()      {}
+func (t *fakeT) Name() string { return "TestFake" }
+func (t *fakeT) Logf(format string, args ...any) {
+	t.logs = append(t.logs, fmt.Sprintf(format, args...))
+}
+func (t *fakeT) Errorf(format string, args ...any) {
+	t.errors = append(t.errors, fmt.Sprintf(format, args...))
+}
+func (t *fakeT) Fatalf(format string, args ...any) {
+	t.fatals = append(t.fatals, fmt.Sprintf(format, args...))
+}
+func (t *fakeT) Cleanup(f func()) { t.cleanups = append(t.cleanups, f) }
+func (t *fakeT) TempDir() string  { return t.dir }
+func (t *fakeT) Failed() bool     { return len(t.errors)+len(t.fatals) != 0 }
+func (t *fakeT) runCleanups() {
+	for i := len(t.cleanups) - 1; i >= 0; i-- {
+		t.cleanups[i]()
+	}
+}
+
+func reporterTarget() int {
+	return 42
+}
+
+func testCoverageReporter() {
+	log.SetPrefix("testCoverageReporter: ")
+	ft := &fakeT{dir: *outdirflag}
+	r := coverage.NewTestCoverageReporter(ft)
+	reporterTarget()
+	r.Assert(0)
+	r.Require(0)
+	if len(ft.errors) != 0 || len(ft.fatals) != 0 {
+		log.Fatalf("unexpected failures %v %v", ft.errors, ft.fatals)
+	}
+	r.Assert(100.5)
+	r.Require(100.5)
+	if len(ft.errors) != 1 || len(ft.fatals) != 1 {
+		log.Fatalf("expected one error and one fatal failure, got %v %v", ft.errors, ft.fatals)
+	}
+	ft.runCleanups()
+	if len(ft.errors) != 1 {
+		log.Fatalf("unexpected failures from cleanup %v", ft.errors)
+	}
+	b, err := os.ReadFile(filepath.Join(*outdirflag, "coverage.json"))
+	if err != nil {
+		log.Fatalf("error: reading coverage report: %v", err)
+	}
+	var report struct {
+		Test          string
+		CoveredBlocks int
+		Gained        []struct{ Package, Function string }
+	}
+	if err := json.Unmarshal(b, &report); err != nil {
+		log.Fatalf("error: decoding coverage report: %v", err)
+	}
+	found := false
+	for _, g := range report.Gained {
+		if g.Package == "main" && g.Function == "reporterTarget" {
+			found = true
+		}
+	}
+	if report.Test != "TestFake" || report.CoveredBlocks == 0 || !found {
+		log.Fatalf("unexpected coverage report: %s", b)
+	}
+}
+
+func printCoverageReport() {
+	log.SetPrefix("printCoverageReport: ")
+	report := func() string {
+		path := filepath.Join(*outdirflag, "report.txt")
+		f, err := os.Create(path)
+		if err != nil {
+			log.Fatalf("error: %v", err)
+		}
+		stdout := os.Stdout
+		os.Stdout = f
+		coverage.PrintCoverageReport()
+		os.Stdout = stdout
+		if err := f.Close(); err != nil {
+			log.Fatalf("error: %v", err)
+		}
+		b, err := os.ReadFile(path)
+		if err != nil {
+			log.Fatalf("error: %v", err)
+		}
+		return string(b)
+	}
+	check := func(got string) {
+		var pct float64
+		if _, err := fmt.Sscanf(got, "coverage: %f%% of statements\n", &pct); err != nil {
+			log.Fatalf("unexpected report %q: %v", got, err)
+		}
+		if pct <= 0 || pct > 100 || !strings.HasSuffix(got, "% of statements\n") {
+			log.Fatalf("unexpected report %q", got)
+		}
+	}
+	if got := report(); os.Getenv("GOCOVERDIR") == "" {
+		if got != "" {
+			log.Fatalf("expected no output without an output directory, got %q", got)
+		}
+	} else {
+		check(got)
+	}
+
+	// An output directory set at run time enables the report even
+	// without GOCOVERDIR.
+	if err := coverage.SetCoverageOutputDir(*outdirflag); err != nil {
+		log.Fatalf("error: SetCoverageOutputDir returns %v", err)
+	}
+	got := report()
+	if err := coverage.SetCoverageOutputDir(""); err != nil {
+		log.Fatalf("error: SetCoverageOutputDir(\"\") returns %v", err)
+	}
+	check(got)
+}
+
+func emitWithTimeout() {
+	log.SetPrefix("emitWithTimeout: ")
+	var mb, cb bytes.Buffer
+	if err := coverage.EmitMetaDataToWriterWithTimeout(&mb, time.Minute); err != nil {
+		log.Fatalf("error: EmitMetaDataToWriterWithTimeout returns %v", err)
+	}
+	if err := coverage.EmitCounterDataToWriterWithTimeout(&cb, time.Minute); err != nil {
+		log.Fatalf("error: EmitCounterDataToWriterWithTimeout returns %v", err)
+	}
+	if mb.Len() == 0 || cb.Len() == 0 {
+		log.Fatalf("error: no data written")
+	}
+	if err := coverage.EmitMetaDataToWriterWithTimeout(io.Discard, 0); err != context.DeadlineExceeded {
+		log.Fatalf("error: EmitMetaDataToWriterWithTimeout(0) returns %v, want context.DeadlineExceeded", err)
+	}
+	if err := coverage.EmitCounterDataToWriterWithTimeout(io.Discard, 0); err != context.DeadlineExceeded {
+		log.Fatalf("error: EmitCounterDataToWriterWithTimeout(0) returns %v, want context.DeadlineExceeded", err)
+	}
+	if err := coverage.EmitCounterDataToWriterWithTimeout(nil, time.Minute); err == nil {
+		log.Fatalf("error: EmitCounterDataToWriterWithTimeout(nil) succeeded")
+	}
+}
+
+func gzipFile() {
+	log.SetPrefix("gzipFile: ")
+	dir, err := os.MkdirTemp(*outdirflag, "gz")
+	if err != nil {
+		log.Fatalf("error: %v", err)
+	}
+	g, err := coverage.NewCounterDataGZIPFile(filepath.Join(dir, "counters"))
+	if err != nil {
+		log.Fatalf("error: NewCounterDataGZIPFile: %v", err)
+	}
+	if want := filepath.Join(dir, "counters.gz"); g.Name() != want {
+		log.Fatalf("error: Name() = %q, want %q", g.Name(), want)
+	}
+	if err := coverage.EmitCounterDataToWriter(g.Writer()); err != nil {
+		log.Fatalf("error: EmitCounterDataToWriter: %v", err)
+	}
+	if err := g.Commit(); err != nil {
+		log.Fatalf("error: Commit: %v", err)
+	}
+	if err := g.Commit(); err == nil {
+		log.Fatalf("error: second Commit succeeded")
+	}
+	f, err := os.Open(g.Name())
+	if err != nil {
+		log.Fatalf("error: %v", err)
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		log.Fatalf("error: gzip.NewReader: %v", err)
+	}
+	b, err := io.ReadAll(zr)
+	if err != nil {
+		log.Fatalf("error: decompressing: %v", err)
+	}
+	if !bytes.HasPrefix(b, icov.CovCounterMagic[:]) {
+		log.Fatalf("error: decompressed data is not counter data")
+	}
+
+	g, err = coverage.NewCounterDataGZIPFile(filepath.Join(dir, "aborted.gz"))
+	if err != nil {
+		log.Fatalf("error: NewCounterDataGZIPFile: %v", err)
+	}
+	if _, err := g.Writer().Write([]byte("partial")); err != nil {
+		log.Fatalf("error: %v", err)
+	}
+	if err := g.Abort(); err != nil {
+		log.Fatalf("error: Abort: %v", err)
+	}
+	ents, err := os.ReadDir(dir)
+	if err != nil {
+		log.Fatalf("error: %v", err)
+	}
+	if len(ents) != 1 || ents[0].Name() != "counters.gz" {
+		var names []string
+		for _, e := range ents {
+			names = append(names, e.Name())
+		}
+		log.Fatalf("error: unexpected files after Commit/Abort: %v", names)
+	}
+}
+
+// mainCounters writes 'snap' as a counter data file to a new
+// directory below the output dir, then reads it back, returning the
+// counter values for the functions in package main (package index
+// 'mainIdx'), keyed by function index.
+func mainCounters(snap *coverage.CounterSnapshot, tag string, mainIdx uint32) map[uint32][]uint32 {
+	dir := filepath.Join(*outdirflag, tag)
+	if err := os.Mkdir(dir, 0777); err != nil {
+		log.Fatalf("error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	if err := coverage.EmitCounterDataSnapshotToDir(snap, dir); err != nil {
+		log.Fatalf("error: EmitCounterDataSnapshotToDir returns %v", err)
+	}
+	ents, err := os.ReadDir(dir)
+	if err != nil || len(ents) != 1 {
+		log.Fatalf("error: reading %s: %v %v", dir, ents, err)
+	}
+	path := filepath.Join(dir, ents[0].Name())
+	f, err := os.Open(path)
+	if err != nil {
+		log.Fatalf("error: %v", err)
+	}
+	defer f.Close()
+	return readMainCounters(path, f, mainIdx)
+}
+
+// readMainCounters reads counter data from 'r', returning the counter
+// values for the functions in package main (package index 'mainIdx'),
+// keyed by function index.
+func readMainCounters(path string, r io.ReadSeeker, mainIdx uint32) map[uint32][]uint32 {
+	cdr, err := decodecounter.NewCounterDataReader(path, r)
+	if err != nil {
+		log.Fatalf("error: reading %s: %v", path, err)
+	}
+	m := make(map[uint32][]uint32)
+	var fp decodecounter.FuncPayload
+	for {
+		ok, err := cdr.NextFunc(&fp)
+		if err != nil {
+			log.Fatalf("error: reading %s: %v", path, err)
+		}
+		if !ok {
+			break
+		}
+		if fp.PkgIdx == mainIdx {
+			m[fp.FuncIdx] = append([]uint32(nil), fp.Counters...)
+		}
+	}
+	return m
+}
+
+func snapshotPool() {
+	log.SetPrefix("snapshotPool: ")
+	c, err := coverage.NewCoverage()
+	if err != nil {
+		log.Fatalf("error: NewCoverage returns %v", err)
+	}
+	mainIdx := -1
+	for i, p := range c.Meta.Packages {
+		if p.ImportPath == "main" {
+			mainIdx = i
+		}
+	}
+	if mainIdx < 0 {
+		log.Fatalf("error: package main not found in meta-data")
+	}
+	var pool coverage.SnapshotPool
+	for i := 0; i < 3; i++ {
+		// No code in package main runs between the two reads, so
+		// the snapshots must agree on its counters.
+		got := pool.Get()
+		want, err := coverage.ReadCounterSnapshot()
+		if err != nil {
+			log.Fatalf("error: ReadCounterSnapshot returns %v", err)
+		}
+		if got == nil {
+			log.Fatalf("error: SnapshotPool.Get returns nil")
+		}
+		gm := mainCounters(got, "pooled", uint32(mainIdx))
+		wm := mainCounters(want, "fresh", uint32(mainIdx))
+		if len(wm) == 0 || !reflect.DeepEqual(gm, wm) {
+			log.Fatalf("error: pooled snapshot %d differs from fresh snapshot:\n%v\n%v", i, gm, wm)
+		}
+		pool.Put(got)
+	}
+
+	// Exercise concurrent recycling.
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				snap := pool.Get()
+				if snap == nil {
+					log.Fatalf("error: SnapshotPool.Get returns nil")
+				}
+				pool.Put(snap)
+			}
+		}()
+	}
+	wg.Wait()
+	pool.Put(nil)
+}
+
+func decayTarget(n int) int {
+	s := 0
+	for i := 0; i < n; i++ {
+		s += i
+	}
+	return s
+}
+
+func decayTracker() {
+	log.SetPrefix("decayTracker: ")
+	for _, bad := range []float64{0, -1, 1.5} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					log.Fatalf("error: CoverageDecayTracker(%v) did not panic", bad)
+				}
+			}()
+			coverage.CoverageDecayTracker(bad)
+		}()
+	}
+	dt := coverage.CoverageDecayTracker(0.5)
+	decayTarget(10)
+	if err := dt.Tick(); err != nil {
+		log.Fatalf("error: Tick returns %v", err)
+	}
+	if p := dt.WeightedCoveragePercent(); p <= 0 || p > 100 {
+		log.Fatalf("error: WeightedCoveragePercent() = %v after tick", p)
+	}
+	dt.SetThreshold(1e12)
+	if p := dt.WeightedCoveragePercent(); p != 0 {
+		log.Fatalf("error: WeightedCoveragePercent() = %v with huge threshold", p)
+	}
+}
+
+// emitDeterministic writes deterministic counter data to the file
+// "deterministic.dat" in the current directory, so that the output of
+// runs with identical arguments can be compared.
+func emitDeterministic() {
+	log.SetPrefix("emitDeterministic: ")
+	var b bytes.Buffer
+	if err := coverage.EmitDeterministicCounterData(&b); err != nil {
+		log.Fatalf("error: EmitDeterministicCounterData returns %v", err)
+	}
+	if err := os.WriteFile("deterministic.dat", b.Bytes(), 0666); err != nil {
+		log.Fatalf("error: %v", err)
+	}
+	if err := coverage.EmitDeterministicCounterData(nil); err == nil {
+		log.Fatalf("error: EmitDeterministicCounterData(nil) succeeded")
+	}
+}
+
+func counterDataStats() {
+	log.SetPrefix("counterDataStats: ")
+	st, err := coverage.GetCounterDataStats()
+	if err != nil {
+		log.Fatalf("error: GetCounterDataStats returns %v", err)
+	}
+	if st.NonZeroSlots == 0 || st.NonZeroSlots > st.TotalSlots {
+		log.Fatalf("error: bad slot counts %+v", st)
+	}
+	if st.EstimatedEmitBytes <= 0 || st.EstimatedEmitTimeNs < 0 {
+		log.Fatalf("error: bad estimates %+v", st)
+	}
+	raw, err := coverage.GetCoverageMetaRaw()
+	if err != nil {
+		log.Fatalf("error: GetCoverageMetaRaw returns %v", err)
+	}
+	if st.MetaBytes <= 0 || st.MetaBytes > len(raw) {
+		log.Fatalf("error: MetaBytes is %d, meta-data file is %d bytes", st.MetaBytes, len(raw))
+	}
+	var b bytes.Buffer
+	if err := coverage.EmitCounterDataToWriter(&b); err != nil {
+		log.Fatalf("error: EmitCounterDataToWriter returns %v", err)
+	}
+	// The estimate is made from an earlier snapshot, so allow for
+	// counters that have become live since.
+	if n := int64(b.Len()); st.EstimatedEmitBytes > n || st.EstimatedEmitBytes < n/2 {
+		log.Fatalf("error: estimated %d bytes, wrote %d", st.EstimatedEmitBytes, n)
+	}
+}
+
+func coverageBarrier() {
+	log.SetPrefix("coverageBarrier: ")
+	b := coverage.NewCoverageBarrier(0)
+	if err := b.WaitUntilCovered(context.Background()); err != nil {
+		log.Fatalf("error: WaitUntilCovered returns %v", err)
+	}
+	if p := b.CurrentCoverage(); p <= 0 || p > 100 {
+		log.Fatalf("error: CurrentCoverage() = %v", p)
+	}
+	b = coverage.NewCoverageBarrier(101)
+	b.SetPollInterval(5 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := b.WaitUntilCovered(ctx); err != context.DeadlineExceeded {
+		log.Fatalf("error: WaitUntilCovered returns %v, want context.DeadlineExceeded", err)
+	}
+	if p := b.CurrentCoverage(); p <= 0 || p > 100 {
+		log.Fatalf("error: CurrentCoverage() = %v after timeout", p)
+	}
+}
+
+func lineTarget() int {
+	_, _, line, _ := runtime.Caller(0)
+	return line
+}
+
+func lineProfiler() {
+	log.SetPrefix("lineProfiler: ")
+	lp := coverage.NewLineProfiler()
+	line := lineTarget()
+	snap, err := coverage.ReadCounterSnapshot()
+	if err != nil {
+		log.Fatalf("error: ReadCounterSnapshot returns %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := lp.Add(snap); err != nil {
+			log.Fatalf("error: Add returns %v", err)
+		}
+	}
+	var b bytes.Buffer
+	if err := lp.EmitTextProfile(&b); err != nil {
+		log.Fatalf("error: EmitTextProfile returns %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	if !strings.HasPrefix(lines[0], "mode: ") {
+		log.Fatalf("error: profile does not start with mode line: %q", lines[0])
+	}
+	found := false
+	for _, l := range lines[1:] {
+		var file string
+		var st, en, nstmt int
+		var count uint64
+		if i := strings.LastIndex(l, ":"); i >= 0 {
+			file = l[:i]
+			if _, err := fmt.Sscanf(l[i+1:], "%d.1,%d.1 %d %d", &st, &en, &nstmt, &count); err != nil {
+				log.Fatalf("error: bad profile line %q: %v", l, err)
+			}
+		}
+		if strings.HasSuffix(file, "harness.go") && st == line {
+			// Added twice, so the count must be even and non-zero.
+			found = count != 0 && count%2 == 0
+		}
+	}
+	if !found {
+		log.Fatalf("error: line %d not reported with expected count in profile:\n%s", line, b.String())
+	}
+	lp.Reset()
+	b.Reset()
+	if err := lp.EmitTextProfile(&b); err != nil {
+		log.Fatalf("error: EmitTextProfile returns %v", err)
+	}
+	if strings.Count(b.String(), "\n") != 1 {
+		log.Fatalf("error: profile not empty after Reset:\n%s", b.String())
+	}
+}
+
+func unchangedTarget() int {
+	return 1
+}
+
+func newlyCoveredTarget() int {
+	return 2
+}
+
+var exactSink int
+
+func exactTarget() {
+	exactSink++
+}
+
+func coverageAssertions() {
+	log.SetPrefix("coverageAssertions: ")
+	ft := &fakeT{dir: *outdirflag}
+	unchangedTarget()
+	callUnchanged := func() { unchangedTarget() }
+	callUnchanged()
+	coverage.AssertCoverageUnchanged(ft, callUnchanged)
+	if len(ft.errors) != 0 {
+		log.Fatalf("error: unexpected failures %v", ft.errors)
+	}
+	coverage.AssertCoverageUnchanged(ft, func() { newlyCoveredTarget() })
+	if len(ft.errors) != 1 || !strings.Contains(ft.errors[0], "main.newlyCoveredTarget") {
+		log.Fatalf("error: expected failure mentioning newlyCoveredTarget, got %v", ft.errors)
+	}
+	// With -coverpkg=all, library code run in the background (for
+	// example sync.Pool cleanup during a garbage collection) can show
+	// up in the results, so retry a few times before failing, and
+	// only check the main package's functions in the expected
+	// failures.
+	for try := 0; ; try++ {
+		ft.errors = nil
+		coverage.AssertExactlyCovered(ft, exactTarget, []string{"main.exactTarget"})
+		if len(ft.errors) == 0 {
+			break
+		}
+		if try == 4 {
+			log.Fatalf("error: unexpected failures %v", ft.errors)
+		}
+	}
+	coverage.AssertExactlyCovered(ft, func() {}, []string{"main.exactTarget"})
+	if len(ft.errors) != 2 || !strings.Contains(ft.errors[0], "functions not executed: main.exactTarget") ||
+		!strings.Contains(ft.errors[1], "main.coverageAssertions") {
+		log.Fatalf("error: expected missing and unexpected function failures, got %v", ft.errors)
+	}
+	if len(ft.fatals) != 0 {
+		log.Fatalf("error: unexpected fatal failures %v", ft.fatals)
+	}
+}
+
+func svgTarget(n int) int {
+	s := 0
+	for i := 0; i < n; i++ {
+		s += i
+	}
+	return s
+}
+
+func counterProfileToSVG() {
+	log.SetPrefix("counterProfileToSVG: ")
+	svgTarget(100)
+	snap, err := coverage.ReadCounterSnapshot()
+	if err != nil {
+		log.Fatalf("error: ReadCounterSnapshot returns %v", err)
+	}
+	var b bytes.Buffer
+	if err := coverage.CounterProfileToSVG(snap, "main", &b); err != nil {
+		log.Fatalf("error: CounterProfileToSVG returns %v", err)
+	}
+	var doc struct {
+		XMLName xml.Name
+		Groups  []struct {
+			Title string `xml:"title"`
+			Rect  struct {
+				Width float64 `xml:"width,attr"`
+			} `xml:"rect"`
+		} `xml:"g"`
+	}
+	if err := xml.Unmarshal(b.Bytes(), &doc); err != nil {
+		log.Fatalf("error: output is not valid XML: %v", err)
+	}
+	if doc.XMLName.Local != "svg" || len(doc.Groups) == 0 {
+		log.Fatalf("error: unexpected SVG output:\n%s", b.String())
+	}
+	found := false
+	for i, g := range doc.Groups {
+		if i > 0 && g.Rect.Width > doc.Groups[i-1].Rect.Width {
+			log.Fatalf("error: bars not in descending order of hits")
+		}
+		if strings.HasPrefix(g.Title, "svgTarget\n") && g.Rect.Width > 0 {
+			found = true
+		}
+	}
+	if !found {
+		log.Fatalf("error: no bar for svgTarget:\n%s", b.String())
+	}
+	if err := coverage.CounterProfileToSVG(snap, "no/such/package", io.Discard); err == nil {
+		log.Fatalf("error: CounterProfileToSVG succeeded for uninstrumented package")
+	}
+}
+
+func eventTarget() int {
+	return 4
+}
+
+func eventBus() {
+	log.SetPrefix("eventBus: ")
+	bus := coverage.NewCoverageEventBus()
+	ch := make(chan coverage.CoverageEvent, 100)
+	unsub := bus.Subscribe(ch)
+	unsubFull := bus.Subscribe(make(chan coverage.CoverageEvent))
+	bus.Publish(coverage.CoverageEvent{Kind: 42})
+	if ev := <-ch; ev.Kind != 42 {
+		log.Fatalf("error: received %+v", ev)
+	}
+	if n := bus.DroppedEvents(); n != 1 {
+		log.Fatalf("error: DroppedEvents() = %d, want 1", n)
+	}
+	unsubFull()
+
+	stop := bus.StartPolling(5 * time.Millisecond)
+	eventTarget()
+	select {
+	case ev := <-ch:
+		if ev.Kind != coverage.CoverageChangedEvent || ev.Stats == nil || ev.Stats.CoveredBlocks == 0 {
+			log.Fatalf("error: unexpected event %+v", ev)
+		}
+	case <-time.After(time.Minute):
+		log.Fatalf("error: no event after coverage change")
+	}
+	stop()
+	stop()
+
+	unsub()
+	for len(ch) > 0 {
+		<-ch
+	}
+	bus.Publish(coverage.CoverageEvent{Kind: 42})
+	if len(ch) != 0 {
+		log.Fatalf("error: event delivered after unsubscribe")
+	}
+	if n := bus.DroppedEvents(); n != 1 {
+		log.Fatalf("error: DroppedEvents() = %d after unsubscribe, want 1", n)
+	}
+}
+
+func deltaTarget(n int) int {
+	if n%2 == 0 {
+		return n / 2
+	}
+	return 3*n + 1
+}
+
+func deltaStream() {
+	log.SetPrefix("deltaStream: ")
+	c, err := coverage.NewCoverage()
+	if err != nil {
+		log.Fatalf("error: NewCoverage returns %v", err)
+	}
+	mainIdx := -1
+	for i, p := range c.Meta.Packages {
+		if p.ImportPath == "main" {
+			mainIdx = i
+		}
+	}
+	if mainIdx < 0 {
+		log.Fatalf("error: package main not found in meta-data")
+	}
+	base, err := coverage.ReadCounterSnapshot()
+	if err != nil {
+		log.Fatalf("error: ReadCounterSnapshot returns %v", err)
+	}
+	if err := coverage.EmitCounterDataToWriterDeltaFrom(nil, base); err == nil {
+		log.Fatalf("error: EmitCounterDataToWriterDeltaFrom with nil writer succeeded")
+	}
+	for i := 0; i < 4; i++ {
+		if i != 2 {
+			deltaTarget(i)
+		}
+		// No code in package main runs between the delta and the
+		// fresh read, so they must agree on its counters.
+		var delta bytes.Buffer
+		derr := coverage.EmitCounterDataToWriterDeltaFrom(&delta, base)
+		want, err := coverage.ReadCounterSnapshot()
+		if derr != nil {
+			log.Fatalf("error: EmitCounterDataToWriterDeltaFrom returns %v", derr)
+		}
+		if err != nil {
+			log.Fatalf("error: ReadCounterSnapshot returns %v", err)
+		}
+		var full bytes.Buffer
+		if err := coverage.EmitCounterDataToWriter(&full); err != nil {
+			log.Fatalf("error: EmitCounterDataToWriter returns %v", err)
+		}
+		if delta.Len() >= full.Len() {
+			log.Fatalf("error: delta %d is %d bytes, full data %d bytes", i, delta.Len(), full.Len())
+		}
+		got, err := coverage.ReconstructFromDelta(base, &delta)
+		if err != nil {
+			log.Fatalf("error: ReconstructFromDelta returns %v", err)
+		}
+		gm := mainCounters(got, fmt.Sprintf("delta%d", i), uint32(mainIdx))
+		wm := mainCounters(want, fmt.Sprintf("fresh%d", i), uint32(mainIdx))
+		if len(wm) == 0 || !reflect.DeepEqual(gm, wm) {
+			log.Fatalf("error: reconstructed snapshot %d differs from fresh snapshot:\n%v\n%v", i, gm, wm)
+		}
+		base = got
+	}
+	if _, err := coverage.ReconstructFromDelta(base, strings.NewReader("junk")); err == nil {
+		log.Fatalf("error: ReconstructFromDelta of junk succeeded")
+	}
+}
+
+func pinTarget() int {
+	return 5
+}
+
+func pinnedResult() {
+	log.SetPrefix("pinnedResult: ")
+	snap, err := coverage.ReadCounterSnapshot()
+	if err != nil {
+		log.Fatalf("error: ReadCounterSnapshot returns %v", err)
+	}
+	pr := coverage.Pin(snap)
+	runtime.GC()
+	pinTarget()
+	b1, err := pr.JSON()
+	if err != nil {
+		log.Fatalf("error: JSON returns %v", err)
+	}
+	b2, err := pr.JSON()
+	if err != nil {
+		log.Fatalf("error: JSON returns %v", err)
+	}
+	if !bytes.Equal(b1, b2) {
+		log.Fatalf("error: successive JSON results differ")
+	}
+	var jc jsonCoverage
+	if err := json.Unmarshal(b1, &jc); err != nil {
+		log.Fatalf("error: decoding JSON output: %v", err)
+	}
+	found := false
+	for _, ctr := range jc.Counters {
+		if ctr.Package != "main" || ctr.Function != "pinTarget" {
+			continue
+		}
+		found = true
+		for _, h := range ctr.Hits {
+			if h != 0 {
+				log.Fatalf("error: pinned result sees later execution of pinTarget: %v", ctr.Hits)
+			}
+		}
+	}
+	if !found {
+		log.Fatalf("error: pinTarget not in pinned result")
+	}
+	pr.Unpin()
+	if _, err := pr.JSON(); err == nil {
+		log.Fatalf("error: JSON after Unpin succeeded")
+	}
+}
+
+func postCombined() int {
+	return 6
+}
+
+func combinedData() {
+	log.SetPrefix("combinedData: ")
+	if err := coverage.EmitCombinedDataToWriter(nil); err == nil {
+		log.Fatalf("error: EmitCombinedDataToWriter with nil writer succeeded")
+	}
+	var b bytes.Buffer
+	if err := coverage.EmitCombinedDataToWriter(&b); err != nil {
+		log.Fatalf("error: EmitCombinedDataToWriter returns %v", err)
+	}
+	postCombined()
+	split := filepath.Join(*outdirflag, "split")
+	direct := filepath.Join(*outdirflag, "direct")
+	for _, d := range []string{split, direct} {
+		if err := os.Mkdir(d, 0777); err != nil {
+			log.Fatalf("error: %v", err)
+		}
+	}
+	if err := coverage.SplitCombinedDataToDir(bytes.NewReader(b.Bytes()), split); err != nil {
+		log.Fatalf("error: SplitCombinedDataToDir returns %v", err)
+	}
+	if err := coverage.EmitCombinedDataToDir(direct); err != nil {
+		log.Fatalf("error: EmitCombinedDataToDir returns %v", err)
+	}
+	if err := coverage.SplitCombinedDataToDir(bytes.NewReader(b.Bytes()[:b.Len()-1]), split); err == nil {
+		log.Fatalf("error: SplitCombinedDataToDir of truncated stream succeeded")
+	}
+	if err := coverage.SplitCombinedDataToDir(strings.NewReader("junk"), split); err == nil {
+		log.Fatalf("error: SplitCombinedDataToDir of junk succeeded")
+	}
+}
+
+func unsafeClearTarget() int {
+	return 7
+}
+
+func clearUnsafe() {
+	log.SetPrefix("clearUnsafe: ")
+	c, err := coverage.NewCoverage()
+	if err != nil {
+		log.Fatalf("error: NewCoverage returns %v", err)
+	}
+	mainIdx := -1
+	for i, p := range c.Meta.Packages {
+		if p.ImportPath == "main" {
+			mainIdx = i
+		}
+	}
+	if mainIdx < 0 {
+		log.Fatalf("error: package main not found in meta-data")
+	}
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(1))
+	unsafeClearTarget()
+
+	// No code in package main runs between the clear and the
+	// read, so all of its counters must be zero.
+	cerr := coverage.ClearCoverageCountersUnsafe()
+	snap, err := coverage.ReadCounterSnapshot()
+	if cerr != nil {
+		log.Fatalf("error: ClearCoverageCountersUnsafe returns %v", cerr)
+	}
+	if err != nil {
+		log.Fatalf("error: ReadCounterSnapshot returns %v", err)
+	}
+	for fn, ctrs := range mainCounters(snap, "cleared", uint32(mainIdx)) {
+		for _, v := range ctrs {
+			if v != 0 {
+				log.Fatalf("error: counters for function %d not cleared: %v", fn, ctrs)
+			}
+		}
+	}
+
+	// Function prologs must have survived the clear, so that new
+	// counter updates are attributed to the right functions.
+	unsafeClearTarget()
+	snap, err = coverage.ReadCounterSnapshot()
+	if err != nil {
+		log.Fatalf("error: ReadCounterSnapshot returns %v", err)
+	}
+	live := 0
+	for _, ctrs := range mainCounters(snap, "rerun", uint32(mainIdx)) {
+		for _, v := range ctrs {
+			if v != 0 {
+				live++
+				break
+			}
+		}
+	}
+	if live == 0 {
+		log.Fatalf("error: no live functions in package main after clear")
+	}
+}
+
+func coverageEnabled() {
+	log.SetPrefix("coverageEnabled: ")
+	if !coverage.CoverageEnabled() {
+		log.Fatalf("error: CoverageEnabled() = false")
+	}
+}
+
+func coveredFuncTarget() int {
+	return 8
+}
+
+func uncoveredFuncTarget() int {
+	return 9
+}
+
+func coveredFunctions() {
+	log.SetPrefix("coveredFunctions: ")
+	coveredFuncTarget()
+	all, err := coverage.GetAllFunctions()
+	if err != nil {
+		log.Fatalf("error: GetAllFunctions returns %v", err)
+	}
+	covered, err := coverage.GetCoveredFunctions()
+	if err != nil {
+		log.Fatalf("error: GetCoveredFunctions returns %v", err)
+	}
+	if len(covered) == 0 || len(covered) >= len(all) {
+		log.Fatalf("error: %d covered functions, %d functions in all", len(covered), len(all))
+	}
+	find := func(l []coverage.CoveredFunction, name string) *coverage.CoveredFunction {
+		for i := range l {
+			if l[i].PackagePath == "main" && l[i].FunctionName == name {
+				return &l[i]
+			}
+		}
+		return nil
+	}
+	for _, name := range []string{"coveredFuncTarget", "uncoveredFuncTarget"} {
+		f := find(all, name)
+		if f == nil {
+			log.Fatalf("error: %s not in GetAllFunctions result", name)
+		}
+		if f.StartLine == 0 || f.EndLine < f.StartLine {
+			log.Fatalf("error: bad line range for %s: %+v", name, *f)
+		}
+	}
+	if f := find(covered, "coveredFuncTarget"); f == nil || f.HitCount == 0 {
+		log.Fatalf("error: coveredFuncTarget not reported as covered: %v", f)
+	}
+	if f := find(covered, "uncoveredFuncTarget"); f != nil {
+		log.Fatalf("error: uncoveredFuncTarget reported as covered: %+v", *f)
+	}
+	if f := find(all, "uncoveredFuncTarget"); f.HitCount != 0 {
+		log.Fatalf("error: uncoveredFuncTarget has hits: %+v", *f)
+	}
+	for _, f := range covered {
+		if f.HitCount == 0 {
+			log.Fatalf("error: function with no hits in GetCoveredFunctions result: %+v", f)
+		}
+	}
+}
+
+func packageStats() {
+	log.SetPrefix("packageStats: ")
+	c, err := coverage.NewCoverage()
+	if err != nil {
+		log.Fatalf("error: NewCoverage returns %v", err)
+	}
+	prog, err := coverage.ProgramCoverageStats()
+	if err != nil {
+		log.Fatalf("error: ProgramCoverageStats returns %v", err)
+	}
+	if prog.TotalBlocks != c.Stats.TotalBlocks || prog.TotalLines != c.Stats.TotalLines || prog.CoveredBlocks < c.Stats.CoveredBlocks {
+		log.Fatalf("error: ProgramCoverageStats %+v inconsistent with NewCoverage stats %+v", prog, c.Stats)
+	}
+	pst, err := coverage.PackageCoverageStats("main")
+	if err != nil {
+		log.Fatalf("error: PackageCoverageStats returns %v", err)
+	}
+	if pst.CoveredBlocks == 0 || pst.TotalBlocks >= prog.TotalBlocks || pst.CoveredLines > pst.TotalLines {
+		log.Fatalf("error: unexpected stats for package main: %+v (program %+v)", pst, prog)
+	}
+	if pst.BlockCoveragePercent <= 0 || pst.BlockCoveragePercent > 100 {
+		log.Fatalf("error: bad block coverage percentage for package main: %+v", pst)
+	}
+	if _, err := coverage.PackageCoverageStats("no/such/package"); err == nil {
+		log.Fatalf("error: PackageCoverageStats of unknown package succeeded")
+	}
+}
+
+func jsonWrapper() {
+	log.SetPrefix("jsonWrapper: ")
+	var cb, mb bytes.Buffer
+	if err := covjson.EmitCounterDataAsJSON(&cb); err != nil {
+		log.Fatalf("error: EmitCounterDataAsJSON returns %v", err)
+	}
+	if err := covjson.EmitMetaDataAsJSON(&mb); err != nil {
+		log.Fatalf("error: EmitMetaDataAsJSON returns %v", err)
+	}
+	c, err := coverage.NewCoverage()
+	if err != nil {
+		log.Fatalf("error: NewCoverage returns %v", err)
+	}
+	var cd struct {
+		CoverMode   string
+		Granularity string
+		Packages    map[string]map[string][]uint32
+	}
+	if err := json.Unmarshal(cb.Bytes(), &cd); err != nil {
+		log.Fatalf("error: decoding EmitCounterDataAsJSON output: %v", err)
+	}
+	if cd.CoverMode != c.Meta.Mode || cd.Granularity != c.Meta.Granularity || len(cd.Packages) != len(c.Meta.Packages) {
+		log.Fatalf("error: counter data mismatch: %s %s %d packages", cd.CoverMode, cd.Granularity, len(cd.Packages))
+	}
+	if hits := cd.Packages["main"]["jsonWrapper"]; len(hits) == 0 || hits[0] == 0 {
+		log.Fatalf("error: no hits recorded for main.jsonWrapper: %v", hits)
+	}
+	var jc jsonCoverage
+	if err := json.Unmarshal(mb.Bytes(), &jc.Meta); err != nil {
+		log.Fatalf("error: decoding EmitMetaDataAsJSON output: %v", err)
+	}
+	if jc.Meta.Hash != fmt.Sprintf("%x", c.Meta.Hash) || len(jc.Meta.Packages) != len(c.Meta.Packages) {
+		log.Fatalf("error: meta-data mismatch: %s %d packages", jc.Meta.Hash, len(jc.Meta.Packages))
+	}
+	for i, p := range jc.Meta.Packages {
+		pm := c.Meta.Packages[i]
+		if p.ImportPath != pm.ImportPath || len(p.Functions) != len(pm.Functions) {
+			log.Fatalf("error: package %d mismatch: %s vs %s", i, p.ImportPath, pm.ImportPath)
+		}
+		for j, f := range p.Functions {
+			if f.File != pm.Functions[j].SourceFile || len(f.Blocks) != pm.Functions[j].NumBlocks {
+				log.Fatalf("error: function %s mismatch", f.Name)
+			}
+		}
+	}
+}
+
+func lcovData() {
+	log.SetPrefix("lcovData: ")
+	var b bytes.Buffer
+	if err := lcov.EmitLCOVData(&b); err != nil {
+		log.Fatalf("error: EmitLCOVData returns %v", err)
+	}
+	c, err := coverage.NewCoverage()
+	if err != nil {
+		log.Fatalf("error: NewCoverage returns %v", err)
+	}
+	files := make(map[string]bool)
+	for _, p := range c.Meta.Packages {
+		for _, f := range p.Functions {
+			files[f.SourceFile] = true
+		}
+	}
+
+	// Check the record structure, and that the line and function
+	// totals agree with the DA: and FNDA: entries.
+	records := 0
+	var sf string
+	var lf, lh, fnf, fnh int
+	for _, line := range strings.Split(strings.TrimSuffix(b.String(), "\n"), "\n") {
+		tag, val, _ := strings.Cut(line, ":")
+		switch tag {
+		case "TN":
+		case "SF":
+			if !files[val] {
+				log.Fatalf("error: unexpected source file %q", val)
+			}
+			sf = val
+			lf, lh, fnf, fnh = 0, 0, 0, 0
+		case "FN":
+			fnf++
+		case "FNDA":
+			if !strings.HasPrefix(val, "0,") {
+				fnh++
+			}
+		case "DA":
+			lf++
+			if !strings.HasSuffix(val, ",0") {
+				lh++
+			}
+		case "FNF", "FNH", "LF", "LH":
+			want := map[string]int{"FNF": fnf, "FNH": fnh, "LF": lf, "LH": lh}[tag]
+			if val != fmt.Sprint(want) {
+				log.Fatalf("error: %s for %s is %s, want %d", tag, sf, val, want)
+			}
+		case "end_of_record":
+			records++
+		default:
+			log.Fatalf("error: unexpected line %q", line)
+		}
+	}
+	if records != len(files) {
+		log.Fatalf("error: %d records for %d source files", records, len(files))
+	}
+	if !strings.Contains(b.String(), ",lcovData\n") || strings.Contains(b.String(), "FNDA:0,lcovData\n") {
+		log.Fatalf("error: no executed function record for lcovData")
+	}
+}
+
+func mergeTarget() int {
+	return 10
+}
+
+func mergeCounters() {
+	log.SetPrefix("mergeCounters: ")
+	c, err := coverage.NewCoverage()
+	if err != nil {
+		log.Fatalf("error: NewCoverage returns %v", err)
+	}
+	mainIdx, fnIdx := -1, -1
+	for i, p := range c.Meta.Packages {
+		if p.ImportPath != "main" {
+			continue
+		}
+		mainIdx = i
+		for j, f := range p.Functions {
+			if f.Name == "mergeTarget" {
+				fnIdx = j
+			}
+		}
+	}
+	if mainIdx < 0 || fnIdx < 0 {
+		log.Fatalf("error: main.mergeTarget not found in meta-data")
+	}
+	for i := 0; i < 3; i++ {
+		mergeTarget()
+	}
+	var b bytes.Buffer
+	if err := coverage.EmitCounterDataToWriter(&b); err != nil {
+		log.Fatalf("error: EmitCounterDataToWriter returns %v", err)
+	}
+	before, err := coverage.ReadCounterSnapshot()
+	if err != nil {
+		log.Fatalf("error: ReadCounterSnapshot returns %v", err)
+	}
+	if err := coverage.MergeCoverageCounters(bytes.NewReader(b.Bytes())); err != nil {
+		log.Fatalf("error: MergeCoverageCounters returns %v", err)
+	}
+	after, err := coverage.ReadCounterSnapshot()
+	if err != nil {
+		log.Fatalf("error: ReadCounterSnapshot returns %v", err)
+	}
+	bc := mainCounters(before, "before", uint32(mainIdx))[uint32(fnIdx)]
+	ac := mainCounters(after, "after", uint32(mainIdx))[uint32(fnIdx)]
+	if len(bc) == 0 || len(ac) != len(bc) {
+		log.Fatalf("error: counters for mergeTarget: before %v after %v", bc, ac)
+	}
+	for i := range bc {
+		want := 2 * bc[i]
+		if c.Meta.Mode == "set" {
+			want = bc[i]
+		}
+		if ac[i] != want {
+			log.Fatalf("error: merged counters for mergeTarget: before %v after %v (mode %s)", bc, ac, c.Meta.Mode)
+		}
+	}
+	if err := coverage.MergeCoverageCounters(strings.NewReader("junk")); err == nil {
+		log.Fatalf("error: MergeCoverageCounters of junk succeeded")
+	}
+}
+
+func flushHook() {
+	log.SetPrefix("flushHook: ")
+	if err := coverage.RegisterFlushHook(nil); err == nil {
+		log.Fatalf("error: RegisterFlushHook(nil) succeeded")
+	}
+	hooks := []func(){
+		func() { fmt.Fprintln(os.Stderr, "flush hook 1 ran") },
+		func() { panic("flush hook 2 failed") },
+		func() {
+			err := coverage.RegisterFlushHook(func() {})
+			fmt.Fprintf(os.Stderr, "flush hook 3 ran, RegisterFlushHook returns %v\n", err)
+		},
+	}
+	for _, h := range hooks {
+		if err := coverage.RegisterFlushHook(h); err != nil {
+			log.Fatalf("error: RegisterFlushHook returns %v", err)
+		}
+	}
+}
+
+func deltaCountsTarget(n int) int {
+	if n > 1 {
+		return n * 2
+	}
+	return n
+}
+
+func deltaCounts() {
+	log.SetPrefix("deltaCounts: ")
+	c, err := coverage.NewCoverage()
+	if err != nil {
+		log.Fatalf("error: NewCoverage returns %v", err)
+	}
+	mainIdx := -1
+	for i, p := range c.Meta.Packages {
+		if p.ImportPath == "main" {
+			mainIdx = i
+		}
+	}
+	if mainIdx < 0 {
+		log.Fatalf("error: package main not found in meta-data")
+	}
+	deltaCountsTarget(1)
+	var base bytes.Buffer
+	if err := coverage.EmitCounterDataToWriter(&base); err != nil {
+		log.Fatalf("error: EmitCounterDataToWriter returns %v", err)
+	}
+	deltaCountsTarget(2)
+	deltaCountsTarget(3)
+
+	// No code in package main runs between the delta and the
+	// fresh read, so they must agree on its counters.
+	var delta, full bytes.Buffer
+	derr := coverage.EmitDeltaCounterDataToWriter(&delta, bytes.NewReader(base.Bytes()))
+	ferr := coverage.EmitCounterDataToWriter(&full)
+	if derr != nil {
+		log.Fatalf("error: EmitDeltaCounterDataToWriter returns %v", derr)
+	}
+	if ferr != nil {
+		log.Fatalf("error: EmitCounterDataToWriter returns %v", ferr)
+	}
+	if delta.Len() >= full.Len() {
+		log.Fatalf("error: delta is %d bytes, full data %d bytes", delta.Len(), full.Len())
+	}
+	var merged bytes.Buffer
+	if err := coverage.MergeDeltaCounterData(bytes.NewReader(base.Bytes()), bytes.NewReader(delta.Bytes()), &merged); err != nil {
+		log.Fatalf("error: MergeDeltaCounterData returns %v", err)
+	}
+	gm := readMainCounters("merged", bytes.NewReader(merged.Bytes()), uint32(mainIdx))
+	wm := readMainCounters("full", bytes.NewReader(full.Bytes()), uint32(mainIdx))
+	if len(wm) == 0 || !reflect.DeepEqual(gm, wm) {
+		log.Fatalf("error: merged counter data differs from full counter data:\n%v\n%v", gm, wm)
+	}
+}
+
+func queryBlockTarget(x int) int {
+	if x > 0 {
+		return x
+	}
+	return -x
+}
+
+func queryBlockHits() {
+	log.SetPrefix("queryBlockHits: ")
+	queryBlockTarget(1)
+	// Blocks are numbered in meta-data order: the function entry,
+	// the final return, then the body of the "if".
+	for blk, live := range []bool{true, false, true} {
+		hits, err := coverage.QueryBlockHits("main", "queryBlockTarget", blk)
+		if err != nil {
+			log.Fatalf("error: QueryBlockHits(%d) returns %v", blk, err)
+		}
+		if (hits != 0) != live {
+			log.Fatalf("error: block %d has %d hits, want live=%v", blk, hits, live)
+		}
+	}
+	if _, err := coverage.QueryBlockHits("main", "queryBlockTarget", 3); err == nil || !strings.Contains(err.Error(), "out of range") {
+		log.Fatalf("error: QueryBlockHits with bad block index returns %v", err)
+	}
+	if _, err := coverage.QueryBlockHits("main", "queryBlockTarget", -1); err == nil || !strings.Contains(err.Error(), "out of range") {
+		log.Fatalf("error: QueryBlockHits with negative block index returns %v", err)
+	}
+	if _, err := coverage.QueryBlockHits("main", "noSuchFunction", 0); err == nil || !strings.Contains(err.Error(), "not found") {
+		log.Fatalf("error: QueryBlockHits for missing function returns %v", err)
+	}
+	if _, err := coverage.QueryBlockHits("no/such/pkg", "queryBlockTarget", 0); err == nil || !strings.Contains(err.Error(), "not instrumented") {
+		log.Fatalf("error: QueryBlockHits for missing package returns %v", err)
+	}
+}
+
+func counterFileNamer() {
+	log.SetPrefix("counterFileNamer: ")
+	emitTo := func(tag string) string {
+		dir := filepath.Join(*outdirflag, tag)
+		if err := os.Mkdir(dir, 0777); err != nil {
+			log.Fatalf("error: %v", err)
+		}
+		if err := coverage.EmitMetaDataToDir(dir); err != nil {
+			log.Fatalf("error: EmitMetaDataToDir returns %v", err)
+		}
+		if err := coverage.EmitCounterDataToDir(dir); err != nil {
+			log.Fatalf("error: EmitCounterDataToDir returns %v", err)
+		}
+		pl, err := pods.CollectPods([]string{dir}, true)
+		if err != nil {
+			log.Fatalf("error: CollectPods returns %v", err)
+		}
+		if len(pl) != 1 || len(pl[0].CounterDataFiles) != 1 {
+			log.Fatalf("error: bad pods for %s: %+v", dir, pl)
+		}
+		return filepath.Base(pl[0].CounterDataFiles[0])
+	}
+
+	// Random names from UUIDFileNamer, generated on each emit.
+	uuidNamer := coverage.UUIDFileNamer()
+	calls := 0
+	if err := coverage.SetCounterFileNamer(func(metaHash [16]byte, pid int) string {
+		calls++
+		return uuidNamer(metaHash, pid)
+	}); err != nil {
+		log.Fatalf("error: SetCounterFileNamer returns %v", err)
+	}
+	n1, n2 := emitTo("uuid1"), emitTo("uuid2")
+	if calls != 2 {
+		log.Fatalf("error: namer called %d times, want 2", calls)
+	}
+	if n1 == n2 {
+		log.Fatalf("error: UUIDFileNamer returned %s twice", n1)
+	}
+
+	// A name with a directory component is rejected.
+	if err := coverage.SetCounterFileNamer(func(metaHash [16]byte, pid int) string {
+		return filepath.Join("sub", "covcounters")
+	}); err != nil {
+		log.Fatalf("error: SetCounterFileNamer returns %v", err)
+	}
+	want := "invalid counter data file name"
+	if err := coverage.EmitCounterDataToDir(*outdirflag); err == nil || !strings.Contains(err.Error(), want) {
+		log.Fatalf("error: EmitCounterDataToDir with bad namer returns %v, want error containing %q", err, want)
+	}
+
+	// A nil namer restores the default scheme.
+	if err := coverage.SetCounterFileNamer(nil); err != nil {
+		log.Fatalf("error: SetCounterFileNamer(nil) returns %v", err)
+	}
+	n3 := emitTo("default")
+	if !strings.HasPrefix(n3, fmt.Sprintf("%s.", icov.CounterFilePref)) || strings.Count(n3, ".") != 3 {
+		log.Fatalf("error: unexpected default counter file name %s", n3)
+	}
+}
+
+func streamWriter() {
+	log.SetPrefix("streamWriter: ")
+	mainIdx := mainPackageIndex()
+	var out bytes.Buffer
+	cw, err := coverage.NewCounterDataWriter(&out)
+	if err != nil {
+		log.Fatalf("error: NewCounterDataWriter returns %v", err)
+	}
+	cw.FlushInterval = 1
+	if err := cw.WritePackage(int(mainIdx)); err == nil {
+		log.Fatalf("error: WritePackage before WriteHeader succeeded")
+	}
+
+	// Write main's counters and read the full counter data back to
+	// back, with no code in package main running in between.
+	var full bytes.Buffer
+	herr := cw.WriteHeader()
+	werr := cw.WritePackage(int(mainIdx))
+	ferr := coverage.EmitCounterDataToWriter(&full)
+	if herr != nil {
+		log.Fatalf("error: WriteHeader returns %v", herr)
+	}
+	if werr != nil {
+		log.Fatalf("error: WritePackage returns %v", werr)
+	}
+	if ferr != nil {
+		log.Fatalf("error: EmitCounterDataToWriter returns %v", ferr)
+	}
+	if out.Len() == 0 {
+		log.Fatalf("error: nothing written after WritePackage with FlushInterval 1")
+	}
+	if err := cw.WritePackage(int(mainIdx)); err == nil {
+		log.Fatalf("error: second WritePackage for main succeeded")
+	}
+	if err := cw.WritePackage(-1); err == nil {
+		log.Fatalf("error: WritePackage(-1) succeeded")
+	}
+	if err := cw.Close(); err != nil {
+		log.Fatalf("error: Close returns %v", err)
+	}
+	if err := cw.Close(); err == nil {
+		log.Fatalf("error: second Close succeeded")
+	}
+	got := readMainCounters("stream", bytes.NewReader(out.Bytes()), mainIdx)
+	want := readMainCounters("full", bytes.NewReader(full.Bytes()), mainIdx)
+	if len(got) == 0 || !reflect.DeepEqual(got, want) {
+		log.Fatalf("error: streamed main counters %v, want %v", got, want)
+	}
+}
+
+func outputDir() {
+	log.SetPrefix("outputDir: ")
+	if got, want := coverage.GetCoverageOutputDir(), os.Getenv("GOCOVERDIR"); got != want {
+		log.Fatalf("error: GetCoverageOutputDir returns %q, want %q", got, want)
+	}
+	if err := coverage.SetCoverageOutputDir(filepath.Join(*outdirflag, "missing")); err == nil {
+		log.Fatalf("error: SetCoverageOutputDir of missing directory succeeded")
+	}
+	mkdir := func(tag string) string {
+		dir := filepath.Join(*outdirflag, tag)
+		if err := os.Mkdir(dir, 0777); err != nil {
+			log.Fatalf("error: %v", err)
+		}
+		return dir
+	}
+
+	dir := mkdir("outdir")
+	if err := coverage.SetCoverageOutputDir(dir); err != nil {
+		log.Fatalf("error: SetCoverageOutputDir returns %v", err)
+	}
+	if got := coverage.GetCoverageOutputDir(); got != dir {
+		log.Fatalf("error: GetCoverageOutputDir returns %q, want %q", got, dir)
+	}
+	// The output directory is not a default for the emit APIs.
+	if err := coverage.EmitMetaDataToDir(""); err == nil {
+		log.Fatalf("error: EmitMetaDataToDir(\"\") succeeded")
+	}
+	if err := coverage.EmitCounterDataToDir(""); err == nil {
+		log.Fatalf("error: EmitCounterDataToDir(\"\") succeeded")
+	}
+	if err := coverage.EmitMetaDataToDir(coverage.GetCoverageOutputDir()); err != nil {
+		log.Fatalf("error: EmitMetaDataToDir returns %v", err)
+	}
+	if err := coverage.EmitCounterDataToDir(coverage.GetCoverageOutputDir()); err != nil {
+		log.Fatalf("error: EmitCounterDataToDir returns %v", err)
+	}
+	pl, err := pods.CollectPods([]string{dir}, true)
+	if err != nil {
+		log.Fatalf("error: CollectPods returns %v", err)
+	}
+	if len(pl) != 1 || len(pl[0].CounterDataFiles) != 1 {
+		log.Fatalf("error: bad pods for %s: %+v", dir, pl)
+	}
+
+	// An empty directory reverts to GOCOVERDIR.
+	if err := coverage.SetCoverageOutputDir(""); err != nil {
+		log.Fatalf("error: SetCoverageOutputDir(\"\") returns %v", err)
+	}
+	if got, want := coverage.GetCoverageOutputDir(), os.Getenv("GOCOVERDIR"); got != want {
+		log.Fatalf("error: GetCoverageOutputDir returns %q after reset, want %q", got, want)
+	}
+
+	// Leave a directory set, for the exit-time emit.
+	if err := coverage.SetCoverageOutputDir(mkdir("exit")); err != nil {
+		log.Fatalf("error: SetCoverageOutputDir returns %v", err)
+	}
+}
+
+func periodicFlusher() {
+	log.SetPrefix("periodicFlusher: ")
+	dir := filepath.Join(*outdirflag, "flush")
+	if err := os.Mkdir(dir, 0777); err != nil {
+		log.Fatalf("error: %v", err)
+	}
+	if _, err := coverage.NewPeriodicFlusher(dir, 0); err == nil {
+		log.Fatalf("error: NewPeriodicFlusher with zero interval succeeded")
+	}
+	if _, err := coverage.NewPeriodicFlusher(filepath.Join(*outdirflag, "missing"), time.Millisecond); err == nil {
+		log.Fatalf("error: NewPeriodicFlusher with missing directory succeeded")
+	}
+
+	f, err := coverage.NewPeriodicFlusher(dir, 5*time.Millisecond)
+	if err != nil {
+		log.Fatalf("error: NewPeriodicFlusher returns %v", err)
+	}
+	errs := make(chan error, 100)
+	f.ErrorHandler = func(err error) { errs <- err }
+	time.Sleep(50 * time.Millisecond)
+	if err := f.Stop(); err != nil {
+		log.Fatalf("error: Stop returns %v", err)
+	}
+	if err := f.Stop(); err == nil {
+		log.Fatalf("error: second Stop succeeded")
+	}
+	select {
+	case err := <-errs:
+		log.Fatalf("error: flusher reported %v", err)
+	default:
+	}
+	pl, err := pods.CollectPods([]string{dir}, true)
+	if err != nil {
+		log.Fatalf("error: CollectPods returns %v", err)
+	}
+	if len(pl) != 1 || len(pl[0].CounterDataFiles) < 2 {
+		log.Fatalf("error: bad pods for %s: %+v", dir, pl)
+	}
+
+	// Resetting the counters needs atomic mode; otherwise the
+	// error goes to the handler and the flusher keeps running.
+	c, err := coverage.NewCoverage()
+	if err != nil {
+		log.Fatalf("error: NewCoverage returns %v", err)
+	}
+	rdir := filepath.Join(*outdirflag, "reset")
+	if err := os.Mkdir(rdir, 0777); err != nil {
+		log.Fatalf("error: %v", err)
+	}
+	f, err = coverage.NewPeriodicFlusher(rdir, 5*time.Millisecond)
+	if err != nil {
+		log.Fatalf("error: NewPeriodicFlusher returns %v", err)
+	}
+	f.ResetAfterFlush = true
+	f.ErrorHandler = func(err error) { errs <- err }
+	time.Sleep(50 * time.Millisecond)
+	if err := f.Stop(); err != nil {
+		log.Fatalf("error: Stop returns %v", err)
+	}
+	select {
+	case err := <-errs:
+		if c.Meta.Mode == "atomic" {
+			log.Fatalf("error: flusher reported %v", err)
+		}
+	default:
+		if c.Meta.Mode != "atomic" {
+			log.Fatalf("error: no reset error reported in mode %s", c.Meta.Mode)
+		}
+	}
+}
+
+func profileTarget(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+func textProfile() {
+	log.SetPrefix("textProfile: ")
+	for i := 0; i < 3; i++ {
+		profileTarget(i)
+	}
+	var buf bytes.Buffer
+	if err := coverage.WriteCoverageProfile(&buf); err != nil {
+		log.Fatalf("error: WriteCoverageProfile returns %v", err)
+	}
+	c, err := coverage.NewCoverage()
+	if err != nil {
+		log.Fatalf("error: NewCoverage returns %v", err)
+	}
+	all, err := coverage.GetAllFunctions()
+	if err != nil {
+		log.Fatalf("error: GetAllFunctions returns %v", err)
+	}
+	var target coverage.CoveredFunction
+	for _, f := range all {
+		if f.PackagePath == "main" && f.FunctionName == "profileTarget" {
+			target = f
+		}
+	}
+	if target.StartLine == 0 {
+		log.Fatalf("error: profileTarget not found")
+	}
+
+	// Parse the profile, checking that the lines for each file are
+	// together and sorted by position, and collect the counts for
+	// profileTarget's blocks.
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if want := "mode: " + c.Meta.Mode; lines[0] != want {
+		log.Fatalf("error: profile starts with %q, want %q", lines[0], want)
+	}
+	type pos struct {
+		file          string
+		line, col     int
+		count, nstmts int
+	}
+	var prev pos
+	var counts []int
+	seen := make(map[string]bool)
+	for _, l := range lines[1:] {
+		var p pos
+		colon := strings.LastIndex(l, ":")
+		if colon < 0 {
+			log.Fatalf("error: malformed profile line %q", l)
+		}
+		p.file = l[:colon]
+		var enLine, enCol int
+		if _, err := fmt.Sscanf(l[colon+1:], "%d.%d,%d.%d %d %d", &p.line, &p.col, &enLine, &enCol, &p.nstmts, &p.count); err != nil {
+			log.Fatalf("error: malformed profile line %q: %v", l, err)
+		}
+		if p.file != prev.file {
+			if seen[p.file] {
+				log.Fatalf("error: profile lines for %s not together", p.file)
+			}
+			seen[p.file] = true
+		} else if p.line < prev.line || p.line == prev.line && p.col < prev.col {
+			log.Fatalf("error: profile line %q out of order", l)
+		}
+		prev = p
+		if strings.HasSuffix(p.file, "harness.go") && p.line >= target.StartLine && enLine <= target.EndLine {
+			counts = append(counts, p.count)
+		}
+	}
+	hits := 3
+	if c.Meta.Mode == "set" {
+		hits = 1
+	}
+	// The function entry, the body of the "if" (never executed),
+	// and the final return.
+	if want := []int{hits, 0, hits}; !reflect.DeepEqual(counts, want) {
+		log.Fatalf("error: profileTarget block counts %v, want %v", counts, want)
+	}
+}
+
+func snapshotMapTarget(x int) int {
+	if x > 0 {
+		return x
+	}
+	return -x
+}
+
+func counterSnapshotMap() {
+	log.SetPrefix("counterSnapshotMap: ")
+	snapshotMapTarget(1)
+	snapshotMapTarget(2)
+
+	// Call from several goroutines at once.
+	var wg sync.WaitGroup
+	results := make([]map[string][]uint64, 4)
+	errs := make([]error, len(results))
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], errs[i] = coverage.CoverageCounterSnapshot()
+		}(i)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			log.Fatalf("error: CoverageCounterSnapshot call %d returns %v", i, err)
+		}
+	}
+	for _, m := range results {
+		vals, ok := m["main.snapshotMapTarget"]
+		if !ok || len(vals) != 3 {
+			log.Fatalf("error: bad values for main.snapshotMapTarget: %v", vals)
+		}
+		for blk, v := range vals {
+			hits, err := coverage.QueryBlockHits("main", "snapshotMapTarget", blk)
+			if err != nil {
+				log.Fatalf("error: QueryBlockHits returns %v", err)
+			}
+			if v != hits {
+				log.Fatalf("error: block %d has value %d, QueryBlockHits returns %d", blk, v, hits)
+			}
+		}
+		if vals[0] == 0 || vals[2] == 0 || vals[1] != 0 {
+			log.Fatalf("error: unexpected values for main.snapshotMapTarget: %v", vals)
+		}
+		vals, ok = m["main.uncoveredFuncTarget"]
+		if !ok || len(vals) == 0 {
+			log.Fatalf("error: no values for main.uncoveredFuncTarget")
+		}
+		for _, v := range vals {
+			if v != 0 {
+				log.Fatalf("error: main.uncoveredFuncTarget has values %v", vals)
+			}
+		}
+	}
+}
+
+func concurrentMergeTarget() int {
+	return 20
+}
+
+func concurrentMerge() {
+	log.SetPrefix("concurrentMerge: ")
+	c, err := coverage.NewCoverage()
+	if err != nil {
+		log.Fatalf("error: NewCoverage returns %v", err)
+	}
+	mainIdx, fnIdx := -1, -1
+	for i, p := range c.Meta.Packages {
+		if p.ImportPath != "main" {
+			continue
+		}
+		mainIdx = i
+		for j, f := range p.Functions {
+			if f.Name == "concurrentMergeTarget" {
+				fnIdx = j
+			}
+		}
+	}
+	if mainIdx < 0 || fnIdx < 0 {
+		log.Fatalf("error: main.concurrentMergeTarget not found in meta-data")
+	}
+	for i := 0; i < 3; i++ {
+		concurrentMergeTarget()
+	}
+	var b bytes.Buffer
+	if err := coverage.EmitCounterDataToWriter(&b); err != nil {
+		log.Fatalf("error: EmitCounterDataToWriter returns %v", err)
+	}
+	before, err := coverage.ReadCounterSnapshot()
+	if err != nil {
+		log.Fatalf("error: ReadCounterSnapshot returns %v", err)
+	}
+
+	// Three copies of the data plus one bad source: the bad source
+	// should be reported, and the others merged regardless.
+	srcs := []io.Reader{
+		bytes.NewReader(b.Bytes()),
+		strings.NewReader("junk"),
+		bytes.NewReader(b.Bytes()),
+		bytes.NewReader(b.Bytes()),
+	}
+	err = coverage.ConcurrentMergeCoverageCounters(srcs)
+	if err == nil || !strings.Contains(err.Error(), "source 1:") {
+		log.Fatalf("error: ConcurrentMergeCoverageCounters returns %v, want error for source 1", err)
+	}
+	if strings.Contains(err.Error(), "source 0:") || strings.Contains(err.Error(), "source 2:") {
+		log.Fatalf("error: ConcurrentMergeCoverageCounters returns unexpected errors: %v", err)
+	}
+	after, err := coverage.ReadCounterSnapshot()
+	if err != nil {
+		log.Fatalf("error: ReadCounterSnapshot returns %v", err)
+	}
+	bc := mainCounters(before, "before", uint32(mainIdx))[uint32(fnIdx)]
+	ac := mainCounters(after, "after", uint32(mainIdx))[uint32(fnIdx)]
+	if len(bc) == 0 || len(ac) != len(bc) {
+		log.Fatalf("error: counters for concurrentMergeTarget: before %v after %v", bc, ac)
+	}
+	for i := range bc {
+		want := 4 * bc[i]
+		if c.Meta.Mode == "set" {
+			want = bc[i]
+		}
+		if ac[i] != want {
+			log.Fatalf("error: merged counters for concurrentMergeTarget: before %v after %v (mode %s)", bc, ac, c.Meta.Mode)
+		}
+	}
+	if err := coverage.ConcurrentMergeCoverageCounters(nil); err != nil {
+		log.Fatalf("error: ConcurrentMergeCoverageCounters(nil) returns %v", err)
+	}
+}
+
+func atomicEmitToDir() {
+	log.SetPrefix("atomicEmitToDir: ")
+	dir := filepath.Join(*outdirflag, "atomic")
+	if err := os.Mkdir(dir, 0777); err != nil {
+		log.Fatalf("error: %v", err)
+	}
+
+	// Read every counter data file that appears in the directory
+	// while the files are being written; each must decode cleanly.
+	stop := make(chan struct{})
+	readerErr := make(chan error, 1)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				readerErr <- nil
+				return
+			default:
+			}
+			ents, err := os.ReadDir(dir)
+			if err != nil {
+				readerErr <- err
+				return
+			}
+			for _, e := range ents {
+				if !strings.HasPrefix(e.Name(), icov.CounterFilePref) {
+					continue
+				}
+				path := filepath.Join(dir, e.Name())
+				data, err := os.ReadFile(path)
+				if err != nil {
+					readerErr <- err
+					return
+				}
+				if err := decodeAllFuncs(path, data); err != nil {
+					readerErr <- fmt.Errorf("partial file observed: %v", err)
+					return
+				}
+			}
+		}
+	}()
+	const nfiles = 20
+	for i := 0; i < nfiles; i++ {
+		if err := coverage.EmitCounterDataToDirAtomic(dir); err != nil {
+			log.Fatalf("error: EmitCounterDataToDirAtomic returns %v", err)
+		}
+	}
+	close(stop)
+	if err := <-readerErr; err != nil {
+		log.Fatalf("error: reader: %v", err)
+	}
+
+	ents, err := os.ReadDir(dir)
+	if err != nil {
+		log.Fatalf("error: %v", err)
+	}
+	n := 0
+	for _, e := range ents {
+		switch {
+		case strings.HasPrefix(e.Name(), "."):
+			log.Fatalf("error: temporary file %s left behind", e.Name())
+		case strings.HasPrefix(e.Name(), icov.CounterFilePref):
+			n++
+		}
+	}
+	if n != nfiles {
+		log.Fatalf("error: got %d counter data files, want %d", n, nfiles)
+	}
+	if err := coverage.EmitCounterDataToDirAtomic(filepath.Join(dir, "nonexistent")); err == nil {
+		log.Fatalf("error: EmitCounterDataToDirAtomic to nonexistent dir succeeded")
+	}
+}
+
+// decodeAllFuncs decodes all of the function records in the counter
+// data file contents 'data'.
+func decodeAllFuncs(path string, data []byte) error {
+	cdr, err := decodecounter.NewCounterDataReader(path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	var fp decodecounter.FuncPayload
+	for {
+		ok, err := cdr.NextFunc(&fp)
+		if err != nil || !ok {
+			return err
+		}
+	}
+}
+
+func granularity() {
+	log.SetPrefix("granularity: ")
+	g, err := coverage.GetCoverageGranularity()
+	if err != nil {
+		log.Fatalf("error: GetCoverageGranularity returns %v", err)
+	}
+	c, err := coverage.NewCoverage()
+	if err != nil {
+		log.Fatalf("error: NewCoverage returns %v", err)
+	}
+	if g != c.Meta.Granularity {
+		log.Fatalf("error: GetCoverageGranularity returns %q, meta-data has %q", g, c.Meta.Granularity)
+	}
+	if g != "perblock" {
+		log.Fatalf("error: GetCoverageGranularity returns %q, want %q", g, "perblock")
+	}
+}
+
+func neverCalled() int {
+	return 30
+}
+
+func calledTwice() int {
+	return 40
+}
+
+func uncoveredFuncs() {
+	log.SetPrefix("uncoveredFuncs: ")
+	c, err := coverage.NewCoverage()
+	if err != nil {
+		log.Fatalf("error: NewCoverage returns %v", err)
+	}
+	calledTwice()
+	calledTwice()
+	find := func(funcs []coverage.UncoveredFunction, name string) *coverage.UncoveredFunction {
+		for i := range funcs {
+			if funcs[i].PackagePath == "main" && funcs[i].FunctionName == name {
+				return &funcs[i]
+			}
+		}
+		return nil
+	}
+
+	unc, err := coverage.GetUncoveredFunctions()
+	if err != nil {
+		log.Fatalf("error: GetUncoveredFunctions returns %v", err)
+	}
+	f := find(unc, "neverCalled")
+	if f == nil {
+		log.Fatalf("error: neverCalled missing from GetUncoveredFunctions result")
+	}
+	if filepath.Base(f.SourceFile) != "harness.go" || f.StartLine == 0 || f.EndLine < f.StartLine {
+		log.Fatalf("error: bad entry for neverCalled: %+v", *f)
+	}
+	if find(unc, "calledTwice") != nil || find(unc, "uncoveredFuncs") != nil {
+		log.Fatalf("error: executed function in GetUncoveredFunctions result")
+	}
+
+	for _, tc := range []struct {
+		minHits uint64
+		want    bool // whether calledTwice should be reported
+	}{
+		{1, false},
+		{2, c.Meta.Mode == "set"},
+		{3, true},
+	} {
+		unc, err := coverage.GetUncoveredFunctionsThreshold(tc.minHits)
+		if err != nil {
+			log.Fatalf("error: GetUncoveredFunctionsThreshold(%d) returns %v", tc.minHits, err)
+		}
+		if got := find(unc, "calledTwice") != nil; got != tc.want {
+			log.Fatalf("error: GetUncoveredFunctionsThreshold(%d) reports calledTwice: %v, want %v (mode %s)", tc.minHits, got, tc.want, c.Meta.Mode)
+		}
+		if find(unc, "neverCalled") == nil {
+			log.Fatalf("error: neverCalled missing from GetUncoveredFunctionsThreshold(%d) result", tc.minHits)
+		}
+	}
+	unc, err = coverage.GetUncoveredFunctionsThreshold(0)
+	if err != nil || unc == nil || len(unc) != 0 {
+		log.Fatalf("error: GetUncoveredFunctionsThreshold(0) returns %v, %v; want empty non-nil slice", unc, err)
+	}
+}
+
+func finalHashCallback() {
+	log.SetPrefix("finalHashCallback: ")
+	if err := coverage.SetFinalHashCallback(nil); err == nil {
+		log.Fatalf("error: SetFinalHashCallback(nil) succeeded")
+	}
+	c, err := coverage.NewCoverage()
+	if err != nil {
+		log.Fatalf("error: NewCoverage returns %v", err)
+	}
+	// The hash has already been computed, so the callback should be
+	// invoked right away.
+	var got [16]byte
+	calls := 0
+	err = coverage.SetFinalHashCallback(func(h [16]byte) {
+		got = h
+		calls++
+	})
+	if err != nil {
+		log.Fatalf("error: SetFinalHashCallback returns %v", err)
+	}
+	if calls != 1 || got != c.Meta.Hash {
+		log.Fatalf("error: callback invoked %d times with %x, want once with %x", calls, got, c.Meta.Hash)
+	}
+	if err := coverage.SetFinalHashCallback(func([16]byte) {}); err == nil {
+		log.Fatalf("error: second SetFinalHashCallback succeeded")
+	}
+	// Writing meta-data again must not invoke the callback again.
+	if err := coverage.EmitMetaDataToDir(*outdirflag); err != nil {
+		log.Fatalf("error: EmitMetaDataToDir returns %v", err)
+	}
+	if calls != 1 {
+		log.Fatalf("error: callback invoked %d times, want 1", calls)
+	}
+}
+
+// recordingProgressWriter records the progress reports it receives,
+// along with the amount of data in 'out' at the time of each report.
+type recordingProgressWriter struct {
+	out     *bytes.Buffer
+	pkgs    []string
+	done    []int
+	total   []int
+	written []int
+}
+
+func (rp *recordingProgressWriter) ReportProgress(pkg string, done, total int) {
+	rp.pkgs = append(rp.pkgs, pkg)
+	rp.done = append(rp.done, done)
+	rp.total = append(rp.total, total)
+	rp.written = append(rp.written, rp.out.Len())
+}
+
+func progressWriter() {
+	log.SetPrefix("progressWriter: ")
+	var b bytes.Buffer
+	rp := &recordingProgressWriter{out: &b}
+	coverage.SetEmitProgressWriter(rp)
+	if err := coverage.EmitCounterDataToWriter(&b); err != nil {
+		log.Fatalf("error: EmitCounterDataToWriter returns %v", err)
+	}
+	if len(rp.done) == 0 {
+		log.Fatalf("error: no progress reported")
+	}
+	sawMain := false
+	for i := range rp.done {
+		if rp.done[i] != i+1 || rp.total[i] != len(rp.done) {
+			log.Fatalf("error: report %d is %d/%d, want %d/%d", i, rp.done[i], rp.total[i], i+1, len(rp.done))
+		}
+		if i > 0 && rp.written[i] <= rp.written[i-1] {
+			log.Fatalf("error: no data flushed before report %d (%d bytes, previously %d)", i, rp.written[i], rp.written[i-1])
+		}
+		if rp.pkgs[i] == "main" {
+			sawMain = true
+		}
+	}
+	if !sawMain {
+		log.Fatalf("error: no progress report for package main: %v", rp.pkgs)
+	}
+	if m := readMainCounters("<buffer>", bytes.NewReader(b.Bytes()), mainPackageIndex()); len(m) == 0 {
+		log.Fatalf("error: no counters for package main in output")
+	}
+
+	var lb bytes.Buffer
+	coverage.SetEmitProgressWriter(coverage.LogProgressWriter(&lb))
+	if err := coverage.EmitCounterDataToWriter(io.Discard); err != nil {
+		log.Fatalf("error: EmitCounterDataToWriter returns %v", err)
+	}
+	lines := strings.Split(strings.TrimSuffix(lb.String(), "\n"), "\n")
+	if !strings.HasPrefix(lines[0], "coverage: wrote pkg 1/") || !strings.Contains(lb.String(), ": main\n") {
+		log.Fatalf("error: unexpected LogProgressWriter output: %q", lb.String())
+	}
+
+	coverage.SetEmitProgressWriter(nil)
+	n := len(rp.done)
+	lb.Reset()
+	if err := coverage.EmitCounterDataToWriter(io.Discard); err != nil {
+		log.Fatalf("error: EmitCounterDataToWriter returns %v", err)
+	}
+	if len(rp.done) != n || lb.Len() != 0 {
+		log.Fatalf("error: progress reported after SetEmitProgressWriter(nil)")
+	}
+}
+
+func validateFiles() {
+	log.SetPrefix("validateFiles: ")
+	dir := filepath.Join(*outdirflag, "validate")
+	if err := os.Mkdir(dir, 0777); err != nil {
+		log.Fatalf("error: %v", err)
+	}
+	if err := coverage.EmitMetaDataToDir(dir); err != nil {
+		log.Fatalf("error: EmitMetaDataToDir returns %v", err)
+	}
+	if err := coverage.EmitCounterDataToDir(dir); err != nil {
+		log.Fatalf("error: EmitCounterDataToDir returns %v", err)
+	}
+	ents, err := os.ReadDir(dir)
+	if err != nil {
+		log.Fatalf("error: %v", err)
+	}
+	var good string
+	for _, e := range ents {
+		if strings.HasPrefix(e.Name(), icov.CounterFilePref) {
+			good = filepath.Join(dir, e.Name())
+		}
+	}
+	if good == "" {
+		log.Fatalf("error: no counter data file in %s", dir)
+	}
+	if err := coverage.ValidateCoverageDataFile(good); err != nil {
+		log.Fatalf("error: ValidateCoverageDataFile(%s) returns %v", good, err)
+	}
+	data, err := os.ReadFile(good)
+	if err != nil {
+		log.Fatalf("error: %v", err)
+	}
+
+	// Write damaged copies of the file, using the same meta-data hash
+	// in their names but a different final field.
+	base := strings.TrimSuffix(filepath.Base(good), filepath.Ext(good))
+	bad := map[string][]byte{
+		"1": data[:len(data)/2],
+		"2": data[:len(data)-1],
+		"3": append(append([]byte(nil), data...), 0, 0, 0, 0),
+		"4": append([]byte{'x'}, data[1:]...),
+	}
+	var want []string
+	for suffix, content := range bad {
+		path := filepath.Join(dir, base+"."+suffix)
+		if err := os.WriteFile(path, content, 0666); err != nil {
+			log.Fatalf("error: %v", err)
+		}
+		want = append(want, path)
+		err := coverage.ValidateCoverageDataFile(path)
+		var cerr *coverage.CorruptCoverageFileError
+		if !errors.As(err, &cerr) {
+			log.Fatalf("error: ValidateCoverageDataFile(%s) returns %v, want *CorruptCoverageFileError", path, err)
+		}
+		if cerr.Path != path || cerr.Offset < 0 || cerr.Offset > int64(len(content)) || cerr.Reason == "" {
+			log.Fatalf("error: bad CorruptCoverageFileError for %s: %+v", path, *cerr)
+		}
+	}
+	sort.Strings(want)
+	got, err := coverage.ValidateCoverageDataDir(dir)
+	if err != nil {
+		log.Fatalf("error: ValidateCoverageDataDir returns %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		log.Fatalf("error: ValidateCoverageDataDir returns %v, want %v", got, want)
+	}
+	if err := coverage.ValidateCoverageDataFile(filepath.Join(dir, "nonexistent")); err == nil || errors.As(err, new(*coverage.CorruptCoverageFileError)) {
+		log.Fatalf("error: ValidateCoverageDataFile of missing file returns %v", err)
+	}
+}
+
+func appendTarget() int {
+	return 50
+}
+
+func appendToFile() {
+	log.SetPrefix("appendToFile: ")
+	c, err := coverage.NewCoverage()
+	if err != nil {
+		log.Fatalf("error: NewCoverage returns %v", err)
+	}
+	mainIdx := mainPackageIndex()
+	fnIdx := -1
+	for j, f := range c.Meta.Packages[mainIdx].Functions {
+		if f.Name == "appendTarget" {
+			fnIdx = j
+		}
+	}
+	if fnIdx < 0 {
+		log.Fatalf("error: main.appendTarget not found in meta-data")
+	}
+	path := filepath.Join(*outdirflag, "cumulative.counters")
+	readTarget := func() uint32 {
+		f, err := os.Open(path)
+		if err != nil {
+			log.Fatalf("error: %v", err)
+		}
+		defer f.Close()
+		ctrs := readMainCounters(path, f, mainIdx)[uint32(fnIdx)]
+		if len(ctrs) == 0 {
+			log.Fatalf("error: no counters for appendTarget in %s", path)
+		}
+		return ctrs[0]
+	}
+
+	var prev uint32
+	for i := 0; i < 100; i++ {
+		appendTarget()
+		if err := coverage.AppendCounterDataToFile(path); err != nil {
+			log.Fatalf("error: AppendCounterDataToFile returns %v", err)
+		}
+		got := readTarget()
+		if c.Meta.Mode == "set" {
+			if got != 1 {
+				log.Fatalf("error: iteration %d: appendTarget count %d, want 1", i, got)
+			}
+		} else if got <= prev {
+			log.Fatalf("error: iteration %d: appendTarget count %d, previously %d", i, got, prev)
+		}
+		prev = got
+	}
+	// In count and atomic modes the live count after iteration i is
+	// i+1, and the file holds the sum over all iterations.
+	if c.Meta.Mode != "set" && prev != 100*101/2 {
+		log.Fatalf("error: final appendTarget count %d, want %d", prev, 100*101/2)
+	}
+	if ents, err := filepath.Glob(filepath.Join(*outdirflag, ".cumulative.counters.*")); err != nil || len(ents) != 0 {
+		log.Fatalf("error: temporary files left behind: %v %v", ents, err)
+	}
+
+	// A file written by a different program is rejected.
+	data, err := os.ReadFile(path)
+	if err != nil {
+		log.Fatalf("error: %v", err)
+	}
+	data[8] ^= 0xff // first byte of the meta-data hash
+	other := filepath.Join(*outdirflag, "other.counters")
+	if err := os.WriteFile(other, data, 0666); err != nil {
+		log.Fatalf("error: %v", err)
+	}
+	err = coverage.AppendCounterDataToFile(other)
+	var herr *coverage.HashMismatchError
+	if !errors.As(err, &herr) || herr.Path != other || herr.ProgramHash != c.Meta.Hash || herr.FileHash == c.Meta.Hash {
+		log.Fatalf("error: AppendCounterDataToFile of mismatched file returns %v, want *HashMismatchError", err)
+	}
+}
+
+func packageList() {
+	log.SetPrefix("packageList: ")
+	pkgs, err := coverage.CoveragePackageList()
+	if err != nil {
+		log.Fatalf("error: CoveragePackageList returns %v", err)
+	}
+	if !sort.StringsAreSorted(pkgs) {
+		log.Fatalf("error: CoveragePackageList result not sorted: %v", pkgs)
+	}
+	for i := 1; i < len(pkgs); i++ {
+		if pkgs[i] == pkgs[i-1] {
+			log.Fatalf("error: duplicate %q in CoveragePackageList result", pkgs[i])
+		}
+	}
+	// The harness is built with -coverpkg=all, so library packages
+	// that have not run are listed too.
+	c, err := coverage.NewCoverage()
+	if err != nil {
+		log.Fatalf("error: NewCoverage returns %v", err)
+	}
+	for _, p := range c.Meta.Packages {
+		if i := sort.SearchStrings(pkgs, p.ImportPath); i == len(pkgs) || pkgs[i] != p.ImportPath {
+			log.Fatalf("error: package %q missing from CoveragePackageList result", p.ImportPath)
+		}
+	}
+
+	files, err := coverage.CoverageFileList("main")
+	if err != nil {
+		log.Fatalf("error: CoverageFileList returns %v", err)
+	}
+	if len(files) != 1 || filepath.Base(files[0]) != "harness.go" {
+		log.Fatalf("error: CoverageFileList(\"main\") returns %v, want [.../harness.go]", files)
+	}
+	if _, err := coverage.CoverageFileList("no/such/package"); err == nil {
+		log.Fatalf("error: CoverageFileList of unknown package succeeded")
+	}
+}
+
+// countingWriter counts the bytes written to it.
+type countingWriter struct {
+	n int
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	cw.n += len(p)
+	return len(p), nil
+}
+
+func contextEmitAll() {
+	log.SetPrefix("contextEmitAll: ")
+	ctx := context.Background()
+	var b bytes.Buffer
+	if err := coverage.EmitCounterDataToWriterContext(ctx, &b); err != nil {
+		log.Fatalf("error: EmitCounterDataToWriterContext returns %v", err)
+	}
+	if m := readMainCounters("<buffer>", bytes.NewReader(b.Bytes()), mainPackageIndex()); len(m) == 0 {
+		log.Fatalf("error: no counters for package main in output")
+	}
+
+	// With a canceled context, nothing is written.
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	var cw countingWriter
+	if err := coverage.EmitCounterDataToWriterContext(cctx, &cw); err != context.Canceled {
+		log.Fatalf("error: EmitCounterDataToWriterContext with canceled context returns %v", err)
+	}
+	if cw.n != 0 {
+		log.Fatalf("error: %d bytes written with canceled context", cw.n)
+	}
+
+	dir := filepath.Join(*outdirflag, "ctxdir")
+	if err := os.Mkdir(dir, 0777); err != nil {
+		log.Fatalf("error: %v", err)
+	}
+	if err := coverage.EmitCounterDataToDirContext(cctx, dir); err != context.Canceled {
+		log.Fatalf("error: EmitCounterDataToDirContext with canceled context returns %v", err)
+	}
+	if ents, err := os.ReadDir(dir); err != nil || len(ents) != 0 {
+		log.Fatalf("error: files left in %s after canceled emit: %v %v", dir, ents, err)
+	}
+	if err := coverage.EmitCounterDataToDirContext(ctx, dir); err != nil {
+		log.Fatalf("error: EmitCounterDataToDirContext returns %v", err)
+	}
+	ents, err := os.ReadDir(dir)
+	if err != nil || len(ents) != 1 || !strings.HasPrefix(ents[0].Name(), icov.CounterFilePref+".") {
+		log.Fatalf("error: want one counter data file in %s, got %v %v", dir, ents, err)
+	}
+	if err := coverage.ValidateCoverageDataFile(filepath.Join(dir, ents[0].Name())); err != nil {
+		log.Fatalf("error: ValidateCoverageDataFile returns %v", err)
+	}
+	if err := coverage.EmitCounterDataToDirContext(ctx, filepath.Join(dir, "nonexistent")); err == nil {
+		log.Fatalf("error: EmitCounterDataToDirContext to nonexistent dir succeeded")
+	}
+}
+
+func recTargetA() int {
+	return 60
+}
+
+func recTargetB() int {
+	return 70
+}
+
+func recorder() {
+	log.SetPrefix("recorder: ")
+	c, err := coverage.NewCoverage()
+	if err != nil {
+		log.Fatalf("error: NewCoverage returns %v", err)
+	}
+	all, err := coverage.GetAllFunctions()
+	if err != nil {
+		log.Fatalf("error: GetAllFunctions returns %v", err)
+	}
+	funcs := make(map[string]coverage.CoveredFunction)
+	for _, f := range all {
+		if f.PackagePath == "main" {
+			funcs[f.FunctionName] = f
+		}
+	}
+	// profileCount returns the count recorded in the text profile
+	// 'prof' for the (single-block) function 'name'.
+	profileCount := func(prof, name string) int {
+		fn, ok := funcs[name]
+		if !ok {
+			log.Fatalf("error: function %s not found", name)
+		}
+		for _, l := range strings.Split(prof, "\n") {
+			colon := strings.LastIndex(l, ":")
+			if colon < 0 || filepath.Base(l[:colon]) != "harness.go" {
+				continue
+			}
+			var stLine, stCol, enLine, enCol, nstmts, count int
+			if _, err := fmt.Sscanf(l[colon+1:], "%d.%d,%d.%d %d %d", &stLine, &stCol, &enLine, &enCol, &nstmts, &count); err != nil {
+				log.Fatalf("error: malformed profile line %q: %v", l, err)
+			}
+			if stLine >= fn.StartLine && enLine <= fn.EndLine {
+				return count
+			}
+		}
+		log.Fatalf("error: no profile line for %s", name)
+		return 0
+	}
+	profile := func(rs *coverage.RecorderSnapshot) string {
+		var b bytes.Buffer
+		if err := rs.WriteCoverageProfile(&b); err != nil {
+			log.Fatalf("error: WriteCoverageProfile returns %v", err)
+		}
+		if want := "mode: " + c.Meta.Mode + "\n"; !strings.HasPrefix(b.String(), want) {
+			log.Fatalf("error: profile does not start with %q", want)
+		}
+		return b.String()
+	}
+
+	r1, err := coverage.NewRecorder()
+	if err != nil {
+		log.Fatalf("error: NewRecorder returns %v", err)
+	}
+	r2, err := coverage.NewRecorder()
+	if err != nil {
+		log.Fatalf("error: NewRecorder returns %v", err)
+	}
+	if _, err := r2.Stop(); err == nil {
+		log.Fatalf("error: Stop before Start succeeded")
+	}
+	r1.Start()
+	recTargetA()
+	r2.Start()
+	recTargetB()
+	s2, err := r2.Stop()
+	if err != nil {
+		log.Fatalf("error: Stop returns %v", err)
+	}
+	recTargetA()
+	s1, err := r1.Stop()
+	if err != nil {
+		log.Fatalf("error: Stop returns %v", err)
+	}
+	if _, err := r1.Stop(); err == nil {
+		log.Fatalf("error: second Stop succeeded")
+	}
+
+	wantA := 2
+	if c.Meta.Mode == "set" {
+		wantA = 1
+	}
+	p1, p2 := profile(s1), profile(s2)
+	if got := profileCount(p1, "recTargetA"); got != wantA {
+		log.Fatalf("error: recorder 1 count for recTargetA is %d, want %d", got, wantA)
+	}
+	if got := profileCount(p1, "recTargetB"); got != 1 {
+		log.Fatalf("error: recorder 1 count for recTargetB is %d, want 1", got)
+	}
+	if got := profileCount(p2, "recTargetA"); got != 0 {
+		log.Fatalf("error: recorder 2 count for recTargetA is %d, want 0", got)
+	}
+	if got := profileCount(p2, "recTargetB"); got != 1 {
+		log.Fatalf("error: recorder 2 count for recTargetB is %d, want 1", got)
+	}
+}
+
+// queryTarget is laid out so that each of its blocks has a line of
+// its own (see queryLineHits).
+func queryTarget(x int) int {
+	if x > 0 {
+		return x
+	}
+	return -x
+}
+
+func queryLineHits() {
+	log.SetPrefix("queryLineHits: ")
+	c, err := coverage.NewCoverage()
+	if err != nil {
+		log.Fatalf("error: NewCoverage returns %v", err)
+	}
+	all, err := coverage.GetAllFunctions()
+	if err != nil {
+		log.Fatalf("error: GetAllFunctions returns %v", err)
+	}
+	start := 0
+	for _, f := range all {
+		if f.PackagePath == "main" && f.FunctionName == "queryTarget" {
+			start = f.StartLine
+		}
+	}
+	if start == 0 {
+		log.Fatalf("error: queryTarget not found")
+	}
+	files, err := coverage.CoverageFileList("main")
+	if err != nil || len(files) != 1 {
+		log.Fatalf("error: CoverageFileList returns %v, %v", files, err)
+	}
+	for i := 0; i < 3; i++ {
+		queryTarget(1)
+	}
+	queryTarget(-1)
+
+	want3, want1 := uint64(3), uint64(1)
+	if c.Meta.Mode == "set" {
+		want3 = 1
+	}
+	for _, file := range []string{files[0], "harness.go"} {
+		for _, tc := range []struct {
+			line int
+			want uint64
+		}{
+			{start - 1, 0},     // comment
+			{start + 2, want3}, // return x
+			{start + 4, want1}, // return -x
+		} {
+			// Query twice, to exercise the cached lookup.
+			for i := 0; i < 2; i++ {
+				got, err := coverage.QueryLineHits(file, tc.line)
+				if err != nil {
+					log.Fatalf("error: QueryLineHits(%s, %d) returns %v", file, tc.line, err)
+				}
+				if got != tc.want {
+					log.Fatalf("error: QueryLineHits(%s, %d) = %d, want %d (mode %s)", file, tc.line, got, tc.want, c.Meta.Mode)
+				}
+			}
+		}
+	}
+	queryTarget(2)
+	if got, _ := coverage.QueryLineHits("harness.go", start+2); c.Meta.Mode != "set" && got != 4 {
+		log.Fatalf("error: QueryLineHits after another call = %d, want 4", got)
+	}
+	if got, err := coverage.QueryLineHits("nosuchfile.go", start+2); err != nil || got != 0 {
+		log.Fatalf("error: QueryLineHits for unknown file returns %d, %v", got, err)
+	}
+}
+
+// limitedEmit writes counter data to a buffer and returns the file's
+// args, the number of packages, and the estimated size (4 bytes per
+// value) of the function entries.
+func limitedEmit() (map[string]string, int, int) {
+	return limitedEmitWith("EmitCounterDataToWriter", coverage.EmitCounterDataToWriter)
+}
+
+// emitAndWaitWithProgress calls EmitCounterDataToWriterWithProgress
+// and waits for it to finish.
+func emitAndWaitWithProgress(w io.Writer) error {
+	ch, err := coverage.EmitCounterDataToWriterWithProgress(w)
+	if err != nil {
+		return err
+	}
+	for p := range ch {
+		if p.Err != nil {
+			return p.Err
+		}
+	}
+	return nil
+}
+
+// emitWithMinuteTimeout calls EmitCounterDataToWriterWithTimeout with
+// a timeout long enough not to expire.
+func emitWithMinuteTimeout(w io.Writer) error {
+	return coverage.EmitCounterDataToWriterWithTimeout(w, time.Minute)
+}
+
+// emitWithContext calls EmitCounterDataToWriterContext with a
+// background context.
+func emitWithContext(w io.Writer) error {
+	return coverage.EmitCounterDataToWriterContext(context.Background(), w)
+}
+
+func limitedEmitWith(name string, emit func(io.Writer) error) (map[string]string, int, int) {
+	var buf bytes.Buffer
+	if err := emit(&buf); err != nil {
+		log.Fatalf("error: %s returns %v", name, err)
+	}
+	cdr, err := decodecounter.NewCounterDataReader("<buf>", bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		log.Fatalf("error: NewCounterDataReader returns %v", err)
+	}
+	pkgs := make(map[uint32]bool)
+	size := 0
+	var fp decodecounter.FuncPayload
+	for {
+		ok, err := cdr.NextFunc(&fp)
+		if err != nil {
+			log.Fatalf("error: NextFunc returns %v", err)
+		}
+		if !ok {
+			break
+		}
+		pkgs[fp.PkgIdx] = true
+		size += 4 * (3 + len(fp.Counters))
+	}
+	return cdr.Args(), len(pkgs), size
+}
+
+func maxCounterFileSize() {
+	log.SetPrefix("maxCounterFileSize: ")
+	if got := coverage.GetMaxCounterFileSize(); got != -1 {
+		log.Fatalf("error: GetMaxCounterFileSize() = %d initially, want -1", got)
+	}
+	if err := coverage.SetMaxCounterFileSize(1<<10 - 1); err == nil {
+		log.Fatalf("error: SetMaxCounterFileSize accepts a limit below 1KB")
+	}
+	args, npkgs, size := limitedEmit()
+	if _, ok := args["truncated"]; ok {
+		log.Fatalf("error: unlimited counter data marked truncated")
+	}
+	if size <= 1<<10 {
+		log.Fatalf("error: counter data only %d bytes, too small to test with", size)
+	}
+
+	if err := coverage.SetMaxCounterFileSize(1 << 10); err != nil {
+		log.Fatalf("error: SetMaxCounterFileSize returns %v", err)
+	}
+	if got := coverage.GetMaxCounterFileSize(); got != 1<<10 {
+		log.Fatalf("error: GetMaxCounterFileSize() = %d, want %d", got, 1<<10)
+	}
+	for _, e := range []struct {
+		name string
+		emit func(io.Writer) error
+	}{
+		{"EmitCounterDataToWriter", coverage.EmitCounterDataToWriter},
+		{"EmitDeterministicCounterData", coverage.EmitDeterministicCounterData},
+		{"EmitCounterDataToWriterWithProgress", emitAndWaitWithProgress},
+		{"EmitCounterDataToWriterWithTimeout", emitWithMinuteTimeout},
+		{"EmitCounterDataToWriterContext", emitWithContext},
+	} {
+		args, n, size := limitedEmitWith(e.name, e.emit)
+		if size > 1<<10 {
+			log.Fatalf("error: %s: limited counter data estimated at %d bytes", e.name, size)
+		}
+		if args["truncated"] == "" || args["truncated"] == "0" {
+			log.Fatalf("error: %s: limited counter data has truncated=%q", e.name, args["truncated"])
+		}
+		// More packages may have become live since the first emit,
+		// so the total can only grow.
+		if omitted, _ := strconv.Atoi(args["truncated"]); n == 0 || n+omitted < npkgs {
+			log.Fatalf("error: %s: %d packages written, %s omitted, want at least %d in all", e.name, n, args["truncated"], npkgs)
+		}
+	}
+
+	if err := coverage.SetMaxCounterFileSize(1 << 40); err != nil {
+		log.Fatalf("error: SetMaxCounterFileSize returns %v", err)
+	}
+	if args, _, _ := limitedEmit(); args["truncated"] != "" {
+		log.Fatalf("error: counter data within limit marked truncated")
+	}
+	if err := coverage.SetMaxCounterFileSize(-1); err != nil {
+		log.Fatalf("error: SetMaxCounterFileSize(-1) returns %v", err)
+	}
+	if got := coverage.GetMaxCounterFileSize(); got != -1 {
+		log.Fatalf("error: GetMaxCounterFileSize() = %d after reset, want -1", got)
+	}
+}
+
+func dataSetTarget() int {
+	return 42
+}
+
+func counterDataSet() {
+	log.SetPrefix("counterDataSet: ")
+	c, err := coverage.NewCoverage()
+	if err != nil {
+		log.Fatalf("error: NewCoverage returns %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		dataSetTarget()
+	}
+	dir, err := os.MkdirTemp("", "counterdataset")
+	if err != nil {
+		log.Fatalf("error: MkdirTemp returns %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "counters")
+	var buf bytes.Buffer
+	if err := coverage.EmitCounterDataToWriter(&buf); err != nil {
+		log.Fatalf("error: EmitCounterDataToWriter returns %v", err)
+	}
+	if err := os.WriteFile(path, buf.Bytes(), 0666); err != nil {
+		log.Fatalf("error: WriteFile returns %v", err)
+	}
+
+	ds, err := coverage.ParseCounterDataFile(path)
+	if err != nil {
+		log.Fatalf("error: ParseCounterDataFile returns %v", err)
+	}
+	if ds.MetaHash != c.Meta.Hash || ds.Mode != c.Meta.Mode {
+		log.Fatalf("error: parsed hash %x mode %q, want %x %q", ds.MetaHash, ds.Mode, c.Meta.Hash, c.Meta.Mode)
+	}
+	want := uint32(3)
+	if c.Meta.Mode == "set" {
+		want = 1
+	}
+	if got := ds.Counters["main.dataSetTarget"]; len(got) != 1 || got[0] != want {
+		log.Fatalf("error: parsed counters for main.dataSetTarget = %v, want [%d]", got, want)
+	}
+
+	// Merge in a second copy of the same file.
+	ds2, err := coverage.ParseCounterDataFile(path)
+	if err != nil {
+		log.Fatalf("error: ParseCounterDataFile returns %v", err)
+	}
+	if err := ds.Add(ds2); err != nil {
+		log.Fatalf("error: Add returns %v", err)
+	}
+	if c.Meta.Mode != "set" {
+		want *= 2
+	}
+	if got := ds.Counters["main.dataSetTarget"]; got[0] != want {
+		log.Fatalf("error: merged counters for main.dataSetTarget = %v, want [%d]", got, want)
+	}
+
+	// Write the merged set out and read it back.
+	merged := filepath.Join(dir, "merged")
+	if err := ds.WriteCounterDataFile(merged); err != nil {
+		log.Fatalf("error: WriteCounterDataFile returns %v", err)
+	}
+	ds3, err := coverage.ParseCounterDataFile(merged)
+	if err != nil {
+		log.Fatalf("error: ParseCounterDataFile(merged) returns %v", err)
+	}
+	if !reflect.DeepEqual(ds3.Counters, ds.Counters) {
+		log.Fatalf("error: counters read back differ from those written")
+	}
+
+	ds2.MetaHash[0] ^= 0xff
+	if err := ds.Add(ds2); err == nil {
+		log.Fatalf("error: Add of set with different meta-data hash succeeded")
+	}
+	if _, err := coverage.ParseCounterDataFile(filepath.Join(dir, "missing")); err == nil {
+		log.Fatalf("error: ParseCounterDataFile of missing file succeeded")
+	}
+}
+
+func parseMetaDataFile() {
+	log.SetPrefix("parseMetaDataFile: ")
+	c, err := coverage.NewCoverage()
+	if err != nil {
+		log.Fatalf("error: NewCoverage returns %v", err)
+	}
+	dir, err := os.MkdirTemp("", "parsemetadatafile")
+	if err != nil {
+		log.Fatalf("error: MkdirTemp returns %v", err)
+	}
+	defer os.RemoveAll(dir)
+	var buf bytes.Buffer
+	if err := coverage.EmitMetaDataToWriter(&buf); err != nil {
+		log.Fatalf("error: EmitMetaDataToWriter returns %v", err)
+	}
+	path := filepath.Join(dir, "meta")
+	if err := os.WriteFile(path, buf.Bytes(), 0666); err != nil {
+		log.Fatalf("error: WriteFile returns %v", err)
+	}
+
+	mi, err := coverage.ParseMetaDataFile(path)
+	if err != nil {
+		log.Fatalf("error: ParseMetaDataFile returns %v", err)
+	}
+	if !reflect.DeepEqual(mi, c.Meta) {
+		log.Fatalf("error: parsed meta-data differs from that of the running program")
+	}
+	fm, ok := mi.FindFunction("main", "parseMetaDataFile")
+	if !ok || fm.Name != "parseMetaDataFile" || fm.StartLine == 0 || fm.NumBlocks == 0 {
+		log.Fatalf("error: FindFunction(main, parseMetaDataFile) = %+v, %v", fm, ok)
+	}
+	if fm, ok := mi.FindFunction("main", "noSuchFunction"); ok {
+		log.Fatalf("error: FindFunction of missing function returns %+v", fm)
+	}
+
+	// Malformed files.
+	for _, tc := range []struct {
+		name string
+		data []byte
+	}{
+		{"badmagic", append([]byte{'x'}, buf.Bytes()[1:]...)},
+		{"truncated", buf.Bytes()[:buf.Len()/2]},
+		{"short", buf.Bytes()[:8]},
+	} {
+		p := filepath.Join(dir, tc.name)
+		if err := os.WriteFile(p, tc.data, 0666); err != nil {
+			log.Fatalf("error: WriteFile returns %v", err)
+		}
+		_, err := coverage.ParseMetaDataFile(p)
+		var perr *coverage.MetaDataParseError
+		if !errors.As(err, &perr) || perr.Path != p {
+			log.Fatalf("error: ParseMetaDataFile(%s) returns %v, want *MetaDataParseError", tc.name, err)
+		}
+	}
+	_, err = coverage.ParseMetaDataFile(filepath.Join(dir, "missing"))
+	var perr *coverage.MetaDataParseError
+	if err == nil || errors.As(err, &perr) {
+		log.Fatalf("error: ParseMetaDataFile of missing file returns %v", err)
+	}
+}
+
+// recordingHook is a coverage.Hook that keeps the data passed to it.
+type recordingHook struct {
+	meta, counters [][]byte
+}
+
+func (h *recordingHook) read(r io.Reader) ([]byte, error) {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	// Check that the data can be read again, as for a retry.
+	if _, err := r.(io.Seeker).Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	if b2, err := io.ReadAll(r); err != nil || !bytes.Equal(b, b2) {
+		return nil, fmt.Errorf("data differs when read again (err %v)", err)
+	}
+	return b, nil
+}
+
+func (h *recordingHook) EmitMeta(r io.Reader) error {
+	b, err := h.read(r)
+	h.meta = append(h.meta, b)
+	return err
+}
+
+func (h *recordingHook) EmitCounters(r io.Reader) error {
+	b, err := h.read(r)
+	h.counters = append(h.counters, b)
+	return err
+}
+
+func emitHooks() {
+	log.SetPrefix("emitHooks: ")
+	type request struct {
+		kind, ctype, token string
+		body               []byte
+	}
+	var mu sync.Mutex
+	var reqs []request
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		reqs = append(reqs, request{r.Header.Get(httphook.KindHeader), r.Header.Get("Content-Type"), r.Header.Get("Token"), b})
+		mu.Unlock()
+	}))
+	defer srv.Close()
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+
+	rh := &recordingHook{}
+	for _, h := range []coverage.Hook{rh, httphook.New(srv.URL, map[string]string{"Token": "t0k"})} {
+		if err := coverage.RegisterEmitHook(h); err != nil {
+			log.Fatalf("error: RegisterEmitHook returns %v", err)
+		}
+	}
+	if err := coverage.RegisterEmitHook(nil); err == nil {
+		log.Fatalf("error: RegisterEmitHook(nil) succeeded")
+	}
+	dir := *outdirflag
+	if err := coverage.EmitMetaDataToDir(dir); err != nil {
+		log.Fatalf("error: EmitMetaDataToDir returns %v", err)
+	}
+	if err := coverage.EmitCounterDataToDir(dir); err != nil {
+		log.Fatalf("error: EmitCounterDataToDir returns %v", err)
+	}
+	// The files are still written to the directory.
+	if pl, err := pods.CollectPods([]string{dir}, true); err != nil || len(pl) != 1 || len(pl[0].CounterDataFiles) != 1 {
+		log.Fatalf("error: bad pods for %s: %+v (err %v)", dir, pl, err)
+	}
+
+	raw, err := coverage.GetCoverageMetaRaw()
+	if err != nil {
+		log.Fatalf("error: GetCoverageMetaRaw returns %v", err)
+	}
+	if len(rh.meta) != 1 || !bytes.Equal(rh.meta[0], raw) {
+		log.Fatalf("error: hook received %d meta-data payloads, want 1 matching GetCoverageMetaRaw", len(rh.meta))
+	}
+	if len(rh.counters) != 1 {
+		log.Fatalf("error: hook received %d counter data payloads, want 1", len(rh.counters))
+	}
+	if err := decodeAllFuncs("<hook>", rh.counters[0]); err != nil {
+		log.Fatalf("error: decoding counter data passed to hook: %v", err)
+	}
+	mu.Lock()
+	if len(reqs) != 2 {
+		log.Fatalf("error: server received %d requests, want 2", len(reqs))
+	}
+	for i, want := range []request{{"meta", "application/octet-stream", "t0k", rh.meta[0]}, {"counters", "application/octet-stream", "t0k", rh.counters[0]}} {
+		got := reqs[i]
+		if got.kind != want.kind || got.ctype != want.ctype || got.token != want.token || !bytes.Equal(got.body, want.body) {
+			log.Fatalf("error: request %d: got kind %q type %q token %q (%d bytes), want %q %q %q (%d bytes)", i, got.kind, got.ctype, got.token, len(got.body), want.kind, want.ctype, want.token, len(want.body))
+		}
+	}
+	mu.Unlock()
+
+	// A failing hook is reported, but earlier hooks still run.
+	if err := coverage.RegisterEmitHook(httphook.New(failing.URL, nil)); err != nil {
+		log.Fatalf("error: RegisterEmitHook returns %v", err)
+	}
+	if err := coverage.EmitCounterDataToDir(dir); err == nil || !strings.Contains(err.Error(), "503") {
+		log.Fatalf("error: EmitCounterDataToDir with failing hook returns %v", err)
+	}
+	if len(rh.counters) != 2 {
+		log.Fatalf("error: hook received %d counter data payloads, want 2", len(rh.counters))
+	}
+}
+
+func compressedTarget() int {
+	return 7
+}
+
+func compressedEmit() {
+	log.SetPrefix("compressedEmit: ")
+	c, err := coverage.NewCoverage()
+	if err != nil {
+		log.Fatalf("error: NewCoverage returns %v", err)
+	}
+	for i := 0; i < 5; i++ {
+		compressedTarget()
+	}
+	dir, err := os.MkdirTemp("", "compressedemit")
+	if err != nil {
+		log.Fatalf("error: MkdirTemp returns %v", err)
+	}
+	defer os.RemoveAll(dir)
+	if err := coverage.EmitCompressedCounterDataToWriter(io.Discard, 42); err == nil {
+		log.Fatalf("error: EmitCompressedCounterDataToWriter accepts level 42")
+	}
+	want := uint32(5)
+	if c.Meta.Mode == "set" {
+		want = 1
+	}
+	for _, level := range []int{gzip.DefaultCompression, gzip.BestSpeed, gzip.BestCompression} {
+		var buf bytes.Buffer
+		if err := coverage.EmitCompressedCounterDataToWriter(&buf, level); err != nil {
+			log.Fatalf("error: EmitCompressedCounterDataToWriter(%d) returns %v", level, err)
+		}
+		if !bytes.HasPrefix(buf.Bytes(), []byte("\x00cwz")) {
+			log.Fatalf("error: compressed data starts with %q", buf.Bytes()[:4])
+		}
+		path := filepath.Join(dir, fmt.Sprintf("counters.%d", level))
+		if err := os.WriteFile(path, buf.Bytes(), 0666); err != nil {
+			log.Fatalf("error: WriteFile returns %v", err)
+		}
+		ds, err := coverage.ParseCounterDataFile(path)
+		if err != nil {
+			log.Fatalf("error: ParseCounterDataFile of compressed data returns %v", err)
+		}
+		if got := ds.Counters["main.compressedTarget"]; len(got) != 1 || got[0] != want {
+			log.Fatalf("error: counters for main.compressedTarget = %v, want [%d]", got, want)
+		}
+	}
+}
+
+func diffGainedTarget() int {
+	return 1
+}
+
+func diffChangedTarget() int {
+	return 2
+}
+
+func binaryDiff() {
+	log.SetPrefix("binaryDiff: ")
+	c, err := coverage.NewCoverage()
+	if err != nil {
+		log.Fatalf("error: NewCoverage returns %v", err)
+	}
+	emit := func() []byte {
+		var buf bytes.Buffer
+		if err := coverage.EmitCounterDataToWriter(&buf); err != nil {
+			log.Fatalf("error: EmitCounterDataToWriter returns %v", err)
+		}
+		return buf.Bytes()
+	}
+	find := func(entries []coverage.DiffEntry, fn string) *coverage.DiffEntry {
+		for i := range entries {
+			if entries[i].PackagePath == "main" && entries[i].FunctionName == fn {
+				return &entries[i]
+			}
+		}
+		return nil
+	}
+
+	diffChangedTarget()
+	a := emit()
+	diffChangedTarget()
+	diffGainedTarget()
+	b := emit()
+	d, err := coverage.BinaryDiff(bytes.NewReader(a), bytes.NewReader(b))
+	if err != nil {
+		log.Fatalf("error: BinaryDiff returns %v", err)
+	}
+	if e := find(d.Gained, "diffGainedTarget"); e == nil || e.Before != 0 || e.After != 1 {
+		log.Fatalf("error: Gained entry for diffGainedTarget is %+v", e)
+	}
+	if c.Meta.Mode != "set" {
+		if e := find(d.Changed, "diffChangedTarget"); e == nil || e.Before != 1 || e.After != 2 {
+			log.Fatalf("error: Changed entry for diffChangedTarget is %+v", e)
+		}
+	}
+	if c.Meta.Mode == "atomic" {
+		if err := coverage.ClearCoverageCounters(); err != nil {
+			log.Fatalf("error: ClearCoverageCounters returns %v", err)
+		}
+		d, err := coverage.BinaryDiff(bytes.NewReader(b), bytes.NewReader(emit()))
+		if err != nil {
+			log.Fatalf("error: BinaryDiff returns %v", err)
+		}
+		if e := find(d.Lost, "diffGainedTarget"); e == nil || e.Before != 1 || e.After != 0 {
+			log.Fatalf("error: Lost entry for diffGainedTarget is %+v", e)
+		}
+	}
+
+	// Counter data for another program.
+	other := append([]byte(nil), b...)
+	other[8] ^= 0xff
+	if _, err := coverage.BinaryDiff(bytes.NewReader(other), bytes.NewReader(other)); err == nil {
+		log.Fatalf("error: BinaryDiff of data for another program succeeded")
+	}
+}
+
+func scopedTarget() int {
+	return 3
+}
+
+func testScopedRecorder() {
+	log.SetPrefix("testScopedRecorder: ")
+	ft := &fakeT{dir: *outdirflag}
+	r := coverage.NewTestScopedRecorder(ft)
+	scopedTarget()
+	ctx := coverage.ContextWithRecorder(context.Background(), r)
+	if got, ok := coverage.RecorderFromContext(ctx); !ok || got != r {
+		log.Fatalf("error: RecorderFromContext returns %p, %v, want %p", got, ok, r)
+	}
+	if _, ok := coverage.RecorderFromContext(context.Background()); ok {
+		log.Fatalf("error: RecorderFromContext finds a recorder in an empty context")
+	}
+	ft.runCleanups()
+	logs := strings.Join(ft.logs, "\n")
+	if !strings.Contains(logs, "newly covered functions:") || !strings.Contains(logs, "\tmain.scopedTarget\n") {
+		log.Fatalf("error: passing test logs:\n%s", logs)
+	}
+
+	// A failing test lists the functions it executed, whether or
+	// not they were covered before (except in "set" mode, where
+	// counters for code already executed don't change).
+	c, err := coverage.NewCoverage()
+	if err != nil {
+		log.Fatalf("error: NewCoverage returns %v", err)
+	}
+	ft = &fakeT{dir: *outdirflag}
+	coverage.NewTestScopedRecorder(ft)
+	scopedTarget()
+	ft.Errorf("failed")
+	ft.runCleanups()
+	logs = strings.Join(ft.logs, "\n")
+	if !strings.Contains(logs, "functions executed during failed test:") {
+		log.Fatalf("error: failing test logs:\n%s", logs)
+	}
+	if c.Meta.Mode != "set" && !strings.Contains(logs, "\tmain.scopedTarget\n") {
+		log.Fatalf("error: failing test logs:\n%s", logs)
+	}
+}
+
+func clearTargetA() int {
+	return 1
+}
+
+func clearTargetB() int {
+	return 2
+}
+
+func clearFunction() {
+	log.SetPrefix("clearFunction: ")
+	c, err := coverage.NewCoverage()
+	if err != nil {
+		log.Fatalf("error: NewCoverage returns %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		clearTargetA()
+		clearTargetB()
+	}
+	if c.Meta.Mode != "atomic" {
+		if err := coverage.ClearFunctionCoverageCounters("main", "clearTargetA"); err == nil {
+			log.Fatalf("error: ClearFunctionCoverageCounters succeeds in mode %s", c.Meta.Mode)
+		}
+		return
+	}
+	counters := func() map[string][]uint32 {
+		var buf bytes.Buffer
+		if err := coverage.EmitCounterDataToWriter(&buf); err != nil {
+			log.Fatalf("error: EmitCounterDataToWriter returns %v", err)
+		}
+		path := filepath.Join(*outdirflag, "counters")
+		if err := os.WriteFile(path, buf.Bytes(), 0666); err != nil {
+			log.Fatalf("error: WriteFile returns %v", err)
+		}
+		ds, err := coverage.ParseCounterDataFile(path)
+		if err != nil {
+			log.Fatalf("error: ParseCounterDataFile returns %v", err)
+		}
+		return ds.Counters
+	}
+	// Clear twice, the second time using the cached counter location.
+	for iter := 0; iter < 2; iter++ {
+		if err := coverage.ClearFunctionCoverageCounters("main", "clearTargetA"); err != nil {
+			log.Fatalf("error: ClearFunctionCoverageCounters returns %v", err)
+		}
+		m := counters()
+		if got, ok := m["main.clearTargetA"]; ok {
+			log.Fatalf("error: iteration %d: counters for cleared function are %v", iter, got)
+		}
+		if got := m["main.clearTargetB"]; len(got) != 1 || got[0] != uint32(3+iter) {
+			log.Fatalf("error: iteration %d: counters for main.clearTargetB are %v, want [%d]", iter, got, 3+iter)
+		}
+		clearTargetA()
+		clearTargetB()
+		if got := counters()["main.clearTargetA"]; len(got) != 1 || got[0] != 1 {
+			log.Fatalf("error: iteration %d: counters for main.clearTargetA after one call are %v, want [1]", iter, got)
+		}
+	}
+
+	err = coverage.ClearFunctionCoverageCounters("main", "noSuchFunction")
+	var nf *coverage.FuncNotFoundError
+	if !errors.As(err, &nf) || nf.PkgPath != "main" || nf.FuncName != "noSuchFunction" {
+		log.Fatalf("error: ClearFunctionCoverageCounters of missing function returns %v", err)
+	}
+}
+
+func crossTarget() int {
+	return 3
+}
+
+func crossAggregator() {
+	log.SetPrefix("crossAggregator: ")
+	c, err := coverage.NewCoverage()
+	if err != nil {
+		log.Fatalf("error: NewCoverage returns %v", err)
+	}
+	name := fmt.Sprintf("harness-%d", os.Getpid())
+	a, err := coverage.NewCrossAggregator(name)
+	if err != nil {
+		log.Fatalf("error: NewCrossAggregator returns %v", err)
+	}
+	if runtime.GOOS != "linux" && runtime.GOOS != "darwin" {
+		if _, err := coverage.ReadCrossAggregator(name); err == nil {
+			log.Fatalf("error: ReadCrossAggregator succeeds on %s", runtime.GOOS)
+		}
+		return
+	}
+	defer coverage.RemoveCrossAggregator(name)
+	read := func() []uint32 {
+		ds, err := coverage.ReadCrossAggregator(name)
+		if err != nil {
+			log.Fatalf("error: ReadCrossAggregator returns %v", err)
+		}
+		if ds.MetaHash != c.Meta.Hash {
+			log.Fatalf("error: segment hash %x, want %x", ds.MetaHash, c.Meta.Hash)
+		}
+		if ds.Mode != c.Meta.Mode {
+			log.Fatalf("error: segment mode %s, want %s", ds.Mode, c.Meta.Mode)
+		}
+		return ds.Counters["main.crossTarget"]
+	}
+	if got := read(); got != nil {
+		log.Fatalf("error: counters for main.crossTarget before call are %v", got)
+	}
+	for i := 0; i < 3; i++ {
+		crossTarget()
+	}
+	if err := a.Update(); err != nil {
+		log.Fatalf("error: Update returns %v", err)
+	}
+	want := uint32(3)
+	if c.Meta.Mode == "set" {
+		want = 1
+	}
+	if got := read(); len(got) != 1 || got[0] != want {
+		log.Fatalf("error: counters for main.crossTarget are %v, want [%d]", got, want)
+	}
+
+	// Check that the periodic updates pick up new counter values.
+	if err := a.SetUpdateInterval(0); err == nil {
+		log.Fatalf("error: SetUpdateInterval(0) succeeds")
+	}
+	if err := a.SetUpdateInterval(10 * time.Millisecond); err != nil {
+		log.Fatalf("error: SetUpdateInterval returns %v", err)
+	}
+	crossTarget()
+	if c.Meta.Mode != "set" {
+		want++
+		deadline := time.Now().Add(10 * time.Second)
+		for {
+			got := read()
+			if len(got) == 1 && got[0] == want {
+				break
+			}
+			if time.Now().After(deadline) {
+				log.Fatalf("error: counters for main.crossTarget are %v after periodic update, want [%d]", got, want)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	if err := a.Close(); err != nil {
+		log.Fatalf("error: Close returns %v", err)
+	}
+	if err := a.Close(); err == nil {
+		log.Fatalf("error: second Close succeeds")
+	}
+	if err := a.Update(); err == nil {
+		log.Fatalf("error: Update after Close succeeds")
+	}
+	if got := read(); len(got) != 1 || got[0] != want {
+		log.Fatalf("error: counters for main.crossTarget after Close are %v, want [%d]", got, want)
+	}
+	if err := coverage.RemoveCrossAggregator(name); err != nil {
+		log.Fatalf("error: RemoveCrossAggregator returns %v", err)
+	}
+	if _, err := coverage.ReadCrossAggregator(name); err == nil {
+		log.Fatalf("error: ReadCrossAggregator succeeds after RemoveCrossAggregator")
+	}
+}
+
+func percentTarget(x int) int {
+	if x > 0 {
+		return 1
+	}
+	return 0
+}
+
+func percentUncalled() int {
+	return 0
+}
+
+func functionCoveragePercent() {
+	log.SetPrefix("functionCoveragePercent: ")
+	check := func(fn string, ok func(float64) bool) {
+		got, err := coverage.FunctionCoveragePercent("main", fn)
+		if err != nil {
+			log.Fatalf("error: FunctionCoveragePercent(main, %s) returns %v", fn, err)
+		}
+		if !ok(got) {
+			log.Fatalf("error: FunctionCoveragePercent(main, %s) = %v", fn, got)
+		}
+	}
+	check("percentTarget", func(p float64) bool { return p == 0 })
+	percentTarget(1)
+	// Only part of the function has executed.
+	check("percentTarget", func(p float64) bool { return p > 0 && p < 1 })
+	percentTarget(0)
+	check("percentTarget", func(p float64) bool { return p == 1 })
+	check("percentUncalled", func(p float64) bool { return p == 0 })
+
+	got, err := coverage.FunctionCoveragePercent("main", "noSuchFunction")
+	var nf *coverage.FuncNotFoundError
+	if !errors.As(err, &nf) || !math.IsNaN(got) {
+		log.Fatalf("error: FunctionCoveragePercent of missing function returns %v, %v", got, err)
+	}
+}
+
+// failPlugin is a coverage plugin that rejects all data.
+type failPlugin struct{}
+
+func (failPlugin) ProcessMetaData(r io.Reader) (io.Reader, error) {
+	return nil, errors.New("failPlugin")
+}
+
+func (failPlugin) ProcessCounterData(r io.Reader) (io.Reader, error) {
+	return nil, errors.New("failPlugin")
+}
+
+func coverageOverhead() {
+	log.SetPrefix("coverageOverhead: ")
+	// Profiling times the encoders directly, without running plugins.
+	coverage.RegisterCoveragePlugin("fail", failPlugin{})
+	defer coverage.UnregisterCoveragePlugin("fail")
+	// Serve the overhead report as a running server would.
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/coverage/overhead", func(w http.ResponseWriter, r *http.Request) {
+		oh, err := coverage.ProfileCoverageOverhead()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(oh)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	resp, err := http.Get(srv.URL + "/debug/coverage/overhead")
+	if err != nil {
+		log.Fatalf("error: GET returns %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		log.Fatalf("error: GET returns status %s", resp.Status)
+	}
+	var oh coverage.CoverageOverhead
+	if err := json.NewDecoder(resp.Body).Decode(&oh); err != nil {
+		log.Fatalf("error: decoding response: %v", err)
+	}
+	if oh.CounterMemoryBytes <= 0 || oh.CounterMemoryBytes%4 != 0 {
+		log.Fatalf("error: bad CounterMemoryBytes %d", oh.CounterMemoryBytes)
+	}
+	if oh.EmitMetaMs <= 0 || oh.EmitCounterMs <= 0 {
+		log.Fatalf("error: bad emit times %v, %v", oh.EmitMetaMs, oh.EmitCounterMs)
+	}
+	if math.IsNaN(oh.CounterIncrementNs) || math.IsInf(oh.CounterIncrementNs, 0) {
+		log.Fatalf("error: bad CounterIncrementNs %v", oh.CounterIncrementNs)
+	}
+}
+
+func watchTarget() int {
+	return 4
+}
+
+func watchCounterFile() {
+	log.SetPrefix("watchCounterFile: ")
+	if _, err := coverage.WatchCounterFile("x", 0, func(*coverage.CounterDataSet) {}); err == nil {
+		log.Fatalf("error: WatchCounterFile with zero interval succeeds")
+	}
+	if _, err := coverage.WatchCounterFile("x", time.Second, nil); err == nil {
+		log.Fatalf("error: WatchCounterFile with nil callback succeeds")
+	}
+	path := filepath.Join(*outdirflag, "watched")
+	write := func() {
+		var buf bytes.Buffer
+		if err := coverage.EmitCounterDataToWriter(&buf); err != nil {
+			log.Fatalf("error: EmitCounterDataToWriter returns %v", err)
+		}
+		tmp := path + ".tmp"
+		if err := os.WriteFile(tmp, buf.Bytes(), 0666); err != nil {
+			log.Fatalf("error: WriteFile returns %v", err)
+		}
+		if err := os.Rename(tmp, path); err != nil {
+			log.Fatalf("error: Rename returns %v", err)
+		}
+	}
+	got := make(chan []uint32, 100)
+	w, err := coverage.WatchCounterFile(path, 10*time.Millisecond, func(ds *coverage.CounterDataSet) {
+		got <- ds.Counters["main.watchTarget"]
+	})
+	if err != nil {
+		log.Fatalf("error: WatchCounterFile returns %v", err)
+	}
+	// waitFor waits for a callback reporting 'want' counts for
+	// watchTarget.
+	waitFor := func(what string, want uint32) {
+		timeout := time.After(10 * time.Second)
+		for {
+			select {
+			case c := <-got:
+				if len(c) == 1 && c[0] == want {
+					return
+				}
+			case <-timeout:
+				log.Fatalf("error: no callback with count %d after %s", want, what)
+			}
+		}
+	}
+	watchTarget()
+	write()
+	waitFor("create", 1)
+	watchTarget()
+	want := uint32(2)
+	c, err := coverage.NewCoverage()
+	if err != nil {
+		log.Fatalf("error: NewCoverage returns %v", err)
+	}
+	if c.Meta.Mode == "set" {
+		want = 1
+	}
+	write()
+	waitFor("rewrite", want)
+	if err := os.Remove(path); err != nil {
+		log.Fatalf("error: Remove returns %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	for len(got) > 0 {
+		<-got
+	}
+	write()
+	waitFor("recreate", want)
+
+	if err := w.Close(); err != nil {
+		log.Fatalf("error: Close returns %v", err)
+	}
+	if err := w.Close(); err == nil {
+		log.Fatalf("error: second Close succeeds")
+	}
+}
+
+func filterTarget() int {
+	return 5
+}
+
+func filterUncalled() int {
+	return 6
+}
+
+func filteredEmit() {
+	log.SetPrefix("filteredEmit: ")
+	filterTarget()
+	parse := func(filter func(pkgPath, funcName string) bool) map[string][]uint32 {
+		var buf bytes.Buffer
+		if err := coverage.EmitFilteredCounterData(&buf, filter); err != nil {
+			log.Fatalf("error: EmitFilteredCounterData returns %v", err)
+		}
+		path := filepath.Join(*outdirflag, "filtered")
+		if err := os.WriteFile(path, buf.Bytes(), 0666); err != nil {
+			log.Fatalf("error: WriteFile returns %v", err)
+		}
+		ds, err := coverage.ParseCounterDataFile(path)
+		if err != nil {
+			log.Fatalf("error: ParseCounterDataFile returns %v", err)
+		}
+		return ds.Counters
+	}
+
+	seen := make(map[string]bool)
+	m := parse(func(pkgPath, funcName string) bool {
+		seen[pkgPath+"."+funcName] = true
+		return pkgPath == "main" && funcName == "filterTarget"
+	})
+	if !seen["main.filterUncalled"] {
+		log.Fatalf("error: filter not called for main.filterUncalled")
+	}
+	if len(m) != 1 || m["main.filterTarget"] == nil {
+		var keys []string
+		for k := range m {
+			keys = append(keys, k)
+		}
+		log.Fatalf("error: filtered counters for %v, want only main.filterTarget", keys)
+	}
+
+	m = parse(coverage.PkgPrefixFilter("main"))
+	if m["main.filterTarget"] == nil || m["main.main"] == nil {
+		log.Fatalf("error: PkgPrefixFilter(main) omits main functions")
+	}
+	for k := range m {
+		if !strings.HasPrefix(k, "main.") {
+			log.Fatalf("error: PkgPrefixFilter(main) includes %s", k)
+		}
+	}
+}
+
+func pkgCoverageMap() {
+	log.SetPrefix("pkgCoverageMap: ")
+	pst, err := coverage.PackageCoverageStats("main")
+	if err != nil {
+		log.Fatalf("error: PackageCoverageStats returns %v", err)
+	}
+	m, err := coverage.PkgCoverageMap()
+	if err != nil {
+		log.Fatalf("error: PkgCoverageMap returns %v", err)
+	}
+	// Counters keep changing as the program runs, so allow a little
+	// slack when comparing with the stats APIs.
+	close := func(a, b float64) bool { return math.Abs(a-b) < 0.05 }
+	if got, ok := m["main"]; !ok || !close(got, pst.BlockCoveragePercent/100) {
+		log.Fatalf("error: PkgCoverageMap()[main] = %v, %v, want about %v", got, ok, pst.BlockCoveragePercent/100)
+	}
+	for p, v := range m {
+		if v < 0 || v > 1 {
+			log.Fatalf("error: PkgCoverageMap()[%s] = %v, out of range", p, v)
+		}
+		if strings.HasSuffix(p, "/") || strings.HasSuffix(p, "_test") {
+			log.Fatalf("error: PkgCoverageMap has non-canonical key %q", p)
+		}
+	}
+	pkgs, err := coverage.CoveragePackageList()
+	if err != nil {
+		log.Fatalf("error: CoveragePackageList returns %v", err)
+	}
+	if len(m) != len(pkgs) {
+		log.Fatalf("error: PkgCoverageMap has %d packages, CoveragePackageList has %d", len(m), len(pkgs))
+	}
+
+	st, err := coverage.ProgramCoverageStats()
+	if err != nil {
+		log.Fatalf("error: ProgramCoverageStats returns %v", err)
+	}
+	got, err := coverage.ProgramCoveragePercent()
+	if err != nil {
+		log.Fatalf("error: ProgramCoveragePercent returns %v", err)
+	}
+	if !close(got, st.BlockCoveragePercent/100) {
+		log.Fatalf("error: ProgramCoveragePercent() = %v, want about %v", got, st.BlockCoveragePercent/100)
+	}
+}
+
+func assertMinCoverage() {
+	log.SetPrefix("assertMinCoverage: ")
+	if err := coverage.AssertMinCoverage(0); err != nil {
+		log.Fatalf("error: AssertMinCoverage(0) returns %v", err)
+	}
+	for _, bad := range []float64{-1, 101, math.NaN()} {
+		if err := coverage.AssertMinCoverage(bad); err == nil {
+			log.Fatalf("error: AssertMinCoverage(%v) succeeds", bad)
+		}
+	}
+	// With -coverpkg=all, coverage is nowhere near 100%.
+	err := coverage.AssertMinCoverage(100)
+	if err == nil {
+		log.Fatalf("error: AssertMinCoverage(100) succeeds")
+	}
+	lines := strings.Split(err.Error(), "\n")
+	if !strings.HasPrefix(lines[0], "coverage: ") || !strings.HasSuffix(lines[0], "minimum 100.0%") {
+		log.Fatalf("error: bad summary line %q", lines[0])
+	}
+	if len(lines) < 2 || len(lines) > 11 {
+		log.Fatalf("error: %d package lines, want 1 to 10", len(lines)-1)
+	}
+	last := -1
+	for _, l := range lines[1:] {
+		var pkg string
+		var unc, tot int
+		var pct float64
+		if n, err := fmt.Sscanf(l, "uncovered: pkg=%s uncovered_blocks=%d total_blocks=%d coverage=%f%%", &pkg, &unc, &tot, &pct); n != 4 {
+			log.Fatalf("error: can't parse package line %q: %v", l, err)
+		}
+		if unc <= 0 || unc > tot || (last >= 0 && unc > last) {
+			log.Fatalf("error: bad or misordered package line %q", l)
+		}
+		last = unc
+	}
+
+	if err := coverage.AssertMinPackageCoverage("main", 0); err != nil {
+		log.Fatalf("error: AssertMinPackageCoverage(main, 0) returns %v", err)
+	}
+	if err := coverage.AssertMinPackageCoverage("main", 100); err == nil || !strings.HasPrefix(err.Error(), "coverage: main: ") {
+		log.Fatalf("error: AssertMinPackageCoverage(main, 100) returns %v", err)
+	}
+	if err := coverage.AssertMinPackageCoverage("no/such/pkg", 0); err == nil {
+		log.Fatalf("error: AssertMinPackageCoverage of missing package succeeds")
+	}
+}
+
+func dumpTarget(x int) int {
+	if x > 0 {
+		return 1
+	}
+	return 0
+}
+
+func dumpUncalled() int {
+	return 0
+}
+
+func dumpCounters() {
+	log.SetPrefix("dumpCounters: ")
+	dumpTarget(1)
+	var buf bytes.Buffer
+	if err := coverage.DumpCountersToText(&buf); err != nil {
+		log.Fatalf("error: DumpCountersToText returns %v", err)
+	}
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	byFunc := make(map[string][]string)
+	var prev []string
+	for _, l := range lines {
+		f := strings.Split(l, "\t")
+		if len(f) < 3 || len(f) > 4 || (len(f) == 4 && f[3] != "[UNCOVERED]") {
+			log.Fatalf("error: malformed line %q", l)
+		}
+		if prev != nil && (f[0] < prev[0] || f[0] == prev[0] && f[1] < prev[1]) {
+			log.Fatalf("error: line %q out of order", l)
+		}
+		prev = f
+		byFunc[f[0]+"."+f[1]] = f
+	}
+	f := byFunc["main.dumpTarget"]
+	if f == nil || len(f) != 3 {
+		log.Fatalf("error: bad line for main.dumpTarget: %q", f)
+	}
+	vals := strings.Fields(f[2])
+	if !strings.HasPrefix(vals[0], "block0=") || vals[0] == "block0=0" {
+		log.Fatalf("error: main.dumpTarget entry block not covered: %q", f[2])
+	}
+	if !strings.Contains(f[2], "=0") {
+		log.Fatalf("error: main.dumpTarget has no uncovered block: %q", f[2])
+	}
+	if f := byFunc["main.dumpUncalled"]; len(f) != 4 || strings.Contains(f[2], "=1") {
+		log.Fatalf("error: bad line for main.dumpUncalled: %q", f)
+	}
+}
+
+func resetTarget() int {
+	return 7
+}
+
+func resetSpin() int {
+	return 8
+}
+
+func resetAndSnapshot() {
+	log.SetPrefix("resetAndSnapshot: ")
+	c, err := coverage.NewCoverage()
+	if err != nil {
+		log.Fatalf("error: NewCoverage returns %v", err)
+	}
+	if c.Meta.Mode != "atomic" {
+		if _, err := coverage.ResetAndSnapshot(); err == nil {
+			log.Fatalf("error: ResetAndSnapshot succeeds in mode %s", c.Meta.Mode)
+		}
+		return
+	}
+	reset := func() *coverage.CounterDataSet {
+		ds, err := coverage.ResetAndSnapshot()
+		if err != nil {
+			log.Fatalf("error: ResetAndSnapshot returns %v", err)
+		}
+		return ds
+	}
+	for i := 0; i < 3; i++ {
+		resetTarget()
+	}
+	ds := reset()
+	if got := ds.Counters["main.resetTarget"]; len(got) != 1 || got[0] != 3 {
+		log.Fatalf("error: captured counters for main.resetTarget are %v, want [3]", got)
+	}
+	if got, ok := reset().Counters["main.resetTarget"]; ok {
+		log.Fatalf("error: counters for main.resetTarget after reset are %v", got)
+	}
+	resetTarget()
+
+	// Put the captured values back.
+	var buf bytes.Buffer
+	if _, err := ds.WriteTo(&buf); err != nil {
+		log.Fatalf("error: WriteTo returns %v", err)
+	}
+	if err := coverage.MergeCoverageCounters(&buf); err != nil {
+		log.Fatalf("error: MergeCoverageCounters returns %v", err)
+	}
+	if got, err := coverage.QueryBlockHits("main", "resetTarget", 0); err != nil || got != 4 {
+		log.Fatalf("error: QueryBlockHits after merge returns %d, %v, want 4", got, err)
+	}
+
+	// No increment may be lost when resetting concurrently with
+	// updates.
+	const workers, calls = 4, 20000
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < calls; i++ {
+				resetSpin()
+			}
+		}()
+	}
+	total := uint64(0)
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	for finished := false; !finished; {
+		select {
+		case <-done:
+			finished = true
+		default:
+		}
+		if got := reset().Counters["main.resetSpin"]; len(got) == 1 {
+			total += uint64(got[0])
+		}
+	}
+	if total != workers*calls {
+		log.Fatalf("error: captured %d calls of main.resetSpin, want %d", total, workers*calls)
+	}
+}
+
+// annotateTarget is annotated by the annotateSource testpoint.
+func annotateTarget(x int) int {
+	if x > 0 {
+		return 1 // annotate: executed
+	}
+	return 0 // annotate: not executed
+}
+
+func annotateSource() {
+	log.SetPrefix("annotateSource: ")
+	if _, err := coverage.NewSourceAnnotator("", "/does/not/exist"); err == nil {
+		log.Fatalf("error: NewSourceAnnotator with missing module root succeeds")
+	}
+	annotateTarget(1)
+	_, thisFile, _, _ := runtime.Caller(0)
+	a, err := coverage.NewSourceAnnotator(runtime.GOROOT(), filepath.Dir(thisFile))
+	if err != nil {
+		log.Fatalf("error: NewSourceAnnotator returns %v", err)
+	}
+	a.WithColumnWidth(4)
+	var buf bytes.Buffer
+	if err := a.AnnotateFile("harness.go", &buf); err != nil {
+		log.Fatalf("error: AnnotateFile returns %v", err)
+	}
+	want := map[string]string{
+		"// annotateTarget is annotated":     "     ",
+		"func annotateTarget(x int) int {":   ">1   ",
+		"return 1 // annotate: executed":     ">1   ",
+		"return 0 // annotate: not executed": "!0   ",
+	}
+	for _, l := range strings.Split(buf.String(), "\n") {
+		if len(l) < 5 {
+			continue
+		}
+		for text, prefix := range want {
+			if strings.HasPrefix(strings.TrimSpace(l[5:]), text) {
+				if l[:5] != prefix {
+					log.Fatalf("error: annotated line %q, want prefix %q", l, prefix)
+				}
+				delete(want, text)
+			}
+		}
+	}
+	if len(want) != 0 {
+		log.Fatalf("error: annotated lines missing: %v", want)
+	}
+	if err := a.AnnotateFile("no_such_file.go", &buf); err == nil {
+		log.Fatalf("error: AnnotateFile of unknown file succeeds")
+	}
+}
+
+func lowCoverageExit() {
+	log.SetPrefix("lowCoverageExit: ")
+	for _, bad := range []float64{-1, 100.5, math.NaN()} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					log.Fatalf("error: SetPanicOnLowCoverage(%v) did not panic", bad)
+				}
+			}()
+			coverage.SetPanicOnLowCoverage(bad)
+		}()
+	}
+	// No program covers all of "-coverpkg=all", so this run fails
+	// at exit.
+	coverage.SetPanicOnLowCoverage(100)
+}
+
+func lowCoverageDisabled() {
+	log.SetPrefix("lowCoverageDisabled: ")
+	coverage.SetPanicOnLowCoverage(100)
+	coverage.SetPanicOnLowCoverage(0)
+}
+
+func lowCoverageFailingRun() {
+	log.SetPrefix("lowCoverageFailingRun: ")
+	coverage.SetPanicOnLowCoverage(100)
+	os.Exit(3)
+}
+
+func sonarQubeXML() {
+	log.SetPrefix("sonarQubeXML: ")
+	// The instrumented lines must be the same as in the LCOV output,
+	// and lines executed before the LCOV output was written must be
+	// reported as covered. (Code that runs in between, such as the
+	// LCOV writer itself, can cover more lines.)
+	var lb bytes.Buffer
+	if err := lcov.EmitLCOVData(&lb); err != nil {
+		log.Fatalf("error: EmitLCOVData returns %v", err)
+	}
+	var b bytes.Buffer
+	if err := sonarqube.WriteSonarQubeXML(&b); err != nil {
+		log.Fatalf("error: WriteSonarQubeXML returns %v", err)
+	}
+	var doc struct {
+		XMLName xml.Name `xml:"coverage"`
+		Version string   `xml:"version,attr"`
+		Files   []struct {
+			Path  string `xml:"path,attr"`
+			Lines []struct {
+				LineNumber int    `xml:"lineNumber,attr"`
+				Covered    string `xml:"covered,attr"`
+			} `xml:"lineToCover"`
+		} `xml:"file"`
+	}
+	if err := xml.Unmarshal(b.Bytes(), &doc); err != nil {
+		log.Fatalf("error: parsing XML: %v\n%s", err, b.String())
+	}
+	if doc.Version != "1" {
+		log.Fatalf("error: coverage version %q, want \"1\"", doc.Version)
+	}
+
+	want := make(map[string]map[int]bool)
+	var sf string
+	for _, line := range strings.Split(lb.String(), "\n") {
+		tag, val, _ := strings.Cut(line, ":")
+		switch tag {
+		case "SF":
+			sf = val
+			want[sf] = make(map[int]bool)
+		case "DA":
+			ln, count, _ := strings.Cut(val, ",")
+			n, err := strconv.Atoi(ln)
+			if err != nil {
+				log.Fatalf("error: bad LCOV line %q", line)
+			}
+			want[sf][n] = count != "0"
+		}
+	}
+	if len(doc.Files) != len(want) {
+		log.Fatalf("error: %d file elements for %d source files", len(doc.Files), len(want))
+	}
+	sawSelf := false
+	for i, f := range doc.Files {
+		if i > 0 && doc.Files[i-1].Path >= f.Path {
+			log.Fatalf("error: file elements out of order at %q", f.Path)
+		}
+		lines, ok := want[f.Path]
+		if !ok {
+			log.Fatalf("error: unexpected source file %q", f.Path)
+		}
+		if len(f.Lines) != len(lines) {
+			log.Fatalf("error: %d lineToCover elements for %s, want %d", len(f.Lines), f.Path, len(lines))
+		}
+		for j, l := range f.Lines {
+			if j > 0 && f.Lines[j-1].LineNumber >= l.LineNumber {
+				log.Fatalf("error: lines of %s out of order at %d", f.Path, l.LineNumber)
+			}
+			covered, ok := lines[l.LineNumber]
+			if !ok {
+				log.Fatalf("error: %s:%d is not instrumented", f.Path, l.LineNumber)
+			}
+			if l.Covered != "true" && (l.Covered != "false" || covered) {
+				log.Fatalf("error: %s:%d covered=%q, want true", f.Path, l.LineNumber, l.Covered)
+			}
+			if covered && strings.HasSuffix(f.Path, "harness.go") {
+				sawSelf = true
+			}
+		}
+	}
+	if !sawSelf {
+		log.Fatalf("error: no covered lines in harness.go")
+	}
+}
+
+func counterFileRetention() {
+	log.SetPrefix("counterFileRetention: ")
+	if err := coverage.SetCounterFileRetentionPolicy(*outdirflag, 0); err == nil {
+		log.Fatalf("error: SetCounterFileRetentionPolicy with keep=0 succeeded")
+	}
+	dir := filepath.Join(*outdirflag, "retention")
+	if err := os.Mkdir(dir, 0777); err != nil {
+		log.Fatalf("error: %v", err)
+	}
+	// Files that must survive pruning: one that isn't coverage data,
+	// and a counter data file header for some other program.
+	other := append(icov.CovCounterMagic[:], make([]byte, 4+16)...)
+	other[8] = 0xff
+	others := map[string][]byte{
+		"notes.txt": []byte("not coverage data\n"),
+		icov.CounterFilePref + ".ff000000000000000000000000000000.1.1": other,
+	}
+	for name, data := range others {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0666); err != nil {
+			log.Fatalf("error: %v", err)
+		}
+	}
+	if err := coverage.SetCounterFileRetentionPolicy(dir, 2); err != nil {
+		log.Fatalf("error: SetCounterFileRetentionPolicy returns %v", err)
+	}
+
+	list := func() map[string]bool {
+		ents, err := os.ReadDir(dir)
+		if err != nil {
+			log.Fatalf("error: %v", err)
+		}
+		m := make(map[string]bool)
+		for _, e := range ents {
+			if others[e.Name()] == nil {
+				m[e.Name()] = true
+			}
+		}
+		return m
+	}
+	var written []string
+	for i := 0; i < 4; i++ {
+		before := list()
+		if err := coverage.EmitCounterDataToDir(dir); err != nil {
+			log.Fatalf("error: EmitCounterDataToDir returns %v", err)
+		}
+		for name := range list() {
+			if !before[name] {
+				written = append(written, name)
+			}
+		}
+		if len(written) != i+1 {
+			log.Fatalf("error: after emit %d, %d new files written", i, len(written))
+		}
+		// Make sure that the modification times differ.
+		time.Sleep(20 * time.Millisecond)
+	}
+	got := list()
+	if len(got) != 2 || !got[written[2]] || !got[written[3]] {
+		log.Fatalf("error: files left after pruning are %v, want %v", got, written[2:])
+	}
+	for name := range others {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			log.Fatalf("error: %v", err)
+		}
+	}
+}
+
+func fuzzTarget(x int) int {
+	if x > 10 {
+		return x * 2
+	}
+	return x
+}
+
+func fuzzFeedback() {
+	log.SetPrefix("fuzzFeedback: ")
+	fuzzTarget(1)
+	coverage.FuzzCoverageReset()
+	a := coverage.FuzzCoverageSnapshot()
+	fuzzTarget(1)
+	b := coverage.FuzzCoverageSnapshot()
+	if len(a) == 0 || len(a) != len(b) {
+		log.Fatalf("error: snapshot lengths %d and %d", len(a), len(b))
+	}
+	// The counters for fuzzTarget were reset, so running it again
+	// is new coverage.
+	if !coverage.FuzzCoverageNew(a, b) {
+		log.Fatalf("error: no new coverage after running fuzzTarget(1)")
+	}
+	// Taking the other branch is new coverage too.
+	coverage.FuzzCoverageReset()
+	fuzzTarget(1)
+	c := coverage.FuzzCoverageSnapshot()
+	fuzzTarget(100)
+	d := coverage.FuzzCoverageSnapshot()
+	if !coverage.FuzzCoverageNew(c, d) {
+		log.Fatalf("error: no new coverage after running fuzzTarget(100)")
+	}
+	for i := range c {
+		if c[i] > 1 || d[i] > 1 {
+			log.Fatalf("error: snapshot byte %d is %d, %d", i, c[i], d[i])
+		}
+	}
+}
+
+func buildInfo() {
+	log.SetPrefix("buildInfo: ")
+	bi, err := coverage.BuildInfo()
+	if err != nil {
+		log.Fatalf("error: BuildInfo returns %v", err)
+	}
+	c, err := coverage.NewCoverage()
+	if err != nil {
+		log.Fatalf("error: NewCoverage returns %v", err)
+	}
+	nf, nb := 0, 0
+	for _, p := range c.Meta.Packages {
+		nf += len(p.Functions)
+		for _, f := range p.Functions {
+			nb += f.NumBlocks
+		}
+	}
+	want := coverage.CoverageBuildInfo{
+		Mode:                     c.Meta.Mode,
+		Granularity:              c.Meta.Granularity,
+		GoVersion:                runtime.Version(),
+		NumInstrumentedPackages:  len(c.Meta.Packages),
+		NumInstrumentedFunctions: nf,
+		NumInstrumentedBlocks:    nb,
+		FinalMetaHash:            c.Meta.Hash,
+	}
+	if *bi != want {
+		log.Fatalf("error: BuildInfo returns %+v, want %+v", *bi, want)
+	}
+	if nb < nf || nf < len(c.Meta.Packages) {
+		log.Fatalf("error: implausible counts in %+v", *bi)
+	}
+}
+
+func debugHTTP() {
+	log.SetPrefix("debugHTTP: ")
+	srv := httptest.NewServer(http.DefaultServeMux)
+	defer srv.Close()
+	get := func(method, path string, wantStatus int, wantType string) []byte {
+		req, err := http.NewRequest(method, srv.URL+"/debug/coverage"+path, nil)
+		if err != nil {
+			log.Fatalf("error: %v", err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			log.Fatalf("error: %s %s: %v", method, path, err)
+		}
+		defer resp.Body.Close()
+		b, err := io.ReadAll(resp.Body)
+		if err != nil {
+			log.Fatalf("error: reading %s: %v", path, err)
+		}
+		if resp.StatusCode != wantStatus {
+			log.Fatalf("error: %s %s: status %d, want %d: %s", method, path, resp.StatusCode, wantStatus, b)
+		}
+		if ct := resp.Header.Get("Content-Type"); wantType != "" && !strings.HasPrefix(ct, wantType) {
+			log.Fatalf("error: %s %s: content type %q, want %q", method, path, ct, wantType)
+		}
+		return b
+	}
+
+	page := string(get("GET", "/", 200, "text/html"))
+	if !strings.Contains(page, `<a href="./?pkg=main">main</a>`) {
+		log.Fatalf("error: index page does not list package main:\n%s", page)
+	}
+	get("GET", "/nosuch", 404, "")
+	get("POST", "/json", 405, "")
+
+	counters := get("GET", "/counters", 200, "application/octet-stream")
+	mainCounters := get("GET", "/counters?pkg=main", 200, "application/octet-stream")
+	if !bytes.HasPrefix(counters, icov.CovCounterMagic[:]) || !bytes.HasPrefix(mainCounters, icov.CovCounterMagic[:]) {
+		log.Fatalf("error: /counters is not counter data")
+	}
+	if len(mainCounters) >= len(counters) {
+		log.Fatalf("error: filtered counter data is %d bytes, unfiltered %d", len(mainCounters), len(counters))
+	}
+	if meta := get("GET", "/meta", 200, "application/octet-stream"); !bytes.HasPrefix(meta, icov.CovMetaMagic[:]) {
+		log.Fatalf("error: /meta is not meta-data")
+	}
+
+	profile := strings.Split(strings.TrimSuffix(string(get("GET", "/profile?pkg=main", 200, "text/plain")), "\n"), "\n")
+	if !strings.HasPrefix(profile[0], "mode: ") || len(profile) < 2 {
+		log.Fatalf("error: bad profile for package main: %q", profile)
+	}
+	for _, line := range profile[1:] {
+		if file, _, _ := strings.Cut(line, ":"); !strings.HasSuffix(file, "/harness.go") {
+			log.Fatalf("error: profile for package main has line %q", line)
+		}
+	}
+	full := string(get("GET", "/profile", 200, "text/plain"))
+	if strings.Count(full, "\n") <= len(profile) {
+		log.Fatalf("error: unfiltered profile is no longer than the one for package main")
+	}
+
+	type pkgSummary struct {
+		ImportPath                 string
+		TotalBlocks, CoveredBlocks int
+		BlockCoveragePercent       float64
+	}
+	var sum struct {
+		Packages []pkgSummary
+		pkgSummary
+	}
+	if err := json.Unmarshal(get("GET", "/json?pkg=main", 200, "application/json"), &sum); err != nil {
+		log.Fatalf("error: decoding /json: %v", err)
+	}
+	if len(sum.Packages) != 1 || sum.Packages[0].ImportPath != "main" {
+		log.Fatalf("error: /json?pkg=main returns packages %+v", sum.Packages)
+	}
+	if p := sum.Packages[0]; p.TotalBlocks != sum.TotalBlocks || p.CoveredBlocks != sum.CoveredBlocks || p.CoveredBlocks == 0 || p.CoveredBlocks > p.TotalBlocks {
+		log.Fatalf("error: /json?pkg=main returns %+v", sum)
+	}
+
+	// The handler can also be installed elsewhere.
+	rec := httptest.NewRecorder()
+	debughttp.HTTPHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/profile", nil))
+	if rec.Code != 200 || !strings.HasPrefix(rec.Body.String(), "mode: ") {
+		log.Fatalf("error: HTTPHandler returns %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func emitOnSignal() {
+	log.SetPrefix("emitOnSignal: ")
+	if runtime.GOOS == "windows" || runtime.GOOS == "plan9" {
+		// Can't send os.Interrupt to ourselves.
+		return
+	}
+	func() {
+		defer func() {
+			if recover() == nil {
+				log.Fatalf("error: MustEmitOnSignal(nil) did not panic")
+			}
+		}()
+		signals.MustEmitOnSignal(nil)
+	}()
+	dir := filepath.Join(*outdirflag, "signal")
+	if err := os.Mkdir(dir, 0777); err != nil {
+		log.Fatalf("error: %v", err)
+	}
+	if err := coverage.SetCoverageOutputDir(dir); err != nil {
+		log.Fatalf("error: SetCoverageOutputDir returns %v", err)
+	}
+	defer coverage.SetCoverageOutputDir("")
+
+	countFiles := func() (meta, counters int) {
+		ents, err := os.ReadDir(dir)
+		if err != nil {
+			log.Fatalf("error: %v", err)
+		}
+		for _, e := range ents {
+			switch {
+			case strings.HasPrefix(e.Name(), icov.MetaFilePref+"."):
+				meta++
+			case strings.HasPrefix(e.Name(), icov.CounterFilePref+"."):
+				counters++
+			}
+		}
+		return meta, counters
+	}
+	self, err := os.FindProcess(os.Getpid())
+	if err != nil {
+		log.Fatalf("error: %v", err)
+	}
+	// Installing a second handler for the same signal replaces the
+	// first, so each signal writes a single counter data file.
+	signals.MustEmitOnSignal(os.Interrupt)
+	signals.MustEmitOnSignal(os.Interrupt)
+	defer signals.StopSignalEmit(os.Interrupt)
+	for want := 1; want <= 2; want++ {
+		if err := self.Signal(os.Interrupt); err != nil {
+			log.Fatalf("error: sending signal: %v", err)
+		}
+		deadline := time.Now().Add(10 * time.Second)
+		for {
+			if _, n := countFiles(); n >= want {
+				break
+			}
+			if time.Now().After(deadline) {
+				log.Fatalf("error: no counter data file written for signal %d", want)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		time.Sleep(100 * time.Millisecond)
+		if meta, n := countFiles(); meta != 1 || n != want {
+			log.Fatalf("error: after signal %d, %d meta-data and %d counter data files, want 1 and %d", want, meta, n, want)
+		}
+	}
+}
+
 func final() int {
 	println("I run last.")
 	return 43
@@ -252,6 +4853,182 @@ func main() {
 		emitToFailingWriter()
 	case "emitWithCounterClear":
 		emitWithCounterClear()
+	case "counterSummary":
+		counterSummary()
+	case "runWithCoverage":
+		runWithCoverage()
+	case "iterateCounterChanges":
+		iterateCounterChanges()
+	case "emitWithProgress":
+		emitWithProgress()
+	case "drainCounters":
+		drainCounters()
+	case "lazyMetaDecoder":
+		lazyMetaDecoder()
+	case "coveragePlugin":
+		coveragePlugin()
+	case "metaRaw":
+		metaRaw()
+	case "writeJSON":
+		writeJSON()
+	case "hashChain":
+		hashChain()
+	case "emitter":
+		emitter()
+	case "emitSnapshotToDir":
+		emitSnapshotToDir()
+	case "uniformCoveragePackages":
+		uniformCoveragePackages()
+	case "mergeDirs":
+		mergeDirs()
+	case "coverageProfile":
+		coverageProfile()
+	case "testCoverageReporter":
+		testCoverageReporter()
+	case "printCoverageReport":
+		printCoverageReport()
+	case "emitWithTimeout":
+		emitWithTimeout()
+	case "gzipFile":
+		gzipFile()
+	case "snapshotPool":
+		snapshotPool()
+	case "decayTracker":
+		decayTracker()
+	case "emitDeterministic":
+		emitDeterministic()
+	case "counterDataStats":
+		counterDataStats()
+	case "clearAndEmit":
+		clearAndEmit()
+	case "clearPackage":
+		clearPackage()
+	case "coverageBarrier":
+		coverageBarrier()
+	case "lineProfiler":
+		lineProfiler()
+	case "coverageAssertions":
+		coverageAssertions()
+	case "counterProfileToSVG":
+		counterProfileToSVG()
+	case "eventBus":
+		eventBus()
+	case "deltaStream":
+		deltaStream()
+	case "pinnedResult":
+		pinnedResult()
+	case "combinedData":
+		combinedData()
+	case "clearUnsafe":
+		clearUnsafe()
+	case "coverageEnabled":
+		coverageEnabled()
+	case "coveredFunctions":
+		coveredFunctions()
+	case "packageStats":
+		packageStats()
+	case "jsonWrapper":
+		jsonWrapper()
+	case "lcovData":
+		lcovData()
+	case "mergeCounters":
+		mergeCounters()
+	case "flushHook":
+		flushHook()
+	case "deltaCounts":
+		deltaCounts()
+	case "queryBlockHits":
+		queryBlockHits()
+	case "counterFileNamer":
+		counterFileNamer()
+	case "streamWriter":
+		streamWriter()
+	case "outputDir":
+		outputDir()
+	case "periodicFlusher":
+		periodicFlusher()
+	case "textProfile":
+		textProfile()
+	case "counterSnapshotMap":
+		counterSnapshotMap()
+	case "concurrentMerge":
+		concurrentMerge()
+	case "atomicEmitToDir":
+		atomicEmitToDir()
+	case "granularity":
+		granularity()
+	case "uncoveredFuncs":
+		uncoveredFuncs()
+	case "finalHashCallback":
+		finalHashCallback()
+	case "progressWriter":
+		progressWriter()
+	case "validateFiles":
+		validateFiles()
+	case "appendToFile":
+		appendToFile()
+	case "packageList":
+		packageList()
+	case "contextEmitAll":
+		contextEmitAll()
+	case "recorder":
+		recorder()
+	case "queryLineHits":
+		queryLineHits()
+	case "maxCounterFileSize":
+		maxCounterFileSize()
+	case "counterDataSet":
+		counterDataSet()
+	case "parseMetaDataFile":
+		parseMetaDataFile()
+	case "emitHooks":
+		emitHooks()
+	case "compressedEmit":
+		compressedEmit()
+	case "binaryDiff":
+		binaryDiff()
+	case "testScopedRecorder":
+		testScopedRecorder()
+	case "clearFunction":
+		clearFunction()
+	case "crossAggregator":
+		crossAggregator()
+	case "functionCoveragePercent":
+		functionCoveragePercent()
+	case "coverageOverhead":
+		coverageOverhead()
+	case "watchCounterFile":
+		watchCounterFile()
+	case "filteredEmit":
+		filteredEmit()
+	case "pkgCoverageMap":
+		pkgCoverageMap()
+	case "assertMinCoverage":
+		assertMinCoverage()
+	case "dumpCounters":
+		dumpCounters()
+	case "resetAndSnapshot":
+		resetAndSnapshot()
+	case "annotateSource":
+		annotateSource()
+	case "lowCoverageExit":
+		lowCoverageExit()
+	case "lowCoverageDisabled":
+		lowCoverageDisabled()
+	case "lowCoverageFailingRun":
+		lowCoverageFailingRun()
+	case "sonarQubeXML":
+		sonarQubeXML()
+	case "counterFileRetention":
+		counterFileRetention()
+	case "fuzzFeedback":
+		fuzzFeedback()
+	case "buildInfo":
+		buildInfo()
+	case "debugHTTP":
+		debugHTTP()
+	case "emitOnSignal":
+		emitOnSignal()
 	default:
 		log.Fatalf("error: unknown testpoint %q", *testpointflag)
 	}
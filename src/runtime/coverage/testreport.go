@@ -0,0 +1,297 @@
+// Copyright 2022 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package coverage
+
+import (
+	"fmt"
+	"internal/coverage"
+	"internal/coverage/decodemeta"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// TestingTB is the subset of the testing.TB interface used by the
+// test-oriented helpers in this package. It is satisfied by
+// *testing.T and *testing.B (this package cannot import "testing"
+// directly, since it is linked into every coverage-instrumented
+// program).
+type TestingTB interface {
+	Helper()
+	Name() string
+	Logf(format string, args ...any)
+	Errorf(format string, args ...any)
+	Fatalf(format string, args ...any)
+	Cleanup(func())
+	TempDir() string
+	Failed() bool
+}
+
+// TestCoverageReporter reports on the coverage achieved during a
+// single test. See NewTestCoverageReporter.
+type TestCoverageReporter struct {
+	t      TestingTB
+	before *CounterSnapshot
+	dir    string
+	err    error
+}
+
+// NewTestCoverageReporter returns a reporter for the test 't',
+// capturing a snapshot of the program's coverage counters. When the
+// test completes, the reporter writes a JSON report describing the
+// blocks and functions executed since the snapshot to the file
+// "coverage.json" in a directory obtained from t.TempDir, and logs
+// its location. The test binary must be built with "-cover".
+func NewTestCoverageReporter(t TestingTB) *TestCoverageReporter {
+	t.Helper()
+	r := &TestCoverageReporter{t: t}
+	r.before, r.err = ReadCounterSnapshot()
+	if r.err == nil {
+		r.dir = t.TempDir()
+		t.Cleanup(r.report)
+	}
+	return r
+}
+
+// Assert reports a test error if the percentage of instrumented
+// blocks executed since the reporter was created is less than
+// 'minPct' (in the range [0, 100]).
+func (r *TestCoverageReporter) Assert(minPct float64) {
+	r.t.Helper()
+	if msg := r.check(minPct); msg != "" {
+		r.t.Errorf("%s", msg)
+	}
+}
+
+// Require is like Assert, but stops the test with t.Fatalf if the
+// coverage is below 'minPct'.
+func (r *TestCoverageReporter) Require(minPct float64) {
+	r.t.Helper()
+	if msg := r.check(minPct); msg != "" {
+		r.t.Fatalf("%s", msg)
+	}
+}
+
+// check returns a failure message if the coverage since the reporter
+// was created is below 'minPct', or the empty string otherwise.
+func (r *TestCoverageReporter) check(minPct float64) string {
+	st, _, err := r.delta()
+	if err != nil {
+		return fmt.Sprintf("coverage data unavailable: %v", err)
+	}
+	if st.BlockCoveragePercent < minPct {
+		return fmt.Sprintf("coverage for %s is %.1f%%, want at least %.1f%%", r.t.Name(), st.BlockCoveragePercent, minPct)
+	}
+	return ""
+}
+
+// delta returns statistics for, and a diff of, the counter
+// increments since the reporter was created.
+func (r *TestCoverageReporter) delta() (*CoverageStats, *CounterDiff, error) {
+	if r.err != nil {
+		return nil, nil, r.err
+	}
+	after, err := ReadCounterSnapshot()
+	if err != nil {
+		return nil, nil, err
+	}
+	payloads := metaPayloads(getCovMetaList())
+	diff, err := diffSnapshots(payloads, r.before, after)
+	if err != nil {
+		return nil, nil, err
+	}
+	st, err := computeStats(payloads, cgran, deltaCounters(r.before.counterMap(), after.counterMap()))
+	if err != nil {
+		return nil, nil, err
+	}
+	return st, diff, nil
+}
+
+// report writes the JSON coverage report for the test.
+func (r *TestCoverageReporter) report() {
+	st, diff, err := r.delta()
+	if err != nil {
+		r.t.Errorf("computing coverage report: %v", err)
+		return
+	}
+	entries := func(des []DiffEntry) []any {
+		l := make([]any, 0, len(des))
+		for _, e := range des {
+			l = append(l, jsonObject{
+				{"package", e.PackagePath},
+				{"function", e.FunctionName},
+				{"before", e.Before},
+				{"after", e.After},
+			})
+		}
+		return l
+	}
+	doc := jsonObject{
+		{"test", r.t.Name()},
+		{"totalBlocks", st.TotalBlocks},
+		{"coveredBlocks", st.CoveredBlocks},
+		{"blockCoveragePercent", st.BlockCoveragePercent},
+		{"totalLines", st.TotalLines},
+		{"coveredLines", st.CoveredLines},
+		{"lineCoveragePercent", st.LineCoveragePercent},
+		{"gained", entries(diff.Gained)},
+		{"changed", entries(diff.Changed)},
+	}
+	var sb strings.Builder
+	writeJSON(&sb, doc, true, 0)
+	sb.WriteByte('\n')
+	path := filepath.Join(r.dir, "coverage.json")
+	if err := os.WriteFile(path, []byte(sb.String()), 0666); err != nil {
+		r.t.Errorf("writing coverage report: %v", err)
+		return
+	}
+	r.t.Logf("coverage report written to %s", path)
+}
+
+// AssertCoverageUnchanged calls 'fn' and reports a test error listing
+// each instrumented block that was executed for the first time during
+// the call. It is intended for regression tests checking that a change
+// does not exercise new code paths. Blocks in runtime/coverage itself,
+// and in the runtime and the packages it depends on, are ignored (see
+// AssertExactlyCovered). The test binary must be built with "-cover".
+func AssertCoverageUnchanged(t TestingTB, fn func()) {
+	t.Helper()
+	before, after, err := coverageDuring(fn)
+	if err != nil {
+		t.Errorf("coverage data unavailable: %v", err)
+		return
+	}
+	blocks, err := newlyCoveredBlocks(before, after)
+	if err != nil {
+		t.Errorf("comparing coverage: %v", err)
+		return
+	}
+	if len(blocks) != 0 {
+		t.Errorf("%d newly covered blocks:\n\t%s", len(blocks), strings.Join(blocks, "\n\t"))
+	}
+}
+
+// AssertExactlyCovered calls 'fn' and reports a test error unless the
+// functions executed during the call are exactly those named in
+// 'expected', each given as "<import path>.<function name>" (for
+// example "example.com/pkg.Parse" or "example.com/pkg.T.Method").
+// Functions in runtime/coverage itself are ignored, as are those in
+// the runtime and the packages it depends on: with -coverpkg=all,
+// background work such as scheduling and garbage collection would
+// otherwise appear to have been executed by 'fn'. Note that in
+// "set" counter mode only the first execution of a function is
+// recorded, so functions that had already run before the call are
+// not seen. The test binary must be built with "-cover".
+func AssertExactlyCovered(t TestingTB, fn func(), expected []string) {
+	t.Helper()
+	before, after, err := coverageDuring(fn)
+	if err != nil {
+		t.Errorf("coverage data unavailable: %v", err)
+		return
+	}
+	diff, err := diffSnapshots(metaPayloads(getCovMetaList()), before, after)
+	if err != nil {
+		t.Errorf("comparing coverage: %v", err)
+		return
+	}
+	got := make(map[string]bool)
+	for _, des := range [][]DiffEntry{diff.Gained, diff.Changed} {
+		for _, e := range des {
+			if !ignoredPkg(e.PackagePath) {
+				got[e.PackagePath+"."+e.FunctionName] = true
+			}
+		}
+	}
+	want := make(map[string]bool)
+	for _, f := range expected {
+		want[f] = true
+	}
+	var missing, extra []string
+	for f := range want {
+		if !got[f] {
+			missing = append(missing, f)
+		}
+	}
+	for f := range got {
+		if !want[f] {
+			extra = append(extra, f)
+		}
+	}
+	sort.Strings(missing)
+	sort.Strings(extra)
+	if len(missing) != 0 {
+		t.Errorf("functions not executed: %s", strings.Join(missing, ", "))
+	}
+	if len(extra) != 0 {
+		t.Errorf("unexpected functions executed: %s", strings.Join(extra, ", "))
+	}
+}
+
+// selfPkgPath is the import path of this package.
+const selfPkgPath = "runtime/coverage"
+
+// ignoredPkg reports whether the functions of the package 'pkgPath'
+// are excluded from the results of the assertion helpers: those of
+// this package, and those of the runtime and its dependencies, which
+// also run in the background and so may execute during any call.
+func ignoredPkg(pkgPath string) bool {
+	return pkgPath == selfPkgPath || coverage.HardCodedPkgID(pkgPath) != coverage.NotHardCoded
+}
+
+// coverageDuring returns snapshots of the counters taken immediately
+// before and after calling 'fn'. To keep the snapshots from recording
+// anything but 'fn' itself, all storage is allocated up front and
+// only the counter values are read around the call.
+func coverageDuring(fn func()) (before, after *CounterSnapshot, err error) {
+	cl := getCovCounterList()
+	if len(cl) == 0 {
+		return nil, nil, fmt.Errorf("program not built with -cover")
+	}
+	if err := ensureFinalHash(); err != nil {
+		return nil, nil, err
+	}
+	pm := getCovPkgMap()
+	before = &CounterSnapshot{metaHash: finalHash, pkgmap: pm, slabs: make([][]uint32, len(cl))}
+	after = &CounterSnapshot{metaHash: finalHash, pkgmap: pm, slabs: make([][]uint32, len(cl))}
+	for k, c := range cl {
+		before.slabs[k] = make([]uint32, 0, c.Len)
+		after.slabs[k] = make([]uint32, 0, c.Len)
+	}
+	for k, c := range cl {
+		before.slabs[k] = readCounterSlab(c, before.slabs[k])
+	}
+	fn()
+	for k, c := range cl {
+		after.slabs[k] = readCounterSlab(c, after.slabs[k])
+	}
+	return before, after, nil
+}
+
+// newlyCoveredBlocks returns a description of each block (outside of
+// the packages excluded by ignoredPkg) that has a zero count in 'before' and a non-zero
+// count in 'after'.
+func newlyCoveredBlocks(before, after *CounterSnapshot) ([]string, error) {
+	bm, am := before.counterMap(), after.counterMap()
+	var blocks []string
+	err := visitMetaFuncs(metaPayloads(getCovMetaList()), func(pkIdx, fnIdx uint32, pd *decodemeta.CoverageMetaDataDecoder, fd *coverage.FuncDesc) error {
+		if ignoredPkg(pd.PackagePath()) {
+			return nil
+		}
+		key := pkfunc{pk: pkIdx, fcn: fnIdx}
+		bc, ac := bm[key], am[key]
+		for i, u := range fd.Units {
+			if u.Parent != 0 {
+				continue
+			}
+			if unitCount(cgran, bc, i) == 0 && unitCount(cgran, ac, i) != 0 {
+				blocks = append(blocks, fmt.Sprintf("%s.%s: %s:%d.%d,%d.%d",
+					pd.PackagePath(), fd.Funcname, fd.Srcfile, u.StLine, u.StCol, u.EnLine, u.EnCol))
+			}
+		}
+		return nil
+	})
+	return blocks, err
+}
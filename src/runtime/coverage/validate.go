@@ -0,0 +1,240 @@
+// Copyright 2022 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package coverage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"internal/coverage"
+	"os"
+	"path/filepath"
+	"strings"
+	"unsafe"
+)
+
+// CorruptCoverageFileError is the error returned by
+// ValidateCoverageDataFile for a counter data file whose contents are
+// malformed, for example because the process writing it was killed
+// part way through.
+type CorruptCoverageFileError struct {
+	Path   string // path of the file
+	Offset int64  // offset within the file at which the problem was found
+	Reason string // description of the problem
+}
+
+func (e *CorruptCoverageFileError) Error() string {
+	return fmt.Sprintf("corrupt counter data file %s at offset %d: %s", e.Path, e.Offset, e.Reason)
+}
+
+// ValidateCoverageDataFile checks the structure of the counter data
+// file 'path': that its header and footer are intact, that the
+// meta-data hash in the header agrees with the file name (for files
+// named in the usual way), and that the function entries of each
+// segment account for exactly the bytes between the segment preamble
+// and its footer, so that the file has not been truncated or extended.
+// The counter values themselves are skipped over, not decoded. If the
+// file is malformed, the error returned is a *CorruptCoverageFileError;
+// other errors (for example, a failure to read the file) are returned
+// as is.
+func ValidateCoverageDataFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	v := &counterFileValidator{path: path, data: data}
+	return v.validate()
+}
+
+// ValidateCoverageDataDir calls ValidateCoverageDataFile for each
+// counter data file in the directory 'dir' (other files are ignored),
+// returning the paths of the files found to be malformed, in
+// lexical order. An error is returned if the directory can't be read,
+// or if a file can't be read for reasons other than corruption.
+func ValidateCoverageDataDir(dir string) ([]string, error) {
+	ents, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	corrupt := []string{}
+	for _, e := range ents {
+		if !e.Type().IsRegular() || !strings.HasPrefix(e.Name(), coverage.CounterFilePref+".") {
+			continue
+		}
+		path := filepath.Join(dir, e.Name())
+		err := ValidateCoverageDataFile(path)
+		var cerr *CorruptCoverageFileError
+		if errors.As(err, &cerr) {
+			corrupt = append(corrupt, path)
+		} else if err != nil {
+			return corrupt, err
+		}
+	}
+	return corrupt, nil
+}
+
+// counterFileValidator walks the contents of a counter data file.
+type counterFileValidator struct {
+	path string
+	data []byte
+	off  int64
+	hdr  coverage.CounterFileHeader
+}
+
+func (v *counterFileValidator) corrupt(off int64, format string, a ...any) error {
+	return &CorruptCoverageFileError{Path: v.path, Offset: off, Reason: fmt.Sprintf(format, a...)}
+}
+
+// read decodes a fixed-size value 'p' at the current offset, advancing
+// past it.
+func (v *counterFileValidator) read(p any, what string) error {
+	sz := int64(binary.Size(p))
+	if v.off+sz > int64(len(v.data)) {
+		return v.corrupt(v.off, "file truncated in %s", what)
+	}
+	if err := binary.Read(bytes.NewReader(v.data[v.off:v.off+sz]), binary.LittleEndian, p); err != nil {
+		return v.corrupt(v.off, "reading %s: %v", what, err)
+	}
+	v.off += sz
+	return nil
+}
+
+// skip advances past 'n' bytes.
+func (v *counterFileValidator) skip(n int64, what string) error {
+	if v.off+n > int64(len(v.data)) {
+		return v.corrupt(v.off, "file truncated in %s", what)
+	}
+	v.off += n
+	return nil
+}
+
+// value reads a single counter file value (a function entry field or
+// counter) in the file's counter flavor, advancing past it.
+func (v *counterFileValidator) value() (uint32, error) {
+	if v.hdr.CFlavor == coverage.CtrRaw {
+		if v.off+4 > int64(len(v.data)) {
+			return 0, v.corrupt(v.off, "file truncated in function entry")
+		}
+		b := v.data[v.off : v.off+4]
+		v.off += 4
+		if v.hdr.BigEndian {
+			return binary.BigEndian.Uint32(b), nil
+		}
+		return binary.LittleEndian.Uint32(b), nil
+	}
+	start := v.off
+	var shift uint
+	var value uint64
+	for {
+		if v.off >= int64(len(v.data)) {
+			return 0, v.corrupt(v.off, "file truncated in function entry")
+		}
+		b := v.data[v.off]
+		v.off++
+		value |= uint64(b&0x7F) << shift
+		if b&0x80 == 0 {
+			break
+		}
+		shift += 7
+		if shift > 32 {
+			return 0, v.corrupt(start, "malformed ULEB128 value")
+		}
+	}
+	return uint32(value), nil
+}
+
+func (v *counterFileValidator) validate() error {
+	var ftr coverage.CounterFileFooter
+	hsz := int64(unsafe.Sizeof(v.hdr))
+	fsz := int64(unsafe.Sizeof(ftr))
+	if int64(len(v.data)) < hsz+fsz {
+		return v.corrupt(int64(len(v.data)), "file too short (%d bytes)", len(v.data))
+	}
+
+	// Header.
+	if err := v.read(&v.hdr, "file header"); err != nil {
+		return err
+	}
+	if v.hdr.Magic != coverage.CovCounterMagic {
+		return v.corrupt(0, "invalid magic string: not a counter data file")
+	}
+	if v.hdr.Version == 0 || v.hdr.Version > coverage.CounterFileVersion {
+		return v.corrupt(4, "unsupported file version %d", v.hdr.Version)
+	}
+	if v.hdr.CFlavor != coverage.CtrRaw && v.hdr.CFlavor != coverage.CtrULeb128 {
+		return v.corrupt(24, "unknown counter flavor %d", v.hdr.CFlavor)
+	}
+	if h, ok := counterFileNameHash(v.path); ok && h != fmt.Sprintf("%x", v.hdr.MetaHash) {
+		return v.corrupt(8, "meta-data hash %x does not match file name", v.hdr.MetaHash)
+	}
+
+	// The footer at the end of the file gives the number of segments.
+	v.off = int64(len(v.data)) - fsz
+	if err := v.read(&ftr, "file footer"); err != nil {
+		return err
+	}
+	if ftr.Magic != coverage.CovCounterMagic {
+		return v.corrupt(int64(len(v.data))-fsz, "invalid footer magic string (file truncated?)")
+	}
+	if ftr.NumSegments == 0 {
+		return v.corrupt(int64(len(v.data))-fsz, "no segments")
+	}
+	nsegs := ftr.NumSegments
+
+	// Segments, each followed by a footer.
+	v.off = hsz
+	for seg := uint32(0); seg < nsegs; seg++ {
+		var shdr coverage.CounterSegmentHeader
+		if err := v.read(&shdr, "segment header"); err != nil {
+			return err
+		}
+		if err := v.skip(int64(shdr.StrTabLen)+int64(shdr.ArgsLen), "segment string table and args"); err != nil {
+			return err
+		}
+		if rem := v.off % 4; rem != 0 {
+			if err := v.skip(4-rem, "segment padding"); err != nil {
+				return err
+			}
+		}
+		for i := uint64(0); i < shdr.FcnEntries; i++ {
+			nc, err := v.value()
+			if err != nil {
+				return err
+			}
+			// Package index, function index, then the counters.
+			for j := uint64(0); j < 2+uint64(nc); j++ {
+				if _, err := v.value(); err != nil {
+					return err
+				}
+			}
+		}
+		fo := v.off
+		if err := v.read(&ftr, "segment footer"); err != nil {
+			return err
+		}
+		if ftr.Magic != coverage.CovCounterMagic {
+			return v.corrupt(fo, "invalid segment footer magic string (function entry count mismatch?)")
+		}
+		if ftr.NumSegments != seg+1 {
+			return v.corrupt(fo, "segment footer reports %d segments, want %d", ftr.NumSegments, seg+1)
+		}
+	}
+	if v.off != int64(len(v.data)) {
+		return v.corrupt(v.off, "%d bytes of unexpected data after final segment", int64(len(v.data))-v.off)
+	}
+	return nil
+}
+
+// counterFileNameHash returns the hexadecimal meta-data hash in the
+// name of the counter data file 'path', if it is named in the usual
+// way (see coverage.CounterFileTempl).
+func counterFileNameHash(path string) (string, bool) {
+	fields := strings.Split(filepath.Base(path), ".")
+	if len(fields) < 2 || fields[0] != coverage.CounterFilePref || len(fields[1]) != 32 {
+		return "", false
+	}
+	return fields[1], true
+}
@@ -0,0 +1,66 @@
+// Copyright 2022 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package coverage
+
+import (
+	"fmt"
+	"internal/coverage"
+	"strconv"
+	"strings"
+)
+
+// formatExtVersion tracks extensions to the coverage data formats
+// made at the level of the runtime/coverage APIs (for example the
+// combined stream written by Coverage.Write). It should be
+// incremented whenever such an extension is added.
+const formatExtVersion = 1
+
+// CoverageFormatVersion returns a string of the form
+// "coverage/<major>.<minor>" describing the coverage data formats
+// produced by this package, for use by programs that exchange
+// coverage data and need to negotiate a format. The major version is
+// the version of the meta-data and counter data file formats; the
+// minor version tracks compatible extensions made by this package.
+func CoverageFormatVersion() string {
+	return fmt.Sprintf("coverage/%d.%d", coverage.MetaFileVersion, formatExtVersion)
+}
+
+// ParseCoverageFormatVersion parses a version string of the form
+// returned by CoverageFormatVersion, returning the major and minor
+// version numbers.
+func ParseCoverageFormatVersion(s string) (major, minor int, err error) {
+	name, v, ok := strings.Cut(s, "/")
+	if !ok || name != "coverage" {
+		return 0, 0, fmt.Errorf("malformed coverage format version %q", s)
+	}
+	ms, ns, ok := strings.Cut(v, ".")
+	if !ok {
+		return 0, 0, fmt.Errorf("malformed coverage format version %q", s)
+	}
+	if major, err = strconv.Atoi(ms); err != nil || major < 0 {
+		return 0, 0, fmt.Errorf("malformed major version in coverage format version %q", s)
+	}
+	if minor, err = strconv.Atoi(ns); err != nil || minor < 0 {
+		return 0, 0, fmt.Errorf("malformed minor version in coverage format version %q", s)
+	}
+	return major, minor, nil
+}
+
+// IsCompatible reports whether data produced at coverage format
+// version 'v1' can be read by a consumer at version 'v2'. This is the
+// case if both have the same major version and the minor version of
+// 'v1' is no greater than that of 'v2'. Malformed versions are never
+// compatible.
+func IsCompatible(v1, v2 string) bool {
+	pmaj, pmin, err := ParseCoverageFormatVersion(v1)
+	if err != nil {
+		return false
+	}
+	cmaj, cmin, err := ParseCoverageFormatVersion(v2)
+	if err != nil {
+		return false
+	}
+	return pmaj == cmaj && pmin <= cmin
+}
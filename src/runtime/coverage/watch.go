@@ -0,0 +1,133 @@
+// Copyright 2022 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package coverage
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// counterFileWatcher polls a counter data file for changes. See
+// WatchCounterFile.
+type counterFileWatcher struct {
+	path   string
+	cb     func(*CounterDataSet)
+	ticker *time.Ticker
+	done   chan struct{}
+	exited chan struct{}
+	closed sync.Once
+
+	// State of the file when last parsed; exists is false if the
+	// file has not been parsed or has since been removed.
+	exists  bool
+	modTime time.Time
+	size    int64
+
+	seq       uint64         // sequence number of the last parse, set by the poll goroutine
+	cbMu      sync.Mutex     // serializes callbacks; guards delivered
+	delivered uint64         // sequence number of the last data set passed to cb
+	cbs       sync.WaitGroup // callbacks started but not finished
+}
+
+// WatchCounterFile starts watching the counter data file 'path' (for
+// example one that another process updates with
+// AppendCounterDataToFile), polling it with os.Stat every
+// 'interval'. Whenever the file's modification time or size changes,
+// including when it first appears, it is re-read with
+// ParseCounterDataFile and 'cb' is called with the result. A file that
+// can't be parsed (for example, because it is still being written) is
+// retried on the next poll; a file that is removed and later
+// recreated is picked up again. The first poll happens immediately.
+//
+// Callbacks run on their own goroutines, one at a time, so a slow
+// callback doesn't delay polling. If the file changes several times
+// while a callback is running, some of the intermediate data sets may
+// be skipped, but data sets are never delivered out of order.
+//
+// Closing the returned io.Closer stops the polling and waits for any
+// callback in progress to finish, so it must not be called from 'cb'.
+// An error is returned if 'interval' is not positive or 'cb' is nil.
+func WatchCounterFile(path string, interval time.Duration, cb func(*CounterDataSet)) (io.Closer, error) {
+	if interval <= 0 {
+		return nil, fmt.Errorf("non-positive poll interval %v", interval)
+	}
+	if cb == nil {
+		return nil, fmt.Errorf("error: nil callback in WatchCounterFile")
+	}
+	w := &counterFileWatcher{
+		path:   path,
+		cb:     cb,
+		ticker: time.NewTicker(interval),
+		done:   make(chan struct{}),
+		exited: make(chan struct{}),
+	}
+	go w.run()
+	return w, nil
+}
+
+// run polls the file immediately and then on each tick, until the
+// watcher is closed.
+func (w *counterFileWatcher) run() {
+	defer close(w.exited)
+	for {
+		w.poll()
+		select {
+		case <-w.done:
+			return
+		case <-w.ticker.C:
+		}
+	}
+}
+
+// poll checks whether the file has changed since it was last parsed,
+// and if so parses it and starts a callback.
+func (w *counterFileWatcher) poll() {
+	fi, err := os.Stat(w.path)
+	if err != nil {
+		// Removed (or not yet created); parse it again when it
+		// reappears.
+		w.exists = false
+		return
+	}
+	if w.exists && fi.ModTime().Equal(w.modTime) && fi.Size() == w.size {
+		return
+	}
+	ds, err := ParseCounterDataFile(w.path)
+	if err != nil {
+		return
+	}
+	w.exists, w.modTime, w.size = true, fi.ModTime(), fi.Size()
+	w.seq++
+	seq := w.seq
+	w.cbs.Add(1)
+	go func() {
+		defer w.cbs.Done()
+		w.cbMu.Lock()
+		defer w.cbMu.Unlock()
+		if seq <= w.delivered {
+			// A later data set has already been delivered.
+			return
+		}
+		w.delivered = seq
+		w.cb(ds)
+	}()
+}
+
+// Close stops the watcher and waits for any callback in progress to
+// finish. Calls to Close after the first return an error.
+func (w *counterFileWatcher) Close() error {
+	err := fmt.Errorf("counter file watcher already closed")
+	w.closed.Do(func() {
+		w.ticker.Stop()
+		close(w.done)
+		<-w.exited
+		w.cbs.Wait()
+		err = nil
+	})
+	return err
+}
@@ -9,8 +9,8 @@ import (
 	"unsafe"
 )
 
-//go:linkname runtime_coverage_getCovCounterList runtime/coverage.getCovCounterList
-func runtime_coverage_getCovCounterList() []rtcov.CovCounterBlob {
+//go:linkname runtime_coverage_runtimeCovCounterList runtime/coverage.runtimeCovCounterList
+func runtime_coverage_runtimeCovCounterList() []rtcov.CovCounterBlob {
 	res := []rtcov.CovCounterBlob{}
 	u32sz := unsafe.Sizeof(uint32(0))
 	for datap := &firstmoduledata; datap != nil; datap = datap.next {
@@ -24,3 +24,25 @@ func runtime_coverage_getCovCounterList() []rtcov.CovCounterBlob {
 	}
 	return res
 }
+
+//go:linkname runtime_coverage_stopTheWorld runtime/coverage.stopTheWorld
+func runtime_coverage_stopTheWorld() {
+	stopTheWorld("coverage counter clear")
+}
+
+//go:linkname runtime_coverage_startTheWorld runtime/coverage.startTheWorld
+func runtime_coverage_startTheWorld() {
+	startTheWorld()
+}
+
+//go:linkname runtime_coverage_procPin runtime/coverage.procPin
+//go:nosplit
+func runtime_coverage_procPin() int {
+	return procPin()
+}
+
+//go:linkname runtime_coverage_procUnpin runtime/coverage.procUnpin
+//go:nosplit
+func runtime_coverage_procUnpin() {
+	procUnpin()
+}